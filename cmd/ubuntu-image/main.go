@@ -48,6 +48,7 @@ func initStateMachine(imageType string, commonOpts *commands.CommonOpts, stateMa
 		}
 	case "classic":
 		stateMachine = &statemachine.ClassicStateMachine{
+			Opts: ubuntuImageCommand.Classic.ClassicOptsPassed,
 			Args: ubuntuImageCommand.Classic.ClassicArgsPassed,
 		}
 	default:
@@ -396,10 +396,12 @@ func Test_initStateMachine(t *testing.T) {
 				ubuntuImageCommand: &commands.UbuntuImageCommand{
 					Classic: commands.ClassicCommand{
 						ClassicArgsPassed: commands.ClassicArgs{},
+						ClassicOptsPassed: commands.ClassicOpts{},
 					},
 				},
 			},
 			want: &statemachine.ClassicStateMachine{
+				Opts: commands.ClassicOpts{},
 				Args: commands.ClassicArgs{},
 			},
 		},
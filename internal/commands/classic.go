@@ -5,6 +5,13 @@ type ClassicArgs struct {
 	ImageDefinition string `positional-arg-name:"image_definition" description:"Classic image definition file. This is used to define what should be in the image and the outputs that are created."`
 }
 
+// ClassicOpts holds all flags that are specific to the classic command
+type ClassicOpts struct {
+	SignKey   string `long:"sign-key" description:"Name of the OpenPGP key used to create detached signatures of the checksums artifacts" value-name:"KEY"`
+	GnupgHome string `long:"gnupg-home" description:"GnuPG home directory holding the key given with --sign-key. Defaults to the one of gpg" value-name:"DIRECTORY"`
+}
+
 type ClassicCommand struct {
 	ClassicArgsPassed ClassicArgs `positional-args:"true" required:"false"`
+	ClassicOptsPassed ClassicOpts
 }
@@ -16,7 +16,8 @@ type CommonOpts struct {
 	Validation string `long:"validation" description:"Control whether validations should be ignored or enforced" choice:"ignore" choice:"enforce"`                                                                      //nolint:staticcheck,SA5008
 	// The library we use to handle command-line flags (github.com/jessevdk/go-flags) relies on this method to list valid values for a flag, even though this is not a recommended way.
 	// Ignore these warnings until we use another library.
-	DryRun bool `long:"dry-run" description:"Print the states to be executed to build the image and return."`
+	DryRun       bool `long:"dry-run" description:"Print the states to be executed to build the image and return."`
+	Reproducible bool `long:"reproducible" description:"Build reproducibly, honouring SOURCE_DATE_EPOCH"`
 }
 
 // StateMachineOpts stores the options that are related to the state machine
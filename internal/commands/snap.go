@@ -20,6 +20,7 @@ type SnapOpts struct {
 	SysfsOverlay              string         `long:"sysfs-overlay" description:"The optional sysfs overlay to used for preseeding. Directories from /sys/class/* and /sys/devices/platform will be bind-mounted to the chroot when preseeding"`
 	ExtraAssertionFilenames   []string       `long:"assertion" description:"Include extra assertions. Each usage indicates the path to a file containing the assertions. The paths are passed through to \"snap-prepare-image\" that validates their contents." value-name:"ASSERTION-FILE"`
 	AllowSnapdKernelMismatch  bool           `long:"allow-snapd-kernel-mismatch" description:"Allow mismatch between snap-bootstrap in the kernel and the snapd snap"`
+	SBOMFormats               []string       `long:"sbom" description:"Generate a software bill of materials of the seeded snaps in the given format, written to sbom.spdx.json or sbom.cdx.json. Can be given several times." value-name:"FORMAT" choice:"spdx" choice:"cyclonedx"`
 }
 
 type SnapCommand struct {
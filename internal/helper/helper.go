@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/invopop/jsonschema"
 	"github.com/snapcore/snapd/gadget/quantity"
@@ -385,8 +386,10 @@ func SafeQuantitySubtraction(orig, subtract quantity.Size) quantity.Size {
 
 // CreateTarArchive places all of the files from a source directory into a tar.
 // Currently supported are uncompressed tar archives and the following
-// compression types: gzip, xz bzip2, zstd
-func CreateTarArchive(src, dest, compression string, debug bool) error {
+// compression types: gzip, xz bzip2, zstd. If sourceDateEpoch is set, the
+// archive is reproducible: entries are sorted, modification times are clamped
+// to it and nothing depending on the host or the time of the build is recorded
+func CreateTarArchive(src, dest, compression string, debug bool, sourceDateEpoch *time.Time) error {
 	tarCommand := exec.Command(
 		"tar",
 		"--directory",
@@ -402,6 +405,15 @@ func CreateTarArchive(src, dest, compression string, debug bool) error {
 	if debug {
 		tarCommand.Args = append(tarCommand.Args, "--verbose")
 	}
+	if sourceDateEpoch != nil {
+		tarCommand.Args = append(tarCommand.Args,
+			"--sort=name",
+			fmt.Sprintf("--mtime=@%d", sourceDateEpoch.Unix()),
+			"--clamp-mtime",
+			"--numeric-owner",
+			"--pax-option=exthdr.name=%d/PaxHeaders/%f,delete=atime,delete=ctime",
+		)
+	}
 	// set up any compression arguments
 	switch compression {
 	case "uncompressed":
@@ -1,6 +1,10 @@
 package helper
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -10,6 +14,7 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/invopop/jsonschema"
@@ -460,7 +465,7 @@ func TestTarXattrs(t *testing.T) {
 
 	// now run the helper tar creation and extraction functions
 	tarPath := filepath.Join(testDir, "test-xattrs.tar")
-	err = CreateTarArchive(testDir, tarPath, "uncompressed", false)
+	err = CreateTarArchive(testDir, tarPath, "uncompressed", false, nil)
 	asserter.AssertErrNil(err, true)
 
 	err = ExtractTarArchive(tarPath, extractDir, false)
@@ -475,6 +480,55 @@ func TestTarXattrs(t *testing.T) {
 	}
 }
 
+// TestCreateReproducibleTarArchive creates the same archive twice with
+// SOURCE_DATE_EPOCH and ensures it is identical and holds no newer mtime
+func TestCreateReproducibleTarArchive(t *testing.T) {
+	asserter := Asserter{T: t}
+	testDir, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-reproducible-tar-test")
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(testDir) })
+	contentDir := filepath.Join(testDir, "content")
+	for _, file := range []string{"b", "a", "c/d"} {
+		err = os.MkdirAll(filepath.Dir(filepath.Join(contentDir, file)), 0755)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(filepath.Join(contentDir, file), []byte(file), 0644)
+		asserter.AssertErrNil(err, true)
+	}
+
+	sourceDateEpoch := time.Unix(1700000000, 0)
+	archives := make([][]byte, 0)
+	for i, mtime := range []time.Time{time.Now(), time.Now().Add(time.Hour)} {
+		err = os.Chtimes(filepath.Join(contentDir, "a"), mtime, mtime)
+		asserter.AssertErrNil(err, true)
+		tarPath := filepath.Join(testDir, fmt.Sprintf("archive%d.tar.gz", i))
+		err = CreateTarArchive(contentDir, tarPath, "gzip", false, &sourceDateEpoch)
+		asserter.AssertErrNil(err, true)
+		archive, err := os.ReadFile(tarPath)
+		asserter.AssertErrNil(err, true)
+		archives = append(archives, archive)
+	}
+	if !bytes.Equal(archives[0], archives[1]) {
+		t.Fatal("Archives of the same content with the same SOURCE_DATE_EPOCH differ")
+	}
+
+	gzipReader, err := gzip.NewReader(bytes.NewReader(archives[0]))
+	asserter.AssertErrNil(err, true)
+	tarReader := tar.NewReader(gzipReader)
+	names := make([]string, 0)
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		asserter.AssertErrNil(err, true)
+		names = append(names, header.Name)
+		if header.ModTime.After(sourceDateEpoch) {
+			t.Errorf("%s has a modification time more recent than SOURCE_DATE_EPOCH", header.Name)
+		}
+	}
+	asserter.AssertEqual([]string{"./", "./a", "./b", "./c/", "./c/d"}, names)
+}
+
 // TestPingXattrs runs the ExtractTarArchive file on a pre-made test file that contains /bin/ping
 // and ensures that the security.capability extended attribute is still present
 func TestPingXattrs(t *testing.T) {
@@ -6,9 +6,12 @@ package imagedefinition
 
 import (
 	"fmt"
+	"maps"
+	"slices"
 	"strings"
 
 	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v2"
 
 	"github.com/canonical/ubuntu-image/internal/arch"
 )
@@ -23,6 +26,7 @@ type ImageDefinition struct {
 	Series         string         `yaml:"series"          json:"Series"`
 	Kernel         string         `yaml:"kernel"          json:"Kernel,omitempty"`
 	Gadget         *Gadget        `yaml:"gadget"          json:"Gadget,omitempty"`
+	Layout         *Layout        `yaml:"layout"          json:"Layout,omitempty"`
 	ModelAssertion string         `yaml:"model-assertion" json:"ModelAssertion,omitempty" jsonschema:"type=string,format=uri"`
 	Rootfs         *Rootfs        `yaml:"rootfs"          json:"Rootfs"`
 	Customization  *Customization `yaml:"customization"   json:"Customization,omitempty"`
@@ -32,11 +36,93 @@ type ImageDefinition struct {
 
 // Gadget defines the gadget section of the image definition file
 type Gadget struct {
-	Ref          string `yaml:"ref"    json:"Ref,omitempty"`
-	GadgetTarget string `yaml:"target" json:"GadgetTarget,omitempty"`
-	GadgetBranch string `yaml:"branch" json:"GadgetBranch,omitempty"`
-	GadgetType   string `yaml:"type"   json:"GadgetType"             jsonschema:"enum=git,enum=directory,enum=prebuilt"`
-	GadgetURL    string `yaml:"url"    json:"GadgetURL,omitempty"    jsonschema:"type=string,format=uri"`
+	Ref           string   `yaml:"ref"                json:"Ref,omitempty"`
+	GadgetTarget  string   `yaml:"target"             json:"GadgetTarget,omitempty"`
+	GadgetBranch  string   `yaml:"branch"             json:"GadgetBranch,omitempty"`
+	GadgetType    string   `yaml:"type"               json:"GadgetType"                  jsonschema:"enum=git,enum=directory,enum=prebuilt,enum=snap"`
+	GadgetURL     string   `yaml:"url"                json:"GadgetURL,omitempty"         jsonschema:"type=string,format=uri"`
+	GadgetName    string   `yaml:"name"               json:"GadgetName,omitempty"`
+	GadgetChannel string   `yaml:"channel"            json:"GadgetChannel,omitempty"     default:"stable"`
+	BuildInChroot *bool    `yaml:"build-in-chroot"    json:"BuildInChroot,omitempty"     default:"false"`
+	BuildDeps     []string `yaml:"build-dependencies" json:"BuildDependencies,omitempty"`
+}
+
+// Layout defines an inline disk layout, following the gadget.yaml
+// semantics, used to generate a gadget.yaml when no gadget is provided
+type Layout struct {
+	Volumes map[string]*LayoutVolume `yaml:"volumes" json:"Volumes"`
+	// VolumeOrder lists the names of the volumes in the order they are
+	// defined, which is the order of the volumes in the image. It is
+	// recorded when decoding the layout and kept in the build metadata
+	VolumeOrder []string `yaml:"-" json:"VolumeOrder,omitempty"`
+}
+
+// UnmarshalYAML decodes the layout and records the order of its volumes,
+// which is lost in the Volumes map
+func (l *Layout) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plainLayout Layout
+	if err := unmarshal((*plainLayout)(l)); err != nil {
+		return err
+	}
+
+	var orderedLayout struct {
+		Volumes yaml.MapSlice `yaml:"volumes"`
+	}
+	if err := unmarshal(&orderedLayout); err != nil {
+		return err
+	}
+	l.VolumeOrder = make([]string, len(orderedLayout.Volumes))
+	for i, volume := range orderedLayout.Volumes {
+		l.VolumeOrder[i] = fmt.Sprint(volume.Key)
+	}
+	return nil
+}
+
+// VolumeNames returns the names of the volumes in the order they are defined.
+// Volumes whose order is unknown come last, sorted by name
+func (l *Layout) VolumeNames() []string {
+	volumeNames := make([]string, 0, len(l.Volumes))
+	for _, volumeName := range l.VolumeOrder {
+		if _, found := l.Volumes[volumeName]; found && !slices.Contains(volumeNames, volumeName) {
+			volumeNames = append(volumeNames, volumeName)
+		}
+	}
+	for _, volumeName := range slices.Sorted(maps.Keys(l.Volumes)) {
+		if !slices.Contains(volumeNames, volumeName) {
+			volumeNames = append(volumeNames, volumeName)
+		}
+	}
+	return volumeNames
+}
+
+// LayoutVolume defines a volume of the inline disk layout
+type LayoutVolume struct {
+	Schema     string             `yaml:"schema,omitempty"     json:"Schema,omitempty"     jsonschema:"enum=gpt,enum=mbr"`
+	Bootloader string             `yaml:"bootloader,omitempty" json:"Bootloader,omitempty" jsonschema:"enum=grub,enum=u-boot,enum=piboot"`
+	ID         string             `yaml:"id,omitempty"         json:"ID,omitempty"`
+	Structure  []*LayoutStructure `yaml:"structure"            json:"Structure"`
+}
+
+// LayoutStructure defines a structure of a volume in the inline disk layout
+type LayoutStructure struct {
+	Name            string           `yaml:"name,omitempty"             json:"Name,omitempty"`
+	Role            string           `yaml:"role,omitempty"             json:"Role,omitempty"            jsonschema:"enum=mbr,enum=system-boot,enum=system-data,enum=system-seed,enum=system-seed-null,enum=system-save"`
+	Type            string           `yaml:"type"                       json:"Type"`
+	ID              string           `yaml:"id,omitempty"               json:"ID,omitempty"`
+	Offset          string           `yaml:"offset,omitempty"           json:"Offset,omitempty"`
+	Size            string           `yaml:"size"                       json:"Size"`
+	MinSize         string           `yaml:"min-size,omitempty"         json:"MinSize,omitempty"`
+	Filesystem      string           `yaml:"filesystem,omitempty"       json:"Filesystem,omitempty"      jsonschema:"enum=none,enum=vfat,enum=vfat-16,enum=vfat-32,enum=ext4"`
+	FilesystemLabel string           `yaml:"filesystem-label,omitempty" json:"FilesystemLabel,omitempty"`
+	Content         []*LayoutContent `yaml:"content,omitempty"          json:"Content,omitempty"`
+}
+
+// LayoutContent defines the content of a structure in the inline disk layout.
+// Source and Image are paths in the rootfs of the image
+type LayoutContent struct {
+	Source string `yaml:"source,omitempty" json:"Source,omitempty"`
+	Target string `yaml:"target,omitempty" json:"Target,omitempty"`
+	Image  string `yaml:"image,omitempty"  json:"Image,omitempty"`
 }
 
 // Rootfs defines the rootfs section of the image definition file
@@ -71,15 +157,24 @@ type Tarball struct {
 
 // Customization defines the customization section of the image definition file.
 type Customization struct {
-	Components    []string   `yaml:"components"     json:"Components,omitempty"   default:"main,restricted,universe"`
-	Pocket        string     `yaml:"pocket"         json:"Pocket"                 jsonschema:"enum=release,enum=Release,enum=updates,enum=Updates,enum=security,enum=Security,enum=proposed,enum=Proposed" default:"release"`
-	Installer     *Installer `yaml:"installer"      json:"Installer,omitempty"`
-	CloudInit     *CloudInit `yaml:"cloud-init"     json:"CloudInit,omitempty"`
-	ExtraPPAs     []*PPA     `yaml:"extra-ppas"     json:"ExtraPPAs,omitempty"`
-	ExtraPackages []*Package `yaml:"extra-packages" json:"ExtraPackages,omitempty"`
-	ExtraSnaps    []*Snap    `yaml:"extra-snaps"    json:"ExtraSnaps,omitempty"`
-	Fstab         []*Fstab   `yaml:"fstab"          json:"Fstab,omitempty"`
-	Manual        *Manual    `yaml:"manual"         json:"Manual,omitempty"`
+	Components        []string         `yaml:"components"         json:"Components,omitempty"        default:"main,restricted,universe"`
+	Pocket            string           `yaml:"pocket"             json:"Pocket"                      jsonschema:"enum=release,enum=Release,enum=updates,enum=Updates,enum=security,enum=Security,enum=proposed,enum=Proposed" default:"release"`
+	Installer         *Installer       `yaml:"installer"          json:"Installer,omitempty"`
+	CloudInit         *CloudInit       `yaml:"cloud-init"         json:"CloudInit,omitempty"`
+	AptPreferences    []*AptPreference `yaml:"apt-preferences"    json:"AptPreferences,omitempty"`
+	Debconf           []*Debconf       `yaml:"debconf"            json:"Debconf,omitempty"`
+	ExtraPPAs         []*PPA           `yaml:"extra-ppas"         json:"ExtraPPAs,omitempty"`
+	ExtraRepositories []*Repository    `yaml:"extra-repositories" json:"ExtraRepositories,omitempty"`
+	ExtraPackages     []*Package       `yaml:"extra-packages"     json:"ExtraPackages,omitempty"`
+	ExtraDebs         []*Deb           `yaml:"extra-debs"         json:"ExtraDebs,omitempty"`
+	RemovePackages    []*RemovePackage `yaml:"remove-packages"    json:"RemovePackages,omitempty"`
+	ExtraSnaps        []*Snap          `yaml:"extra-snaps"        json:"ExtraSnaps,omitempty"`
+	Fstab             []*Fstab         `yaml:"fstab"              json:"Fstab,omitempty"`
+	Files             []*File          `yaml:"files"              json:"Files,omitempty"`
+	Systemd           *Systemd         `yaml:"systemd"            json:"Systemd,omitempty"`
+	Bootloader        *Bootloader      `yaml:"bootloader"         json:"Bootloader,omitempty"`
+	System            *System          `yaml:"system"             json:"System,omitempty"`
+	Manual            *Manual          `yaml:"manual"             json:"Manual,omitempty"`
 }
 
 // Installer provides customization options specific to installer images
@@ -97,15 +192,55 @@ type CloudInit struct {
 
 // PPA contains information about a public or private PPA
 type PPA struct {
-	Name        string `yaml:"name"         json:"PPAName"               jsonschema:"pattern=^[a-zA-Z0-9_.+-]+/[a-zA-Z0-9_.+-]+$"`
-	Auth        string `yaml:"auth"         json:"Auth,omitempty"        jsonschema:"pattern=^[a-zA-Z0-9_.+-]+:[a-zA-Z0-9]+$"`
-	Fingerprint string `yaml:"fingerprint"  json:"Fingerprint,omitempty"`
-	KeepEnabled *bool  `yaml:"keep-enabled" json:"KeepEnabled"           default:"true"`
+	Name         string `yaml:"name"          json:"PPAName"                jsonschema:"pattern=^[a-zA-Z0-9_.+-]+/[a-zA-Z0-9_.+-]+$"`
+	Auth         string `yaml:"auth"          json:"Auth,omitempty"         jsonschema:"pattern=^[a-zA-Z0-9_.+-]+:[a-zA-Z0-9]+$"`
+	Fingerprint  string `yaml:"fingerprint"   json:"Fingerprint,omitempty"`
+	KeepEnabled  *bool  `yaml:"keep-enabled"  json:"KeepEnabled"            default:"true"`
+	Priority     int    `yaml:"priority"      json:"Priority,omitempty"     jsonschema:"type=integer"`
+	KeyFile      string `yaml:"key-file"      json:"KeyFile,omitempty"`
+	Key          string `yaml:"key"           json:"Key,omitempty"`
+	Keyserver    string `yaml:"keyserver"     json:"Keyserver,omitempty"`
+	LaunchpadURL string `yaml:"launchpad-url" json:"LaunchpadURL,omitempty"`
+}
+
+// Repository contains information about a third-party deb repository
+type Repository struct {
+	Name          string   `yaml:"name"          json:"Name"                    jsonschema:"pattern=^[a-zA-Z0-9_.+-]+$"`
+	URIs          []string `yaml:"uris"          json:"URIs"`
+	Suites        []string `yaml:"suites"        json:"Suites"`
+	Components    []string `yaml:"components"    json:"Components,omitempty"`
+	Architectures []string `yaml:"architectures" json:"Architectures,omitempty"`
+	KeyFile       string   `yaml:"key-file"      json:"KeyFile,omitempty"`
+	Key           string   `yaml:"key"           json:"Key,omitempty"`
+	KeepEnabled   *bool    `yaml:"keep-enabled"  json:"KeepEnabled"             default:"true"`
+}
+
+// AptPreference contains information about an apt preferences file
+type AptPreference struct {
+	Name        string `yaml:"name"         json:"Name"        jsonschema:"pattern=^[a-zA-Z0-9_.-]+$"`
+	Package     string `yaml:"package"      json:"Package"`
+	Pin         string `yaml:"pin"          json:"Pin"`
+	PinPriority int    `yaml:"pin-priority" json:"PinPriority" jsonschema:"type=integer"`
+	KeepEnabled *bool  `yaml:"keep-enabled" json:"KeepEnabled" default:"false"`
 }
 
 // Package contains information about packages
 type Package struct {
-	PackageName string `yaml:"name" json:"PackageName"`
+	PackageName string `yaml:"name"    json:"PackageName"`
+	Version     string `yaml:"version" json:"Version,omitempty"`
+	Hold        *bool  `yaml:"hold"    json:"Hold,omitempty"    default:"false"`
+}
+
+// Deb contains information about a local .deb file to install
+type Deb struct {
+	Path string `yaml:"path" json:"Path"`
+}
+
+// RemovePackage contains information about packages to remove
+type RemovePackage struct {
+	PackageName string `yaml:"name"       json:"PackageName"`
+	Purge       *bool  `yaml:"purge"      json:"Purge,omitempty"      default:"false"`
+	Autoremove  *bool  `yaml:"autoremove" json:"Autoremove,omitempty" default:"false"`
 }
 
 // Snap contains information about snaps
@@ -126,6 +261,50 @@ type Manual struct {
 	AddUser   []*AddUser   `yaml:"add-user"   json:"AddUser,omitempty"`
 }
 
+// Systemd provides customization options for systemd units
+type Systemd struct {
+	Enable        []string `yaml:"enable"         json:"Enable,omitempty"`
+	Disable       []string `yaml:"disable"        json:"Disable,omitempty"`
+	Mask          []string `yaml:"mask"           json:"Mask,omitempty"`
+	DefaultTarget string   `yaml:"default-target" json:"DefaultTarget,omitempty" jsonschema:"pattern=^[a-zA-Z0-9@_.:-]+[.]target$"`
+}
+
+// Bootloader provides customization options for the bootloader
+type Bootloader struct {
+	CmdlineAppend []string `yaml:"cmdline-append" json:"CmdlineAppend,omitempty"`
+	CmdlineRemove []string `yaml:"cmdline-remove" json:"CmdlineRemove,omitempty"`
+	Timeout       *int     `yaml:"timeout"        json:"Timeout,omitempty"       jsonschema:"minimum=0"`
+	Terminal      string   `yaml:"terminal"       json:"Terminal,omitempty"`
+	SerialCommand string   `yaml:"serial-command" json:"SerialCommand,omitempty"`
+	DefaultEntry  string   `yaml:"default-entry"  json:"DefaultEntry,omitempty"`
+	ConfigTxt     []string `yaml:"config-txt"     json:"ConfigTxt,omitempty"`
+}
+
+// System provides customization options for the identity of the system
+type System struct {
+	Hostname string    `yaml:"hostname" json:"Hostname,omitempty" jsonschema:"pattern=^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?([.][a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$,maxLength=64"`
+	Timezone string    `yaml:"timezone" json:"Timezone,omitempty"`
+	Locale   string    `yaml:"locale"   json:"Locale,omitempty"`
+	Locales  []string  `yaml:"locales"  json:"Locales,omitempty"`
+	Keyboard *Keyboard `yaml:"keyboard" json:"Keyboard,omitempty"`
+}
+
+// Keyboard defines the console keyboard configuration
+type Keyboard struct {
+	Layout  string `yaml:"layout"  json:"Layout"`
+	Model   string `yaml:"model"   json:"Model,omitempty"   default:"pc105"`
+	Variant string `yaml:"variant" json:"Variant,omitempty"`
+	Options string `yaml:"options" json:"Options,omitempty"`
+}
+
+// Debconf defines an answer to a debconf question, set before installing packages
+type Debconf struct {
+	Package  string `yaml:"package"  json:"Package"`
+	Question string `yaml:"question" json:"Question"`
+	Type     string `yaml:"type"     json:"Type"     jsonschema:"enum=string,enum=boolean,enum=select,enum=multiselect,enum=note,enum=text,enum=password,enum=title,enum=error"`
+	Value    string `yaml:"value"    json:"Value,omitempty"`
+}
+
 // Fstab defines the information that gets rendered into an fstab
 type Fstab struct {
 	Label        string `yaml:"label"           json:"Label"`
@@ -148,9 +327,26 @@ type CopyFile struct {
 	Source string `yaml:"source"      json:"Source"`
 }
 
+// File allows users to create files and directories in the rootfs of an
+// image, either from inline content or from a source in the definition directory
+type File struct {
+	Path    string `yaml:"path"    json:"Path"`
+	Content string `yaml:"content" json:"Content,omitempty"`
+	Source  string `yaml:"source"  json:"Source,omitempty"`
+	Mode    string `yaml:"mode"    json:"Mode,omitempty"    jsonschema:"pattern=^[0-7]?[0-7][0-7][0-7]$"`
+	Owner   string `yaml:"owner"   json:"Owner,omitempty"`
+	Group   string `yaml:"group"   json:"Group,omitempty"`
+}
+
 // Execute allows users to execute a script in the rootfs of an image
 type Execute struct {
-	ExecutePath string `yaml:"path" json:"ExecutePath"`
+	Name        string            `yaml:"name"    json:"Name,omitempty"`
+	ExecutePath string            `yaml:"path"    json:"ExecutePath,omitempty"`
+	Script      string            `yaml:"script"  json:"Script,omitempty"`
+	Args        []string          `yaml:"args"    json:"Args,omitempty"`
+	Env         map[string]string `yaml:"env"     json:"Env,omitempty"`
+	Chroot      *bool             `yaml:"chroot"  json:"Chroot"           default:"true"`
+	Timeout     int               `yaml:"timeout" json:"Timeout,omitempty" jsonschema:"minimum=0"`
 }
 
 // TouchFile allows users to touch a file in the rootfs of an image
@@ -166,10 +362,19 @@ type AddGroup struct {
 
 // AddUser allows users to add a user in the image that is being built
 type AddUser struct {
-	UserName     string `yaml:"name"          json:"UserName"`
-	UserID       string `yaml:"id"            json:"UserID,omitempty"`
-	Password     string `yaml:"password"      json:"Password,omitempty"`
-	PasswordType string `yaml:"password-type" json:"PasswordType"        default:"hash" jsonschema:"enum=text,enum=hash"`
+	UserName       string   `yaml:"name"            json:"UserName"`
+	UserID         string   `yaml:"id"              json:"UserID,omitempty"`
+	Password       string   `yaml:"password"        json:"Password,omitempty"`
+	PasswordType   string   `yaml:"password-type"   json:"PasswordType"             default:"hash" jsonschema:"enum=text,enum=hash"`
+	ExpirePassword *bool    `yaml:"expire-password" json:"ExpirePassword"           default:"true"`
+	PrimaryGroup   string   `yaml:"primary-group"   json:"PrimaryGroup,omitempty"`
+	Groups         []string `yaml:"groups"          json:"Groups,omitempty"`
+	Shell          string   `yaml:"shell"           json:"Shell,omitempty"          jsonschema:"pattern=^/"`
+	HomeDir        string   `yaml:"home"            json:"HomeDir,omitempty"`
+	System         *bool    `yaml:"system"          json:"System,omitempty"         default:"false"`
+	AuthorizedKeys []string `yaml:"authorized-keys" json:"AuthorizedKeys,omitempty"`
+	Sudo           *bool    `yaml:"sudo"            json:"Sudo,omitempty"           default:"false"`
+	SudoNoPassword *bool    `yaml:"sudo-nopasswd"   json:"SudoNoPassword,omitempty" default:"false"`
 }
 
 // Artifact contains information about the files that are created
@@ -177,18 +382,30 @@ type AddUser struct {
 type Artifact struct {
 	Img        *[]Img     `yaml:"img"            json:"Img,omitempty"       is_disk:"true"`
 	Qcow2      *[]Qcow2   `yaml:"qcow2"          json:"Qcow2,omitempty"     is_disk:"true"`
+	Vmdk       *[]Vmdk    `yaml:"vmdk"           json:"Vmdk,omitempty"      is_disk:"true"`
+	Vhd        *[]Vhd     `yaml:"vhd"            json:"Vhd,omitempty"       is_disk:"true"`
+	Vhdx       *[]Vhdx    `yaml:"vhdx"           json:"Vhdx,omitempty"      is_disk:"true"`
+	Ova        *[]Ova     `yaml:"ova"            json:"Ova,omitempty"       is_disk:"true"`
+	Iso        *Iso       `yaml:"iso"            json:"Iso,omitempty"       is_disk:"true"`
 	Manifest   *Manifest  `yaml:"manifest"       json:"Manifest,omitempty"    is_disk:"false"`
 	ManifestV2 *Manifest  `yaml:"manifest-v2"    json:"ManifestV2,omitempty"  is_disk:"false"`
 	Filelist   *Filelist  `yaml:"filelist"       json:"Filelist,omitempty"    is_disk:"false"`
 	Changelog  *Changelog `yaml:"changelog"      json:"Changelog,omitempty" is_disk:"false"`
 	RootfsTar  *RootfsTar `yaml:"rootfs-tarball" json:"RootfsTar,omitempty" is_disk:"false"`
+	Squashfs   *Squashfs  `yaml:"squashfs"       json:"Squashfs,omitempty"  is_disk:"false"`
+	Sbom       *[]Sbom    `yaml:"sbom"           json:"Sbom,omitempty"      is_disk:"false"`
+	Oci        *Oci       `yaml:"oci"            json:"Oci,omitempty"       is_disk:"false"`
+	Checksums  *Checksums `yaml:"checksums"      json:"Checksums,omitempty" is_disk:"false"`
 }
 
-// Img specifies the name of the resulting .img file.
+// Img specifies the name of the resulting .img file, how to compress it
+// and whether to generate its block map.
 // If left emtpy no .img file will be created
 type Img struct {
-	ImgName   string `yaml:"name"   json:"ImgName"`
-	ImgVolume string `yaml:"volume" json:"ImgVolume"`
+	ImgName     string `yaml:"name"        json:"ImgName"`
+	ImgVolume   string `yaml:"volume"      json:"ImgVolume"`
+	Compression string `yaml:"compression" json:"Compression,omitempty" jsonschema:"enum=uncompressed,enum=xz,enum=zstd,enum=gzip"`
+	Bmap        bool   `yaml:"bmap"        json:"Bmap,omitempty"`
 }
 
 // Qcow2 specifies the name of the resulting .qcow2 file
@@ -198,6 +415,46 @@ type Qcow2 struct {
 	Qcow2Volume string `yaml:"volume" json:"Qcow2Volume"`
 }
 
+// Vmdk specifies the name of the resulting stream-optimized .vmdk file
+// If left empty no .vmdk file will be created
+type Vmdk struct {
+	VmdkName   string `yaml:"name"   json:"VmdkName"`
+	VmdkVolume string `yaml:"volume" json:"VmdkVolume"`
+}
+
+// Vhd specifies the name of the resulting fixed size .vhd file
+// If left empty no .vhd file will be created
+type Vhd struct {
+	VhdName   string `yaml:"name"   json:"VhdName"`
+	VhdVolume string `yaml:"volume" json:"VhdVolume"`
+}
+
+// Vhdx specifies the name of the resulting .vhdx file
+// If left empty no .vhdx file will be created
+type Vhdx struct {
+	VhdxName   string `yaml:"name"   json:"VhdxName"`
+	VhdxVolume string `yaml:"volume" json:"VhdxVolume"`
+}
+
+// Ova specifies the name of the resulting .ova file, and the number
+// of CPUs and memory in MiB of the virtual machine it describes
+// If left empty no .ova file will be created
+type Ova struct {
+	OvaName   string `yaml:"name"   json:"OvaName"`
+	OvaVolume string `yaml:"volume" json:"OvaVolume"`
+	CPUs      int    `yaml:"cpus"   json:"CPUs,omitempty"   jsonschema:"minimum=1"`
+	Memory    int    `yaml:"memory" json:"Memory,omitempty" jsonschema:"minimum=1"`
+}
+
+// Iso specifies the name of the resulting bootable .iso file,
+// the volume of the gadget providing its EFI system partition and
+// its ISO 9660 volume ID, derived from the display-name if not set
+type Iso struct {
+	IsoName   string `yaml:"name"      json:"IsoName"`
+	IsoVolume string `yaml:"volume"    json:"IsoVolume,omitempty"`
+	VolumeID  string `yaml:"volume-id" json:"VolumeID,omitempty"  jsonschema:"maxLength=32"`
+}
+
 // Manifest specifies the name of the manifest file.
 // If left emtpy no manifest file will be created
 type Manifest struct {
@@ -223,6 +480,43 @@ type RootfsTar struct {
 	Compression   string `yaml:"compression" json:"Compression"   jsonschema:"enum=uncompressed,enum=bzip2,enum=gzip,enum=xz,enum=zstd" default:"uncompressed"`
 }
 
+// Squashfs specifies the name of a squashfs image to create from the
+// rootfs, along with its compression, block size and the patterns
+// of the paths to leave out of it
+type Squashfs struct {
+	SquashfsName string   `yaml:"name"        json:"SquashfsName"`
+	Compression  string   `yaml:"compression" json:"Compression"         jsonschema:"enum=xz,enum=zstd,enum=gzip,enum=lz4" default:"xz"`
+	BlockSize    string   `yaml:"block-size"  json:"BlockSize,omitempty" jsonschema:"enum=4K,enum=8K,enum=16K,enum=32K,enum=64K,enum=128K,enum=256K,enum=512K,enum=1M"`
+	Exclude      []string `yaml:"exclude"     json:"Exclude,omitempty"`
+}
+
+// Oci specifies the name of an OCI image layout to create from the rootfs,
+// either as a directory or a tar archive, and the configuration of its image.
+// The content of /boot and the kernel modules and firmware can be left out
+type Oci struct {
+	OciName            string            `yaml:"name"                 json:"OciName"`
+	Format             string            `yaml:"format"               json:"Format"                       jsonschema:"enum=directory,enum=tar" default:"directory"`
+	Tag                string            `yaml:"tag"                  json:"Tag,omitempty"`
+	Entrypoint         []string          `yaml:"entrypoint"           json:"Entrypoint,omitempty"`
+	Cmd                []string          `yaml:"cmd"                  json:"Cmd,omitempty"`
+	Env                map[string]string `yaml:"env"                  json:"Env,omitempty"`
+	Labels             map[string]string `yaml:"labels"               json:"Labels,omitempty"`
+	ExcludeBootContent *bool             `yaml:"exclude-boot-content" json:"ExcludeBootContent,omitempty" default:"false"`
+}
+
+// Sbom specifies the name of a software bill of materials of the
+// image to create and its format
+type Sbom struct {
+	SbomName string `yaml:"name"   json:"SbomName"`
+	Format   string `yaml:"format" json:"Format"   jsonschema:"enum=spdx,enum=cyclonedx"`
+}
+
+// Checksums specifies that checksum files of the artifacts are created,
+// and whether SHA512 ones are created along with the SHA256 ones
+type Checksums struct {
+	SHA512 *bool `yaml:"sha512" json:"SHA512,omitempty" default:"false"`
+}
+
 // NewMissingURLError fails the image definition parsing when a dict
 // requires a URL conditionally based on the value of other keys
 // in the dict but does not have one included
@@ -281,6 +575,44 @@ type PathNotAbsoluteError struct {
 	gojsonschema.ResultErrorFields
 }
 
+// NewPathNotInOutputDirError fails the image definition parsing when an
+// artifact path does not point inside the output directory
+func NewPathNotInOutputDirError(context *gojsonschema.JsonContext, value interface{}, details gojsonschema.ErrorDetails) *PathNotInOutputDirError {
+	err := PathNotInOutputDirError{}
+	err.SetContext(context)
+	err.SetType("path_not_in_output_dir_error")
+	err.SetDescriptionFormat("Key {{.key}} needs to be a relative path inside the output directory ({{.value}})")
+	err.SetValue(value)
+	err.SetDetails(details)
+
+	return &err
+}
+
+// PathNotInOutputDirError implements gojsonschema.ErrorType. It is used for custom
+// errors for artifact paths that escape the output directory
+type PathNotInOutputDirError struct {
+	gojsonschema.ResultErrorFields
+}
+
+// NewURLSchemeError fails the image definition parsing when a URL uses a
+// scheme that is not supported for its key
+func NewURLSchemeError(context *gojsonschema.JsonContext, value interface{}, details gojsonschema.ErrorDetails) *URLSchemeError {
+	err := URLSchemeError{}
+	err.SetContext(context)
+	err.SetType("url_scheme_error")
+	err.SetDescriptionFormat("Key {{.key}} only supports {{.scheme}} URLs ({{.value}})")
+	err.SetValue(value)
+	err.SetDetails(details)
+
+	return &err
+}
+
+// URLSchemeError implements gojsonschema.ErrorType. It is used for custom
+// errors for URLs whose scheme is not supported
+type URLSchemeError struct {
+	gojsonschema.ResultErrorFields
+}
+
 // NewDependentKeyError fails the image definition parsing when one
 // field depends on another being specified
 func NewDependentKeyError(context *gojsonschema.JsonContext, value interface{}, details gojsonschema.ErrorDetails) *DependentKeyError {
@@ -301,6 +633,86 @@ type DependentKeyError struct {
 	gojsonschema.ResultErrorFields
 }
 
+// NewExclusiveKeysError fails the image definition parsing when two
+// mutually exclusive fields are specified
+func NewExclusiveKeysError(context *gojsonschema.JsonContext, value interface{}, details gojsonschema.ErrorDetails) *ExclusiveKeysError {
+	err := ExclusiveKeysError{}
+	err.SetContext(context)
+	err.SetType("exclusive_keys_error")
+	err.SetDescriptionFormat("Key {{.key1}} cannot be used together with key {{.key2}}")
+	err.SetValue(value)
+	err.SetDetails(details)
+
+	return &err
+}
+
+// ExclusiveKeysError implements gojsonschema.ErrorType.
+// It is used for custom errors for keys that cannot
+// be specified together
+type ExclusiveKeysError struct {
+	gojsonschema.ResultErrorFields
+}
+
+// NewMissingKeysError fails the image definition parsing when none
+// of two alternative fields is specified
+func NewMissingKeysError(context *gojsonschema.JsonContext, value interface{}, details gojsonschema.ErrorDetails) *MissingKeysError {
+	err := MissingKeysError{}
+	err.SetContext(context)
+	err.SetType("missing_keys_error")
+	err.SetDescriptionFormat("One of the keys {{.key1}} or {{.key2}} must be specified")
+	err.SetValue(value)
+	err.SetDetails(details)
+
+	return &err
+}
+
+// MissingKeysError implements gojsonschema.ErrorType.
+// It is used for custom errors when none of two
+// alternative keys is specified
+type MissingKeysError struct {
+	gojsonschema.ResultErrorFields
+}
+
+// NewInvalidClassKeyError fails the image definition parsing when a field
+// is specified for an image class it does not apply to
+func NewInvalidClassKeyError(context *gojsonschema.JsonContext, value interface{}, details gojsonschema.ErrorDetails) *InvalidClassKeyError {
+	err := InvalidClassKeyError{}
+	err.SetContext(context)
+	err.SetType("invalid_class_key_error")
+	err.SetDescriptionFormat("Key {{.key}} can only be used when class is {{.class}}")
+	err.SetValue(value)
+	err.SetDetails(details)
+
+	return &err
+}
+
+// InvalidClassKeyError implements gojsonschema.ErrorType.
+// It is used for custom errors for keys that only apply
+// to some image classes
+type InvalidClassKeyError struct {
+	gojsonschema.ResultErrorFields
+}
+
+// NewInvalidInstallerLayerError fails the image definition parsing when
+// the installer layers do not stack seeds on top of each other
+func NewInvalidInstallerLayerError(context *gojsonschema.JsonContext, value interface{}, details gojsonschema.ErrorDetails) *InvalidInstallerLayerError {
+	err := InvalidInstallerLayerError{}
+	err.SetContext(context)
+	err.SetType("invalid_installer_layer_error")
+	err.SetDescriptionFormat("Invalid installer layer {{.layer}}: {{.reason}}")
+	err.SetValue(value)
+	err.SetDetails(details)
+
+	return &err
+}
+
+// InvalidInstallerLayerError implements gojsonschema.ErrorType.
+// It is used for custom errors when an installer layer
+// is not named after the seeds it stacks
+type InvalidInstallerLayerError struct {
+	gojsonschema.ResultErrorFields
+}
+
 func (i ImageDefinition) securityMirror() string {
 	if i.Architecture == arch.AMD64 || i.Architecture == arch.I386 {
 		return "http://security.ubuntu.com/ubuntu/"
@@ -489,3 +901,34 @@ func (i *ImageDefinition) deb822SourcesList(target bool) string {
 
 	return ubuntuSources
 }
+
+// GadgetYaml returns the content of a gadget.yaml describing the layout.
+// Content paths, given in the rootfs, are made relative so they can be
+// resolved in a gadget directory mirroring the rootfs. Volumes keep the
+// order they are defined in, as it is the order of the volumes in the image
+func (l *Layout) GadgetYaml() ([]byte, error) {
+	volumes := make(yaml.MapSlice, 0, len(l.Volumes))
+	for _, volumeName := range l.VolumeNames() {
+		volume := l.Volumes[volumeName]
+		gadgetVolume := *volume
+		gadgetVolume.Structure = make([]*LayoutStructure, 0, len(volume.Structure))
+		for _, structure := range volume.Structure {
+			gadgetStructure := *structure
+			gadgetStructure.Content = make([]*LayoutContent, 0, len(structure.Content))
+			for _, content := range structure.Content {
+				gadgetStructure.Content = append(gadgetStructure.Content, &LayoutContent{
+					Source: strings.TrimPrefix(content.Source, "/"),
+					Target: content.Target,
+					Image:  strings.TrimPrefix(content.Image, "/"),
+				})
+			}
+			gadgetVolume.Structure = append(gadgetVolume.Structure, &gadgetStructure)
+		}
+		volumes = append(volumes, yaml.MapItem{Key: volumeName, Value: &gadgetVolume})
+	}
+
+	gadgetYaml := struct {
+		Volumes yaml.MapSlice `yaml:"volumes"`
+	}{volumes}
+	return yaml.Marshal(&gadgetYaml)
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v2"
 
 	"github.com/canonical/ubuntu-image/internal/arch"
 	"github.com/canonical/ubuntu-image/internal/helper"
@@ -153,6 +154,17 @@ func TestCustomErrors(t *testing.T) {
 		t.Errorf("pathNotAbsoluteError description format \"%s\" is invalid",
 			pathNotAbsoluteErr.DescriptionFormat())
 	}
+	pathNotInOutputDirErr := NewPathNotInOutputDirError(
+		gojsonschema.NewJsonContext("testPathNotInOutputDir", jsonContext),
+		52,
+		errDetail,
+	)
+	// spot check the description format
+	if !strings.Contains(pathNotInOutputDirErr.DescriptionFormat(),
+		"Key {{.key}} needs to be a relative path inside the output directory ({{.value}})") {
+		t.Errorf("pathNotInOutputDirError description format \"%s\" is invalid",
+			pathNotInOutputDirErr.DescriptionFormat())
+	}
 	dependentKeyErr := NewDependentKeyError(
 		gojsonschema.NewJsonContext("testDependentKey", jsonContext),
 		52,
@@ -164,6 +176,39 @@ func TestCustomErrors(t *testing.T) {
 		t.Errorf("dependentKeyError description format \"%s\" is invalid",
 			dependentKeyErr.DescriptionFormat())
 	}
+	missingKeysErr := NewMissingKeysError(
+		gojsonschema.NewJsonContext("testMissingKeys", jsonContext),
+		52,
+		errDetail,
+	)
+	// spot check the description format
+	if !strings.Contains(missingKeysErr.DescriptionFormat(),
+		"One of the keys {{.key1}} or {{.key2}} must be specified") {
+		t.Errorf("missingKeysError description format \"%s\" is invalid",
+			missingKeysErr.DescriptionFormat())
+	}
+	invalidClassKeyErr := NewInvalidClassKeyError(
+		gojsonschema.NewJsonContext("testInvalidClassKey", jsonContext),
+		52,
+		errDetail,
+	)
+	// spot check the description format
+	if !strings.Contains(invalidClassKeyErr.DescriptionFormat(),
+		"Key {{.key}} can only be used when class is {{.class}}") {
+		t.Errorf("invalidClassKeyError description format \"%s\" is invalid",
+			invalidClassKeyErr.DescriptionFormat())
+	}
+	invalidInstallerLayerErr := NewInvalidInstallerLayerError(
+		gojsonschema.NewJsonContext("testInvalidInstallerLayer", jsonContext),
+		52,
+		errDetail,
+	)
+	// spot check the description format
+	if !strings.Contains(invalidInstallerLayerErr.DescriptionFormat(),
+		"Invalid installer layer {{.layer}}: {{.reason}}") {
+		t.Errorf("invalidInstallerLayerError description format \"%s\" is invalid",
+			invalidInstallerLayerErr.DescriptionFormat())
+	}
 }
 
 // TestImageDefinition_SetDefaults make sure we do not add a boolean field
@@ -207,7 +252,10 @@ func TestImageDefinition_SetDefaults(t *testing.T) {
 				},
 			},
 			want: &ImageDefinition{
-				Gadget: &Gadget{},
+				Gadget: &Gadget{
+					GadgetChannel: "stable",
+					BuildInChroot: helper.BoolPtr(false),
+				},
 				Rootfs: &Rootfs{
 					Seed: &Seed{
 						Vcs: helper.BoolPtr(true),
@@ -228,7 +276,9 @@ func TestImageDefinition_SetDefaults(t *testing.T) {
 					ExtraPPAs: []*PPA{{
 						KeepEnabled: helper.BoolPtr(true),
 					}},
-					ExtraPackages: []*Package{{}},
+					ExtraPackages: []*Package{{
+						Hold: helper.BoolPtr(false),
+					}},
 					ExtraSnaps: []*Snap{{
 						Store:   "canonical",
 						Channel: "stable",
@@ -239,7 +289,11 @@ func TestImageDefinition_SetDefaults(t *testing.T) {
 					Manual: &Manual{
 						AddUser: []*AddUser{
 							{
-								PasswordType: "hash",
+								PasswordType:   "hash",
+								ExpirePassword: helper.BoolPtr(true),
+								System:         helper.BoolPtr(false),
+								Sudo:           helper.BoolPtr(false),
+								SudoNoPassword: helper.BoolPtr(false),
 							},
 						},
 					},
@@ -266,7 +320,10 @@ func TestImageDefinition_SetDefaults(t *testing.T) {
 				},
 			},
 			want: &ImageDefinition{
-				Gadget: &Gadget{},
+				Gadget: &Gadget{
+					GadgetChannel: "stable",
+					BuildInChroot: helper.BoolPtr(false),
+				},
 				Rootfs: &Rootfs{
 					Seed: &Seed{
 						Vcs: helper.BoolPtr(true),
@@ -457,3 +514,48 @@ Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
 		})
 	}
 }
+
+// TestLayout_GadgetYaml checks the gadget.yaml generated from a layout keeps
+// the volumes in the order they are defined and makes content paths relative
+func TestLayout_GadgetYaml(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	definition := `volumes:
+  system:
+    schema: gpt
+    structure:
+      - name: ubuntu-seed
+        type: C12A7328-F81F-11D2-BA4B-00A0C93EC93B
+        size: 1G
+        content:
+          - source: /boot/efi/
+            target: /
+  data:
+    structure:
+      - type: 0FC63DAF-8483-4772-8E79-3D69D8477DE4
+        size: 1G
+  aux:
+    structure:
+      - type: 0FC63DAF-8483-4772-8E79-3D69D8477DE4
+        size: 1G
+`
+	var layout Layout
+	err := yaml.Unmarshal([]byte(definition), &layout)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual([]string{"system", "data", "aux"}, layout.VolumeNames())
+
+	gadgetYaml, err := layout.GadgetYaml()
+	asserter.AssertErrNil(err, true)
+	systemIndex := strings.Index(string(gadgetYaml), "system:")
+	dataIndex := strings.Index(string(gadgetYaml), "data:")
+	auxIndex := strings.Index(string(gadgetYaml), "aux:")
+	if systemIndex < 0 || systemIndex > dataIndex || dataIndex > auxIndex {
+		t.Errorf("Volumes are not in definition order in the gadget.yaml:\n%s", gadgetYaml)
+	}
+	if !strings.Contains(string(gadgetYaml), "source: boot/efi/") {
+		t.Errorf("Content paths are not relative in the gadget.yaml:\n%s", gadgetYaml)
+	}
+
+	// layouts not decoded from YAML have their volumes sorted by name
+	layout = Layout{Volumes: map[string]*LayoutVolume{"system": {}, "aux": {}}}
+	asserter.AssertEqual([]string{"aux", "system"}, layout.VolumeNames())
+}
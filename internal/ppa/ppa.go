@@ -1,5 +1,6 @@
 // Package ppa manages Private Package Archives sources list.
-// It enables adding and removing a PPA on a system.
+// It enables adding and removing a PPA, or any third-party
+// deb repository, on a system.
 package ppa
 
 import (
@@ -25,11 +26,15 @@ var (
 	osMkdirAll    = os.MkdirAll
 	osMkdirTemp   = os.MkdirTemp
 	osOpenFile    = os.OpenFile
+	osReadFile    = os.ReadFile
+	osWriteFile   = os.WriteFile
 	execCommand   = exec.Command
 
 	sourcesListDPath = filepath.Join("etc", "apt", "sources.list.d")
 	trustedGPGDPath  = filepath.Join("etc", "apt", "trusted.gpg.d")
+	preferencesDPath = filepath.Join("etc", "apt", "preferences.d")
 	lpBaseURL        = "https://api.launchpad.net"
+	keyserverURL     = "hkp://keyserver.ubuntu.com:80"
 )
 
 // PPAInterface is the only interface that should be used outside of this package.
@@ -46,14 +51,18 @@ type PPAPrivateInterface interface {
 	FileName() string
 	FileContent() (string, error)
 	ImportKey(basePath string, debug bool) error
+	PreferencesFileName() string
+	PreferencesContent() string
 	Remove(basePath string) error
 }
 
-// New instantiates the proper PPA implementation based on the deb822 flag
-func New(imageDefPPA *imagedefinition.PPA, deb822 bool, series string) PPAInterface {
+// New instantiates the proper PPA implementation based on the deb822 flag.
+// Relative key files are looked up in confDefPath.
+func New(imageDefPPA *imagedefinition.PPA, deb822 bool, series string, confDefPath string) PPAInterface {
 	basePPA := BasePPA{
-		PPA:    imageDefPPA,
-		series: series,
+		PPA:         imageDefPPA,
+		series:      series,
+		confDefPath: confDefPath,
 	}
 
 	if deb822 {
@@ -74,8 +83,9 @@ func New(imageDefPPA *imagedefinition.PPA, deb822 bool, series string) PPAInterf
 // BasePPA holds fields and methods common to every PPAPrivateInterface implementation
 type BasePPA struct {
 	*imagedefinition.PPA
-	series     string
-	signingKey string
+	series      string
+	signingKey  string
+	confDefPath string
 }
 
 func (p *BasePPA) FullName() string {
@@ -100,7 +110,32 @@ func (p *BasePPA) url() string {
 	return fmt.Sprintf("%s/%s/%s/ubuntu", baseURL, p.user(), p.name())
 }
 
-// removePPAFile removes the PPA file from the sources.list.d directory
+// PreferencesFileName returns the name of the apt preferences file pinning the PPA
+func (p *BasePPA) PreferencesFileName() string {
+	return fmt.Sprintf("%s-ubuntu-%s-%s.pref", p.user(), p.name(), p.series)
+}
+
+// PreferencesContent returns the content of the apt preferences file pinning
+// the PPA, or an empty string if no priority was requested
+func (p *BasePPA) PreferencesContent() string {
+	if p.Priority == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Package: *\nPin: release o=%s\nPin-Priority: %d\n",
+		p.origin(), p.Priority)
+}
+
+// origin returns the origin Launchpad publishes the PPA with. The name of
+// PPAs called "ppa" is left out of it
+func (p *BasePPA) origin() string {
+	if p.name() == "ppa" {
+		return "LP-PPA-" + p.user()
+	}
+	return fmt.Sprintf("LP-PPA-%s-%s", p.user(), p.name())
+}
+
+// removePPAFile removes the PPA file from the sources.list.d directory,
+// along with its apt preferences file if a priority was set
 func (p *BasePPA) removePPAFile(basePath string, fileName string) error {
 	sourcesListD := filepath.Join(basePath, sourcesListDPath)
 	if p.KeepEnabled == nil {
@@ -116,21 +151,73 @@ func (p *BasePPA) removePPAFile(basePath string, fileName string) error {
 	if err != nil {
 		return fmt.Errorf("Error removing %s: %s", ppaFile, err.Error())
 	}
+
+	if p.Priority != 0 {
+		prefFile := filepath.Join(basePath, preferencesDPath, p.PreferencesFileName())
+		err = osRemove(prefFile)
+		if err != nil {
+			return fmt.Errorf("Error removing %s: %s", prefFile, err.Error())
+		}
+	}
 	return nil
 }
 
+// keyserver returns the keyserver to fetch the signing key of the PPA from
+func (p *BasePPA) keyserver() string {
+	if p.Keyserver != "" {
+		return p.Keyserver
+	}
+	return keyserverURL
+}
+
+// launchpadURL returns the base URL of the Launchpad API to query
+func (p *BasePPA) launchpadURL() string {
+	if p.LaunchpadURL != "" {
+		return strings.TrimSuffix(p.LaunchpadURL, "/")
+	}
+	return lpBaseURL
+}
+
+// hasLocalKey returns whether the signing key of the PPA is provided in the
+// image definition, either inline or as a file
+func (p *BasePPA) hasLocalKey() bool {
+	return p.Key != "" || p.KeyFile != ""
+}
+
+// localKeyFile returns the path of the file holding the signing key of the PPA
+// when provided in the image definition. An inline key is written to tmpGPGDir.
+func (p *BasePPA) localKeyFile(tmpGPGDir string) (string, error) {
+	if p.KeyFile != "" {
+		if filepath.IsAbs(p.KeyFile) {
+			return p.KeyFile, nil
+		}
+		return filepath.Join(p.confDefPath, p.KeyFile), nil
+	}
+
+	keyFile := filepath.Join(tmpGPGDir, "inline-key.asc")
+	err := osWriteFile(keyFile, []byte(p.Key), 0600)
+	if err != nil {
+		return "", fmt.Errorf("Error writing signing key: %s", err.Error())
+	}
+	return keyFile, nil
+}
+
 // importKey fetches and imports the public key of a PPA.
 // This function relies on gpg to fetch the key from the keyserver. We cannot reliably get this key
 // from Launchpad because it is not publicly accessible for private PPAs.
+// If the key is provided in the image definition, it is imported from there instead
+// and no network access is needed.
 // If the ascii arg is set to true, the key is also stored dearmored in the signingKey field of p.
 func (p *BasePPA) importKey(basePath string, ppaFileName string, ascii bool, debug bool) (err error) {
 	trustedGPGD := filepath.Join(basePath, trustedGPGDPath)
 	keyFileName := strings.Replace(ppaFileName, ".list", ".gpg", 1)
 	keyFilePath := filepath.Join(trustedGPGD, keyFileName)
 
-	err = p.ensureFingerprint(lpBaseURL)
-	if err != nil {
-		return err
+	if !p.hasLocalKey() {
+		err = p.ensureFingerprint(p.launchpadURL())
+		if err != nil {
+			return err
+		}
 	}
 
 	tmpGPGDir, err := p.createTmpGPGDir()
@@ -158,10 +245,19 @@ func (p *BasePPA) importKey(basePath string, ppaFileName string, ascii bool, deb
 		"--batch",
 		"--homedir",
 		tmpGPGDir,
-		"--keyserver",
-		"hkp://keyserver.ubuntu.com:80",
 	}
-	recvKeyArgs := append(commonGPGArgs, "--recv-keys", p.Fingerprint)
+
+	var recvKeyArgs []string
+	if p.hasLocalKey() {
+		localKeyFile, err := p.localKeyFile(tmpGPGDir)
+		if err != nil {
+			return err
+		}
+		recvKeyArgs = append(commonGPGArgs, "--import", localKeyFile)
+	} else {
+		commonGPGArgs = append(commonGPGArgs, "--keyserver", p.keyserver())
+		recvKeyArgs = append(commonGPGArgs, "--recv-keys", p.Fingerprint)
+	}
 
 	exportKeyArgs := make([]string, 0)
 	exportKeyArgs = append(exportKeyArgs, commonGPGArgs...)
@@ -172,7 +268,11 @@ func (p *BasePPA) importKey(basePath string, ppaFileName string, ascii bool, deb
 		exportKeyArgs = append(exportKeyArgs, "--output", keyFilePath)
 	}
 
-	exportKeyArgs = append(exportKeyArgs, "--export", p.Fingerprint)
+	// without a fingerprint, the temporary keyring only holds the local key
+	exportKeyArgs = append(exportKeyArgs, "--export")
+	if p.Fingerprint != "" {
+		exportKeyArgs = append(exportKeyArgs, p.Fingerprint)
+	}
 
 	gpgCmds := []*exec.Cmd{
 		execCommand(
@@ -297,6 +397,35 @@ func (p *PPA) Add(basePath string, debug bool) error {
 		return fmt.Errorf("unable to write ppa file %s: %w", ppaFile, err)
 	}
 
+	return p.addPreferences(basePath)
+}
+
+// addPreferences writes the apt preferences file pinning the PPA to the
+// requested priority, if any
+func (p *PPA) addPreferences(basePath string) error {
+	content := p.PreferencesContent()
+	if content == "" {
+		return nil
+	}
+
+	preferencesD := filepath.Join(basePath, preferencesDPath)
+	err := osMkdirAll(preferencesD, 0755)
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Failed to create apt preferences.d: %s", err.Error())
+	}
+
+	prefFile := filepath.Join(preferencesD, p.PreferencesFileName())
+	prefIO, err := osOpenFile(prefFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Error creating %s: %s", prefFile, err.Error())
+	}
+	defer prefIO.Close()
+
+	_, err = prefIO.Write([]byte(content))
+	if err != nil {
+		return fmt.Errorf("unable to write preferences file %s: %w", prefFile, err)
+	}
+
 	return nil
 }
 
@@ -375,8 +504,14 @@ func (p *Deb822PPA) formatKey(rawKey string) (string, error) {
 		return "", fmt.Errorf("received an empty signing key for PPA %s", p.Name)
 	}
 
+	return formatDeb822Field(rawKey), nil
+}
+
+// formatDeb822Field formats a multiline value to be set in a deb822 field,
+// indenting every line and replacing empty ones with " ."
+func formatDeb822Field(value string) string {
 	lines := make([]string, 0)
-	for _, l := range strings.Split(rawKey, "\n") {
+	for _, l := range strings.Split(value, "\n") {
 		if l == "" {
 			lines = append(lines, " .")
 		} else {
@@ -384,5 +519,5 @@ func (p *Deb822PPA) formatKey(rawKey string) (string, error) {
 		}
 	}
 
-	return strings.Join(lines, "\n"), nil
+	return strings.Join(lines, "\n")
 }
@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -120,6 +121,7 @@ func TestNew(t *testing.T) {
 		imageDefPPA *imagedefinition.PPA
 		deb822      bool
 		series      string
+		confDefPath string
 	}
 	tests := []struct {
 		name string
@@ -132,12 +134,14 @@ func TestNew(t *testing.T) {
 				imageDefPPA: imageDefPPA1,
 				deb822:      false,
 				series:      "jammy",
+				confDefPath: "/conf",
 			},
 			want: &PPA{
 				PPAPrivateInterface: &LegacyPPA{
 					BasePPA: BasePPA{
-						PPA:    imageDefPPA1,
-						series: "jammy",
+						PPA:         imageDefPPA1,
+						series:      "jammy",
+						confDefPath: "/conf",
 					},
 				},
 			},
@@ -148,12 +152,14 @@ func TestNew(t *testing.T) {
 				imageDefPPA: imageDefPPA1,
 				deb822:      true,
 				series:      "jammy",
+				confDefPath: "/conf",
 			},
 			want: &PPA{
 				PPAPrivateInterface: &Deb822PPA{
 					BasePPA: BasePPA{
-						PPA:    imageDefPPA1,
-						series: "jammy",
+						PPA:         imageDefPPA1,
+						series:      "jammy",
+						confDefPath: "/conf",
 					},
 				},
 			},
@@ -162,7 +168,7 @@ func TestNew(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			asserter := helper.Asserter{T: t}
-			got := New(tt.args.imageDefPPA, tt.args.deb822, tt.args.series)
+			got := New(tt.args.imageDefPPA, tt.args.deb822, tt.args.series, tt.args.confDefPath)
 			asserter.AssertEqual(tt.want, got, cmpOpts...)
 		})
 	}
@@ -342,6 +348,213 @@ func TestDeb822AddRemove(t *testing.T) {
 	}
 }
 
+func TestPPAPreferences(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	tmpDirPath, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(tmpDirPath) })
+
+	p := &PPA{
+		PPAPrivateInterface: &Deb822PPA{
+			BasePPA{
+				PPA: &imagedefinition.PPA{
+					Name:        "canonical-foundations/ubuntu-image",
+					KeepEnabled: helper.BoolPtr(false),
+				},
+				series: "jammy",
+			},
+		},
+	}
+
+	// no priority, no preferences file
+	asserter.AssertEqual("", p.PreferencesContent())
+	err = p.addPreferences(tmpDirPath)
+	asserter.AssertErrNil(err, true)
+	prefFile := filepath.Join(tmpDirPath, preferencesDPath, "canonical-foundations-ubuntu-ubuntu-image-jammy.pref")
+	_, err = os.Stat(prefFile)
+	if !os.IsNotExist(err) {
+		t.Errorf("File %s should not exist, but does", prefFile)
+	}
+
+	p = &PPA{
+		PPAPrivateInterface: &Deb822PPA{
+			BasePPA{
+				PPA: &imagedefinition.PPA{
+					Name:        "canonical-foundations/ubuntu-image",
+					KeepEnabled: helper.BoolPtr(false),
+					Priority:    1001,
+				},
+				series: "jammy",
+			},
+		},
+	}
+
+	err = p.addPreferences(tmpDirPath)
+	asserter.AssertErrNil(err, true)
+	prefBytes, err := os.ReadFile(prefFile)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("Package: *\nPin: release o=LP-PPA-canonical-foundations-ubuntu-image\nPin-Priority: 1001\n", string(prefBytes))
+
+	// the preferences file is removed along with the sources file
+	sourcesListD := filepath.Join(tmpDirPath, sourcesListDPath)
+	err = os.MkdirAll(sourcesListD, 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(sourcesListD, p.FileName()), []byte(""), 0644)
+	asserter.AssertErrNil(err, true)
+
+	err = p.Remove(tmpDirPath)
+	asserter.AssertErrNil(err, true)
+	_, err = os.Stat(prefFile)
+	if !os.IsNotExist(err) {
+		t.Errorf("File %s should not exist, but does", prefFile)
+	}
+
+	// PPAs named "ppa" are published with the origin LP-PPA-<user>
+	p = &PPA{
+		PPAPrivateInterface: &Deb822PPA{
+			BasePPA{
+				PPA: &imagedefinition.PPA{
+					Name:        "deadsnakes/ppa",
+					KeepEnabled: helper.BoolPtr(false),
+					Priority:    500,
+				},
+				series: "jammy",
+			},
+		},
+	}
+	asserter.AssertEqual("Package: *\nPin: release o=LP-PPA-deadsnakes\nPin-Priority: 500\n", p.PreferencesContent())
+
+	// make sure failures are reported
+	osOpenFile = mockOpenFile
+	t.Cleanup(func() {
+		osOpenFile = os.OpenFile
+	})
+	err = p.addPreferences(tmpDirPath)
+	asserter.AssertErrContains(err, "Error creating")
+	osOpenFile = os.OpenFile
+
+	osMkdirAll = mockMkdirAll
+	t.Cleanup(func() {
+		osMkdirAll = os.MkdirAll
+	})
+	err = p.addPreferences(tmpDirPath)
+	asserter.AssertErrContains(err, "Failed to create apt preferences.d")
+	osMkdirAll = os.MkdirAll
+}
+
+func TestImportLocalKey(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	tmpDirPath, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(tmpDirPath) })
+
+	key := `-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mI0EUL4ncAEEAOZssKpJDMZKbmsf9lHwlKA0vN6yQ0sOIPc500waH3xTC0sVlqQc
+3pUxCIdhU+qK1mH2D51FGHDb504k0Lpb+LE56TWa/X3xrZqUQX0UD1fykEruR4W2
+CdkXXZvmNBNatE9GurR6p407X5TED+dlUK/hIKNCb5unTEilBb4WwArxABEBAAG0
+LExhdW5jaHBhZCBQUEEgZm9yIENhbm9uaWNhbCBGb3VuZGF0aW9ucyBUZWFtiLgE
+EwECACIFAlC+J3ACGwMGCwkIBwMCBhUIAgkKCwQWAgMBAh4BAheAAAoJENTAtmj9
+TJE5u/MD/2j2auOv62YUFwT7POylj7ihhZOarOSCEiQGita8II77j5AoK5O75uD+
+oQc5pdxVN2NGYD5R0PmDCPFN1Rb869YjtsPgLefEB+6Tc1GOR9hgnwuSU5lrwqdQ
+Ht/skh2wZSHtJgejt9kqIKMho1wtYz7ZTqMtN9GJK0VONbHP0Xu6
+=Cfxk
+-----END PGP PUBLIC KEY BLOCK-----`
+	err = os.WriteFile(filepath.Join(tmpDirPath, "ppa.asc"), []byte(key), 0600)
+	asserter.AssertErrNil(err, true)
+
+	osMkdirTemp = wrapMkdirTemp(tmpDirPath)
+	t.Cleanup(func() {
+		osMkdirTemp = os.MkdirTemp
+	})
+
+	// make sure neither Launchpad nor the keyserver are queried
+	httpGet = func(string) (*http.Response, error) {
+		return nil, fmt.Errorf("unexpected call to the Launchpad API")
+	}
+	t.Cleanup(func() {
+		httpGet = http.Get
+	})
+
+	// a relative key file is looked up next to the image definition
+	deb822PPA := &Deb822PPA{
+		BasePPA{
+			PPA: &imagedefinition.PPA{
+				Name:        "canonical-foundations/ubuntu-image",
+				KeyFile:     "ppa.asc",
+				KeepEnabled: helper.BoolPtr(false),
+				Keyserver:   "hkp://127.0.0.1:1",
+			},
+			series:      "jammy",
+			confDefPath: tmpDirPath,
+		},
+	}
+	err = deb822PPA.ImportKey(tmpDirPath, true)
+	asserter.AssertErrNil(err, true)
+	_, err = deb822PPA.FileContent()
+	asserter.AssertErrNil(err, true)
+	if !strings.HasPrefix(deb822PPA.signingKey, "-----BEGIN PGP PUBLIC KEY BLOCK-----") {
+		t.Errorf("Unexpected signing key: %s", deb822PPA.signingKey)
+	}
+
+	// an inline key is imported in trusted.gpg.d
+	gpgDir := filepath.Join(tmpDirPath, trustedGPGDPath)
+	err = os.MkdirAll(gpgDir, 0755)
+	asserter.AssertErrNil(err, true)
+
+	legacyPPA := &LegacyPPA{
+		BasePPA{
+			PPA: &imagedefinition.PPA{
+				Name:        "canonical-foundations/ubuntu-image",
+				Key:         key,
+				Fingerprint: "CDE5112BD4104F975FC8A53FD4C0B668FD4C9139",
+				KeepEnabled: helper.BoolPtr(false),
+			},
+			series: "jammy",
+		},
+	}
+	err = legacyPPA.ImportKey(tmpDirPath, true)
+	asserter.AssertErrNil(err, true)
+	_, err = os.Stat(filepath.Join(gpgDir, "canonical-foundations-ubuntu-ubuntu-image-jammy.gpg"))
+	asserter.AssertErrNil(err, true)
+
+	// a fingerprint not matching the local key is reported
+	legacyPPA.Fingerprint = "0000000000000000000000000000000000000000"
+	err = legacyPPA.ImportKey(tmpDirPath, true)
+	asserter.AssertErrContains(err, "Error running gpg command")
+
+	// a missing key file is reported
+	deb822PPA.KeyFile = "missing.asc"
+	err = deb822PPA.ImportKey(tmpDirPath, true)
+	asserter.AssertErrContains(err, "Error running gpg command")
+
+	osWriteFile = func(string, []byte, os.FileMode) error {
+		return fmt.Errorf("os.WriteFile error")
+	}
+	t.Cleanup(func() {
+		osWriteFile = os.WriteFile
+	})
+	err = legacyPPA.ImportKey(tmpDirPath, true)
+	asserter.AssertErrContains(err, "Error writing signing key")
+	osWriteFile = os.WriteFile
+}
+
+func Test_keyserverAndLaunchpadURL(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	p := &BasePPA{
+		PPA: &imagedefinition.PPA{
+			Name: "canonical-foundations/ubuntu-image",
+		},
+	}
+	asserter.AssertEqual(keyserverURL, p.keyserver())
+	asserter.AssertEqual(lpBaseURL, p.launchpadURL())
+
+	p.Keyserver = "hkps://keyserver.example.com"
+	p.LaunchpadURL = "https://launchpad.example.com/api/"
+	asserter.AssertEqual("hkps://keyserver.example.com", p.keyserver())
+	asserter.AssertEqual("https://launchpad.example.com/api", p.launchpadURL())
+}
+
 func TestAdd_fail(t *testing.T) {
 	asserter := helper.Asserter{T: t}
 	p := &PPA{
@@ -0,0 +1,209 @@
+package ppa
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+const armoredKeyHeader = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+
+// NewRepository instantiates the proper third-party repository implementation
+// based on the deb822 flag. Relative key files are looked up in confDefPath.
+func NewRepository(imageDefRepository *imagedefinition.Repository, deb822 bool, confDefPath string) PPAInterface {
+	baseRepository := BaseRepository{
+		Repository:  imageDefRepository,
+		confDefPath: confDefPath,
+	}
+
+	if deb822 {
+		return &Deb822Repository{
+			BaseRepository: baseRepository,
+		}
+	}
+
+	return &LegacyRepository{
+		BaseRepository: baseRepository,
+	}
+}
+
+// BaseRepository holds fields and methods common to every third-party repository format
+type BaseRepository struct {
+	*imagedefinition.Repository
+	confDefPath string
+}
+
+// signingKey returns the ASCII armored signing key of the repository,
+// or an empty string if none was given
+func (r *BaseRepository) signingKey() (string, error) {
+	key := r.Key
+	if r.KeyFile != "" {
+		keyFile := r.KeyFile
+		if !filepath.IsAbs(keyFile) {
+			keyFile = filepath.Join(r.confDefPath, keyFile)
+		}
+		keyBytes, err := osReadFile(keyFile)
+		if err != nil {
+			return "", fmt.Errorf("Error reading signing key for repository \"%s\": %s",
+				r.Name, err.Error())
+		}
+		key = string(keyBytes)
+	}
+
+	key = strings.TrimSpace(key)
+	if key != "" && !strings.HasPrefix(key, armoredKeyHeader) {
+		return "", fmt.Errorf("The signing key for repository \"%s\" is not an ASCII armored public key",
+			r.Name)
+	}
+	return key, nil
+}
+
+// hasSigningKey returns whether a signing key was given for the repository
+func (r *BaseRepository) hasSigningKey() bool {
+	return r.Key != "" || r.KeyFile != ""
+}
+
+// writeFile writes a file relative to basePath, creating its parent directory if needed
+func (r *BaseRepository) writeFile(basePath string, relPath string, content string) error {
+	dir := filepath.Join(basePath, filepath.Dir(relPath))
+	err := osMkdirAll(dir, 0755)
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Failed to create %s: %s", dir, err.Error())
+	}
+
+	path := filepath.Join(basePath, relPath)
+	err = osWriteFile(path, []byte(content), 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write repository file %s: %w", path, err)
+	}
+	return nil
+}
+
+// removeFiles removes files relative to basePath, unless the repository
+// should be kept enabled in the image
+func (r *BaseRepository) removeFiles(basePath string, relPaths ...string) error {
+	if r.KeepEnabled == nil {
+		return imagedefinition.ErrKeepEnabledNil
+	}
+
+	if *r.KeepEnabled {
+		return nil
+	}
+
+	for _, relPath := range relPaths {
+		path := filepath.Join(basePath, relPath)
+		err := osRemove(path)
+		if err != nil {
+			return fmt.Errorf("Error removing %s: %s", path, err.Error())
+		}
+	}
+	return nil
+}
+
+// LegacyRepository implements behaviors to manage a third-party repository
+// the legacy way, specifically:
+// - write one-line entries in a sources.list file
+// - write the signing key in /etc/apt/trusted.gpg.d
+type LegacyRepository struct {
+	BaseRepository
+}
+
+func (r *LegacyRepository) fileName() string {
+	return r.Name + ".list"
+}
+
+func (r *LegacyRepository) keyFileName() string {
+	return r.Name + ".asc"
+}
+
+func (r *LegacyRepository) fileContent() string {
+	options := ""
+	if len(r.Architectures) > 0 {
+		options = fmt.Sprintf("[arch=%s] ", strings.Join(r.Architectures, ","))
+	}
+
+	var content strings.Builder
+	for _, uri := range r.URIs {
+		for _, suite := range r.Suites {
+			fmt.Fprintf(&content, "deb %s%s %s", options, uri, suite)
+			if len(r.Components) > 0 {
+				fmt.Fprintf(&content, " %s", strings.Join(r.Components, " "))
+			}
+			content.WriteString("\n")
+		}
+	}
+	return content.String()
+}
+
+// Add adds the repository to the sources.list.d directory and its signing key,
+// if any, to the trusted.gpg.d directory
+func (r *LegacyRepository) Add(basePath string, debug bool) error {
+	key, err := r.signingKey()
+	if err != nil {
+		return err
+	}
+
+	if key != "" {
+		err = r.writeFile(basePath, filepath.Join(trustedGPGDPath, r.keyFileName()), key+"\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.writeFile(basePath, filepath.Join(sourcesListDPath, r.fileName()), r.fileContent())
+}
+
+// Remove removes the repository and its signing key, unless it should be kept enabled
+func (r *LegacyRepository) Remove(basePath string) error {
+	files := []string{filepath.Join(sourcesListDPath, r.fileName())}
+	if r.hasSigningKey() {
+		files = append(files, filepath.Join(trustedGPGDPath, r.keyFileName()))
+	}
+	return r.removeFiles(basePath, files...)
+}
+
+// Deb822Repository implements behaviors to manage a third-party repository
+// in the deb822 format, specifically:
+// - write in a <repository>.sources file, in the deb822 format
+// - embed the signing key in the file itself
+type Deb822Repository struct {
+	BaseRepository
+}
+
+func (r *Deb822Repository) fileName() string {
+	return r.Name + ".sources"
+}
+
+func (r *Deb822Repository) fileContent(key string) string {
+	var content strings.Builder
+	fmt.Fprintf(&content, "Types: deb\nURIs: %s\nSuites: %s\n",
+		strings.Join(r.URIs, " "), strings.Join(r.Suites, " "))
+	if len(r.Components) > 0 {
+		fmt.Fprintf(&content, "Components: %s\n", strings.Join(r.Components, " "))
+	}
+	if len(r.Architectures) > 0 {
+		fmt.Fprintf(&content, "Architectures: %s\n", strings.Join(r.Architectures, " "))
+	}
+	if key != "" {
+		fmt.Fprintf(&content, "Signed-By:\n%s\n", formatDeb822Field(key))
+	}
+	return content.String()
+}
+
+// Add adds the repository, with its embedded signing key, to the sources.list.d directory
+func (r *Deb822Repository) Add(basePath string, debug bool) error {
+	key, err := r.signingKey()
+	if err != nil {
+		return err
+	}
+
+	return r.writeFile(basePath, filepath.Join(sourcesListDPath, r.fileName()), r.fileContent(key))
+}
+
+// Remove removes the repository, unless it should be kept enabled
+func (r *Deb822Repository) Remove(basePath string) error {
+	return r.removeFiles(basePath, filepath.Join(sourcesListDPath, r.fileName()))
+}
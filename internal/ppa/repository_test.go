@@ -0,0 +1,219 @@
+package ppa
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+	"github.com/canonical/ubuntu-image/internal/testhelper"
+)
+
+const testArmoredKey = `-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mI0EUL4ncAEEAOZssKpJDMZKbmsf9lHwlKA0vN6yQ0sOIPc500waH3xTC0sVlqQc
+=Cfxk
+-----END PGP PUBLIC KEY BLOCK-----`
+
+func mockWriteFile(string, []byte, os.FileMode) error {
+	return fmt.Errorf("os.WriteFile error")
+}
+
+func TestNewRepository(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	imageDefRepository := &imagedefinition.Repository{Name: "artifactory"}
+
+	r := NewRepository(imageDefRepository, true, "/conf")
+	_, ok := r.(*Deb822Repository)
+	asserter.AssertEqual(true, ok)
+
+	r = NewRepository(imageDefRepository, false, "/conf")
+	_, ok = r.(*LegacyRepository)
+	asserter.AssertEqual(true, ok)
+}
+
+func TestRepositoryAddRemove(t *testing.T) {
+	testCases := []struct {
+		name        string
+		deb822      bool
+		repository  *imagedefinition.Repository
+		wantFiles   map[string]string
+		keepEnabled bool
+	}{
+		{
+			name:   "legacy with inline key",
+			deb822: false,
+			repository: &imagedefinition.Repository{
+				Name:          "artifactory",
+				URIs:          []string{"https://artifactory.example.com/ubuntu", "https://mirror.example.com/ubuntu"},
+				Suites:        []string{"jammy", "jammy-updates"},
+				Components:    []string{"main", "extra"},
+				Architectures: []string{"amd64", "arm64"},
+				Key:           testArmoredKey,
+				KeepEnabled:   helper.BoolPtr(false),
+			},
+			wantFiles: map[string]string{
+				filepath.Join(sourcesListDPath, "artifactory.list"): `deb [arch=amd64,arm64] https://artifactory.example.com/ubuntu jammy main extra
+deb [arch=amd64,arm64] https://artifactory.example.com/ubuntu jammy-updates main extra
+deb [arch=amd64,arm64] https://mirror.example.com/ubuntu jammy main extra
+deb [arch=amd64,arm64] https://mirror.example.com/ubuntu jammy-updates main extra
+`,
+				filepath.Join(trustedGPGDPath, "artifactory.asc"): testArmoredKey + "\n",
+			},
+		},
+		{
+			name:   "legacy flat repository without key",
+			deb822: false,
+			repository: &imagedefinition.Repository{
+				Name:        "flat",
+				URIs:        []string{"https://example.com/debs"},
+				Suites:      []string{"./"},
+				KeepEnabled: helper.BoolPtr(true),
+			},
+			wantFiles: map[string]string{
+				filepath.Join(sourcesListDPath, "flat.list"): "deb https://example.com/debs ./\n",
+			},
+			keepEnabled: true,
+		},
+		{
+			name:   "deb822 with key file",
+			deb822: true,
+			repository: &imagedefinition.Repository{
+				Name:          "artifactory",
+				URIs:          []string{"https://artifactory.example.com/ubuntu"},
+				Suites:        []string{"jammy", "jammy-updates"},
+				Components:    []string{"main"},
+				Architectures: []string{"amd64"},
+				KeyFile:       "key.asc",
+				KeepEnabled:   helper.BoolPtr(false),
+			},
+			wantFiles: map[string]string{
+				filepath.Join(sourcesListDPath, "artifactory.sources"): `Types: deb
+URIs: https://artifactory.example.com/ubuntu
+Suites: jammy jammy-updates
+Components: main
+Architectures: amd64
+Signed-By:
+ -----BEGIN PGP PUBLIC KEY BLOCK-----
+ .
+ mI0EUL4ncAEEAOZssKpJDMZKbmsf9lHwlKA0vN6yQ0sOIPc500waH3xTC0sVlqQc
+ =Cfxk
+ -----END PGP PUBLIC KEY BLOCK-----
+`,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			tmpDirPath, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			t.Cleanup(func() { os.RemoveAll(tmpDirPath) })
+
+			confDefPath := filepath.Join(tmpDirPath, "conf")
+			err = os.MkdirAll(confDefPath, 0755)
+			asserter.AssertErrNil(err, true)
+			err = os.WriteFile(filepath.Join(confDefPath, "key.asc"), []byte(testArmoredKey), 0600)
+			asserter.AssertErrNil(err, true)
+
+			chroot := filepath.Join(tmpDirPath, "chroot")
+			r := NewRepository(tc.repository, tc.deb822, confDefPath)
+			err = r.Add(chroot, true)
+			asserter.AssertErrNil(err, true)
+
+			for file, wantContent := range tc.wantFiles {
+				gotContent, err := os.ReadFile(filepath.Join(chroot, file))
+				asserter.AssertErrNil(err, true)
+				asserter.AssertEqual(wantContent, string(gotContent))
+			}
+
+			err = r.Remove(chroot)
+			asserter.AssertErrNil(err, true)
+
+			for file := range tc.wantFiles {
+				_, err = os.Stat(filepath.Join(chroot, file))
+				if tc.keepEnabled && err != nil {
+					t.Errorf("File %s should exist, but does not", file)
+				}
+				if !tc.keepEnabled && !os.IsNotExist(err) {
+					t.Errorf("File %s should not exist, but does", file)
+				}
+			}
+		})
+	}
+}
+
+func TestRepositoryAdd_fail(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	tmpDirPath, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(tmpDirPath) })
+
+	imageDefRepository := &imagedefinition.Repository{
+		Name:        "artifactory",
+		URIs:        []string{"https://artifactory.example.com/ubuntu"},
+		Suites:      []string{"jammy"},
+		KeyFile:     "missing.asc",
+		KeepEnabled: helper.BoolPtr(false),
+	}
+
+	r := NewRepository(imageDefRepository, false, tmpDirPath)
+	err = r.Add(tmpDirPath, true)
+	asserter.AssertErrContains(err, "Error reading signing key for repository")
+
+	imageDefRepository.KeyFile = ""
+	imageDefRepository.Key = "not a key"
+	err = r.Add(tmpDirPath, true)
+	asserter.AssertErrContains(err, "is not an ASCII armored public key")
+
+	imageDefRepository.Key = testArmoredKey
+	osMkdirAll = mockMkdirAll
+	t.Cleanup(func() {
+		osMkdirAll = os.MkdirAll
+	})
+	err = r.Add(tmpDirPath, true)
+	asserter.AssertErrContains(err, "Failed to create")
+	osMkdirAll = os.MkdirAll
+
+	osWriteFile = mockWriteFile
+	t.Cleanup(func() {
+		osWriteFile = os.WriteFile
+	})
+	err = r.Add(tmpDirPath, true)
+	asserter.AssertErrContains(err, "unable to write repository file")
+	osWriteFile = os.WriteFile
+
+	r = NewRepository(imageDefRepository, true, tmpDirPath)
+	imageDefRepository.Key = "not a key"
+	err = r.Add(tmpDirPath, true)
+	asserter.AssertErrContains(err, "is not an ASCII armored public key")
+}
+
+func TestRepositoryRemove_fail(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	tmpDirPath, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(tmpDirPath) })
+
+	imageDefRepository := &imagedefinition.Repository{
+		Name:   "artifactory",
+		URIs:   []string{"https://artifactory.example.com/ubuntu"},
+		Suites: []string{"jammy"},
+	}
+
+	r := NewRepository(imageDefRepository, true, tmpDirPath)
+	err = r.Remove(tmpDirPath)
+	asserter.AssertErrContains(err, imagedefinition.ErrKeepEnabledNil.Error())
+
+	imageDefRepository.KeepEnabled = helper.BoolPtr(false)
+	osRemove = mockRemove
+	t.Cleanup(func() {
+		osRemove = os.Remove
+	})
+	err = r.Remove(tmpDirPath)
+	asserter.AssertErrContains(err, "Error removing")
+	osRemove = os.Remove
+}
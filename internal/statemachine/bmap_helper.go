@@ -0,0 +1,124 @@
+package statemachine
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// bmapBlockSize is the block size used in block maps, as bmaptool does
+const bmapBlockSize = 4096
+
+// bmapRange is a range of mapped blocks, both ends included
+type bmapRange struct {
+	first int64
+	last  int64
+}
+
+// mappedRanges returns the ranges of blocks of a file holding data, found
+// by skipping over the holes of the sparse file
+func mappedRanges(f *os.File, size int64) ([]bmapRange, error) {
+	ranges := make([]bmapRange, 0)
+	offset := int64(0)
+	for offset < size {
+		dataStart, err := unix.Seek(int(f.Fd()), offset, unix.SEEK_DATA)
+		if err != nil {
+			// ENXIO means there is no data after offset
+			if errors.Is(err, unix.ENXIO) {
+				break
+			}
+			return nil, err
+		}
+		dataEnd, err := unix.Seek(int(f.Fd()), dataStart, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+
+		r := bmapRange{first: dataStart / bmapBlockSize, last: (dataEnd - 1) / bmapBlockSize}
+		// data sharing a block with the previous range extends it
+		if len(ranges) > 0 && r.first <= ranges[len(ranges)-1].last+1 {
+			ranges[len(ranges)-1].last = r.last
+		} else {
+			ranges = append(ranges, r)
+		}
+		offset = dataEnd
+	}
+	return ranges, nil
+}
+
+// rangeChecksum computes the SHA256 sum of the data of a range of blocks
+func rangeChecksum(f *os.File, r bmapRange) (string, error) {
+	hasher := sha256.New()
+	section := io.NewSectionReader(f, r.first*bmapBlockSize, (r.last-r.first+1)*bmapBlockSize)
+	_, err := io.Copy(hasher, section)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// generateBmap generates a bmaptool compatible block map, version 2.0, of
+// the given sparse image. Only the blocks holding data are listed, with
+// their checksums, so flashing tools can skip the holes
+func generateBmap(imgPath string) (string, error) {
+	f, err := os.Open(imgPath)
+	if err != nil {
+		return "", fmt.Errorf("Error opening image \"%s\" to generate its block map: %s", imgPath, err.Error())
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("Error getting size of image \"%s\": %s", imgPath, err.Error())
+	}
+	size := info.Size()
+
+	ranges, err := mappedRanges(f, size)
+	if err != nil {
+		return "", fmt.Errorf("Error finding mapped blocks of image \"%s\": %s", imgPath, err.Error())
+	}
+
+	blockMap := &strings.Builder{}
+	mappedBlocks := int64(0)
+	for _, r := range ranges {
+		checksum, err := rangeChecksum(f, r)
+		if err != nil {
+			return "", fmt.Errorf("Error calculating checksum of image \"%s\": %s", imgPath, err.Error())
+		}
+		mappedBlocks += r.last - r.first + 1
+		if r.first == r.last {
+			fmt.Fprintf(blockMap, "        <Range chksum=\"%s\"> %d </Range>\n", checksum, r.first)
+		} else {
+			fmt.Fprintf(blockMap, "        <Range chksum=\"%s\"> %d-%d </Range>\n", checksum, r.first, r.last)
+		}
+	}
+
+	// the checksum of the bmap file is computed with its own value set to zeroes
+	zeroChecksum := strings.Repeat("0", sha256.Size*2)
+	bmap := fmt.Sprintf(`<?xml version="1.0" ?>
+<!-- This file contains the block map for an image file, which is basically
+     a list of useful (mapped) block numbers in the image file. In other words,
+     it lists only those blocks which contain data (boot sector, partition
+     table, file-system metadata, files, directories, extents, etc). These
+     blocks have to be copied to the target device. The other blocks do not
+     contain any useful data and do not have to be copied to the target
+     device. -->
+<bmap version="2.0">
+    <ImageSize> %d </ImageSize>
+    <BlockSize> %d </BlockSize>
+    <BlocksCount> %d </BlocksCount>
+    <MappedBlocksCount> %d </MappedBlocksCount>
+    <ChecksumType> sha256 </ChecksumType>
+    <BmapFileChecksum> %s </BmapFileChecksum>
+    <BlockMap>
+%s    </BlockMap>
+</bmap>
+`, size, bmapBlockSize, (size+bmapBlockSize-1)/bmapBlockSize, mappedBlocks, zeroChecksum, blockMap.String())
+
+	return strings.Replace(bmap, zeroChecksum, fmt.Sprintf("%x", sha256.Sum256([]byte(bmap))), 1), nil
+}
@@ -0,0 +1,64 @@
+package statemachine
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// Test_generateBmap checks the block map of a sparse image only lists the
+// blocks holding data and can be verified with its own checksum
+func Test_generateBmap(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	imgPath := filepath.Join(t.TempDir(), "test.img")
+
+	// 10 blocks and a half, with data in blocks 0, 3 to 4 and in the last
+	// partial block
+	f, err := os.Create(imgPath)
+	asserter.AssertErrNil(err, true)
+	err = f.Truncate(10*bmapBlockSize + bmapBlockSize/2)
+	asserter.AssertErrNil(err, true)
+	first := []byte(strings.Repeat("a", bmapBlockSize))
+	middle := []byte(strings.Repeat("b", 2*bmapBlockSize))
+	last := []byte(strings.Repeat("c", bmapBlockSize/2))
+	for offset, data := range map[int64][]byte{0: first, 3 * bmapBlockSize: middle, 10 * bmapBlockSize: last} {
+		_, err = f.WriteAt(data, offset)
+		asserter.AssertErrNil(err, true)
+	}
+	err = f.Close()
+	asserter.AssertErrNil(err, true)
+
+	bmap, err := generateBmap(imgPath)
+	asserter.AssertErrNil(err, true)
+
+	for _, expected := range []string{
+		fmt.Sprintf("<ImageSize> %d </ImageSize>", 10*bmapBlockSize+bmapBlockSize/2),
+		"<BlocksCount> 11 </BlocksCount>",
+		"<MappedBlocksCount> 4 </MappedBlocksCount>",
+		fmt.Sprintf("<Range chksum=\"%x\"> 0 </Range>", sha256.Sum256(first)),
+		fmt.Sprintf("<Range chksum=\"%x\"> 3-4 </Range>", sha256.Sum256(middle)),
+		fmt.Sprintf("<Range chksum=\"%x\"> 10 </Range>", sha256.Sum256(last)),
+	} {
+		if !strings.Contains(bmap, expected) {
+			t.Errorf("Expected \"%s\" in the block map, got:\n%s", expected, bmap)
+		}
+	}
+
+	// the file checksum is computed with itself set to zeroes
+	checksumRegex := regexp.MustCompile(`<BmapFileChecksum> ([0-9a-f]{64}) </BmapFileChecksum>`)
+	match := checksumRegex.FindStringSubmatch(bmap)
+	if match == nil {
+		t.Fatalf("No file checksum found in the block map:\n%s", bmap)
+	}
+	zeroed := strings.Replace(bmap, match[1], strings.Repeat("0", 64), 1)
+	asserter.AssertEqual(fmt.Sprintf("%x", sha256.Sum256([]byte(zeroed))), match[1])
+
+	_, err = generateBmap(filepath.Join(t.TempDir(), "missing.img"))
+	asserter.AssertErrContains(err, "Error opening image")
+}
@@ -5,6 +5,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/snapcore/snapd/bootloader"
 	"github.com/snapcore/snapd/gadget"
@@ -12,6 +14,7 @@ import (
 
 	"github.com/canonical/ubuntu-image/internal/arch"
 	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
 )
 
 // handleLkBootloader handles the special "lk" bootloader case where some extra
@@ -333,3 +336,126 @@ func prepareGrubMountDir(mountDir string, rootfsPartNum int, bootPartNum int, lo
 
 	return teardownCmds, nil
 }
+
+// grubCustomizationFile is the file, relative to the rootfs, holding the
+// GRUB settings from the image definition. It is named to be sourced after
+// the configuration files shipped by packages.
+var grubCustomizationFile = filepath.Join("etc", "default", "grub.d", "90-ubuntu-image.cfg")
+
+// shellQuote quotes a string to be used literally in a shell script
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// hasGrubSettings returns whether the bootloader customization holds
+// settings applying to GRUB
+func hasGrubSettings(bootloader *imagedefinition.Bootloader) bool {
+	return len(bootloader.CmdlineAppend) > 0 ||
+		len(bootloader.CmdlineRemove) > 0 ||
+		bootloader.Timeout != nil ||
+		bootloader.Terminal != "" ||
+		bootloader.SerialCommand != "" ||
+		bootloader.DefaultEntry != ""
+}
+
+// generateGrubCustomization generates a shell snippet, to be sourced by
+// grub-mkconfig from /etc/default/grub.d, applying the bootloader customization
+func generateGrubCustomization(bootloader *imagedefinition.Bootloader) string {
+	var cfg strings.Builder
+	cfg.WriteString("# Generated by ubuntu-image from the image definition\n")
+
+	if len(bootloader.CmdlineRemove) > 0 {
+		patterns := make([]string, 0, len(bootloader.CmdlineRemove))
+		for _, arg := range bootloader.CmdlineRemove {
+			patterns = append(patterns, shellQuote(arg))
+		}
+		fmt.Fprintf(&cfg, `ubuntu_image_cmdline_remove() {
+	ubuntu_image_cmdline=""
+	for ubuntu_image_arg in $1; do
+		case "$ubuntu_image_arg" in
+			%s) ;;
+			*) ubuntu_image_cmdline="$ubuntu_image_cmdline $ubuntu_image_arg" ;;
+		esac
+	done
+	echo "${ubuntu_image_cmdline# }"
+}
+GRUB_CMDLINE_LINUX="$(ubuntu_image_cmdline_remove "$GRUB_CMDLINE_LINUX")"
+GRUB_CMDLINE_LINUX_DEFAULT="$(ubuntu_image_cmdline_remove "$GRUB_CMDLINE_LINUX_DEFAULT")"
+`, strings.Join(patterns, "|"))
+	}
+	if len(bootloader.CmdlineAppend) > 0 {
+		fmt.Fprintf(&cfg, "GRUB_CMDLINE_LINUX=\"${GRUB_CMDLINE_LINUX:+$GRUB_CMDLINE_LINUX }\"%s\n",
+			shellQuote(strings.Join(bootloader.CmdlineAppend, " ")))
+	}
+	if bootloader.Timeout != nil {
+		fmt.Fprintf(&cfg, "GRUB_TIMEOUT=%d\n", *bootloader.Timeout)
+		// a hidden menu would ignore the timeout
+		if *bootloader.Timeout > 0 {
+			cfg.WriteString("GRUB_TIMEOUT_STYLE=menu\n")
+		}
+	}
+	if bootloader.Terminal != "" {
+		fmt.Fprintf(&cfg, "GRUB_TERMINAL=%s\n", shellQuote(bootloader.Terminal))
+	}
+	if bootloader.SerialCommand != "" {
+		fmt.Fprintf(&cfg, "GRUB_SERIAL_COMMAND=%s\n", shellQuote(bootloader.SerialCommand))
+	}
+	if bootloader.DefaultEntry != "" {
+		fmt.Fprintf(&cfg, "GRUB_DEFAULT=%s\n", shellQuote(bootloader.DefaultEntry))
+	}
+
+	return cfg.String()
+}
+
+// customizePibootFiles applies the bootloader customization to the cmdline.txt
+// and config.txt files of a piboot boot partition
+func customizePibootFiles(bootloader *imagedefinition.Bootloader, bootDir string) error {
+	if len(bootloader.CmdlineAppend) > 0 || len(bootloader.CmdlineRemove) > 0 {
+		cmdlinePath := filepath.Join(bootDir, "cmdline.txt")
+		cmdline, err := osReadFile(cmdlinePath)
+		if err != nil {
+			return fmt.Errorf("Error reading cmdline.txt: %s", err.Error())
+		}
+
+		// cmdline.txt holds the arguments on a single line
+		args := make([]string, 0)
+		for _, arg := range strings.Fields(string(cmdline)) {
+			if !slices.Contains(bootloader.CmdlineRemove, arg) {
+				args = append(args, arg)
+			}
+		}
+		args = append(args, bootloader.CmdlineAppend...)
+
+		err = osWriteFile(cmdlinePath, []byte(strings.Join(args, " ")+"\n"), 0644)
+		if err != nil {
+			return fmt.Errorf("Error writing cmdline.txt: %s", err.Error())
+		}
+	}
+
+	if len(bootloader.ConfigTxt) > 0 {
+		configPath := filepath.Join(bootDir, "config.txt")
+		config, err := osReadFile(configPath)
+		if err != nil {
+			return fmt.Errorf("Error reading config.txt: %s", err.Error())
+		}
+
+		// make sure the settings apply to every model, whatever the
+		// conditional section config.txt ends with
+		var newConfig strings.Builder
+		newConfig.Write(config)
+		if len(config) > 0 && !strings.HasSuffix(string(config), "\n") {
+			newConfig.WriteString("\n")
+		}
+		newConfig.WriteString("\n# Added by ubuntu-image from the image definition\n[all]\n")
+		for _, line := range bootloader.ConfigTxt {
+			fmt.Fprintf(&newConfig, "%s\n", line)
+		}
+
+		err = osWriteFile(configPath, []byte(newConfig.String()), 0644)
+		if err != nil {
+			return fmt.Errorf("Error writing config.txt: %s", err.Error())
+		}
+	}
+
+	return nil
+}
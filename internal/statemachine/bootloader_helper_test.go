@@ -444,3 +444,106 @@ func TestStateMachine_setupGrub_failed(t *testing.T) {
 	asserter.AssertErrContains(err, "Error setting up /etc/resolv.conf")
 	helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
 }
+
+// Test_generateGrubCustomization checks the generated GRUB settings by sourcing
+// them the same way grub-mkconfig does
+func Test_generateGrubCustomization(t *testing.T) {
+	timeout := 5
+	noTimeout := 0
+	tests := []struct {
+		name       string
+		bootloader *imagedefinition.Bootloader
+		want       string
+	}{
+		{
+			name: "cmdline only",
+			bootloader: &imagedefinition.Bootloader{
+				CmdlineAppend: []string{"console=ttyS0,115200n8", "it's=quoted"},
+				CmdlineRemove: []string{"quiet", "splash"},
+			},
+			want: "cmdline=[console=tty1 console=ttyS0,115200n8 it's=quoted] default=[nomodeset] timeout=[0] style=[hidden] terminal=[] serial=[] entry=[0]",
+		},
+		{
+			name: "all settings",
+			bootloader: &imagedefinition.Bootloader{
+				CmdlineAppend: []string{"console=ttyS0"},
+				Timeout:       &timeout,
+				Terminal:      "console serial",
+				SerialCommand: "serial --speed=115200",
+				DefaultEntry:  "saved",
+			},
+			want: "cmdline=[console=tty1 console=ttyS0] default=[quiet splash nomodeset] timeout=[5] style=[menu] terminal=[console serial] serial=[serial --speed=115200] entry=[saved]",
+		},
+		{
+			name: "no timeout",
+			bootloader: &imagedefinition.Bootloader{
+				Timeout: &noTimeout,
+			},
+			want: "cmdline=[console=tty1] default=[quiet splash nomodeset] timeout=[0] style=[hidden] terminal=[] serial=[] entry=[0]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			tmpDir := t.TempDir()
+			cfgPath := filepath.Join(tmpDir, "90-ubuntu-image.cfg")
+			err := os.WriteFile(cfgPath, []byte(generateGrubCustomization(tt.bootloader)), 0644)
+			asserter.AssertErrNil(err, true)
+
+			script := `GRUB_CMDLINE_LINUX="console=tty1"
+GRUB_CMDLINE_LINUX_DEFAULT="quiet splash nomodeset"
+GRUB_TIMEOUT=0
+GRUB_TIMEOUT_STYLE=hidden
+GRUB_DEFAULT=0
+. "$1"
+echo "cmdline=[$GRUB_CMDLINE_LINUX] default=[$GRUB_CMDLINE_LINUX_DEFAULT] timeout=[$GRUB_TIMEOUT] style=[$GRUB_TIMEOUT_STYLE] terminal=[$GRUB_TERMINAL] serial=[$GRUB_SERIAL_COMMAND] entry=[$GRUB_DEFAULT]"`
+			out, err := exec.Command("sh", "-c", script, "sh", cfgPath).CombinedOutput()
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tt.want, strings.TrimSpace(string(out)))
+		})
+	}
+}
+
+// Test_customizePibootFiles checks cmdline.txt and config.txt are edited as requested
+func Test_customizePibootFiles(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	bootDir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(bootDir, "cmdline.txt"),
+		[]byte("console=serial0,115200 multipath=off dwc_otg.lpm_enable=0 console=tty1 root=LABEL=writable quiet splash\n"), 0644)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(bootDir, "config.txt"), []byte("[all]\nkernel=vmlinuz\n[pi4]\nmax_framebuffers=2"), 0644)
+	asserter.AssertErrNil(err, true)
+
+	bootloader := &imagedefinition.Bootloader{
+		CmdlineAppend: []string{"cfg80211.ieee80211_regdom=FR"},
+		CmdlineRemove: []string{"quiet", "splash"},
+		ConfigTxt:     []string{"enable_uart=1", "dtoverlay=disable-bt"},
+	}
+	err = customizePibootFiles(bootloader, bootDir)
+	asserter.AssertErrNil(err, true)
+
+	cmdline, err := os.ReadFile(filepath.Join(bootDir, "cmdline.txt"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("console=serial0,115200 multipath=off dwc_otg.lpm_enable=0 console=tty1 root=LABEL=writable cfg80211.ieee80211_regdom=FR\n", string(cmdline))
+
+	config, err := os.ReadFile(filepath.Join(bootDir, "config.txt"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("[all]\nkernel=vmlinuz\n[pi4]\nmax_framebuffers=2\n\n# Added by ubuntu-image from the image definition\n[all]\nenable_uart=1\ndtoverlay=disable-bt\n", string(config))
+
+	// missing files are reported
+	err = customizePibootFiles(bootloader, t.TempDir())
+	asserter.AssertErrContains(err, "Error reading cmdline.txt")
+	err = customizePibootFiles(&imagedefinition.Bootloader{ConfigTxt: []string{"enable_uart=1"}}, t.TempDir())
+	asserter.AssertErrContains(err, "Error reading config.txt")
+
+	osWriteFile = mockWriteFile
+	t.Cleanup(func() {
+		osWriteFile = os.WriteFile
+	})
+	err = customizePibootFiles(bootloader, bootDir)
+	asserter.AssertErrContains(err, "Error writing cmdline.txt")
+	err = customizePibootFiles(&imagedefinition.Bootloader{ConfigTxt: []string{"enable_uart=1"}}, bootDir)
+	asserter.AssertErrContains(err, "Error writing config.txt")
+	osWriteFile = os.WriteFile
+}
@@ -3,8 +3,10 @@ package statemachine
 import (
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/invopop/jsonschema"
@@ -30,6 +32,7 @@ var imageCreationStates = []stateFunc{
 type ClassicStateMachine struct {
 	StateMachine
 	ImageDef imagedefinition.ImageDefinition
+	Opts     commands.ClassicOpts
 	Args     commands.ClassicArgs
 }
 
@@ -49,10 +52,18 @@ func (classicStateMachine *ClassicStateMachine) Setup() error {
 		return err
 	}
 
+	if err := classicStateMachine.setReproducibility(classicStateMachine.Args.ImageDefinition); err != nil {
+		return err
+	}
+
 	if err := classicStateMachine.parseImageDefinition(); err != nil {
 		return err
 	}
 
+	if err := classicStateMachine.validateSignKey(); err != nil {
+		return err
+	}
+
 	if err := classicStateMachine.calculateStates(); err != nil {
 		return err
 	}
@@ -207,6 +218,8 @@ func validateImageDefinition(imageDefinition *imagedefinition.ImageDefinition) e
 		return err
 	}
 
+	validateArtifacts(imageDefinition, result)
+
 	// TODO: I've created a PR upstream in xeipuuv/gojsonschema
 	// https://github.com/xeipuuv/gojsonschema/pull/352
 	// if it gets merged this can be removed
@@ -224,9 +237,12 @@ func validateImageDefinition(imageDefinition *imagedefinition.ImageDefinition) e
 
 // validateGadget validates the Gadget section of the image definition
 func validateGadget(imageDefinition *imagedefinition.ImageDefinition, result *gojsonschema.Result) error {
-	// Do custom validation for gadgetURL being required if gadget is not pre-built
+	// Do custom validation for gadgetURL being required if gadget is not pre-built.
+	// Gadget snaps are either a local snap or fetched from the store by name instead.
 	if imageDefinition.Gadget != nil {
-		if imageDefinition.Gadget.GadgetType != "prebuilt" && imageDefinition.Gadget.GadgetURL == "" {
+		if imageDefinition.Gadget.GadgetType == "snap" {
+			validateSnapGadget(imageDefinition.Gadget, result)
+		} else if imageDefinition.Gadget.GadgetType != "prebuilt" && imageDefinition.Gadget.GadgetURL == "" {
 			jsonContext := gojsonschema.NewJsonContext("gadget_validation", nil)
 			errDetail := gojsonschema.ErrorDetails{
 				"key":   "gadget:type",
@@ -241,6 +257,40 @@ func validateGadget(imageDefinition *imagedefinition.ImageDefinition, result *go
 				errDetail,
 			)
 		}
+		// build dependencies are only installed in the gadget build chroot
+		buildInChroot := imageDefinition.Gadget.BuildInChroot
+		if len(imageDefinition.Gadget.BuildDeps) > 0 && (buildInChroot == nil || !*buildInChroot) {
+			jsonContext := gojsonschema.NewJsonContext("gadget_build_dependencies", nil)
+			errDetail := gojsonschema.ErrorDetails{
+				"key1": "gadget:build-dependencies",
+				"key2": "gadget:build-in-chroot",
+			}
+			result.AddError(
+				imagedefinition.NewDependentKeyError(
+					gojsonschema.NewJsonContext("dependentKey", jsonContext),
+					52,
+					errDetail,
+				),
+				errDetail,
+			)
+		}
+		if imageDefinition.Layout != nil {
+			jsonContext := gojsonschema.NewJsonContext("gadget_and_layout", nil)
+			errDetail := gojsonschema.ErrorDetails{
+				"key1": "gadget:",
+				"key2": "layout:",
+			}
+			result.AddError(
+				imagedefinition.NewExclusiveKeysError(
+					gojsonschema.NewJsonContext("exclusiveKeys", jsonContext),
+					52,
+					errDetail,
+				),
+				errDetail,
+			)
+		}
+	} else if imageDefinition.Layout != nil {
+		validateLayout(imageDefinition.Layout, result)
 	} else if imageDefinition.Artifacts != nil {
 		diskUsed, err := helperCheckTags(imageDefinition.Artifacts, "is_disk")
 		if err != nil {
@@ -266,6 +316,69 @@ func validateGadget(imageDefinition *imagedefinition.ImageDefinition, result *go
 	return nil
 }
 
+// validateSnapGadget validates that a gadget snap is given either by the URL
+// of a local file or by name
+func validateSnapGadget(gadget *imagedefinition.Gadget, result *gojsonschema.Result) {
+	jsonContext := gojsonschema.NewJsonContext("snap_gadget_validation", nil)
+	errDetail := gojsonschema.ErrorDetails{
+		"key1": "gadget:url",
+		"key2": "gadget:name",
+	}
+	if gadget.GadgetURL == "" && gadget.GadgetName == "" {
+		result.AddError(
+			imagedefinition.NewMissingKeysError(
+				gojsonschema.NewJsonContext("missingKeys", jsonContext),
+				52,
+				errDetail,
+			),
+			errDetail,
+		)
+	}
+	if gadget.GadgetURL != "" && gadget.GadgetName != "" {
+		result.AddError(
+			imagedefinition.NewExclusiveKeysError(
+				gojsonschema.NewJsonContext("exclusiveKeys", jsonContext),
+				52,
+				errDetail,
+			),
+			errDetail,
+		)
+	}
+	if gadget.GadgetURL != "" && !strings.HasPrefix(gadget.GadgetURL, "file://") {
+		errDetail := gojsonschema.ErrorDetails{
+			"key":    "gadget:url",
+			"scheme": "file://",
+			"value":  gadget.GadgetURL,
+		}
+		result.AddError(
+			imagedefinition.NewURLSchemeError(
+				gojsonschema.NewJsonContext("urlScheme", jsonContext),
+				52,
+				errDetail,
+			),
+			errDetail,
+		)
+	}
+}
+
+// validateLayout validates the Layout section of the image definition
+func validateLayout(layout *imagedefinition.Layout, result *gojsonschema.Result) {
+	jsonContext := gojsonschema.NewJsonContext("layout_validation", nil)
+	for volumeName, volume := range layout.Volumes {
+		for _, structure := range volume.Structure {
+			for _, content := range structure.Content {
+				// content is taken from the rootfs so must be given as absolute paths
+				if content.Source != "" {
+					validateAbsolutePath(content.Source, fmt.Sprintf("layout:volumes:%s:structure:content:source", volumeName), result, jsonContext)
+				}
+				if content.Image != "" {
+					validateAbsolutePath(content.Image, fmt.Sprintf("layout:volumes:%s:structure:content:image", volumeName), result, jsonContext)
+				}
+			}
+		}
+	}
+}
+
 // validateCustomization validates the Customization section of the image definition
 func validateCustomization(imageDefinition *imagedefinition.ImageDefinition, result *gojsonschema.Result) error {
 	if imageDefinition.Customization == nil {
@@ -273,11 +386,16 @@ func validateCustomization(imageDefinition *imagedefinition.ImageDefinition, res
 	}
 
 	validateExtraPPAs(imageDefinition, result)
+	validateExtraRepositories(imageDefinition, result)
+	validateFiles(imageDefinition, result)
+	validateInstaller(imageDefinition, result)
 	if imageDefinition.Customization.Manual != nil {
 		jsonContext := gojsonschema.NewJsonContext("manual_path_validation", nil)
 		validateManualMakeDirs(imageDefinition, result, jsonContext)
 		validateManualCopyFile(imageDefinition, result, jsonContext)
 		validateManualTouchFile(imageDefinition, result, jsonContext)
+		validateManualAddUser(imageDefinition, result, jsonContext)
+		validateManualExecute(imageDefinition, result)
 	}
 
 	return nil
@@ -286,7 +404,24 @@ func validateCustomization(imageDefinition *imagedefinition.ImageDefinition, res
 // validateExtraPPAs validates the Customization.ExtraPPAs section of the image definition
 func validateExtraPPAs(imageDefinition *imagedefinition.ImageDefinition, result *gojsonschema.Result) {
 	for _, p := range imageDefinition.Customization.ExtraPPAs {
-		if p.Auth != "" && p.Fingerprint == "" {
+		if p.Key != "" && p.KeyFile != "" {
+			jsonContext := gojsonschema.NewJsonContext("ppa_validation", nil)
+			errDetail := gojsonschema.ErrorDetails{
+				"key1": fmt.Sprintf("customization:extra-ppas:%s:key", p.Name),
+				"key2": fmt.Sprintf("customization:extra-ppas:%s:key-file", p.Name),
+			}
+			result.AddError(
+				imagedefinition.NewExclusiveKeysError(
+					gojsonschema.NewJsonContext("exclusiveKeys", jsonContext),
+					52,
+					errDetail,
+				),
+				errDetail,
+			)
+		}
+		// the signing key of a private PPA can only be fetched by fingerprint
+		// if it is not provided in the image definition
+		if p.Auth != "" && p.Fingerprint == "" && p.Key == "" && p.KeyFile == "" {
 			jsonContext := gojsonschema.NewJsonContext("ppa_validation", nil)
 			errDetail := gojsonschema.ErrorDetails{
 				"ppaName": p.Name,
@@ -304,6 +439,117 @@ func validateExtraPPAs(imageDefinition *imagedefinition.ImageDefinition, result
 	}
 }
 
+// validateExtraRepositories validates the Customization.ExtraRepositories section of the image definition
+func validateExtraRepositories(imageDefinition *imagedefinition.ImageDefinition, result *gojsonschema.Result) {
+	for _, r := range imageDefinition.Customization.ExtraRepositories {
+		if r.Key != "" && r.KeyFile != "" {
+			jsonContext := gojsonschema.NewJsonContext("repository_validation", nil)
+			errDetail := gojsonschema.ErrorDetails{
+				"key1": fmt.Sprintf("customization:extra-repositories:%s:key", r.Name),
+				"key2": fmt.Sprintf("customization:extra-repositories:%s:key-file", r.Name),
+			}
+			result.AddError(
+				imagedefinition.NewExclusiveKeysError(
+					gojsonschema.NewJsonContext("exclusiveKeys", jsonContext),
+					52,
+					errDetail,
+				),
+				errDetail,
+			)
+		}
+	}
+}
+
+// validateFiles validates the Customization.Files section of the image definition
+func validateFiles(imageDefinition *imagedefinition.ImageDefinition, result *gojsonschema.Result) {
+	jsonContext := gojsonschema.NewJsonContext("files_validation", nil)
+	for _, file := range imageDefinition.Customization.Files {
+		validateAbsolutePath(file.Path, "customization:files:path", result, jsonContext)
+		if file.Content != "" && file.Source != "" {
+			errDetail := gojsonschema.ErrorDetails{
+				"key1": fmt.Sprintf("customization:files:%s:content", file.Path),
+				"key2": fmt.Sprintf("customization:files:%s:source", file.Path),
+			}
+			result.AddError(
+				imagedefinition.NewExclusiveKeysError(
+					gojsonschema.NewJsonContext("exclusiveKeys", jsonContext),
+					52,
+					errDetail,
+				),
+				errDetail,
+			)
+		}
+	}
+}
+
+// validateInstaller validates the Customization.Installer section of the image definition
+func validateInstaller(imageDefinition *imagedefinition.ImageDefinition, result *gojsonschema.Result) {
+	installer := imageDefinition.Customization.Installer
+	if installer == nil {
+		return
+	}
+	jsonContext := gojsonschema.NewJsonContext("installer_validation", nil)
+	if imageDefinition.Class != "installer" {
+		errDetail := gojsonschema.ErrorDetails{
+			"key":   "customization:installer",
+			"class": "installer",
+		}
+		result.AddError(
+			imagedefinition.NewInvalidClassKeyError(
+				gojsonschema.NewJsonContext("invalidClassKey", jsonContext),
+				52,
+				errDetail,
+			),
+			errDetail,
+		)
+	}
+	if len(installer.Layers) == 0 {
+		return
+	}
+	// layers are built from the germinated seeds
+	if imageDefinition.Rootfs.Seed == nil {
+		errDetail := gojsonschema.ErrorDetails{
+			"key1": "customization:installer:layers",
+			"key2": "rootfs:seed",
+		}
+		result.AddError(
+			imagedefinition.NewDependentKeyError(
+				gojsonschema.NewJsonContext("dependentKey", jsonContext),
+				52,
+				errDetail,
+			),
+			errDetail,
+		)
+		return
+	}
+	for i, layer := range installer.Layers {
+		reason := ""
+		switch {
+		case !slices.Contains(imageDefinition.Rootfs.Seed.Names, installerLayerSeed(layer)):
+			reason = fmt.Sprintf("%s is not one of the seeds of the rootfs", installerLayerSeed(layer))
+		case i == 0 && strings.Contains(layer, "."):
+			reason = "the first layer must be named after a single seed"
+		case i > 0 && layer != installer.Layers[i-1]+"."+installerLayerSeed(layer):
+			reason = fmt.Sprintf("the layer must be named %s.<seed>", installer.Layers[i-1])
+		}
+		if reason == "" {
+			continue
+		}
+		errDetail := gojsonschema.ErrorDetails{
+			"layer":  layer,
+			"reason": reason,
+		}
+		result.AddError(
+			imagedefinition.NewInvalidInstallerLayerError(
+				gojsonschema.NewJsonContext("invalidInstallerLayer", jsonContext),
+				52,
+				errDetail,
+			),
+			errDetail,
+		)
+	}
+}
+
 // validateManualMakeDirs validates the Customization.Manual.MakeDirs section of the image definition
 func validateManualMakeDirs(imageDefinition *imagedefinition.ImageDefinition, result *gojsonschema.Result, jsonContext *gojsonschema.JsonContext) {
 	if imageDefinition.Customization.Manual.MakeDirs == nil {
@@ -334,6 +580,85 @@ func validateManualTouchFile(imageDefinition *imagedefinition.ImageDefinition, r
 	}
 }
 
+// validateManualAddUser validates the Customization.Manual.AddUser section of the image definition
+func validateManualAddUser(imageDefinition *imagedefinition.ImageDefinition, result *gojsonschema.Result, jsonContext *gojsonschema.JsonContext) {
+	for _, user := range imageDefinition.Customization.Manual.AddUser {
+		if user.HomeDir != "" {
+			validateAbsolutePath(user.HomeDir, fmt.Sprintf("customization:manual:add-user:%s:home", user.UserName), result, jsonContext)
+		}
+		if user.SudoNoPassword != nil && *user.SudoNoPassword && (user.Sudo == nil || !*user.Sudo) {
+			errDetail := gojsonschema.ErrorDetails{
+				"key1": fmt.Sprintf("customization:manual:add-user:%s:sudo-nopasswd", user.UserName),
+				"key2": fmt.Sprintf("customization:manual:add-user:%s:sudo", user.UserName),
+			}
+			result.AddError(
+				imagedefinition.NewDependentKeyError(
+					gojsonschema.NewJsonContext("dependentKey", jsonContext),
+					52,
+					errDetail,
+				),
+				errDetail,
+			)
+		}
+	}
+}
+
+// validateManualExecute validates the Customization.Manual.Execute section of the image definition
+func validateManualExecute(imageDefinition *imagedefinition.ImageDefinition, result *gojsonschema.Result) {
+	jsonContext := gojsonschema.NewJsonContext("execute_validation", nil)
+	for i, execute := range imageDefinition.Customization.Manual.Execute {
+		errDetail := gojsonschema.ErrorDetails{
+			"key1": fmt.Sprintf("customization:manual:execute:%d:path", i),
+			"key2": fmt.Sprintf("customization:manual:execute:%d:script", i),
+		}
+		if execute.ExecutePath != "" && execute.Script != "" {
+			result.AddError(
+				imagedefinition.NewExclusiveKeysError(
+					gojsonschema.NewJsonContext("exclusiveKeys", jsonContext),
+					52,
+					errDetail,
+				),
+				errDetail,
+			)
+		}
+		if execute.ExecutePath == "" && execute.Script == "" {
+			result.AddError(
+				imagedefinition.NewMissingKeysError(
+					gojsonschema.NewJsonContext("missingKeys", jsonContext),
+					52,
+					errDetail,
+				),
+				errDetail,
+			)
+		}
+	}
+}
+
+// validateArtifacts validates the Artifacts section of the image definition
+func validateArtifacts(imageDefinition *imagedefinition.ImageDefinition, result *gojsonschema.Result) {
+	if imageDefinition.Artifacts == nil || imageDefinition.Artifacts.Oci == nil {
+		return
+	}
+	// the OCI image layout directory is removed before being written, so it
+	// must not be the output directory itself or anything outside of it
+	ociName := imageDefinition.Artifacts.Oci.OciName
+	if !filepath.IsLocal(ociName) || filepath.Clean(ociName) == "." {
+		jsonContext := gojsonschema.NewJsonContext("artifacts_validation", nil)
+		errDetail := gojsonschema.ErrorDetails{
+			"key":   "artifacts:oci:name",
+			"value": ociName,
+		}
+		result.AddError(
+			imagedefinition.NewPathNotInOutputDirError(
+				gojsonschema.NewJsonContext("pathNotInOutputDir", jsonContext),
+				52,
+				errDetail,
+			),
+			errDetail,
+		)
+	}
+}
+
 // validateAbsolutePath validates the
 func validateAbsolutePath(path string, errorKey string, result *gojsonschema.Result, jsonContext *gojsonschema.JsonContext) {
 	// XXX: filepath.IsAbs() does returns true for paths like ../../../something
@@ -367,6 +692,11 @@ func (stateMachine *StateMachine) calculateStates() error {
 
 	if c.ImageDef.Gadget != nil {
 		stateMachine.addGadgetStates(&rootfsCreationStates)
+	} else if c.ImageDef.Layout != nil {
+		rootfsCreationStates = append(rootfsCreationStates,
+			generateGadgetYamlState,
+			loadGadgetYamlState,
+		)
 	}
 
 	if c.ImageDef.Artifacts != nil {
@@ -393,6 +723,15 @@ func (stateMachine *StateMachine) calculateStates() error {
 		rootfsCreationStates = append(rootfsCreationStates, buildRootfsFromTasksState)
 	}
 
+	// Preferences only meant for the build must not end up in the image
+	if c.hasAptPreferences() {
+		rootfsCreationStates = append(rootfsCreationStates, cleanAptPreferencesState)
+	}
+
+	if c.ImageDef.Customization != nil && len(c.ImageDef.Customization.RemovePackages) > 0 {
+		rootfsCreationStates = append(rootfsCreationStates, removePackagesState)
+	}
+
 	// Before customization, make sure we clean unwanted secrets/values that
 	// are supposed to be unique per machine
 	rootfsCreationStates = append(rootfsCreationStates, cleanRootfsState)
@@ -409,10 +748,24 @@ func (stateMachine *StateMachine) calculateStates() error {
 	// The rootfs is laid out in a staging area, now populate it in the correct location
 	rootfsCreationStates = append(rootfsCreationStates, populateClassicRootfsContentsState)
 
+	// The bootloader assets of an inline layout are taken from the populated rootfs
+	if c.ImageDef.Layout != nil {
+		rootfsCreationStates = append(rootfsCreationStates, copyLayoutAssetsState)
+	}
+
+	if c.ImageDef.Class == "installer" {
+		c.addInstallerStates(&rootfsCreationStates)
+	}
+
 	if stateMachine.commonFlags.DiskInfo != "" {
 		rootfsCreationStates = append(rootfsCreationStates, generateDiskInfoState)
 	}
 
+	// The artifacts of reproducible builds must not depend on when the rootfs was built
+	if stateMachine.sourceDateEpoch != nil {
+		rootfsCreationStates = append(rootfsCreationStates, clampRootfsMtimesState)
+	}
+
 	stateMachine.addArtifactsStates(c, &rootfsCreationStates)
 
 	// Append the newly calculated states to the slice of funcs in the parent struct
@@ -421,6 +774,185 @@ func (stateMachine *StateMachine) calculateStates() error {
 	return nil
 }
 
+// addInstallerStates adds the states creating the squashfs layers and
+// copying the preseeds of installer images
+func (classicStateMachine *ClassicStateMachine) addInstallerStates(states *[]stateFunc) {
+	*states = append(*states, makeInstallerLayersState)
+	customization := classicStateMachine.ImageDef.Customization
+	if customization != nil && customization.Installer != nil && len(customization.Installer.Preseeds) > 0 {
+		*states = append(*states, copyInstallerPreseedsState)
+	}
+}
+
+// validateSignKey makes sure there is something to sign when a key is given
+func (classicStateMachine *ClassicStateMachine) validateSignKey() error {
+	if classicStateMachine.Opts.SignKey == "" {
+		return nil
+	}
+	artifacts := classicStateMachine.ImageDef.Artifacts
+	if artifacts == nil || artifacts.Checksums == nil {
+		return fmt.Errorf("--sign-key can only be used with the checksums artifact")
+	}
+	return nil
+}
+
+// outputFiles lists the files created by the build in the output directory,
+// relative to it. Only the artifacts of the image definition are listed, as
+// the output directory may hold other files
+func (classicStateMachine *ClassicStateMachine) outputFiles() ([]string, error) {
+	artifacts := classicStateMachine.ImageDef.Artifacts
+	outputDir := classicStateMachine.commonFlags.OutputDir
+	candidates := make([]string, 0)
+
+	// raw images are also created to be converted, but only the .img
+	// artifacts are compressed and given a block map
+	imgs := make(map[string]imagedefinition.Img)
+	if artifacts.Img != nil {
+		for _, img := range *artifacts.Img {
+			imgs[img.ImgName] = img
+		}
+	}
+	for _, imgName := range classicStateMachine.VolumeNames {
+		img, isArtifact := imgs[imgName]
+		if !isArtifact {
+			candidates = append(candidates, imgName)
+			continue
+		}
+		candidates = append(candidates, imgName+imgCompressionExt(img.Compression))
+		if img.Bmap {
+			candidates = append(candidates, imgName+".bmap")
+		}
+	}
+	if artifacts.Qcow2 != nil {
+		for _, qcow2 := range *artifacts.Qcow2 {
+			candidates = append(candidates, qcow2.Qcow2Name)
+		}
+	}
+	for _, converted := range convertedArtifacts(artifacts) {
+		candidates = append(candidates, converted.name)
+	}
+	if artifacts.Iso != nil {
+		candidates = append(candidates, artifacts.Iso.IsoName)
+	}
+	if artifacts.Squashfs != nil {
+		baseName := strings.TrimSuffix(artifacts.Squashfs.SquashfsName, filepath.Ext(artifacts.Squashfs.SquashfsName))
+		candidates = append(candidates, artifacts.Squashfs.SquashfsName, baseName+".manifest", baseName+".size")
+	}
+	if artifacts.Manifest != nil {
+		candidates = append(candidates, artifacts.Manifest.ManifestName,
+			artifacts.Manifest.ManifestName+localPackagesSuffix)
+	}
+	if artifacts.ManifestV2 != nil {
+		candidates = append(candidates, artifacts.ManifestV2.ManifestName,
+			artifacts.ManifestV2.ManifestName+localPackagesSuffix)
+	}
+	if artifacts.Sbom != nil {
+		for _, sbom := range *artifacts.Sbom {
+			candidates = append(candidates, sbom.SbomName)
+		}
+	}
+	if artifacts.Filelist != nil {
+		candidates = append(candidates, artifacts.Filelist.FilelistName)
+	}
+	if artifacts.RootfsTar != nil {
+		candidates = append(candidates, artifacts.RootfsTar.RootfsTarName)
+	}
+
+	// all the files of these directories are artifacts
+	dirs := make([]string, 0)
+	if artifacts.Oci != nil {
+		if artifacts.Oci.Format == "tar" {
+			candidates = append(candidates, artifacts.Oci.OciName)
+		} else {
+			dirs = append(dirs, artifacts.Oci.OciName)
+		}
+	}
+	if classicStateMachine.ImageDef.Class == "installer" {
+		candidates = append(candidates, "autoinstall.yaml")
+		dirs = append(dirs, "casper", "preseed")
+	}
+	for _, dir := range dirs {
+		err := filepath.WalkDir(filepath.Join(outputDir, dir), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if d.Type().IsRegular() {
+				relPath, err := filepath.Rel(outputDir, path)
+				if err != nil {
+					return err
+				}
+				candidates = append(candidates, relPath)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error listing the files of %s: %s", dir, err.Error())
+		}
+	}
+
+	files := make([]string, 0)
+	for _, candidate := range candidates {
+		info, err := os.Stat(filepath.Join(outputDir, candidate))
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, candidate)
+	}
+	slices.Sort(files)
+	return slices.Compact(files), nil
+}
+
+// installerLayers returns the layers of an installer image, if any
+func (classicStateMachine *ClassicStateMachine) installerLayers() []string {
+	if classicStateMachine.ImageDef.Customization == nil || classicStateMachine.ImageDef.Customization.Installer == nil {
+		return nil
+	}
+	return classicStateMachine.ImageDef.Customization.Installer.Layers
+}
+
+// hasDebconfSelections returns whether debconf selections are defined in the image definition
+func (classicStateMachine *ClassicStateMachine) hasDebconfSelections() bool {
+	return classicStateMachine.ImageDef.Customization != nil &&
+		len(classicStateMachine.ImageDef.Customization.Debconf) > 0
+}
+
+// hasAptPreferences returns whether apt preferences are defined in the image definition
+func (classicStateMachine *ClassicStateMachine) hasAptPreferences() bool {
+	return classicStateMachine.ImageDef.Customization != nil &&
+		len(classicStateMachine.ImageDef.Customization.AptPreferences) > 0
+}
+
+// hasExtraSources returns whether extra PPAs or repositories are defined in the image definition
+func (classicStateMachine *ClassicStateMachine) hasExtraSources() bool {
+	return classicStateMachine.ImageDef.Customization != nil &&
+		(len(classicStateMachine.ImageDef.Customization.ExtraPPAs) > 0 ||
+			len(classicStateMachine.ImageDef.Customization.ExtraRepositories) > 0)
+}
+
+// addInstallPackagesWithExtraSourcesStates adds the states installing packages
+// with the extra PPAs and repositories enabled, and cleaning them afterwards
+func (classicStateMachine *ClassicStateMachine) addInstallPackagesWithExtraSourcesStates(states *[]stateFunc) {
+	customization := classicStateMachine.ImageDef.Customization
+	if len(customization.ExtraPPAs) > 0 {
+		*states = append(*states, addExtraPPAsState)
+	}
+	if len(customization.ExtraRepositories) > 0 {
+		*states = append(*states, addExtraRepositoriesState)
+	}
+
+	*states = append(*states, installPackagesState)
+
+	if len(customization.ExtraPPAs) > 0 {
+		*states = append(*states, cleanExtraPPAsState)
+	}
+	if len(customization.ExtraRepositories) > 0 {
+		*states = append(*states, cleanExtraRepositoriesState)
+	}
+}
+
 func (stateMachine *StateMachine) addGadgetStates(states *[]stateFunc) { //nolint:staticcheck,ST1016
 	c := stateMachine.parent.(*ClassicStateMachine)
 
@@ -429,7 +961,7 @@ func (stateMachine *StateMachine) addGadgetStates(states *[]stateFunc) { //nolin
 	case "git", "directory":
 		*states = append(*states, buildGadgetTreeState)
 		fallthrough
-	case "prebuilt":
+	case "prebuilt", "snap":
 		*states = append(*states, prepareGadgetTreeState)
 	}
 
@@ -442,6 +974,14 @@ func (stateMachine *StateMachine) addRootfsFromTarballStates(states *[]stateFunc
 
 	*states = append(*states, extractRootfsTarState)
 
+	if c.hasAptPreferences() {
+		*states = append(*states, setAptPreferencesState)
+	}
+
+	if c.hasDebconfSelections() {
+		*states = append(*states, setDebconfSelectionsState)
+	}
+
 	if c.ImageDef.Rootfs.Pocket != "release" {
 		*states = append(*states, upgradePackagesState)
 	}
@@ -450,14 +990,9 @@ func (stateMachine *StateMachine) addRootfsFromTarballStates(states *[]stateFunc
 		return
 	}
 
-	if len(c.ImageDef.Customization.ExtraPPAs) > 0 {
-		*states = append(*states,
-			[]stateFunc{
-				addExtraPPAsState,
-				installPackagesState,
-				cleanExtraPPAsState,
-			}...)
-	} else if len(c.ImageDef.Customization.ExtraPackages) > 0 {
+	if c.hasExtraSources() {
+		c.addInstallPackagesWithExtraSourcesStates(states)
+	} else if len(c.ImageDef.Customization.ExtraPackages) > 0 || len(c.ImageDef.Customization.ExtraDebs) > 0 {
 		*states = append(*states, installPackagesState)
 	}
 
@@ -475,19 +1010,22 @@ func (stateMachine *StateMachine) addRootfsFromSeedStates(states *[]stateFunc) {
 
 	*states = append(*states, rootfsSeedStates...)
 
+	if c.hasAptPreferences() {
+		*states = append(*states, setAptPreferencesState)
+	}
+
+	if c.hasDebconfSelections() {
+		*states = append(*states, setDebconfSelectionsState)
+	}
+
 	if c.ImageDef.Rootfs.Pocket != "release" {
 		*states = append(*states, upgradePackagesState)
 	}
 
 	if c.ImageDef.Customization == nil {
 		*states = append(*states, installPackagesState)
-	} else if len(c.ImageDef.Customization.ExtraPPAs) > 0 {
-		*states = append(*states,
-			[]stateFunc{
-				addExtraPPAsState,
-				installPackagesState,
-				cleanExtraPPAsState,
-			}...)
+	} else if c.hasExtraSources() {
+		c.addInstallPackagesWithExtraSourcesStates(states)
 	} else {
 		*states = append(*states, installPackagesState)
 	}
@@ -502,7 +1040,6 @@ func (stateMachine *StateMachine) addRootfsFromSeedStates(states *[]stateFunc) {
 
 // addCustomizationStates determines any customization that needs to run before the image
 // is created
-// TODO: installer image customization... eventually.
 func (stateMachine *StateMachine) addCustomizationStates(states *[]stateFunc) {
 	c := stateMachine.parent.(*ClassicStateMachine)
 
@@ -515,6 +1052,20 @@ func (stateMachine *StateMachine) addCustomizationStates(states *[]stateFunc) {
 	if c.ImageDef.Customization.Manual != nil {
 		*states = append(*states, manualCustomizationState)
 	}
+	// files are created after the manual customization so they can be owned
+	// by the users it adds, and before systemd units are enabled
+	if len(c.ImageDef.Customization.Files) > 0 {
+		*states = append(*states, customizeFilesState)
+	}
+	if c.ImageDef.Customization.Systemd != nil {
+		*states = append(*states, customizeSystemdState)
+	}
+	if c.ImageDef.Customization.Bootloader != nil {
+		*states = append(*states, customizeBootloaderState)
+	}
+	if c.ImageDef.Customization.System != nil {
+		*states = append(*states, customizeSystemState)
+	}
 }
 
 // addArtifactsStates adds the needed states to generates the artifacts
@@ -522,7 +1073,7 @@ func (stateMachine *StateMachine) addArtifactsStates(c *ClassicStateMachine, sta
 	if c.ImageDef.Artifacts == nil {
 		return
 	}
-	if c.ImageDef.Gadget != nil {
+	if c.ImageDef.Gadget != nil || c.ImageDef.Layout != nil {
 		stateMachine.addImgStates(states)
 	}
 
@@ -530,10 +1081,27 @@ func (stateMachine *StateMachine) addArtifactsStates(c *ClassicStateMachine, sta
 		stateMachine.addQcow2States(states)
 	}
 
+	if len(convertedArtifacts(c.ImageDef.Artifacts)) > 0 {
+		stateMachine.addConvertedDiskStates(states)
+	}
+
+	// the raw images are compressed once all the conversions are done
+	if c.ImageDef.Artifacts.Img != nil {
+		stateMachine.addImgCompressionStates(states)
+	}
+
+	if c.ImageDef.Artifacts.Iso != nil {
+		*states = append(*states, makeISOState)
+	}
+
 	if c.ImageDef.Artifacts.Manifest != nil || c.ImageDef.Artifacts.ManifestV2 != nil {
 		*states = append(*states, generatePackageManifestState)
 	}
 
+	if c.ImageDef.Artifacts.Sbom != nil {
+		*states = append(*states, generateSBOMState)
+	}
+
 	if c.ImageDef.Artifacts.Filelist != nil {
 		*states = append(*states, generateFilelistState)
 	}
@@ -541,6 +1109,19 @@ func (stateMachine *StateMachine) addArtifactsStates(c *ClassicStateMachine, sta
 	if c.ImageDef.Artifacts.RootfsTar != nil {
 		*states = append(*states, generateRootfsTarballState)
 	}
+
+	if c.ImageDef.Artifacts.Squashfs != nil {
+		*states = append(*states, generateRootfsSquashfsState)
+	}
+
+	if c.ImageDef.Artifacts.Oci != nil {
+		*states = append(*states, generateOCIImageState)
+	}
+
+	// checksums must cover every other artifact
+	if c.ImageDef.Artifacts.Checksums != nil {
+		*states = append(*states, generateChecksumsState)
+	}
 }
 
 func (stateMachine *StateMachine) addImgStates(states *[]stateFunc) {
@@ -558,6 +1139,50 @@ func (stateMachine *StateMachine) addImgStates(states *[]stateFunc) {
 }
 
 func (stateMachine *StateMachine) addQcow2States(states *[]stateFunc) {
+	addMakeDiskStates(states)
+	*states = append(*states, makeQcow2ImgState)
+}
+
+// addConvertedDiskStates adds the states converting raw disk images to the
+// vmdk, vhd, vhdx and ova formats
+func (stateMachine *StateMachine) addConvertedDiskStates(states *[]stateFunc) {
+	c := stateMachine.parent.(*ClassicStateMachine)
+	addMakeDiskStates(states)
+
+	if c.ImageDef.Artifacts.Vmdk != nil {
+		*states = append(*states, makeVmdkImgState)
+	}
+	if c.ImageDef.Artifacts.Vhd != nil {
+		*states = append(*states, makeVhdImgState)
+	}
+	if c.ImageDef.Artifacts.Vhdx != nil {
+		*states = append(*states, makeVhdxImgState)
+	}
+	if c.ImageDef.Artifacts.Ova != nil {
+		*states = append(*states, makeOvaState)
+	}
+}
+
+// addImgCompressionStates adds the states generating the block maps and
+// compressing the .img artifacts requesting it
+func (stateMachine *StateMachine) addImgCompressionStates(states *[]stateFunc) {
+	c := stateMachine.parent.(*ClassicStateMachine)
+	bmap, compress := false, false
+	for _, img := range *c.ImageDef.Artifacts.Img {
+		bmap = bmap || img.Bmap
+		compress = compress || (img.Compression != "" && img.Compression != "uncompressed")
+	}
+	if bmap {
+		*states = append(*states, makeBmapState)
+	}
+	if compress {
+		*states = append(*states, compressImagesState)
+	}
+}
+
+// addMakeDiskStates adds the states creating the raw disk images, unless
+// they were already added
+func addMakeDiskStates(states *[]stateFunc) {
 	// Only run make_disk once
 	found := false
 	for _, stateFunc := range *states {
@@ -571,5 +1196,4 @@ func (stateMachine *StateMachine) addQcow2States(states *[]stateFunc) {
 			setupBootloaderState,
 		)
 	}
-	*states = append(*states, makeQcow2ImgState)
 }
@@ -3,7 +3,10 @@ package statemachine
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
+	"crypto/sha512"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"os/exec"
@@ -11,6 +14,8 @@ import (
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/snapcore/snapd/image"
@@ -21,6 +26,7 @@ import (
 	"github.com/snapcore/snapd/snap"
 	"github.com/snapcore/snapd/store"
 
+	"github.com/canonical/ubuntu-image/internal/arch"
 	"github.com/canonical/ubuntu-image/internal/helper"
 	"github.com/canonical/ubuntu-image/internal/imagedefinition"
 	"github.com/canonical/ubuntu-image/internal/ppa"
@@ -45,6 +51,11 @@ func (stateMachine *StateMachine) buildGadgetTree() error {
 		return err
 	}
 
+	buildInChroot := classicStateMachine.ImageDef.Gadget.BuildInChroot
+	if buildInChroot != nil && *buildInChroot {
+		return classicStateMachine.buildGadgetTreeInChroot(gadgetDir)
+	}
+
 	makeCmd := execCommand("make")
 
 	// if a make target was specified then add it to the command
@@ -72,6 +83,94 @@ func (stateMachine *StateMachine) buildGadgetTree() error {
 	return nil
 }
 
+// buildGadgetTreeInChroot bootstraps a chroot of the target series and architecture,
+// installs the gadget build dependencies in it and runs "make" there. The resulting
+// install directory is then copied back to the gadget directory
+func (classicStateMachine *ClassicStateMachine) buildGadgetTreeInChroot(gadgetDir string) error {
+	imageDef := classicStateMachine.ImageDef
+	buildChroot := filepath.Join(classicStateMachine.tempDirs.scratch, "gadget-chroot")
+	if err := osMkdir(buildChroot, 0755); err != nil {
+		return fmt.Errorf("Failed to create gadget build chroot directory %s : %s", buildChroot, err.Error())
+	}
+
+	// foreign architectures need a two stage debootstrap with the
+	// qemu static binary copied in the chroot in between
+	qemuStatic := ""
+	if imageDef.Architecture != arch.GetHostArch() {
+		qemuStatic = getQemuStaticForArch(imageDef.Architecture)
+		if qemuStatic == "" {
+			return fmt.Errorf("unsupported architecture for building the gadget in a chroot: %s",
+				imageDef.Architecture)
+		}
+	}
+
+	var debootstrapArgs []string
+	if qemuStatic != "" {
+		debootstrapArgs = append(debootstrapArgs, "--foreign")
+	}
+	debootstrapCmd := generateDebootstrapCmd(imageDef, buildChroot, debootstrapArgs...)
+	if err := helper.RunCmd(debootstrapCmd, classicStateMachine.commonFlags.Debug); err != nil {
+		return fmt.Errorf("Error bootstrapping the gadget build chroot: %s", err.Error())
+	}
+
+	if qemuStatic != "" {
+		qemuStaticPath := filepath.Join("/usr", "bin", qemuStatic)
+		err := osutilCopyFile(qemuStaticPath, filepath.Join(buildChroot, qemuStaticPath), osutil.CopyFlagDefault)
+		if err != nil {
+			return fmt.Errorf("Error copying %s to the gadget build chroot: %s", qemuStatic, err.Error())
+		}
+		secondStageCmd := execCommand("chroot", buildChroot, "/debootstrap/debootstrap", "--second-stage")
+		if err := helper.RunCmd(secondStageCmd, classicStateMachine.commonFlags.Debug); err != nil {
+			return fmt.Errorf("Error bootstrapping the gadget build chroot: %s", err.Error())
+		}
+	}
+
+	buildDir := filepath.Join(buildChroot, "build")
+	if err := osMkdir(buildDir, 0755); err != nil {
+		return fmt.Errorf("Error creating build directory in the gadget build chroot: %s", err.Error())
+	}
+	if err := osutilCopySpecialFile(gadgetDir, buildDir); err != nil {
+		return fmt.Errorf("Error copying gadget source to the gadget build chroot: %s", err.Error())
+	}
+
+	makeCmd := execCommand("chroot", buildChroot, "make", "-C", "/build/gadget")
+	if imageDef.Gadget.GadgetTarget != "" {
+		makeCmd.Args = append(makeCmd.Args, imageDef.Gadget.GadgetTarget)
+	}
+	// the environment of the host is not relevant in the chroot
+	makeCmd.Env = []string{
+		fmt.Sprintf("ARCH=%s", imageDef.Architecture),
+		fmt.Sprintf("SERIES=%s", imageDef.Series),
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"LANG=C.UTF-8",
+	}
+
+	buildDeps := append([]string{"make"}, imageDef.Gadget.BuildDeps...)
+	err := classicStateMachine.runCmdsWithSetupInChroot(buildChroot,
+		[]*exec.Cmd{
+			aptUpdateChrootCmd(buildChroot),
+			aptInstallChrootCmd(buildChroot, buildDeps, false),
+			makeCmd,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("Error building the gadget tree in chroot: %s", err.Error())
+	}
+
+	// the install directory of the gadget source, if any, is replaced so the
+	// built one is not nested in it
+	gadgetTree := filepath.Join(gadgetDir, "install")
+	if err := osRemoveAll(gadgetTree); err != nil {
+		return fmt.Errorf("Error removing gadget tree: %s", err.Error())
+	}
+	builtGadgetTree := filepath.Join(buildDir, "gadget", "install")
+	if err := osutilCopySpecialFile(builtGadgetTree+"/.", gadgetTree); err != nil {
+		return fmt.Errorf("Error copying built gadget tree: %s", err.Error())
+	}
+
+	return nil
+}
+
 // prepareGadgetDir prepares the gadget directory prior to running the make command
 func (classicStateMachine *ClassicStateMachine) prepareGadgetDir(gadgetDir string) error {
 	err := osMkdir(gadgetDir, 0755)
@@ -116,6 +215,13 @@ func (stateMachine *StateMachine) prepareGadgetTree() error {
 	if err != nil && !os.IsExist(err) {
 		return fmt.Errorf("Error creating unpack directory: %s", err.Error())
 	}
+	if classicStateMachine.ImageDef.Gadget.GadgetType == "snap" {
+		if err := classicStateMachine.unpackGadgetSnap(gadgetDir); err != nil {
+			return err
+		}
+		classicStateMachine.YamlFilePath = filepath.Join(gadgetDir, gadgetYamlPathInTree)
+		return nil
+	}
 	// recursively copy the gadget tree to unpack/gadget
 	var gadgetTree string
 	if classicStateMachine.ImageDef.Gadget.GadgetType == "prebuilt" {
@@ -145,6 +251,90 @@ func (stateMachine *StateMachine) prepareGadgetTree() error {
 	return nil
 }
 
+// unpackGadgetSnap extracts the gadget snap, either local or downloaded
+// from the store, into the given directory
+func (classicStateMachine *ClassicStateMachine) unpackGadgetSnap(gadgetDir string) error {
+	gadget := classicStateMachine.ImageDef.Gadget
+	gadgetSnap := strings.TrimPrefix(gadget.GadgetURL, "file://")
+	if gadgetSnap == "" {
+		var err error
+		gadgetSnap, err = downloadSnap(gadget.GadgetName, gadget.GadgetChannel,
+			classicStateMachine.ImageDef.Architecture, classicStateMachine.tempDirs.scratch)
+		if err != nil {
+			return fmt.Errorf("Error downloading gadget snap: %s", err.Error())
+		}
+	} else if !filepath.IsAbs(gadgetSnap) {
+		// relative paths are resolved as for prebuilt gadget trees
+		var err error
+		gadgetSnap, err = filepath.Abs(gadgetSnap)
+		if err != nil {
+			return fmt.Errorf("Error finding the absolute path of the gadget snap: %s", err.Error())
+		}
+	}
+	if err := snapUnpack(gadgetSnap, gadgetDir); err != nil {
+		return fmt.Errorf("Error unpacking gadget snap: %s", err.Error())
+	}
+	return nil
+}
+
+var generateGadgetYamlState = stateFunc{"generate_gadget_yaml", (*StateMachine).generateGadgetYaml}
+
+// generateGadgetYaml generates the gadget.yaml from the inline layout of the image definition
+func (stateMachine *StateMachine) generateGadgetYaml() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	gadgetDir := filepath.Join(classicStateMachine.tempDirs.unpack, "gadget")
+	classicStateMachine.YamlFilePath = filepath.Join(gadgetDir, gadgetYamlPathInTree)
+
+	err := osMkdirAll(filepath.Dir(classicStateMachine.YamlFilePath), 0755)
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Error creating gadget meta directory: %s", err.Error())
+	}
+
+	gadgetYaml, err := classicStateMachine.ImageDef.Layout.GadgetYaml()
+	if err != nil {
+		return fmt.Errorf("Error generating gadget.yaml from layout: %s", err.Error())
+	}
+
+	err = osWriteFile(classicStateMachine.YamlFilePath, gadgetYaml, 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing gadget.yaml: %s", err.Error())
+	}
+
+	return nil
+}
+
+var copyLayoutAssetsState = stateFunc{"copy_layout_assets", (*StateMachine).copyLayoutAssets}
+
+// copyLayoutAssets copies the content referenced by the inline layout
+// from the rootfs to the generated gadget directory
+func (stateMachine *StateMachine) copyLayoutAssets() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	gadgetDir := filepath.Join(classicStateMachine.tempDirs.unpack, "gadget")
+
+	for _, volume := range classicStateMachine.ImageDef.Layout.Volumes {
+		for _, structure := range volume.Structure {
+			for _, content := range structure.Content {
+				for _, asset := range []string{content.Source, content.Image} {
+					if asset == "" {
+						continue
+					}
+					dst := filepath.Join(gadgetDir, asset)
+					err := osMkdirAll(filepath.Dir(dst), 0755)
+					if err != nil && !os.IsExist(err) {
+						return fmt.Errorf("Error creating layout asset directory: %s", err.Error())
+					}
+					err = osutilCopySpecialFile(filepath.Join(classicStateMachine.tempDirs.rootfs, asset), dst)
+					if err != nil {
+						return fmt.Errorf("Error copying layout asset %s from the rootfs: %s", asset, err.Error())
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
 // fixHostname set fresh hostname since debootstrap copies /etc/hostname from build environment
 func (stateMachine *StateMachine) fixHostname() error {
 	hostname := filepath.Join(stateMachine.tempDirs.chroot, "etc", "hostname")
@@ -212,7 +402,7 @@ func (stateMachine *StateMachine) addExtraPPAs() (err error) {
 	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
 
 	for _, extraPPA := range classicStateMachine.ImageDef.Customization.ExtraPPAs {
-		p := ppa.New(extraPPA, *classicStateMachine.ImageDef.Rootfs.SourcesListDeb822, classicStateMachine.ImageDef.Series)
+		p := ppa.New(extraPPA, *classicStateMachine.ImageDef.Rootfs.SourcesListDeb822, classicStateMachine.ImageDef.Series, classicStateMachine.ConfDefPath)
 		err := p.Add(classicStateMachine.tempDirs.chroot, classicStateMachine.commonFlags.Debug)
 		if err != nil {
 			return err
@@ -229,7 +419,7 @@ func (stateMachine *StateMachine) cleanExtraPPAs() (err error) {
 	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
 
 	for _, extraPPA := range classicStateMachine.ImageDef.Customization.ExtraPPAs {
-		p := ppa.New(extraPPA, *classicStateMachine.ImageDef.Rootfs.SourcesListDeb822, classicStateMachine.ImageDef.Series)
+		p := ppa.New(extraPPA, *classicStateMachine.ImageDef.Rootfs.SourcesListDeb822, classicStateMachine.ImageDef.Series, classicStateMachine.ConfDefPath)
 		err := p.Remove(stateMachine.tempDirs.chroot)
 		if err != nil {
 			return err
@@ -239,6 +429,100 @@ func (stateMachine *StateMachine) cleanExtraPPAs() (err error) {
 	return nil
 }
 
+var addExtraRepositoriesState = stateFunc{"add_extra_repositories", (*StateMachine).addExtraRepositories}
+
+// addExtraRepositories adds third-party repositories to the /etc/apt/sources.list.d directory
+func (stateMachine *StateMachine) addExtraRepositories() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	for _, extraRepository := range classicStateMachine.ImageDef.Customization.ExtraRepositories {
+		r := ppa.NewRepository(extraRepository, *classicStateMachine.ImageDef.Rootfs.SourcesListDeb822, classicStateMachine.ConfDefPath)
+		err := r.Add(classicStateMachine.tempDirs.chroot, classicStateMachine.commonFlags.Debug)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var cleanExtraRepositoriesState = stateFunc{"clean_extra_repositories", (*StateMachine).cleanExtraRepositories}
+
+// cleanExtraRepositories cleans previously added third-party repositories from the source list
+func (stateMachine *StateMachine) cleanExtraRepositories() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	for _, extraRepository := range classicStateMachine.ImageDef.Customization.ExtraRepositories {
+		r := ppa.NewRepository(extraRepository, *classicStateMachine.ImageDef.Rootfs.SourcesListDeb822, classicStateMachine.ConfDefPath)
+		err := r.Remove(stateMachine.tempDirs.chroot)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var setAptPreferencesState = stateFunc{"set_apt_preferences", (*StateMachine).setAptPreferences}
+
+// setAptPreferences writes the apt preferences files used to pin packages
+func (stateMachine *StateMachine) setAptPreferences() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	preferencesD := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "preferences.d")
+	if err := osMkdirAll(preferencesD, 0755); err != nil {
+		return fmt.Errorf("Error creating apt preferences.d directory: %s", err.Error())
+	}
+
+	for _, preference := range classicStateMachine.ImageDef.Customization.AptPreferences {
+		content := fmt.Sprintf("Package: %s\nPin: %s\nPin-Priority: %d\n",
+			preference.Package, preference.Pin, preference.PinPriority)
+		preferenceFile := filepath.Join(preferencesD, preference.Name)
+		if err := osWriteFile(preferenceFile, []byte(content), 0644); err != nil {
+			return fmt.Errorf("Error writing apt preferences file %s: %s", preferenceFile, err.Error())
+		}
+	}
+
+	return nil
+}
+
+var setDebconfSelectionsState = stateFunc{"set_debconf_selections", (*StateMachine).setDebconfSelections}
+
+// setDebconfSelections preseeds the debconf database of the chroot so that
+// packages are configured with the given answers when installed
+func (stateMachine *StateMachine) setDebconfSelections() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	selections := make([]string, 0, len(classicStateMachine.ImageDef.Customization.Debconf))
+	for _, d := range classicStateMachine.ImageDef.Customization.Debconf {
+		selections = append(selections, fmt.Sprintf("%s %s %s %s", d.Package, d.Question, d.Type, d.Value))
+	}
+
+	debconfCmd := execCommand("chroot", stateMachine.tempDirs.chroot, "debconf-set-selections")
+	debconfCmd.Stdin = strings.NewReader(strings.Join(selections, "\n") + "\n")
+	return runCmd(debconfCmd, stateMachine.commonFlags.Debug)
+}
+
+var cleanAptPreferencesState = stateFunc{"clean_apt_preferences", (*StateMachine).cleanAptPreferences}
+
+// cleanAptPreferences removes the apt preferences files that are only
+// meant to be used while building the image
+func (stateMachine *StateMachine) cleanAptPreferences() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	for _, preference := range classicStateMachine.ImageDef.Customization.AptPreferences {
+		if preference.KeepEnabled != nil && *preference.KeepEnabled {
+			continue
+		}
+		preferenceFile := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "preferences.d", preference.Name)
+		if err := osRemoveAll(preferenceFile); err != nil {
+			return fmt.Errorf("Error removing apt preferences file %s: %s", preferenceFile, err.Error())
+		}
+	}
+
+	return nil
+}
+
 var upgradePackagesState = stateFunc{"upgrade_packages", (*StateMachine).upgradePackages}
 
 // Upgrade packages in the chroot environment to align with configured pocket
@@ -259,12 +543,167 @@ func (stateMachine *StateMachine) installPackages() error {
 
 	stateMachine.gatherPackages(&classicStateMachine.ImageDef)
 
-	return stateMachine.runCmdsWithChrootSetup(
+	var pinnedPackages []*imagedefinition.Package
+	var heldPackages []string
+	if classicStateMachine.ImageDef.Customization != nil {
+		for _, packageInfo := range classicStateMachine.ImageDef.Customization.ExtraPackages {
+			if packageInfo.Version != "" {
+				pinnedPackages = append(pinnedPackages, packageInfo)
+			}
+			if packageInfo.Hold != nil && *packageInfo.Hold {
+				heldPackages = append(heldPackages, packageInfo.PackageName)
+			}
+		}
+	}
+
+	localDebs, err := stateMachine.copyExtraDebs()
+	if err != nil {
+		return err
+	}
+
+	if len(pinnedPackages) == 0 {
+		packages := make([]string, 0, len(classicStateMachine.Packages)+len(localDebs))
+		packages = append(packages, classicStateMachine.Packages...)
+		packages = append(packages, localDebs...)
+		cmds := []*exec.Cmd{
+			aptUpdateChrootCmd(stateMachine.tempDirs.chroot),
+			aptInstallChrootCmd(stateMachine.tempDirs.chroot, packages, true),
+		}
+		if len(heldPackages) > 0 {
+			cmds = append(cmds, aptMarkHoldChrootCmd(stateMachine.tempDirs.chroot, heldPackages))
+		}
+		return stateMachine.runInstallCmds(cmds)
+	}
+
+	// the package lists must be up to date to resolve the pinned versions
+	err = stateMachine.runCmdsWithChrootSetup(
 		[]*exec.Cmd{
 			aptUpdateChrootCmd(stateMachine.tempDirs.chroot),
-			aptInstallChrootCmd(stateMachine.tempDirs.chroot, classicStateMachine.Packages, true),
 		},
 	)
+	if err != nil {
+		return err
+	}
+
+	packageVersions := make(map[string]string)
+	for _, packageInfo := range pinnedPackages {
+		version, err := resolvePackageVersion(stateMachine.tempDirs.chroot, packageInfo.PackageName, packageInfo.Version)
+		if err != nil {
+			return err
+		}
+		packageVersions[packageInfo.PackageName] = version
+	}
+
+	packages := make([]string, 0, len(classicStateMachine.Packages))
+	for _, packageName := range classicStateMachine.Packages {
+		if version, pinned := packageVersions[packageName]; pinned {
+			packageName = fmt.Sprintf("%s=%s", packageName, version)
+		}
+		packages = append(packages, packageName)
+	}
+	packages = append(packages, localDebs...)
+
+	cmds := []*exec.Cmd{
+		aptInstallChrootCmd(stateMachine.tempDirs.chroot, packages, true),
+	}
+	if len(heldPackages) > 0 {
+		cmds = append(cmds, aptMarkHoldChrootCmd(stateMachine.tempDirs.chroot, heldPackages))
+	}
+	return stateMachine.runInstallCmds(cmds)
+}
+
+// extraDebsDir is the directory, relative to the chroot, where local
+// .deb files are copied to be installed
+var extraDebsDir = filepath.Join("var", "cache", "ubuntu-image", "debs")
+
+// copyExtraDebs copies the local .deb files to install in the chroot, records
+// the names of the packages they hold and returns their paths in the chroot
+func (stateMachine *StateMachine) copyExtraDebs() ([]string, error) {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	if classicStateMachine.ImageDef.Customization == nil ||
+		len(classicStateMachine.ImageDef.Customization.ExtraDebs) == 0 {
+		return nil, nil
+	}
+
+	debsDir := filepath.Join(stateMachine.tempDirs.chroot, extraDebsDir)
+	if err := osMkdirAll(debsDir, 0755); err != nil {
+		return nil, fmt.Errorf("Error creating directory for local .deb files: %s", err.Error())
+	}
+
+	debPaths := make([]string, 0, len(classicStateMachine.ImageDef.Customization.ExtraDebs))
+	for _, deb := range classicStateMachine.ImageDef.Customization.ExtraDebs {
+		debPath := deb.Path
+		if !filepath.IsAbs(debPath) {
+			debPath = filepath.Join(stateMachine.ConfDefPath, debPath)
+		}
+
+		packageName, err := localDebPackageName(debPath)
+		if err != nil {
+			return nil, err
+		}
+		if !helper.SliceHasElement(stateMachine.LocalPackages, packageName) {
+			stateMachine.LocalPackages = append(stateMachine.LocalPackages, packageName)
+		}
+
+		debName := filepath.Base(debPath)
+		err = osutilCopyFile(debPath, filepath.Join(debsDir, debName), osutil.CopyFlagDefault)
+		if err != nil {
+			return nil, fmt.Errorf("Error copying %s to the chroot: %s", debPath, err.Error())
+		}
+		// apt only treats arguments as local files if they are paths
+		debPaths = append(debPaths, filepath.Join("/", extraDebsDir, debName))
+	}
+
+	return debPaths, nil
+}
+
+// runInstallCmds runs the package installation commands in the chroot and
+// removes the local .deb files copied there, if any
+func (stateMachine *StateMachine) runInstallCmds(cmds []*exec.Cmd) error {
+	err := stateMachine.runCmdsWithChrootSetup(cmds)
+	if err != nil {
+		return err
+	}
+
+	err = osRemoveAll(filepath.Join(stateMachine.tempDirs.chroot, filepath.Dir(extraDebsDir)))
+	if err != nil {
+		return fmt.Errorf("Error removing local .deb files from the chroot: %s", err.Error())
+	}
+	return nil
+}
+
+var removePackagesState = stateFunc{"remove_packages", (*StateMachine).removePackages}
+
+// Remove or purge packages from the chroot environment
+func (stateMachine *StateMachine) removePackages() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	// group the packages by removal options to run as few apt commands as possible
+	type removalOptions struct {
+		purge      bool
+		autoremove bool
+	}
+	removals := make(map[removalOptions][]string)
+	removalsOrder := make([]removalOptions, 0)
+	for _, packageInfo := range classicStateMachine.ImageDef.Customization.RemovePackages {
+		options := removalOptions{
+			purge:      packageInfo.Purge != nil && *packageInfo.Purge,
+			autoremove: packageInfo.Autoremove != nil && *packageInfo.Autoremove,
+		}
+		if _, found := removals[options]; !found {
+			removalsOrder = append(removalsOrder, options)
+		}
+		removals[options] = append(removals[options], packageInfo.PackageName)
+	}
+
+	cmds := make([]*exec.Cmd, 0, len(removalsOrder))
+	for _, options := range removalsOrder {
+		cmds = append(cmds, aptRemoveChrootCmd(stateMachine.tempDirs.chroot,
+			removals[options], options.purge, options.autoremove))
+	}
+
+	return stateMachine.runCmdsWithChrootSetup(cmds)
 }
 
 func (stateMachine *StateMachine) gatherPackages(imageDef *imagedefinition.ImageDefinition) {
@@ -283,10 +722,15 @@ func (stateMachine *StateMachine) gatherPackages(imageDef *imagedefinition.Image
 }
 
 // run given commands with the chroot setup (mountpoint, network access, ...)
-func (stateMachine *StateMachine) runCmdsWithChrootSetup(cmds []*exec.Cmd) (err error) {
+func (stateMachine *StateMachine) runCmdsWithChrootSetup(cmds []*exec.Cmd) error {
+	return stateMachine.runCmdsWithSetupInChroot(stateMachine.tempDirs.chroot, cmds)
+}
+
+// runCmdsWithSetupInChroot runs given commands with the setup of the given chroot directory
+func (stateMachine *StateMachine) runCmdsWithSetupInChroot(chroot string, cmds []*exec.Cmd) (err error) {
 	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
 
-	err = helperBackupAndCopyResolvConf(classicStateMachine.tempDirs.chroot)
+	err = helperBackupAndCopyResolvConf(chroot)
 	if err != nil {
 		return fmt.Errorf("Error setting up /etc/resolv.conf in the chroot: \"%s\"", err.Error())
 	}
@@ -301,38 +745,38 @@ func (stateMachine *StateMachine) runCmdsWithChrootSetup(cmds []*exec.Cmd) (err
 
 	// Make sure we left the system as clean as possible if something has gone wrong
 	defer func() {
-		err = teardownMount(stateMachine.tempDirs.chroot, mountPoints, teardownCmds, err, stateMachine.commonFlags.Debug)
+		err = teardownMount(chroot, mountPoints, teardownCmds, err, stateMachine.commonFlags.Debug)
 	}()
 
 	// mount some necessary partitions in the chroot
 	mountPoints = append(mountPoints,
 		&mountPoint{
 			src:      "devtmpfs-build",
-			basePath: stateMachine.tempDirs.chroot,
+			basePath: chroot,
 			relpath:  "/dev",
 			typ:      "devtmpfs",
 		},
 		&mountPoint{
 			src:      "devpts-build",
-			basePath: stateMachine.tempDirs.chroot,
+			basePath: chroot,
 			relpath:  "/dev/pts",
 			typ:      "devpts",
 			opts:     []string{"nodev", "nosuid"},
 		},
 		&mountPoint{
 			src:      "proc-build",
-			basePath: stateMachine.tempDirs.chroot,
+			basePath: chroot,
 			relpath:  "/proc",
 			typ:      "proc",
 		},
 		&mountPoint{
 			src:      "sysfs-build",
-			basePath: stateMachine.tempDirs.chroot,
+			basePath: chroot,
 			relpath:  "/sys",
 			typ:      "sysfs",
 		},
 		&mountPoint{
-			basePath: stateMachine.tempDirs.chroot,
+			basePath: chroot,
 			relpath:  "/run",
 			bind:     true,
 		},
@@ -361,22 +805,22 @@ func (stateMachine *StateMachine) runCmdsWithChrootSetup(cmds []*exec.Cmd) (err
 
 	diversions := []diversion{
 		{
-			path: filepath.Join(classicStateMachine.tempDirs.chroot, "usr", "sbin", "policy-rc.d"),
+			path: filepath.Join(chroot, "usr", "sbin", "policy-rc.d"),
 			fn:   helperDivertPolicyRcD,
 		},
 		{
-			path: filepath.Join(classicStateMachine.tempDirs.chroot, "sbin", "start-stop-daemon"),
+			path: filepath.Join(chroot, "sbin", "start-stop-daemon"),
 			fn:   helperDivertStartStopDaemon,
 		},
 		{
-			path: filepath.Join(classicStateMachine.tempDirs.chroot, "sbin", "initctl"),
+			path: filepath.Join(chroot, "sbin", "initctl"),
 			fn:   helperDivertInitctl,
 		},
 	}
 
 	for _, diversion := range diversions {
 		if osutil.FileExists(diversion.path) {
-			divert, undivert := diversion.fn(stateMachine.tempDirs.chroot, classicStateMachine.commonFlags.Debug)
+			divert, undivert := diversion.fn(chroot, classicStateMachine.commonFlags.Debug)
 			err = divert()
 			if err != nil {
 				return err
@@ -446,10 +890,71 @@ func (stateMachine *StateMachine) verifyArtifactNames() error {
 		if err != nil {
 			return err
 		}
+		iso := classicStateMachine.ImageDef.Artifacts.Iso
+		if iso != nil && iso.IsoVolume == "" {
+			return fmt.Errorf("Volume names must be specified for each image when using a gadget with more than one volume")
+		}
 	} else {
 		stateMachine.prepareImgArtifactOneVolume(classicStateMachine.ImageDef.Artifacts)
 		stateMachine.prepareQcow2ArtifactOneVolume(classicStateMachine.ImageDef.Artifacts)
 	}
+	return stateMachine.prepareConvertedArtifacts(classicStateMachine.ImageDef.Artifacts)
+}
+
+// convertedArtifact is an artifact converted from the raw .img of a volume
+type convertedArtifact struct {
+	name   string
+	volume *string
+}
+
+// convertedArtifacts lists the vmdk, vhd, vhdx and ova artifacts. The volumes
+// are pointers into the image definition so they can be filled in
+func convertedArtifacts(artifacts *imagedefinition.Artifact) []convertedArtifact {
+	converted := make([]convertedArtifact, 0)
+	if artifacts.Vmdk != nil {
+		for i := range *artifacts.Vmdk {
+			vmdk := &(*artifacts.Vmdk)[i]
+			converted = append(converted, convertedArtifact{vmdk.VmdkName, &vmdk.VmdkVolume})
+		}
+	}
+	if artifacts.Vhd != nil {
+		for i := range *artifacts.Vhd {
+			vhd := &(*artifacts.Vhd)[i]
+			converted = append(converted, convertedArtifact{vhd.VhdName, &vhd.VhdVolume})
+		}
+	}
+	if artifacts.Vhdx != nil {
+		for i := range *artifacts.Vhdx {
+			vhdx := &(*artifacts.Vhdx)[i]
+			converted = append(converted, convertedArtifact{vhdx.VhdxName, &vhdx.VhdxVolume})
+		}
+	}
+	if artifacts.Ova != nil {
+		for i := range *artifacts.Ova {
+			ova := &(*artifacts.Ova)[i]
+			converted = append(converted, convertedArtifact{ova.OvaName, &ova.OvaVolume})
+		}
+	}
+	return converted
+}
+
+// prepareConvertedArtifacts makes sure a raw .img file is created for the
+// volume of each converted artifact. Like for qcow2 artifacts, an .img or
+// an image already needed for another conversion is re-used. Otherwise a
+// new one named after the artifact is created
+func (stateMachine *StateMachine) prepareConvertedArtifacts(artifacts *imagedefinition.Artifact) error {
+	for _, artifact := range convertedArtifacts(artifacts) {
+		if *artifact.volume == "" {
+			if len(stateMachine.GadgetInfo.Volumes) > 1 {
+				return fmt.Errorf("Volume names must be specified for each image when using a gadget with more than one volume")
+			}
+			// there is only one volume, so get it from the map
+			*artifact.volume = reflect.ValueOf(stateMachine.GadgetInfo.Volumes).MapKeys()[0].String()
+		}
+		if _, found := stateMachine.VolumeNames[*artifact.volume]; !found {
+			stateMachine.VolumeNames[*artifact.volume] = fmt.Sprintf("%s.img", artifact.name)
+		}
+	}
 	return nil
 }
 
@@ -615,7 +1120,13 @@ func (stateMachine *StateMachine) germinate() error {
 			germinateCmd.String(), err.Error(), germinateOutput.String())
 	}
 
-	pkgsFromSeed, err := packagesFromSeed(".seed", classicStateMachine.ImageDef.Rootfs.Seed.Names, germinateDir)
+	// the seeds of the upper installer layers are installed when creating the layers
+	seedNames := classicStateMachine.ImageDef.Rootfs.Seed.Names
+	if layers := classicStateMachine.installerLayers(); len(layers) > 0 {
+		seedNames = baseLayerSeeds(seedNames, layers)
+	}
+
+	pkgsFromSeed, err := packagesFromSeed(".seed", seedNames, germinateDir)
 	if err != nil {
 		return err
 	}
@@ -796,7 +1307,7 @@ func (stateMachine *StateMachine) manualCustomization() error {
 		return err
 	}
 
-	err = manualExecute(classicStateMachine.ImageDef.Customization.Manual.Execute, stateMachine.tempDirs.chroot, stateMachine.commonFlags.Debug)
+	err = manualExecute(classicStateMachine.ImageDef.Customization.Manual.Execute, classicStateMachine.ConfDefPath, stateMachine.tempDirs.chroot, stateMachine.commonFlags.Debug)
 	if err != nil {
 		return err
 	}
@@ -819,42 +1330,235 @@ func (stateMachine *StateMachine) manualCustomization() error {
 	return nil
 }
 
-var prepareClassicImageState = stateFunc{"prepare_image", (*StateMachine).prepareClassicImage}
+var customizeFilesState = stateFunc{"customize_files", (*StateMachine).customizeFiles}
 
-// prepareClassicImage calls image.Prepare to stage snaps in classic images
-func (stateMachine *StateMachine) prepareClassicImage() error {
+// customizeFiles creates the files and directories listed in the image definition
+func (stateMachine *StateMachine) customizeFiles() error {
 	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
-	imageOpts := &image.Options{}
-	var err error
 
-	imageOpts.Snaps, imageOpts.SnapChannels, err = parseSnapsAndChannels(classicStateMachine.Snaps)
-	if err != nil {
-		return err
-	}
-	if stateMachine.commonFlags.Channel != "" {
-		imageOpts.Channel = stateMachine.commonFlags.Channel
+	for _, file := range classicStateMachine.ImageDef.Customization.Files {
+		err := customizeFile(file, classicStateMachine.ConfDefPath, stateMachine.tempDirs.chroot, stateMachine.commonFlags.Debug)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// plug/slot sanitization needed by provider handling
-	snap.SanitizePlugsSlots = builtin.SanitizePlugsSlots
+var customizeSystemdState = stateFunc{"customize_systemd", (*StateMachine).customizeSystemd}
 
-	err = resetPreseeding(imageOpts, classicStateMachine.tempDirs.chroot, stateMachine.commonFlags.Debug, stateMachine.commonFlags.Verbose)
-	if err != nil {
-		return err
-	}
+// customizeSystemd enables, disables and masks systemd units and sets the
+// default target in the chroot, without running systemd
+func (stateMachine *StateMachine) customizeSystemd() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	systemd := classicStateMachine.ImageDef.Customization.Systemd
 
-	err = ensureSnapBasesInstalled(imageOpts)
-	if err != nil {
-		return err
+	units := make([]string, 0, len(systemd.Enable)+len(systemd.Disable)+len(systemd.Mask)+1)
+	units = append(units, systemd.Enable...)
+	units = append(units, systemd.Disable...)
+	units = append(units, systemd.Mask...)
+	if systemd.DefaultTarget != "" {
+		units = append(units, systemd.DefaultTarget)
 	}
 
-	err = addExtraSnaps(imageOpts, &classicStateMachine.ImageDef)
-	if err != nil {
-		return err
+	missingUnits := make([]string, 0)
+	for _, unit := range units {
+		if !systemdUnitExists(stateMachine.tempDirs.chroot, unit) {
+			missingUnits = append(missingUnits, unit)
+		}
+	}
+	if len(missingUnits) > 0 {
+		return fmt.Errorf("The following systemd units do not exist in the rootfs: %s",
+			strings.Join(missingUnits, ", "))
+	}
+
+	root := fmt.Sprintf("--root=%s", stateMachine.tempDirs.chroot)
+	systemctlCmds := make([]*exec.Cmd, 0)
+	for _, action := range []struct {
+		verb  string
+		units []string
+	}{
+		{"enable", systemd.Enable},
+		{"disable", systemd.Disable},
+		{"mask", systemd.Mask},
+	} {
+		if len(action.units) > 0 {
+			systemctlCmds = append(systemctlCmds,
+				execCommand("systemctl", append([]string{root, action.verb}, action.units...)...))
+		}
+	}
+	if systemd.DefaultTarget != "" {
+		systemctlCmds = append(systemctlCmds,
+			execCommand("systemctl", root, "set-default", systemd.DefaultTarget))
+	}
+
+	return helper.RunCmds(systemctlCmds, stateMachine.commonFlags.Debug)
+}
+
+var customizeBootloaderState = stateFunc{"customize_bootloader", (*StateMachine).customizeBootloader}
+
+// customizeBootloader writes the GRUB settings of the image definition
+// in /etc/default/grub.d so they are used when setting up the bootloader
+func (stateMachine *StateMachine) customizeBootloader() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	bootloader := classicStateMachine.ImageDef.Customization.Bootloader
+
+	if !hasGrubSettings(bootloader) || !stateMachine.mayUseGrub() {
+		return nil
+	}
+
+	grubCfgPath := filepath.Join(stateMachine.tempDirs.chroot, grubCustomizationFile)
+	err := osMkdirAll(filepath.Dir(grubCfgPath), 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating %s: %s", filepath.Dir(grubCfgPath), err.Error())
+	}
+
+	err = osWriteFile(grubCfgPath, []byte(generateGrubCustomization(bootloader)), 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing GRUB configuration: %s", err.Error())
+	}
+	return nil
+}
+
+// mayUseGrub returns whether the image may be booted with GRUB. Without a gadget,
+// the rootfs may end up in any image so GRUB cannot be ruled out.
+func (stateMachine *StateMachine) mayUseGrub() bool {
+	if stateMachine.GadgetInfo == nil {
+		return true
+	}
+	for _, volume := range stateMachine.GadgetInfo.Volumes {
+		if volume.Bootloader == "grub" {
+			return true
+		}
+	}
+	return false
+}
+
+var customizeSystemState = stateFunc{"customize_system", (*StateMachine).customizeSystem}
+
+// customizeSystem sets the hostname, timezone, locale and keyboard layout in the chroot
+func (stateMachine *StateMachine) customizeSystem() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	system := classicStateMachine.ImageDef.Customization.System
+	chroot := stateMachine.tempDirs.chroot
+
+	if system.Timezone != "" && !timezoneExists(chroot, system.Timezone) {
+		return fmt.Errorf("The timezone \"%s\" does not exist in the rootfs", system.Timezone)
+	}
+
+	locales := localesToGenerate(system)
+	if len(locales) > 0 {
+		unsupported, err := unsupportedLocales(chroot, locales)
+		if err != nil {
+			return err
+		}
+		if len(unsupported) > 0 {
+			return fmt.Errorf("The following locales are not supported in the rootfs: %s",
+				strings.Join(unsupported, ", "))
+		}
+	}
+
+	if system.Hostname != "" {
+		err := osWriteFile(filepath.Join(chroot, "etc", "hostname"), []byte(system.Hostname+"\n"), 0644)
+		if err != nil {
+			return fmt.Errorf("Error writing hostname: %s", err.Error())
+		}
+	}
+
+	if system.Timezone != "" {
+		err := stateMachine.setTimezone(system.Timezone)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(locales) > 0 {
+		localeGenCmd := execCommand("chroot", append([]string{chroot, "locale-gen"}, locales...)...)
+		err := helper.RunCmd(localeGenCmd, stateMachine.commonFlags.Debug)
+		if err != nil {
+			return err
+		}
+	}
+
+	defaultPath := filepath.Join(chroot, "etc", "default")
+	if system.Locale != "" || system.Keyboard != nil {
+		err := osMkdirAll(defaultPath, 0755)
+		if err != nil {
+			return fmt.Errorf("Error creating default directory: %s", err.Error())
+		}
 	}
 
-	setModelFile(imageOpts, classicStateMachine.ImageDef.ModelAssertion, stateMachine.ConfDefPath)
-
+	if system.Locale != "" {
+		err := osWriteFile(filepath.Join(defaultPath, "locale"), []byte(fmt.Sprintf("LANG=%s\n", system.Locale)), 0644)
+		if err != nil {
+			return fmt.Errorf("Error writing to locale file: %s", err.Error())
+		}
+	}
+
+	if system.Keyboard != nil {
+		err := osWriteFile(filepath.Join(defaultPath, "keyboard"), []byte(generateKeyboardConfiguration(system.Keyboard)), 0644)
+		if err != nil {
+			return fmt.Errorf("Error writing keyboard configuration: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// setTimezone points /etc/localtime to the given timezone and records it in /etc/timezone
+func (stateMachine *StateMachine) setTimezone(timezone string) error {
+	localtimePath := filepath.Join(stateMachine.tempDirs.chroot, "etc", "localtime")
+	err := osRemoveAll(localtimePath)
+	if err != nil {
+		return fmt.Errorf("Error removing %s: %s", localtimePath, err.Error())
+	}
+	err = osSymlink(filepath.Join("/", zoneinfoPath(timezone)), localtimePath)
+	if err != nil {
+		return fmt.Errorf("Error setting the timezone: %s", err.Error())
+	}
+	err = osWriteFile(filepath.Join(stateMachine.tempDirs.chroot, "etc", "timezone"), []byte(timezone+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing timezone: %s", err.Error())
+	}
+	return nil
+}
+
+var prepareClassicImageState = stateFunc{"prepare_image", (*StateMachine).prepareClassicImage}
+
+// prepareClassicImage calls image.Prepare to stage snaps in classic images
+func (stateMachine *StateMachine) prepareClassicImage() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	imageOpts := &image.Options{}
+	var err error
+
+	imageOpts.Snaps, imageOpts.SnapChannels, err = parseSnapsAndChannels(classicStateMachine.Snaps)
+	if err != nil {
+		return err
+	}
+	if stateMachine.commonFlags.Channel != "" {
+		imageOpts.Channel = stateMachine.commonFlags.Channel
+	}
+
+	// plug/slot sanitization needed by provider handling
+	snap.SanitizePlugsSlots = builtin.SanitizePlugsSlots
+
+	err = resetPreseeding(imageOpts, classicStateMachine.tempDirs.chroot, stateMachine.commonFlags.Debug, stateMachine.commonFlags.Verbose)
+	if err != nil {
+		return err
+	}
+
+	err = ensureSnapBasesInstalled(imageOpts)
+	if err != nil {
+		return err
+	}
+
+	err = addExtraSnaps(imageOpts, &classicStateMachine.ImageDef)
+	if err != nil {
+		return err
+	}
+
+	setModelFile(imageOpts, classicStateMachine.ImageDef.ModelAssertion, stateMachine.ConfDefPath)
+
 	imageOpts.Classic = true
 	imageOpts.Architecture = classicStateMachine.ImageDef.Architecture
 	imageOpts.PrepareDir = classicStateMachine.tempDirs.chroot
@@ -1260,6 +1964,10 @@ func (stateMachine *StateMachine) generatePackageManifest() error {
 		if err != nil {
 			return err
 		}
+		err = writeLocalPackages(outputPath, stateMachine.LocalPackages)
+		if err != nil {
+			return err
+		}
 	}
 
 	if classicStateMachine.ImageDef.Artifacts.ManifestV2 != nil {
@@ -1269,11 +1977,51 @@ func (stateMachine *StateMachine) generatePackageManifest() error {
 		if err != nil {
 			return err
 		}
+		err = writeLocalPackages(outputPath, stateMachine.LocalPackages)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+var generateSBOMState = stateFunc{"generate_sbom", (*StateMachine).generateSBOM}
+
+// generateSBOM generates the software bills of materials of the image, listing
+// the Debian packages installed in the rootfs and the seeded snaps
+func (stateMachine *StateMachine) generateSBOM() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	imageDef := classicStateMachine.ImageDef
+
+	packages, err := listSBOMDebPackages(stateMachine.tempDirs.rootfs, stateMachine.LocalPackages, stateMachine.commonFlags.Debug)
+	if err != nil {
+		return err
+	}
+	seedDir := filepath.Join(stateMachine.tempDirs.rootfs, "var", "lib", "snapd", "seed")
+	snaps, err := listSBOMSeededSnaps(seedDir, "")
+	if err != nil {
+		return err
+	}
+
+	image := sbomImage{
+		Name:         imageDef.ImageName,
+		Version:      strconv.Itoa(imageDef.Revision),
+		Architecture: imageDef.Architecture,
+		Series:       imageDef.Series,
+		Packages:     packages,
+		Snaps:        snaps,
+	}
+	for _, sbom := range *imageDef.Artifacts.Sbom {
+		err := writeSBOM(image, sbom.Format, filepath.Join(stateMachine.commonFlags.OutputDir, sbom.SbomName),
+			stateMachine.buildTime(), stateMachine.buildUUID("sbom", sbom.SbomName))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 var generateFilelistState = stateFunc{"generate_filelist", (*StateMachine).generateFilelist}
 
 // Generate the manifest
@@ -1320,7 +2068,290 @@ func (stateMachine *StateMachine) generateRootfsTarball() error {
 		tarDst,
 		classicStateMachine.ImageDef.Artifacts.RootfsTar.Compression,
 		stateMachine.commonFlags.Debug,
+		stateMachine.sourceDateEpoch,
+	)
+}
+
+var generateRootfsSquashfsState = stateFunc{"generate_rootfs_squashfs", (*StateMachine).generateRootfsSquashfs}
+
+// generateRootfsSquashfs creates a squashfs image of the rootfs, along with
+// the .manifest and .size files livecd-rootfs ships next to it
+func (stateMachine *StateMachine) generateRootfsSquashfs() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	squashfs := classicStateMachine.ImageDef.Artifacts.Squashfs
+
+	squashfsPath := filepath.Join(stateMachine.commonFlags.OutputDir, squashfs.SquashfsName)
+	err := helper.RunCmd(
+		squashfsArtifactCmd(stateMachine.tempDirs.rootfs, squashfsPath, squashfs),
+		stateMachine.commonFlags.Debug,
+	)
+	if err != nil {
+		return err
+	}
+
+	basePath := strings.TrimSuffix(squashfsPath, filepath.Ext(squashfsPath))
+	err = generateClassicManifestV2(stateMachine.tempDirs.rootfs, basePath+".manifest", stateMachine.commonFlags.Debug)
+	if err != nil {
+		return err
+	}
+
+	rootfsSize, err := helper.Du(stateMachine.tempDirs.rootfs)
+	if err != nil {
+		return fmt.Errorf("Error getting rootfs size: %s", err.Error())
+	}
+	err = osWriteFile(basePath+".size", []byte(fmt.Sprintf("%d\n", rootfsSize)), 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing squashfs size file: %s", err.Error())
+	}
+	return nil
+}
+
+var generateOCIImageState = stateFunc{"generate_oci_image", (*StateMachine).generateOCIImage}
+
+// generateOCIImage writes an OCI image layout of the rootfs, as a directory or
+// a tar archive, without relying on a container daemon
+func (stateMachine *StateMachine) generateOCIImage() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	oci := *classicStateMachine.ImageDef.Artifacts.Oci
+	outputPath := filepath.Join(stateMachine.commonFlags.OutputDir, oci.OciName)
+
+	// blobs of a previous build must not be left in the layout. The output
+	// directory may hold other files, so only a previous layout is removed there
+	layoutDir := outputPath
+	removeLayout := removeOCILayout
+	if oci.Format == "tar" {
+		layoutDir = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "oci")
+		removeLayout = osRemoveAll
+	}
+	err := removeLayout(layoutDir)
+	if err != nil {
+		return fmt.Errorf("Error removing previous OCI image layout: %s", err.Error())
+	}
+	err = writeOCILayout(layoutDir, stateMachine.tempDirs.rootfs, oci, classicStateMachine.ImageDef.Architecture,
+		stateMachine.buildTime(), stateMachine.sourceDateEpoch)
+	if err != nil {
+		return err
+	}
+	if oci.Format != "tar" {
+		return nil
+	}
+
+	archive, err := osCreate(outputPath)
+	if err != nil {
+		return fmt.Errorf("Error creating OCI archive: %s", err.Error())
+	}
+	defer archive.Close()
+	err = writeTarFromDir(archive, layoutDir, nil, stateMachine.sourceDateEpoch)
+	if err != nil {
+		return fmt.Errorf("Error writing OCI archive: %s", err.Error())
+	}
+	return nil
+}
+
+var generateChecksumsState = stateFunc{"generate_checksums", (*StateMachine).generateChecksums}
+
+// generateChecksums writes the SHA256SUMS file, and optionally the SHA512SUMS
+// one, of the files created in the output directory. They are signed if a
+// key was given. This must be the last state so every artifact is covered
+func (stateMachine *StateMachine) generateChecksums() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	files, err := classicStateMachine.outputFiles()
+	if err != nil {
+		return err
+	}
+
+	sumsFiles := []string{"SHA256SUMS"}
+	hashes := []func() hash.Hash{sha256.New}
+	withSHA512 := classicStateMachine.ImageDef.Artifacts.Checksums.SHA512
+	if withSHA512 != nil && *withSHA512 {
+		sumsFiles = append(sumsFiles, "SHA512SUMS")
+		hashes = append(hashes, sha512.New)
+	}
+
+	for i, sumsFile := range sumsFiles {
+		sums, err := checksumsFileContent(stateMachine.commonFlags.OutputDir, files, hashes[i])
+		if err != nil {
+			return err
+		}
+		sumsPath := filepath.Join(stateMachine.commonFlags.OutputDir, sumsFile)
+		err = osWriteFile(sumsPath, []byte(sums), 0644)
+		if err != nil {
+			return fmt.Errorf("Error writing %s: %s", sumsFile, err.Error())
+		}
+
+		if classicStateMachine.Opts.SignKey == "" {
+			continue
+		}
+		err = helper.RunCmd(
+			gpgDetachSignCmd(classicStateMachine.Opts.SignKey, classicStateMachine.Opts.GnupgHome, sumsPath),
+			stateMachine.commonFlags.Debug,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var makeInstallerLayersState = stateFunc{"make_installer_layers", (*StateMachine).makeInstallerLayers}
+
+// makeInstallerLayers creates the casper squashfs images of an installer image.
+// The rootfs is the first layer, and each following layer is built in an
+// overlay on top of the previous ones, installing the packages of its seed.
+// Only the changes made by a layer end up in its squashfs, as expected by
+// the layered casper layout
+func (stateMachine *StateMachine) makeInstallerLayers() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	// the layers and preseeds of a previous build in the output directory
+	// would otherwise be shipped in the ISO and checksummed with this one
+	for _, previous := range []string{"casper", "preseed", "autoinstall.yaml"} {
+		err := osRemoveAll(filepath.Join(stateMachine.commonFlags.OutputDir, previous))
+		if err != nil {
+			return fmt.Errorf("Error removing installer files of a previous build: %s", err.Error())
+		}
+	}
+
+	casperDir := filepath.Join(stateMachine.commonFlags.OutputDir, "casper")
+	err := osMkdirAll(casperDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating casper directory: %s", err.Error())
+	}
+
+	layers := classicStateMachine.installerLayers()
+	if len(layers) == 0 {
+		return helper.RunCmd(
+			mksquashfsCmd(stateMachine.tempDirs.rootfs, filepath.Join(casperDir, "filesystem.squashfs")),
+			stateMachine.commonFlags.Debug,
+		)
+	}
+
+	err = helper.RunCmd(
+		mksquashfsCmd(stateMachine.tempDirs.rootfs, filepath.Join(casperDir, layers[0]+".squashfs")),
+		stateMachine.commonFlags.Debug,
 	)
+	if err != nil {
+		return err
+	}
+
+	germinateDir := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "germinate")
+	layersDir := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "installer-layers")
+	lowerDirs := []string{stateMachine.tempDirs.rootfs}
+	for _, layer := range layers[1:] {
+		packages, err := packagesFromSeed(".seed", []string{installerLayerSeed(layer)}, germinateDir)
+		if err != nil {
+			return err
+		}
+		upperDir := filepath.Join(layersDir, layer, "upper")
+		err = stateMachine.installInOverlay(lowerDirs, filepath.Join(layersDir, layer), upperDir, packages)
+		if err != nil {
+			return fmt.Errorf("Error creating installer layer %s: %w", layer, err)
+		}
+		err = cleanInstallerLayer(upperDir)
+		if err != nil {
+			return fmt.Errorf("Error cleaning installer layer %s: %w", layer, err)
+		}
+		err = helper.RunCmd(
+			mksquashfsCmd(upperDir, filepath.Join(casperDir, layer+".squashfs")),
+			stateMachine.commonFlags.Debug,
+		)
+		if err != nil {
+			return err
+		}
+		lowerDirs = append(lowerDirs, upperDir)
+	}
+	return nil
+}
+
+// installInOverlay installs packages in an overlay of the given lower directories,
+// so that the changes are only written to upperDir
+func (stateMachine *StateMachine) installInOverlay(lowerDirs []string, layerDir string, upperDir string, packages []string) (err error) {
+	workDir := filepath.Join(layerDir, "work")
+	mergedDir := filepath.Join(layerDir, "merged")
+	for _, dir := range []string{upperDir, workDir, mergedDir} {
+		err = osMkdirAll(dir, 0755)
+		if err != nil {
+			return fmt.Errorf("Error creating directory %s: %s", dir, err.Error())
+		}
+	}
+
+	// the last lower directory is the top of the stack
+	overlayLowerDirs := slices.Clone(lowerDirs)
+	slices.Reverse(overlayLowerDirs)
+	mountCmd := execCommand("mount", "-t", "overlay", "overlay",
+		"-o", fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(overlayLowerDirs, ":"), upperDir, workDir),
+		mergedDir,
+	)
+	err = helper.RunCmd(mountCmd, stateMachine.commonFlags.Debug)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		umountErr := helper.RunCmd(execCommand("umount", mergedDir), stateMachine.commonFlags.Debug)
+		if err == nil {
+			err = umountErr
+		}
+	}()
+
+	err = stateMachine.runCmdsWithSetupInChroot(mergedDir, []*exec.Cmd{
+		aptUpdateChrootCmd(mergedDir),
+		aptInstallChrootCmd(mergedDir, packages, true),
+		aptCleanChrootCmd(mergedDir),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = helperRestoreResolvConf(mergedDir)
+	if err != nil {
+		return fmt.Errorf("Error restoring /etc/resolv.conf in the chroot: \"%s\"", err.Error())
+	}
+	return nil
+}
+
+// cleanInstallerLayer removes from the upper directory of an installer layer the
+// files unique per machine its packages created, as clean_rootfs does for the
+// rootfs, along with the package lists apt downloaded to build it
+func cleanInstallerLayer(upperDir string) error {
+	err := cleanMachineSpecificFiles(upperDir)
+	if err != nil {
+		return err
+	}
+	aptLists, err := listWithPatterns(upperDir, []string{
+		filepath.Join("var", "lib", "apt", "lists", "*"),
+	})
+	if err != nil {
+		return err
+	}
+	return doDeleteFiles(aptLists)
+}
+
+var copyInstallerPreseedsState = stateFunc{"copy_installer_preseeds", (*StateMachine).copyInstallerPreseeds}
+
+// copyInstallerPreseeds copies the preseed files of an installer image next to
+// the casper directory. Subiquity autoinstall files are expected at the root of
+// the installer media and debian-installer preseeds in the preseed directory
+func (stateMachine *StateMachine) copyInstallerPreseeds() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	preseedDir := filepath.Join(stateMachine.commonFlags.OutputDir, "preseed")
+	for _, preseed := range classicStateMachine.ImageDef.Customization.Installer.Preseeds {
+		source := filepath.Join(classicStateMachine.ConfDefPath, preseed)
+		dest := filepath.Join(preseedDir, filepath.Base(preseed))
+		if filepath.Base(preseed) == "autoinstall.yaml" {
+			dest = filepath.Join(stateMachine.commonFlags.OutputDir, "autoinstall.yaml")
+		}
+		err := osMkdirAll(filepath.Dir(dest), 0755)
+		if err != nil {
+			return fmt.Errorf("Error creating directory for preseed %s: %s", preseed, err.Error())
+		}
+		err = osutilCopyFile(source, dest, osutil.CopyFlagOverwrite)
+		if err != nil {
+			return fmt.Errorf("Error copying preseed %s: %s", preseed, err.Error())
+		}
+	}
+	return nil
 }
 
 var makeQcow2ImgState = stateFunc{"make_qcow2_image", (*StateMachine).makeQcow2Img}
@@ -1348,6 +2379,468 @@ func (stateMachine *StateMachine) makeQcow2Img() error {
 	return nil
 }
 
+var makeVmdkImgState = stateFunc{"make_vmdk_image", (*StateMachine).makeVmdkImg}
+
+// makeVmdkImg converts raw .img artifacts into stream-optimized vmdk artifacts
+func (stateMachine *StateMachine) makeVmdkImg() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	for _, vmdk := range *classicStateMachine.ImageDef.Artifacts.Vmdk {
+		rawImg := filepath.Join(stateMachine.commonFlags.OutputDir, stateMachine.VolumeNames[vmdk.VmdkVolume])
+		resultingFile := filepath.Join(stateMachine.commonFlags.OutputDir, vmdk.VmdkName)
+		err := helper.RunCmd(
+			qemuImgConvertCmd(rawImg, resultingFile, "vmdk", "subformat=streamOptimized"),
+			stateMachine.commonFlags.Debug,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var makeVhdImgState = stateFunc{"make_vhd_image", (*StateMachine).makeVhdImg}
+
+// makeVhdImg converts raw .img artifacts into fixed size vhd artifacts. As
+// required by Azure, their virtual size is aligned to 1 MiB
+func (stateMachine *StateMachine) makeVhdImg() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	for _, vhd := range *classicStateMachine.ImageDef.Artifacts.Vhd {
+		rawImg, err := stateMachine.alignedRawImage(
+			filepath.Join(stateMachine.commonFlags.OutputDir, stateMachine.VolumeNames[vhd.VhdVolume]),
+			vhd.VhdVolume,
+		)
+		if err != nil {
+			return err
+		}
+		resultingFile := filepath.Join(stateMachine.commonFlags.OutputDir, vhd.VhdName)
+		// force_size keeps the aligned size instead of rounding it to the
+		// CHS geometry of the disk
+		err = helper.RunCmd(
+			qemuImgConvertCmd(rawImg, resultingFile, "vpc", "subformat=fixed,force_size"),
+			stateMachine.commonFlags.Debug,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var makeVhdxImgState = stateFunc{"make_vhdx_image", (*StateMachine).makeVhdxImg}
+
+// makeVhdxImg converts raw .img artifacts into vhdx artifacts
+func (stateMachine *StateMachine) makeVhdxImg() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	for _, vhdx := range *classicStateMachine.ImageDef.Artifacts.Vhdx {
+		rawImg := filepath.Join(stateMachine.commonFlags.OutputDir, stateMachine.VolumeNames[vhdx.VhdxVolume])
+		resultingFile := filepath.Join(stateMachine.commonFlags.OutputDir, vhdx.VhdxName)
+		err := helper.RunCmd(
+			qemuImgConvertCmd(rawImg, resultingFile, "vhdx", "subformat=dynamic"),
+			stateMachine.commonFlags.Debug,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var makeOvaState = stateFunc{"make_ova", (*StateMachine).makeOva}
+
+// makeOva bundles raw .img artifacts, converted to stream-optimized vmdk
+// disks, with an OVF descriptor and a manifest into ova artifacts
+func (stateMachine *StateMachine) makeOva() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	for _, ova := range *classicStateMachine.ImageDef.Artifacts.Ova {
+		baseName := strings.TrimSuffix(ova.OvaName, filepath.Ext(ova.OvaName))
+		ovaDir := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "ova", baseName)
+		err := osMkdirAll(ovaDir, 0755)
+		if err != nil {
+			return fmt.Errorf("Error creating OVA directory: %s", err.Error())
+		}
+
+		rawImg := filepath.Join(stateMachine.commonFlags.OutputDir, stateMachine.VolumeNames[ova.OvaVolume])
+		rawImgInfo, err := os.Stat(rawImg)
+		if err != nil {
+			return fmt.Errorf("Error getting size of %s: %s", rawImg, err.Error())
+		}
+		diskFile := baseName + "-disk1.vmdk"
+		err = helper.RunCmd(
+			qemuImgConvertCmd(rawImg, filepath.Join(ovaDir, diskFile), "vmdk", "subformat=streamOptimized"),
+			stateMachine.commonFlags.Debug,
+		)
+		if err != nil {
+			return err
+		}
+
+		ovf, err := generateOVF(classicStateMachine.ImageDef, ova, diskFile, rawImgInfo.Size())
+		if err != nil {
+			return err
+		}
+		ovfFile := baseName + ".ovf"
+		err = osWriteFile(filepath.Join(ovaDir, ovfFile), []byte(ovf), 0644)
+		if err != nil {
+			return fmt.Errorf("Error writing OVF descriptor: %s", err.Error())
+		}
+
+		manifest, err := generateOVAManifest(ovaDir, ovfFile, diskFile)
+		if err != nil {
+			return err
+		}
+		manifestFile := baseName + ".mf"
+		err = osWriteFile(filepath.Join(ovaDir, manifestFile), []byte(manifest), 0644)
+		if err != nil {
+			return fmt.Errorf("Error writing OVA manifest: %s", err.Error())
+		}
+
+		// the OVF descriptor must be the first file of the archive
+		tarArgs := []string{"--format=ustar"}
+		if stateMachine.sourceDateEpoch != nil {
+			tarArgs = append(tarArgs,
+				"--sort=name",
+				fmt.Sprintf("--mtime=@%d", stateMachine.sourceDateEpoch.Unix()),
+				"--owner=0",
+				"--group=0",
+				"--numeric-owner",
+			)
+		}
+		tarArgs = append(tarArgs,
+			"-cf",
+			filepath.Join(stateMachine.commonFlags.OutputDir, ova.OvaName),
+			"-C",
+			ovaDir,
+			ovfFile,
+			manifestFile,
+			diskFile,
+		)
+		tarCmd := execCommand("tar", tarArgs...)
+		err = helper.RunCmd(tarCmd, stateMachine.commonFlags.Debug)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var makeBmapState = stateFunc{"make_bmap", (*StateMachine).makeBmap}
+
+// makeBmap writes the block map of the .img artifacts requesting one. It is
+// computed from the holes of the raw images, so it must happen before they
+// are compressed
+func (stateMachine *StateMachine) makeBmap() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	for _, img := range *classicStateMachine.ImageDef.Artifacts.Img {
+		if !img.Bmap {
+			continue
+		}
+		imgPath := filepath.Join(stateMachine.commonFlags.OutputDir, img.ImgName)
+		bmap, err := generateBmap(imgPath)
+		if err != nil {
+			return err
+		}
+		err = osWriteFile(imgPath+".bmap", []byte(bmap), 0644)
+		if err != nil {
+			return fmt.Errorf("Error writing block map of %s: %s", img.ImgName, err.Error())
+		}
+	}
+	return nil
+}
+
+var compressImagesState = stateFunc{"compress_images", (*StateMachine).compressImages}
+
+// compressImages compresses the .img artifacts requesting it. The raw images
+// are replaced by the compressed ones
+func (stateMachine *StateMachine) compressImages() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+
+	for _, img := range *classicStateMachine.ImageDef.Artifacts.Img {
+		if img.Compression == "" || img.Compression == "uncompressed" {
+			continue
+		}
+		imgPath := filepath.Join(stateMachine.commonFlags.OutputDir, img.ImgName)
+		compressCmd, err := imgCompressCmd(img.Compression, imgPath, stateMachine.sourceDateEpoch != nil)
+		if err != nil {
+			return err
+		}
+		err = helper.RunCmd(compressCmd, stateMachine.commonFlags.Debug)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var makeISOState = stateFunc{"make_iso", (*StateMachine).makeISO}
+
+// makeISO creates a BIOS and UEFI bootable hybrid ISO. The rootfs is
+// shipped as a casper squashfs next to the kernel and initrd it contains,
+// and a copy of the EFI system partition built from the gadget, configured
+// to boot from the ISO, is appended to it and used as El Torito EFI boot image
+func (stateMachine *StateMachine) makeISO() error {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	iso := classicStateMachine.ImageDef.Artifacts.Iso
+
+	gadgetESPImg, err := stateMachine.isoESPImage(iso)
+	if err != nil {
+		return err
+	}
+	espImg, err := stateMachine.isoEFIImage(gadgetESPImg)
+	if err != nil {
+		return err
+	}
+
+	isoDir := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "iso")
+	err = osRemoveAll(isoDir)
+	if err != nil {
+		return fmt.Errorf("Error cleaning ISO staging directory: %s", err.Error())
+	}
+	for _, dir := range []string{"casper", ".disk", "boot/grub"} {
+		err = osMkdirAll(filepath.Join(isoDir, dir), 0755)
+		if err != nil {
+			return fmt.Errorf("Error creating ISO staging directory: %s", err.Error())
+		}
+	}
+
+	graftPoints, err := stateMachine.isoCasperContent(isoDir)
+	if err != nil {
+		return err
+	}
+
+	err = osWriteFile(filepath.Join(isoDir, ".disk", "info"),
+		[]byte(classicStateMachine.ImageDef.DisplayName+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing ISO disk info: %s", err.Error())
+	}
+	err = osWriteFile(filepath.Join(isoDir, "boot", "grub", "grub.cfg"),
+		[]byte(isoGrubConfig(classicStateMachine.ImageDef)), 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing ISO grub configuration: %s", err.Error())
+	}
+
+	biosBoot, err := stateMachine.prepareISOBIOSBoot(isoDir)
+	if err != nil {
+		return err
+	}
+
+	xorrisoArgs := []string{"-as", "mkisofs",
+		"-r", "-J", "-joliet-long", "-iso-level", "3",
+		"-V", isoVolumeID(classicStateMachine.ImageDef),
+		"-o", filepath.Join(stateMachine.commonFlags.OutputDir, iso.IsoName),
+	}
+	if biosBoot {
+		xorrisoArgs = append(xorrisoArgs,
+			"--grub2-mbr", filepath.Join(stateMachine.tempDirs.rootfs, isoGrubBIOSDir, "boot_hybrid.img"),
+			"-partition_offset", "16",
+			"--mbr-force-bootable",
+		)
+	}
+	xorrisoArgs = append(xorrisoArgs,
+		"-append_partition", "2", "0xef", espImg,
+		"-appended_part_as_gpt",
+	)
+	if biosBoot {
+		xorrisoArgs = append(xorrisoArgs,
+			"-b", "boot/grub/i386-pc/eltorito.img",
+			"-no-emul-boot", "-boot-load-size", "4", "-boot-info-table", "--grub2-boot-info",
+			"-eltorito-alt-boot",
+		)
+	}
+	xorrisoArgs = append(xorrisoArgs,
+		"-e", "--interval:appended_partition_2:all::", "-no-emul-boot",
+		"-graft-points", isoDir,
+	)
+	xorrisoArgs = append(xorrisoArgs, graftPoints...)
+
+	return helper.RunCmd(execCommand("xorriso", xorrisoArgs...), stateMachine.commonFlags.Debug)
+}
+
+// isoESPImage returns the path of the EFI system partition image built
+// from the gadget volume selected for the ISO
+func (stateMachine *StateMachine) isoESPImage(iso *imagedefinition.Iso) (string, error) {
+	volumeName := iso.IsoVolume
+	if volumeName == "" {
+		// there is only one volume, so get it from the map
+		volumeName = reflect.ValueOf(stateMachine.GadgetInfo.Volumes).MapKeys()[0].String()
+	}
+	volume, found := stateMachine.GadgetInfo.Volumes[volumeName]
+	if !found {
+		return "", fmt.Errorf("Volume %s used by the iso artifact does not exist in the gadget", volumeName)
+	}
+	for i := range volume.Structure {
+		structure := &volume.Structure[i]
+		if helper.IsSystemBootStructure(structure) && !helper.IsBIOSBootStructure(structure) &&
+			structure.Filesystem == "vfat" {
+			return filepath.Join(stateMachine.tempDirs.volumes, volumeName,
+				"part"+strconv.Itoa(i)+".img"), nil
+		}
+	}
+	return "", fmt.Errorf("No EFI system partition found in volume %s to boot the ISO", volumeName)
+}
+
+// isoEFIGrubConfig makes the GRUB of the EFI image of the ISO find the ISO
+// and load its configuration, as the one of the gadget looks for the rootfs
+// partition of the disk image. Ubuntu ISOs use the same configuration
+const isoEFIGrubConfig = `search --set=root --file /.disk/info
+set prefix=($root)/boot/grub
+configfile $prefix/grub.cfg
+`
+
+// isoEFIImage returns a copy of the EFI system partition image of the gadget
+// in which GRUB, either shim's default one or the fallback one, loads the
+// configuration of the ISO
+func (stateMachine *StateMachine) isoEFIImage(gadgetESPImg string) (string, error) {
+	efiDir := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "iso-efi")
+	err := osMkdirAll(efiDir, 0755)
+	if err != nil {
+		return "", fmt.Errorf("Error creating ISO EFI image directory: %s", err.Error())
+	}
+	efiImg := filepath.Join(efiDir, "efi.img")
+	err = osutilCopyFile(gadgetESPImg, efiImg, osutil.CopyFlagOverwrite)
+	if err != nil {
+		return "", fmt.Errorf("Error copying the EFI system partition for the ISO: %s", err.Error())
+	}
+	grubCfg := filepath.Join(efiDir, "grub.cfg")
+	err = osWriteFile(grubCfg, []byte(isoEFIGrubConfig), 0644)
+	if err != nil {
+		return "", fmt.Errorf("Error writing ISO EFI grub configuration: %s", err.Error())
+	}
+
+	// existing directories of the gadget are kept
+	cmds := []*exec.Cmd{
+		execCommand("mmd", "-D", "s", "-i", efiImg, "::EFI", "::EFI/BOOT", "::EFI/ubuntu"),
+	}
+	for _, dir := range []string{"EFI/BOOT", "EFI/ubuntu"} {
+		cmds = append(cmds, execCommand("mcopy", "-o", "-i", efiImg, grubCfg, "::"+dir+"/grub.cfg"))
+	}
+	for _, cmd := range cmds {
+		err := helper.RunCmd(cmd, stateMachine.commonFlags.Debug)
+		if err != nil {
+			return "", fmt.Errorf("Error configuring the EFI image of the ISO: %s", err.Error())
+		}
+	}
+	return efiImg, nil
+}
+
+// isoCasperContent fills the casper directory of the ISO with the kernel and
+// initrd of the rootfs and its squashfs. Installer images reuse the layers and
+// preseeds already created in the output directory, which are grafted into
+// the ISO rather than copied. The needed graft points are returned
+func (stateMachine *StateMachine) isoCasperContent(isoDir string) ([]string, error) {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	graftPoints := make([]string, 0)
+
+	liveLayers, err := stateMachine.isoLiveLayers()
+	if err != nil {
+		return nil, err
+	}
+	for isoPath, rootfsPath := range map[string]string{
+		"casper/vmlinuz": "boot/vmlinuz",
+		"casper/initrd":  "boot/initrd.img",
+	} {
+		target, err := resolveRootfsLink(liveLayers, rootfsPath)
+		if err != nil {
+			return nil, fmt.Errorf("Error finding %s in the rootfs: %s", rootfsPath, err.Error())
+		}
+		graftPoints = append(graftPoints, "/"+isoPath+"="+target)
+	}
+	// keep a stable order for the xorriso command
+	slices.Sort(graftPoints)
+
+	if classicStateMachine.ImageDef.Class != "installer" {
+		err := helper.RunCmd(
+			mksquashfsCmd(stateMachine.tempDirs.rootfs, filepath.Join(isoDir, "casper", "filesystem.squashfs")),
+			stateMachine.commonFlags.Debug,
+		)
+		if err != nil {
+			return nil, err
+		}
+		return graftPoints, nil
+	}
+
+	casperDir := filepath.Join(stateMachine.commonFlags.OutputDir, "casper")
+	squashfsFiles, err := filepath.Glob(filepath.Join(casperDir, "*.squashfs"))
+	if err != nil {
+		return nil, fmt.Errorf("Error listing installer layers: %s", err.Error())
+	}
+	for _, squashfsFile := range squashfsFiles {
+		graftPoints = append(graftPoints, "/casper/"+filepath.Base(squashfsFile)+"="+squashfsFile)
+	}
+	for _, preseed := range []string{"autoinstall.yaml", "preseed"} {
+		preseedPath := filepath.Join(stateMachine.commonFlags.OutputDir, preseed)
+		if _, err := os.Stat(preseedPath); err == nil {
+			graftPoints = append(graftPoints, "/"+preseed+"="+preseedPath)
+		}
+	}
+	return graftPoints, nil
+}
+
+// isoLiveLayers returns the layers, topmost first, of the live system booted by
+// the ISO. Its initrd must hold the casper boot scripts. Installers get them
+// from their layers. For other images, casper is installed in an overlay of the
+// rootfs, so that the initrd of the rootfs, also used by the disk images, does
+// not boot a live system
+func (stateMachine *StateMachine) isoLiveLayers() ([]string, error) {
+	classicStateMachine := stateMachine.parent.(*ClassicStateMachine)
+	liveLayers := make([]string, 0)
+
+	if classicStateMachine.ImageDef.Class == "installer" {
+		layers := classicStateMachine.installerLayers()
+		layersDir := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "installer-layers")
+		for i := len(layers) - 1; i > 0; i-- {
+			liveLayers = append(liveLayers, filepath.Join(layersDir, layers[i], "upper"))
+		}
+	} else if _, err := resolveRootfsLink([]string{stateMachine.tempDirs.rootfs}, isoCasperScriptsDir); err != nil {
+		liveDir := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "iso-live")
+		upperDir := filepath.Join(liveDir, "upper")
+		err := stateMachine.installInOverlay([]string{stateMachine.tempDirs.rootfs}, liveDir, upperDir, []string{"casper"})
+		if err != nil {
+			return nil, fmt.Errorf("Error building the live initrd of the ISO: %w", err)
+		}
+		liveLayers = append(liveLayers, upperDir)
+	}
+	liveLayers = append(liveLayers, stateMachine.tempDirs.rootfs)
+
+	if _, err := resolveRootfsLink(liveLayers, isoCasperScriptsDir); err != nil {
+		return nil, fmt.Errorf("The initrd of the ISO cannot boot a live system: "+
+			"the casper boot scripts %s were not found", isoCasperScriptsDir)
+	}
+	return liveLayers, nil
+}
+
+// prepareISOBIOSBoot creates the El Torito BIOS boot image of the ISO from the
+// GRUB modules of the rootfs. BIOS boot is skipped if they are not installed
+func (stateMachine *StateMachine) prepareISOBIOSBoot(isoDir string) (bool, error) {
+	grubBIOSDir := filepath.Join(stateMachine.tempDirs.rootfs, isoGrubBIOSDir)
+	if _, err := os.Stat(filepath.Join(grubBIOSDir, "boot_hybrid.img")); err != nil {
+		fmt.Print("WARNING: GRUB BIOS modules not found in the rootfs, the ISO will only boot with UEFI\n")
+		return false, nil
+	}
+
+	isoGrubDir := filepath.Join(isoDir, "boot", "grub", "i386-pc")
+	err := osutilCopySpecialFile(grubBIOSDir, isoGrubDir)
+	if err != nil {
+		return false, fmt.Errorf("Error copying GRUB BIOS modules: %s", err.Error())
+	}
+
+	grubMkimageCmd := execCommand("grub-mkimage",
+		"-d", grubBIOSDir,
+		"-O", "i386-pc-eltorito",
+		"-p", "/boot/grub",
+		"-o", filepath.Join(isoGrubDir, "eltorito.img"),
+		"biosdisk", "iso9660", "part_gpt", "part_msdos",
+	)
+	err = helper.RunCmd(grubMkimageCmd, stateMachine.commonFlags.Debug)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 var setupBootloaderState = stateFunc{"setup_bootloader", (*StateMachine).setupBootloader}
 
 // setupBootloader determines the bootloader for each volume
@@ -1394,15 +2887,21 @@ var cleanRootfsState = stateFunc{"clean_rootfs", (*StateMachine).cleanRootfs}
 // cleanRootfs cleans the created chroot from secrets/values generated
 // during the various preceding install steps
 func (stateMachine *StateMachine) cleanRootfs() error {
+	return cleanMachineSpecificFiles(stateMachine.tempDirs.chroot)
+}
+
+// cleanMachineSpecificFiles deletes or truncates the files of root that are
+// supposed to be unique per machine
+func cleanMachineSpecificFiles(root string) error {
 	toDelete := []string{
-		filepath.Join(stateMachine.tempDirs.chroot, "var", "lib", "dbus", "machine-id"),
+		filepath.Join(root, "var", "lib", "dbus", "machine-id"),
 	}
 
 	toTruncate := []string{
-		filepath.Join(stateMachine.tempDirs.chroot, "etc", "machine-id"),
+		filepath.Join(root, "etc", "machine-id"),
 	}
 
-	toCleanFromPattern, err := listWithPatterns(stateMachine.tempDirs.chroot,
+	toCleanFromPattern, err := listWithPatterns(root,
 		[]string{
 			filepath.Join("etc", "ssh", "ssh_host_*_key.pub"),
 			filepath.Join("etc", "ssh", "ssh_host_*_key"),
@@ -1423,7 +2922,7 @@ func (stateMachine *StateMachine) cleanRootfs() error {
 		return err
 	}
 
-	toTruncateFromPattern, err := listWithPatterns(stateMachine.tempDirs.chroot,
+	toTruncateFromPattern, err := listWithPatterns(root,
 		[]string{
 			// udev persistent rules
 			filepath.Join("etc", "udev", "rules.d", "*persistent-net.rules"),
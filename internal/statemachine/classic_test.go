@@ -3,8 +3,14 @@
 package statemachine
 
 import (
+	"archive/tar"
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -18,7 +24,10 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
 	"github.com/snapcore/snapd/image"
 	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/seed"
@@ -77,10 +86,60 @@ func TestYAMLSchemaParsing(t *testing.T) {
 		{"invalid_ppa_auth", "test_bad_ppa_name.yaml", false, "Auth: Does not match pattern"},
 		{"both_seed_and_tasks", "test_both_seed_and_tasks.yaml", false, "Must validate one and only one schema"},
 		{"git_gadget_without_url", "test_git_gadget_without_url.yaml", false, "When key gadget:type is specified as git, a URL must be provided"},
+		{"valid_image_definition_gadget_build_in_chroot", "test_build_gadget_in_chroot.yaml", true, ""},
+		{"gadget_build_deps_without_chroot", "test_gadget_build_deps_without_chroot.yaml", false, "Key gadget:build-dependencies cannot be used without key gadget:build-in-chroot"},
+		{"valid_image_definition_layout", "test_layout.yaml", true, ""},
+		{"valid_image_definition_layout_multi_volume", "test_layout_multi_volume.yaml", true, ""},
+		{"gadget_and_layout", "test_gadget_and_layout.yaml", false, "Key gadget: cannot be used together with key layout:"},
+		{"relative_paths_in_layout_content", "test_layout_relative_content.yaml", false, "needs to be an absolute path (usr/lib/shim/shimx64.efi.signed)"},
+		{"valid_image_definition_extra_repositories", "test_extra_repositories.yaml", true, ""},
+		{"repository_key_and_key_file", "test_repository_key_and_key_file.yaml", false, "Key customization:extra-repositories:artifactory:key cannot be used together with key customization:extra-repositories:artifactory:key-file"},
+		{"valid_image_definition_systemd", "test_systemd.yaml", true, ""},
+		{"systemd_bad_default_target", "test_systemd_bad_default_target.yaml", false, "DefaultTarget: Does not match pattern"},
+		{"valid_image_definition_bootloader", "test_bootloader.yaml", true, ""},
+		{"bootloader_negative_timeout", "test_bootloader_negative_timeout.yaml", false, "Must be greater than or equal to 0"},
+		{"valid_image_definition_system", "test_system.yaml", true, ""},
+		{"system_bad_hostname", "test_system_bad_hostname.yaml", false, "Hostname: Does not match pattern"},
+		{"valid_image_definition_add_user_service_account", "test_add_user_service_account.yaml", true, ""},
+		{"add_user_sudo_nopasswd_without_sudo", "test_add_user_sudo_nopasswd_without_sudo.yaml", false, "Key customization:manual:add-user:svc:sudo-nopasswd cannot be used without key customization:manual:add-user:svc:sudo"},
+		{"add_user_relative_home", "test_add_user_relative_home.yaml", false, "customization:manual:add-user:svc:home needs to be an absolute path (srv/svc)"},
+		{"valid_image_definition_files", "test_files.yaml", true, ""},
+		{"files_content_and_source", "test_files_content_and_source.yaml", false, "Key customization:files:/etc/motd:content cannot be used together with key customization:files:/etc/motd:source"},
+		{"files_relative_path", "test_files_relative_path.yaml", false, "customization:files:path needs to be an absolute path (etc/motd)"},
+		{"files_bad_mode", "test_files_bad_mode.yaml", false, "Mode: Does not match pattern"},
+		{"valid_image_definition_execute", "test_execute.yaml", true, ""},
+		{"execute_path_and_script", "test_execute_path_and_script.yaml", false, "Key customization:manual:execute:0:path cannot be used together with key customization:manual:execute:0:script"},
+		{"execute_no_path_or_script", "test_execute_no_path_or_script.yaml", false, "One of the keys customization:manual:execute:1:path or customization:manual:execute:1:script must be specified"},
+		{"valid_image_definition_debconf", "test_debconf.yaml", true, ""},
+		{"debconf_bad_type", "test_debconf_bad_type.yaml", false, "Type must be one of the following"},
+		{"valid_image_definition_installer", "test_installer.yaml", true, ""},
+		{"installer_bad_layer", "test_installer_bad_layer.yaml", false, "Invalid installer layer minimal.cloud-image: the layer must be named minimal.standard.<seed>"},
+		{"installer_unknown_seed", "test_installer_unknown_seed.yaml", false, "Invalid installer layer minimal.standard.desktop: desktop is not one of the seeds of the rootfs"},
+		{"installer_wrong_class", "test_installer_wrong_class.yaml", false, "Key customization:installer can only be used when class is installer"},
+		{"valid_image_definition_iso", "test_iso.yaml", true, ""},
+		{"iso_volume_id_too_long", "test_iso_long_volume_id.yaml", false, "String length must be less than or equal to 32"},
+		{"valid_image_definition_squashfs", "test_squashfs.yaml", true, ""},
+		{"squashfs_bad_block_size", "test_squashfs_bad_block_size.yaml", false, "BlockSize must be one of the following"},
+		{"valid_image_definition_virtual_disks", "test_virtual_disks.yaml", true, ""},
+		{"ova_bad_cpus", "test_ova_bad_cpus.yaml", false, "Must be greater than or equal to 1"},
+		{"valid_image_definition_img_compression", "test_img_compression.yaml", true, ""},
+		{"img_bad_compression", "test_img_bad_compression.yaml", false, "Compression must be one of the following"},
+		{"valid_image_definition_checksums", "test_checksums.yaml", true, ""},
+		{"valid_image_definition_sbom", "test_sbom.yaml", true, ""},
+		{"sbom_bad_format", "test_sbom_bad_format.yaml", false, "Format must be one of the following"},
+		{"valid_image_definition_oci", "test_oci.yaml", true, ""},
+		{"oci_bad_format", "test_oci_bad_format.yaml", false, "Format must be one of the following"},
+		{"oci_name_outside_output_dir", "test_oci_name_outside_output_dir.yaml", false, "Key artifacts:oci:name needs to be a relative path inside the output directory (../ubuntu-oci)"},
+		{"oci_name_output_dir", "test_oci_name_output_dir.yaml", false, "Key artifacts:oci:name needs to be a relative path inside the output directory (.)"},
+		{"snap_gadget_without_url_or_name", "test_snap_gadget_without_url_or_name.yaml", false, "One of the keys gadget:url or gadget:name must be specified"},
+		{"snap_gadget_with_url_and_name", "test_snap_gadget_with_url_and_name.yaml", false, "Key gadget:url cannot be used together with key gadget:name"},
+		{"snap_gadget_with_remote_url", "test_snap_gadget_with_remote_url.yaml", false, "Key gadget:url only supports file:// URLs (https://example.com/pc-gadget.snap)"},
 		{"file_doesnt_exist", "test_not_exist.yaml", false, "no such file or directory"},
 		{"not_valid_yaml", "test_invalid_yaml.yaml", false, "yaml: unmarshal errors"},
 		{"missing_yaml_fields", "test_missing_name.yaml", false, "Key \"name\" is required in struct \"ImageDefinition\", but is not in the YAML file!"},
 		{"private_ppa_without_fingerprint", "test_private_ppa_without_fingerprint.yaml", false, "Fingerprint is required for private PPAs"},
+		{"valid_image_definition_private_ppa_with_key_file", "test_private_ppa_with_key_file.yaml", true, ""},
+		{"ppa_key_and_key_file", "test_ppa_key_and_key_file.yaml", false, "Key customization:extra-ppas:test/test-ppa:key cannot be used together with key customization:extra-ppas:test/test-ppa:key-file"},
 		{"invalid_paths_in_manual_copy", "test_invalid_paths_in_manual_copy.yaml", false, "needs to be an absolute path (../../malicious)"},
 		{"invalid_paths_in_manual_copy_bug", "test_invalid_paths_in_manual_copy.yaml", false, "needs to be an absolute path (/../../malicious)"},
 		{"invalid_paths_in_manual_mkdir", "test_invalid_paths_in_manual_mkdir.yaml", false, "needs to be an absolute path (../../malicious)"},
@@ -252,6 +311,7 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 	testCases := []struct {
 		name            string
 		imageDefinition string
+		reproducible    bool
 		expectedStates  []string
 	}{
 		{
@@ -307,17 +367,15 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 			},
 		},
 		{
-			name:            "state_prebuilt_rootfs_extras",
-			imageDefinition: "test_prebuilt_rootfs_extras.yaml",
+			name:            "state_snap_gadget",
+			imageDefinition: "test_snap_gadget.yaml",
 			expectedStates: []string{
-				"build_gadget_tree",
 				"prepare_gadget_tree",
 				"load_gadget_yaml",
 				"verify_artifact_names",
-				"extract_rootfs_tar",
-				"add_extra_ppas",
+				"germinate",
+				"create_chroot",
 				"install_packages",
-				"clean_extra_ppas",
 				"prepare_image",
 				"preseed_image",
 				"clean_rootfs",
@@ -334,8 +392,34 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 			},
 		},
 		{
-			name:            "state_ppa",
-			imageDefinition: "test_amd64.yaml",
+			name:            "state_layout",
+			imageDefinition: "test_layout.yaml",
+			expectedStates: []string{
+				"generate_gadget_yaml",
+				"load_gadget_yaml",
+				"verify_artifact_names",
+				"germinate",
+				"create_chroot",
+				"install_packages",
+				"prepare_image",
+				"preseed_image",
+				"clean_rootfs",
+				"customize_sources_list",
+				"customize_cloud_init",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"copy_layout_assets",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_disk",
+				"setup_bootloader",
+				"generate_package_manifest",
+			},
+		},
+		{
+			name:            "state_remove_packages",
+			imageDefinition: "test_remove_packages.yaml",
 			expectedStates: []string{
 				"build_gadget_tree",
 				"prepare_gadget_tree",
@@ -343,15 +427,12 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 				"verify_artifact_names",
 				"germinate",
 				"create_chroot",
-				"add_extra_ppas",
 				"install_packages",
-				"clean_extra_ppas",
 				"prepare_image",
 				"preseed_image",
+				"remove_packages",
 				"clean_rootfs",
 				"customize_sources_list",
-				"customize_cloud_init",
-				"perform_manual_customization",
 				"set_default_locale",
 				"populate_rootfs_contents",
 				"calculate_rootfs_size",
@@ -359,14 +440,12 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 				"populate_prepare_partitions",
 				"make_disk",
 				"setup_bootloader",
-				"make_qcow2_image",
 				"generate_package_manifest",
-				"generate_filelist",
 			},
 		},
 		{
-			name:            "state_upgrade",
-			imageDefinition: "test_amd64_upgrade.yaml",
+			name:            "state_extra_repositories",
+			imageDefinition: "test_extra_repositories.yaml",
 			expectedStates: []string{
 				"build_gadget_tree",
 				"prepare_gadget_tree",
@@ -374,16 +453,13 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 				"verify_artifact_names",
 				"germinate",
 				"create_chroot",
-				"upgrade_packages",
-				"add_extra_ppas",
+				"add_extra_repositories",
 				"install_packages",
-				"clean_extra_ppas",
+				"clean_extra_repositories",
 				"prepare_image",
 				"preseed_image",
 				"clean_rootfs",
 				"customize_sources_list",
-				"customize_cloud_init",
-				"perform_manual_customization",
 				"set_default_locale",
 				"populate_rootfs_contents",
 				"calculate_rootfs_size",
@@ -391,24 +467,25 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 				"populate_prepare_partitions",
 				"make_disk",
 				"setup_bootloader",
-				"make_qcow2_image",
 				"generate_package_manifest",
-				"generate_filelist",
 			},
 		},
 		{
-			name:            "extract_rootfs_tar",
-			imageDefinition: "test_extract_rootfs_tar.yaml",
+			name:            "state_systemd",
+			imageDefinition: "test_systemd.yaml",
 			expectedStates: []string{
 				"build_gadget_tree",
 				"prepare_gadget_tree",
 				"load_gadget_yaml",
 				"verify_artifact_names",
-				"extract_rootfs_tar",
+				"germinate",
+				"create_chroot",
 				"install_packages",
+				"prepare_image",
+				"preseed_image",
 				"clean_rootfs",
 				"customize_sources_list",
-				"customize_cloud_init",
+				"customize_systemd",
 				"set_default_locale",
 				"populate_rootfs_contents",
 				"calculate_rootfs_size",
@@ -420,16 +497,21 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 			},
 		},
 		{
-			name:            "extract_rootfs_tar_no_customization",
-			imageDefinition: "test_extract_rootfs_tar_no_customization.yaml",
+			name:            "state_bootloader",
+			imageDefinition: "test_bootloader.yaml",
 			expectedStates: []string{
 				"build_gadget_tree",
 				"prepare_gadget_tree",
 				"load_gadget_yaml",
 				"verify_artifact_names",
-				"extract_rootfs_tar",
+				"germinate",
+				"create_chroot",
+				"install_packages",
+				"prepare_image",
+				"preseed_image",
 				"clean_rootfs",
 				"customize_sources_list",
+				"customize_bootloader",
 				"set_default_locale",
 				"populate_rootfs_contents",
 				"calculate_rootfs_size",
@@ -441,8 +523,8 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 			},
 		},
 		{
-			name:            "build_rootfs_from_seed",
-			imageDefinition: "test_rootfs_seed.yaml",
+			name:            "state_debconf",
+			imageDefinition: "test_debconf.yaml",
 			expectedStates: []string{
 				"build_gadget_tree",
 				"prepare_gadget_tree",
@@ -450,12 +532,12 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 				"verify_artifact_names",
 				"germinate",
 				"create_chroot",
+				"set_debconf_selections",
 				"install_packages",
 				"prepare_image",
 				"preseed_image",
 				"clean_rootfs",
 				"customize_sources_list",
-				"customize_cloud_init",
 				"set_default_locale",
 				"populate_rootfs_contents",
 				"calculate_rootfs_size",
@@ -467,14 +549,173 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 			},
 		},
 		{
-			name:            "build_rootfs_from_tasks",
-			imageDefinition: "test_rootfs_tasks.yaml",
+			name:            "state_files",
+			imageDefinition: "test_files.yaml",
 			expectedStates: []string{
 				"build_gadget_tree",
 				"prepare_gadget_tree",
 				"load_gadget_yaml",
 				"verify_artifact_names",
-				"build_rootfs_from_tasks",
+				"germinate",
+				"create_chroot",
+				"install_packages",
+				"prepare_image",
+				"preseed_image",
+				"clean_rootfs",
+				"customize_sources_list",
+				"customize_files",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_disk",
+				"setup_bootloader",
+				"generate_package_manifest",
+			},
+		},
+		{
+			name:            "state_system",
+			imageDefinition: "test_system.yaml",
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"verify_artifact_names",
+				"germinate",
+				"create_chroot",
+				"install_packages",
+				"prepare_image",
+				"preseed_image",
+				"clean_rootfs",
+				"customize_sources_list",
+				"customize_system",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_disk",
+				"setup_bootloader",
+				"generate_package_manifest",
+			},
+		},
+		{
+			name:            "state_apt_preferences",
+			imageDefinition: "test_apt_preferences.yaml",
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"verify_artifact_names",
+				"germinate",
+				"create_chroot",
+				"set_apt_preferences",
+				"install_packages",
+				"prepare_image",
+				"preseed_image",
+				"clean_apt_preferences",
+				"clean_rootfs",
+				"customize_sources_list",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_disk",
+				"setup_bootloader",
+				"generate_package_manifest",
+			},
+		},
+		{
+			name:            "state_installer",
+			imageDefinition: "test_installer.yaml",
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"verify_artifact_names",
+				"germinate",
+				"create_chroot",
+				"install_packages",
+				"prepare_image",
+				"preseed_image",
+				"clean_rootfs",
+				"customize_sources_list",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"make_installer_layers",
+				"copy_installer_preseeds",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_disk",
+				"setup_bootloader",
+				"generate_package_manifest",
+			},
+		},
+		{
+			name:            "state_iso",
+			imageDefinition: "test_iso.yaml",
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"verify_artifact_names",
+				"germinate",
+				"create_chroot",
+				"install_packages",
+				"prepare_image",
+				"preseed_image",
+				"clean_rootfs",
+				"customize_sources_list",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"make_installer_layers",
+				"copy_installer_preseeds",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_iso",
+				"generate_package_manifest",
+			},
+		},
+		{
+			name:            "state_squashfs",
+			imageDefinition: "test_squashfs.yaml",
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"germinate",
+				"create_chroot",
+				"install_packages",
+				"prepare_image",
+				"preseed_image",
+				"clean_rootfs",
+				"customize_sources_list",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"generate_rootfs_squashfs",
+			},
+		},
+		{
+			name:            "state_prebuilt_rootfs_extras",
+			imageDefinition: "test_prebuilt_rootfs_extras.yaml",
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"verify_artifact_names",
+				"extract_rootfs_tar",
+				"add_extra_ppas",
+				"install_packages",
+				"clean_extra_ppas",
+				"prepare_image",
+				"preseed_image",
 				"clean_rootfs",
 				"customize_sources_list",
 				"customize_cloud_init",
@@ -489,8 +730,8 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 			},
 		},
 		{
-			name:            "customization_states",
-			imageDefinition: "test_customization.yaml",
+			name:            "state_ppa",
+			imageDefinition: "test_amd64.yaml",
 			expectedStates: []string{
 				"build_gadget_tree",
 				"prepare_gadget_tree",
@@ -514,12 +755,14 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 				"populate_prepare_partitions",
 				"make_disk",
 				"setup_bootloader",
+				"make_qcow2_image",
 				"generate_package_manifest",
+				"generate_filelist",
 			},
 		},
 		{
-			name:            "qcow2",
-			imageDefinition: "test_qcow2.yaml",
+			name:            "state_img_compression",
+			imageDefinition: "test_img_compression.yaml",
 			expectedStates: []string{
 				"build_gadget_tree",
 				"prepare_gadget_tree",
@@ -535,6 +778,7 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 				"clean_rootfs",
 				"customize_sources_list",
 				"customize_cloud_init",
+				"perform_manual_customization",
 				"set_default_locale",
 				"populate_rootfs_contents",
 				"calculate_rootfs_size",
@@ -543,15 +787,20 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 				"make_disk",
 				"setup_bootloader",
 				"make_qcow2_image",
+				"make_bmap",
+				"compress_images",
+				"generate_package_manifest",
+				"generate_filelist",
 			},
 		},
 		{
-			name:            "no artifact",
-			imageDefinition: "test_no_artifact.yaml",
+			name:            "state_checksums",
+			imageDefinition: "test_checksums.yaml",
 			expectedStates: []string{
 				"build_gadget_tree",
 				"prepare_gadget_tree",
 				"load_gadget_yaml",
+				"verify_artifact_names",
 				"germinate",
 				"create_chroot",
 				"add_extra_ppas",
@@ -565,130 +814,1433 @@ func TestClassicStateMachine_calculateStates(t *testing.T) {
 				"perform_manual_customization",
 				"set_default_locale",
 				"populate_rootfs_contents",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_disk",
+				"setup_bootloader",
+				"make_qcow2_image",
+				"generate_package_manifest",
+				"generate_filelist",
+				"generate_checksums",
 			},
 		},
-	}
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			asserter := helper.Asserter{T: t}
-			restoreCWD := testhelper.SaveCWD()
-			defer restoreCWD()
-
-			var stateMachine ClassicStateMachine
-			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-			stateMachine.parent = &stateMachine
-			stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions", tc.imageDefinition)
-			err := stateMachine.parseImageDefinition()
-			asserter.AssertErrNil(err, true)
-
-			err = stateMachine.calculateStates()
-			asserter.AssertErrNil(err, true)
-
-			stateNames := make([]string, 0)
-			for _, f := range stateMachine.states {
-				stateNames = append(stateNames, f.name)
-			}
-
-			asserter.AssertEqual(tc.expectedStates, stateNames)
-		})
-	}
+		{
+			name:            "state_oci",
+			imageDefinition: "test_oci.yaml",
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"verify_artifact_names",
+				"germinate",
+				"create_chroot",
+				"add_extra_ppas",
+				"install_packages",
+				"clean_extra_ppas",
+				"prepare_image",
+				"preseed_image",
+				"clean_rootfs",
+				"customize_sources_list",
+				"customize_cloud_init",
+				"perform_manual_customization",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_disk",
+				"setup_bootloader",
+				"make_qcow2_image",
+				"generate_package_manifest",
+				"generate_filelist",
+				"generate_oci_image",
+			},
+		},
+		{
+			name:            "state_reproducible",
+			imageDefinition: "test_oci.yaml",
+			reproducible:    true,
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"verify_artifact_names",
+				"germinate",
+				"create_chroot",
+				"add_extra_ppas",
+				"install_packages",
+				"clean_extra_ppas",
+				"prepare_image",
+				"preseed_image",
+				"clean_rootfs",
+				"customize_sources_list",
+				"customize_cloud_init",
+				"perform_manual_customization",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"clamp_rootfs_mtimes",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_disk",
+				"setup_bootloader",
+				"make_qcow2_image",
+				"generate_package_manifest",
+				"generate_filelist",
+				"generate_oci_image",
+			},
+		},
+		{
+			name:            "state_sbom",
+			imageDefinition: "test_sbom.yaml",
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"verify_artifact_names",
+				"germinate",
+				"create_chroot",
+				"add_extra_ppas",
+				"install_packages",
+				"clean_extra_ppas",
+				"prepare_image",
+				"preseed_image",
+				"clean_rootfs",
+				"customize_sources_list",
+				"customize_cloud_init",
+				"perform_manual_customization",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_disk",
+				"setup_bootloader",
+				"make_qcow2_image",
+				"generate_package_manifest",
+				"generate_sbom",
+				"generate_filelist",
+			},
+		},
+		{
+			name:            "state_upgrade",
+			imageDefinition: "test_amd64_upgrade.yaml",
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"verify_artifact_names",
+				"germinate",
+				"create_chroot",
+				"upgrade_packages",
+				"add_extra_ppas",
+				"install_packages",
+				"clean_extra_ppas",
+				"prepare_image",
+				"preseed_image",
+				"clean_rootfs",
+				"customize_sources_list",
+				"customize_cloud_init",
+				"perform_manual_customization",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_disk",
+				"setup_bootloader",
+				"make_qcow2_image",
+				"generate_package_manifest",
+				"generate_filelist",
+			},
+		},
+		{
+			name:            "extract_rootfs_tar",
+			imageDefinition: "test_extract_rootfs_tar.yaml",
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"verify_artifact_names",
+				"extract_rootfs_tar",
+				"install_packages",
+				"clean_rootfs",
+				"customize_sources_list",
+				"customize_cloud_init",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_disk",
+				"setup_bootloader",
+				"generate_package_manifest",
+			},
+		},
+		{
+			name:            "extract_rootfs_tar_no_customization",
+			imageDefinition: "test_extract_rootfs_tar_no_customization.yaml",
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"verify_artifact_names",
+				"extract_rootfs_tar",
+				"clean_rootfs",
+				"customize_sources_list",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_disk",
+				"setup_bootloader",
+				"generate_package_manifest",
+			},
+		},
+		{
+			name:            "build_rootfs_from_seed",
+			imageDefinition: "test_rootfs_seed.yaml",
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"verify_artifact_names",
+				"germinate",
+				"create_chroot",
+				"install_packages",
+				"prepare_image",
+				"preseed_image",
+				"clean_rootfs",
+				"customize_sources_list",
+				"customize_cloud_init",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_disk",
+				"setup_bootloader",
+				"generate_package_manifest",
+			},
+		},
+		{
+			name:            "build_rootfs_from_tasks",
+			imageDefinition: "test_rootfs_tasks.yaml",
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"verify_artifact_names",
+				"build_rootfs_from_tasks",
+				"clean_rootfs",
+				"customize_sources_list",
+				"customize_cloud_init",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_disk",
+				"setup_bootloader",
+				"generate_package_manifest",
+			},
+		},
+		{
+			name:            "customization_states",
+			imageDefinition: "test_customization.yaml",
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"verify_artifact_names",
+				"germinate",
+				"create_chroot",
+				"add_extra_ppas",
+				"install_packages",
+				"clean_extra_ppas",
+				"prepare_image",
+				"preseed_image",
+				"clean_rootfs",
+				"customize_sources_list",
+				"customize_cloud_init",
+				"perform_manual_customization",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_disk",
+				"setup_bootloader",
+				"generate_package_manifest",
+			},
+		},
+		{
+			name:            "qcow2",
+			imageDefinition: "test_qcow2.yaml",
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"verify_artifact_names",
+				"germinate",
+				"create_chroot",
+				"add_extra_ppas",
+				"install_packages",
+				"clean_extra_ppas",
+				"prepare_image",
+				"preseed_image",
+				"clean_rootfs",
+				"customize_sources_list",
+				"customize_cloud_init",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_disk",
+				"setup_bootloader",
+				"make_qcow2_image",
+			},
+		},
+		{
+			name:            "state_virtual_disks",
+			imageDefinition: "test_virtual_disks.yaml",
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"verify_artifact_names",
+				"germinate",
+				"create_chroot",
+				"add_extra_ppas",
+				"install_packages",
+				"clean_extra_ppas",
+				"prepare_image",
+				"preseed_image",
+				"clean_rootfs",
+				"customize_sources_list",
+				"customize_cloud_init",
+				"set_default_locale",
+				"populate_rootfs_contents",
+				"calculate_rootfs_size",
+				"populate_bootfs_contents",
+				"populate_prepare_partitions",
+				"make_disk",
+				"setup_bootloader",
+				"make_qcow2_image",
+				"make_vmdk_image",
+				"make_vhd_image",
+				"make_vhdx_image",
+				"make_ova",
+			},
+		},
+		{
+			name:            "no artifact",
+			imageDefinition: "test_no_artifact.yaml",
+			expectedStates: []string{
+				"build_gadget_tree",
+				"prepare_gadget_tree",
+				"load_gadget_yaml",
+				"germinate",
+				"create_chroot",
+				"add_extra_ppas",
+				"install_packages",
+				"clean_extra_ppas",
+				"prepare_image",
+				"preseed_image",
+				"clean_rootfs",
+				"customize_sources_list",
+				"customize_cloud_init",
+				"perform_manual_customization",
+				"set_default_locale",
+				"populate_rootfs_contents",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			restoreCWD := testhelper.SaveCWD()
+			defer restoreCWD()
+
+			var stateMachine ClassicStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions", tc.imageDefinition)
+			err := stateMachine.parseImageDefinition()
+			asserter.AssertErrNil(err, true)
+			if tc.reproducible {
+				sourceDateEpoch := time.Unix(0, 0)
+				stateMachine.sourceDateEpoch = &sourceDateEpoch
+			}
+
+			err = stateMachine.calculateStates()
+			asserter.AssertErrNil(err, true)
+
+			stateNames := make([]string, 0)
+			for _, f := range stateMachine.states {
+				stateNames = append(stateNames, f.name)
+			}
+
+			asserter.AssertEqual(tc.expectedStates, stateNames)
+		})
+	}
+}
+
+// TestFailedCalculateStates tests failure scenarios in the
+// calculateStates function
+func TestFailedCalculateStates(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Gadget: &imagedefinition.Gadget{
+			GadgetType: "git",
+		},
+		Rootfs: &imagedefinition.Rootfs{
+			ArchiveTasks: []string{"test"},
+		},
+		Customization: &imagedefinition.Customization{},
+		Artifacts:     &imagedefinition.Artifact{},
+	}
+
+	// mock helper.CheckTags
+	// the gadget must be set to nil for this test to work
+	helperCheckTags = mockCheckTags
+	t.Cleanup(func() {
+		helperCheckTags = helper.CheckTags
+	})
+	err := stateMachine.calculateStates()
+	asserter.AssertErrContains(err, "Test Error")
+}
+
+// TestDisplayStates ensures the states are printed to stdout when the --debug flag is set
+func TestDisplayStates(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.Debug = true
+	stateMachine.commonFlags.DiskInfo = "test" // for coverage!
+	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions", "test_raspi.yaml")
+	err := stateMachine.parseImageDefinition()
+	asserter.AssertErrNil(err, true)
+
+	// capture stdout, calculate the states, and ensure they were printed
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	defer restoreStdout()
+	asserter.AssertErrNil(err, true)
+
+	err = stateMachine.calculateStates()
+	asserter.AssertErrNil(err, true)
+
+	stateMachine.displayStates()
+	asserter.AssertErrNil(err, true)
+
+	// restore stdout and examine what was printed
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+
+	expectedStates := `Following states will be executed:
+[0] build_gadget_tree
+[1] prepare_gadget_tree
+[2] load_gadget_yaml
+[3] verify_artifact_names
+[4] germinate
+[5] create_chroot
+[6] upgrade_packages
+[7] install_packages
+[8] prepare_image
+[9] preseed_image
+[10] clean_rootfs
+[11] customize_sources_list
+[12] customize_fstab
+[13] perform_manual_customization
+[14] set_default_locale
+[15] populate_rootfs_contents
+[16] generate_disk_info
+[17] calculate_rootfs_size
+[18] populate_bootfs_contents
+[19] populate_prepare_partitions
+[20] make_disk
+[21] setup_bootloader
+[22] generate_package_manifest
+`
+	if !strings.Contains(string(readStdout), expectedStates) {
+		t.Errorf("Expected states to be printed in output:\n\"%s\"\n but got \n\"%s\"\n instead",
+			expectedStates, string(readStdout))
+	}
+}
+
+// TestClassicStateMachine_Setup_Fail_setConfDefDir tests a failure in the Setup() function when setting the configuration definition directory
+func TestClassicStateMachine_Setup_Fail_setConfDefDir(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+
+	tmpDirPath := filepath.Join(testhelper.DefaultTmpDir, "test_failed_set_conf_dir")
+	err := os.Mkdir(tmpDirPath, 0755)
+	t.Cleanup(func() {
+		os.RemoveAll(tmpDirPath)
+	})
+	asserter.AssertErrNil(err, true)
+
+	err = os.Chdir(tmpDirPath)
+	asserter.AssertErrNil(err, true)
+
+	_ = os.RemoveAll(tmpDirPath)
+
+	err = stateMachine.Setup()
+	asserter.AssertErrContains(err, "unable to determine the configuration definition directory")
+	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+}
+
+// TestFailedValidateInputClassic tests a failure in the Setup() function when validating common input
+func TestFailedValidateInputClassic(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
+	// use both --until and --thru to trigger this failure
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.stateMachineFlags.Until = "until-test"
+	stateMachine.stateMachineFlags.Thru = "thru-test"
+
+	err := stateMachine.Setup()
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	asserter.AssertErrContains(err, "cannot specify both --until and --thru")
+}
+
+// TestFailedReadMetadataClassic tests a failed metadata read by passing --resume with no previous partial state machine run
+func TestFailedReadMetadataClassic(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
+	// start a --resume with no previous SM run
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.stateMachineFlags.Resume = true
+	stateMachine.stateMachineFlags.WorkDir = testDir
+	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
+		"test_amd64.yaml")
+
+	err := stateMachine.Setup()
+	asserter.AssertErrContains(err, "error reading metadata file")
+	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+}
+
+// TestClassicStateMachine_Setup_Fail_makeTemporaryDirectories tests the Setup function
+// with makeTemporaryDirectories failing
+func TestClassicStateMachine_Setup_Fail_makeTemporaryDirectories(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.stateMachineFlags.WorkDir = testDir
+	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
+		"test_amd64.yaml")
+
+	// mock os.MkdirAll
+	osMkdirAll = mockMkdirAll
+	t.Cleanup(func() {
+		osMkdirAll = os.MkdirAll
+	})
+	err := stateMachine.Setup()
+	asserter.AssertErrContains(err, "Error creating work directory")
+}
+
+// TestClassicStateMachine_Setup_Fail_determineOutputDirectory tests the Setup function
+// with determineOutputDirectory failing
+func TestClassicStateMachine_Setup_Fail_determineOutputDirectory(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
+		"test_amd64.yaml")
+	stateMachine.commonFlags.OutputDir = filepath.Join(testhelper.DefaultTmpDir, "test")
+
+	// mock os.MkdirAll
+	osMkdirAll = mockMkdirAll
+	t.Cleanup(func() {
+		osMkdirAll = os.MkdirAll
+	})
+	err := stateMachine.Setup()
+	asserter.AssertErrContains(err, "Error creating OutputDir")
+}
+
+// TestClassicStateMachine_DryRun tests a successful dry-run execution
+func TestClassicStateMachine_DryRun(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
+	workDir := "ubuntu-image-test-dry-run"
+	err := os.Mkdir(workDir, 0755)
+	asserter.AssertErrNil(err, true)
+
+	t.Cleanup(func() { os.RemoveAll(workDir) })
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
+		"test_amd64.yaml")
+	stateMachine.stateMachineFlags.WorkDir = workDir
+	stateMachine.commonFlags.DryRun = true
+
+	err = stateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+
+	files, err := osReadDir(workDir)
+	asserter.AssertErrNil(err, true)
+
+	if len(files) != 0 {
+		t.Errorf("Some files were created in the workdir but should not. Created files: %s", files)
+	}
+
+	err = stateMachine.Run()
+	asserter.AssertErrNil(err, true)
+
+	err = stateMachine.Teardown()
+	asserter.AssertErrNil(err, true)
+}
+
+// TestPrepareGadgetTree runs prepareGadgetTree() and ensures the gadget_tree files
+// are placed in the correct locations
+func TestPrepareGadgetTree(t *testing.T) {
+	t.Parallel()
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: arch.GetHostArch(),
+		Series:       getHostSuite(),
+		Gadget:       &imagedefinition.Gadget{},
+	}
+
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	// place a test gadget tree in the  scratch directory so we don't have to build one
+	gadgetDir := filepath.Join(stateMachine.tempDirs.scratch, "gadget")
+	err = os.MkdirAll(gadgetDir, 0755)
+	asserter.AssertErrNil(err, true)
+
+	gadgetSource := filepath.Join("testdata", "gadget_tree")
+	err = osutil.CopySpecialFile(gadgetSource, filepath.Join(gadgetDir, "install"))
+	asserter.AssertErrNil(err, true)
+
+	err = stateMachine.prepareGadgetTree()
+	asserter.AssertErrNil(err, true)
+
+	gadgetTreeFiles := []string{"grub.conf", "pc-boot.img", "meta/gadget.yaml"}
+	for _, file := range gadgetTreeFiles {
+		_, err := os.Stat(filepath.Join(stateMachine.tempDirs.unpack, "gadget", file))
+		if err != nil {
+			t.Errorf("File %s should be in unpack, but is missing", file)
+		}
+	}
+}
+
+// TestPrepareGadgetTreePrebuilt tests the prepareGadgetTree function with prebuilt gadgets
+func TestPrepareGadgetTreePrebuilt(t *testing.T) {
+	t.Parallel()
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: arch.GetHostArch(),
+		Series:       getHostSuite(),
+		Gadget: &imagedefinition.Gadget{
+			GadgetType: "prebuilt",
+			GadgetURL:  "testdata/gadget_tree/",
+		},
+	}
+
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	err = stateMachine.prepareGadgetTree()
+	asserter.AssertErrNil(err, true)
+
+	gadgetTreeFiles := []string{"grub.conf", "pc-boot.img", "meta/gadget.yaml"}
+	for _, file := range gadgetTreeFiles {
+		_, err := os.Stat(filepath.Join(stateMachine.tempDirs.unpack, "gadget", file))
+		if err != nil {
+			t.Errorf("File %s should be in unpack, but is missing", file)
+		}
+	}
+}
+
+// TestPrepareGadgetTreeSnap tests the prepareGadgetTree function with gadget snaps
+func TestPrepareGadgetTreeSnap(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: arch.GetHostArch(),
+		Series:       getHostSuite(),
+		Gadget: &imagedefinition.Gadget{
+			GadgetType: "snap",
+			GadgetURL:  "file://" + filepath.Join("testdata", "pc_20-gadget-edge-cases.snap"),
+		},
+	}
+
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	var unpackedSnap string
+	snapUnpack = func(snapPath string, destDir string) error {
+		unpackedSnap = snapPath
+		return nil
+	}
+	t.Cleanup(func() {
+		snapUnpack = unpackSnap
+	})
+
+	// relative paths are resolved as for prebuilt gadget trees
+	err = stateMachine.prepareGadgetTree()
+	asserter.AssertErrNil(err, true)
+	wd, err := os.Getwd()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(filepath.Join(wd, "testdata", "pc_20-gadget-edge-cases.snap"), unpackedSnap)
+	asserter.AssertEqual(filepath.Join(stateMachine.tempDirs.unpack, "gadget", "meta", "gadget.yaml"), stateMachine.YamlFilePath)
+
+	// gadget snaps without a URL are downloaded from the store
+	stateMachine.ImageDef.Gadget = &imagedefinition.Gadget{
+		GadgetType:    "snap",
+		GadgetName:    "pc",
+		GadgetChannel: "classic-22.04/stable",
+	}
+	downloadSnap = func(name string, channel string, arch string, targetDir string) (string, error) {
+		asserter.AssertEqual("pc", name)
+		asserter.AssertEqual("classic-22.04/stable", channel)
+		return filepath.Join(targetDir, "pc_1.snap"), nil
+	}
+	t.Cleanup(func() {
+		downloadSnap = downloadSnapFromStore
+	})
+	err = stateMachine.prepareGadgetTree()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(filepath.Join(stateMachine.tempDirs.scratch, "pc_1.snap"), unpackedSnap)
+
+	// download failure
+	downloadSnap = func(name string, channel string, arch string, targetDir string) (string, error) {
+		return "", fmt.Errorf("Test error")
+	}
+	err = stateMachine.prepareGadgetTree()
+	asserter.AssertErrContains(err, "Error downloading gadget snap")
+
+	// unpack failure
+	stateMachine.ImageDef.Gadget.GadgetURL = "/tmp/pc.snap"
+	snapUnpack = func(snapPath string, destDir string) error {
+		return fmt.Errorf("Test error")
+	}
+	err = stateMachine.prepareGadgetTree()
+	asserter.AssertErrContains(err, "Error unpacking gadget snap")
+}
+
+// TestGenerateGadgetYaml generates a gadget.yaml from an inline layout
+// and ensures it can be loaded
+func TestGenerateGadgetYaml(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions", "test_layout.yaml")
+
+	imageDef, err := readImageDefinition(stateMachine.Args.ImageDefinition)
+	asserter.AssertErrNil(err, true)
+	stateMachine.ImageDef = *imageDef
+
+	err = stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	err = stateMachine.generateGadgetYaml()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(filepath.Join(stateMachine.tempDirs.unpack, "gadget", "meta", "gadget.yaml"), stateMachine.YamlFilePath)
+
+	err = stateMachine.loadGadgetYaml()
+	asserter.AssertErrNil(err, true)
+
+	volume := stateMachine.GadgetInfo.Volumes["pc"]
+	asserter.AssertEqual("grub", volume.Bootloader)
+	asserter.AssertEqual(4, len(volume.Structure))
+	asserter.AssertEqual("usr/lib/grub/i386-pc/boot.img", volume.Structure[0].Content[0].Image)
+	asserter.AssertEqual("usr/lib/shim/shimx64.efi.signed", volume.Structure[2].Content[0].UnresolvedSource)
+	asserter.AssertEqual("EFI/BOOT/bootx64.efi", volume.Structure[2].Content[0].Target)
+
+	// volumes keep the order they are defined in
+	imageDef, err = readImageDefinition(filepath.Join("testdata", "image_definitions", "test_layout_multi_volume.yaml"))
+	asserter.AssertErrNil(err, true)
+	stateMachine.ImageDef = *imageDef
+	err = stateMachine.generateGadgetYaml()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.loadGadgetYaml()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual([]string{"pc", "data"}, stateMachine.VolumeOrder)
+
+	// mock os.WriteFile
+	osWriteFile = mockWriteFile
+	t.Cleanup(func() {
+		osWriteFile = os.WriteFile
+	})
+	err = stateMachine.generateGadgetYaml()
+	asserter.AssertErrContains(err, "Error writing gadget.yaml")
+	osWriteFile = os.WriteFile
+
+	// mock os.MkdirAll
+	osMkdirAll = mockMkdirAll
+	t.Cleanup(func() {
+		osMkdirAll = os.MkdirAll
+	})
+	err = stateMachine.generateGadgetYaml()
+	asserter.AssertErrContains(err, "Error creating gadget meta directory")
+}
+
+// TestCopyLayoutAssets ensures the content of an inline layout is copied
+// from the rootfs to the gadget directory
+func TestCopyLayoutAssets(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Layout: &imagedefinition.Layout{
+			Volumes: map[string]*imagedefinition.LayoutVolume{
+				"pc": {
+					Structure: []*imagedefinition.LayoutStructure{
+						{
+							Content: []*imagedefinition.LayoutContent{
+								{Image: "/usr/lib/grub/i386-pc/boot.img"},
+							},
+						},
+						{
+							Content: []*imagedefinition.LayoutContent{
+								{Source: "/usr/lib/shim/", Target: "EFI/BOOT/"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	rootfsAssets := []string{
+		filepath.Join("usr", "lib", "grub", "i386-pc", "boot.img"),
+		filepath.Join("usr", "lib", "shim", "shimx64.efi.signed"),
+	}
+	for _, asset := range rootfsAssets {
+		assetPath := filepath.Join(stateMachine.tempDirs.rootfs, asset)
+		err = os.MkdirAll(filepath.Dir(assetPath), 0755)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(assetPath, []byte(asset), 0644)
+		asserter.AssertErrNil(err, true)
+	}
+
+	err = stateMachine.copyLayoutAssets()
+	asserter.AssertErrNil(err, true)
+
+	for _, asset := range rootfsAssets {
+		content, err := os.ReadFile(filepath.Join(stateMachine.tempDirs.unpack, "gadget", asset))
+		asserter.AssertErrNil(err, true)
+		asserter.AssertEqual(asset, string(content))
+	}
+
+	// mock osutil.CopySpecialFile
+	osutilCopySpecialFile = mockCopySpecialFile
+	t.Cleanup(func() {
+		osutilCopySpecialFile = osutil.CopySpecialFile
+	})
+	err = stateMachine.copyLayoutAssets()
+	asserter.AssertErrContains(err, "Error copying layout asset")
+	osutilCopySpecialFile = osutil.CopySpecialFile
+
+	// mock os.MkdirAll
+	osMkdirAll = mockMkdirAll
+	t.Cleanup(func() {
+		osMkdirAll = os.MkdirAll
+	})
+	err = stateMachine.copyLayoutAssets()
+	asserter.AssertErrContains(err, "Error creating layout asset directory")
 }
 
-// TestFailedCalculateStates tests failure scenarios in the
-// calculateStates function
-func TestFailedCalculateStates(t *testing.T) {
+// TestFailedPrepareGadgetTree tests failures in the prepareGadgetTree function
+func TestFailedPrepareGadgetTree(t *testing.T) {
 	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
-
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 	stateMachine.parent = &stateMachine
 	stateMachine.ImageDef = imagedefinition.ImageDefinition{
-		Gadget: &imagedefinition.Gadget{
-			GadgetType: "git",
+		Architecture: arch.GetHostArch(),
+		Series:       getHostSuite(),
+		Gadget:       &imagedefinition.Gadget{},
+	}
+
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	// place a test gadget tree in the  scratch directory so we don't have to build one
+	gadgetDir := filepath.Join(stateMachine.tempDirs.scratch, "gadget")
+	err = os.MkdirAll(gadgetDir, 0755)
+	asserter.AssertErrNil(err, true)
+
+	gadgetSource := filepath.Join("testdata", "gadget_tree")
+	err = osutil.CopySpecialFile(gadgetSource, filepath.Join(gadgetDir, "install"))
+	asserter.AssertErrNil(err, true)
+
+	// mock os.Mkdir
+	osMkdirAll = mockMkdirAll
+	t.Cleanup(func() {
+		osMkdirAll = os.MkdirAll
+	})
+	err = stateMachine.prepareGadgetTree()
+	asserter.AssertErrContains(err, "Error creating unpack directory")
+	osMkdirAll = os.MkdirAll
+
+	// mock os.ReadDir
+	osReadDir = mockReadDir
+	t.Cleanup(func() {
+		osReadDir = os.ReadDir
+	})
+	err = stateMachine.prepareGadgetTree()
+	asserter.AssertErrContains(err, "Error reading gadget tree")
+	osReadDir = os.ReadDir
+
+	// mock osutil.CopySpecialFile
+	osutilCopySpecialFile = mockCopySpecialFile
+	t.Cleanup(func() {
+		osutilCopySpecialFile = osutil.CopySpecialFile
+	})
+	err = stateMachine.prepareGadgetTree()
+	asserter.AssertErrContains(err, "Error copying gadget tree")
+	osutilCopySpecialFile = osutil.CopySpecialFile
+}
+
+// TestVerifyArtifactNames unit tests the verifyArtifactNames function
+func TestVerifyArtifactNames(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name             string
+		gadgetYAML       string
+		artifacts        *imagedefinition.Artifact
+		img              *[]imagedefinition.Img
+		qcow2            *[]imagedefinition.Qcow2
+		expectedVolNames map[string]string
+		shouldPass       bool
+	}{
+		{
+			name:             "no artifact ",
+			gadgetYAML:       "gadget_tree/meta/gadget.yaml",
+			artifacts:        nil,
+			expectedVolNames: nil,
+			shouldPass:       true,
+		},
+		{
+			name:       "single_volume_specified",
+			gadgetYAML: "gadget_tree/meta/gadget.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Img: &[]imagedefinition.Img{
+					{
+						ImgName:   "test1.img",
+						ImgVolume: "pc",
+					},
+				},
+			},
+			expectedVolNames: map[string]string{
+				"pc": "test1.img",
+			},
+			shouldPass: true,
+		},
+		{
+			name:       "single_volume_not_specified",
+			gadgetYAML: "gadget_tree/meta/gadget.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Img: &[]imagedefinition.Img{
+					{
+						ImgName: "test-single.img",
+					},
+				},
+			},
+			expectedVolNames: map[string]string{
+				"pc": "test-single.img",
+			},
+			shouldPass: true,
+		},
+		{
+			name:       "mutli_volume_specified",
+			gadgetYAML: "gadget-multi.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Img: &[]imagedefinition.Img{
+					{
+						ImgName:   "test1.img",
+						ImgVolume: "first",
+					},
+					{
+						ImgName:   "test2.img",
+						ImgVolume: "second",
+					},
+					{
+						ImgName:   "test3.img",
+						ImgVolume: "third",
+					},
+					{
+						ImgName:   "test4.img",
+						ImgVolume: "fourth",
+					},
+				},
+			},
+			expectedVolNames: map[string]string{
+				"first":  "test1.img",
+				"second": "test2.img",
+				"third":  "test3.img",
+				"fourth": "test4.img",
+			},
+			shouldPass: true,
+		},
+		{
+			name:       "mutli_volume_not_specified",
+			gadgetYAML: "gadget-multi.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Img: &[]imagedefinition.Img{
+					{
+						ImgName: "test1.img",
+					},
+					{
+						ImgName: "test2.img",
+					},
+					{
+						ImgName: "test3.img",
+					},
+					{
+						ImgName: "test4.img",
+					},
+				},
+			},
+			expectedVolNames: map[string]string{},
+			shouldPass:       false,
+		},
+		{
+			name:       "mutli_volume_some_specified",
+			gadgetYAML: "gadget-multi.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Img: &[]imagedefinition.Img{
+					{
+						ImgName:   "test1.img",
+						ImgVolume: "first",
+					},
+					{
+						ImgName:   "test2.img",
+						ImgVolume: "second",
+					},
+					{
+						ImgName: "test3.img",
+					},
+					{
+						ImgName: "test4.img",
+					},
+				},
+			},
+			expectedVolNames: map[string]string{},
+			shouldPass:       false,
+		},
+		{
+			name:       "mutli_volume_only_create_some_images",
+			gadgetYAML: "gadget-multi.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Img: &[]imagedefinition.Img{
+					{
+						ImgName:   "test1.img",
+						ImgVolume: "first",
+					},
+					{
+						ImgName:   "test2.img",
+						ImgVolume: "second",
+					},
+				},
+			},
+			expectedVolNames: map[string]string{
+				"first":  "test1.img",
+				"second": "test2.img",
+			},
+			shouldPass: true,
+		},
+		{
+			name:       "qcow2_single_volume_no_img",
+			gadgetYAML: "gadget_tree/meta/gadget.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Qcow2: &[]imagedefinition.Qcow2{
+					{
+						Qcow2Name:   "test1.qcow2",
+						Qcow2Volume: "pc",
+					},
+				},
+			},
+			expectedVolNames: map[string]string{
+				"pc": "test1.qcow2.img",
+			},
+			shouldPass: true,
+		},
+		{
+			name:       "qcow2_single_volume_not_specified_no_img",
+			gadgetYAML: "gadget_tree/meta/gadget.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Qcow2: &[]imagedefinition.Qcow2{
+					{
+						Qcow2Name: "test1.qcow2",
+					},
+				},
+			},
+			expectedVolNames: map[string]string{
+				"pc": "test1.qcow2.img",
+			},
+			shouldPass: true,
 		},
-		Rootfs: &imagedefinition.Rootfs{
-			ArchiveTasks: []string{"test"},
+		{
+			name:       "qcow2_single_volume_yes_img",
+			gadgetYAML: "gadget_tree/meta/gadget.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Img: &[]imagedefinition.Img{
+					{
+						ImgName:   "test1.img",
+						ImgVolume: "pc",
+					},
+				},
+				Qcow2: &[]imagedefinition.Qcow2{
+					{
+						Qcow2Name:   "test1.img",
+						Qcow2Volume: "pc",
+					},
+				},
+			},
+			expectedVolNames: map[string]string{
+				"pc": "test1.img",
+			},
+			shouldPass: true,
 		},
-		Customization: &imagedefinition.Customization{},
-		Artifacts:     &imagedefinition.Artifact{},
-	}
-
-	// mock helper.CheckTags
-	// the gadget must be set to nil for this test to work
-	helperCheckTags = mockCheckTags
-	t.Cleanup(func() {
-		helperCheckTags = helper.CheckTags
-	})
-	err := stateMachine.calculateStates()
-	asserter.AssertErrContains(err, "Test Error")
-}
-
-// TestDisplayStates ensures the states are printed to stdout when the --debug flag is set
-func TestDisplayStates(t *testing.T) {
-	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
-
-	var stateMachine ClassicStateMachine
-	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.parent = &stateMachine
-	stateMachine.commonFlags.Debug = true
-	stateMachine.commonFlags.DiskInfo = "test" // for coverage!
-	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions", "test_raspi.yaml")
-	err := stateMachine.parseImageDefinition()
-	asserter.AssertErrNil(err, true)
+		{
+			name:       "qcow2_mutli_volume_not_specified",
+			gadgetYAML: "gadget-multi.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Qcow2: &[]imagedefinition.Qcow2{
+					{
+						Qcow2Name: "test1.img",
+					},
+					{
+						Qcow2Name: "test2.img",
+					},
+					{
+						Qcow2Name: "test3.img",
+					},
+					{
+						Qcow2Name: "test4.img",
+					},
+				},
+			},
+			expectedVolNames: map[string]string{},
+			shouldPass:       false,
+		},
+		{
+			name:       "qcow2_mutli_volume_no_img",
+			gadgetYAML: "gadget-multi.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Qcow2: &[]imagedefinition.Qcow2{
+					{
+						Qcow2Name:   "test1.qcow2",
+						Qcow2Volume: "first",
+					},
+					{
+						Qcow2Name:   "test2.qcow2",
+						Qcow2Volume: "second",
+					},
+					{
+						Qcow2Name:   "test3.qcow2",
+						Qcow2Volume: "third",
+					},
+					{
+						Qcow2Name:   "test4.qcow2",
+						Qcow2Volume: "fourth",
+					},
+				},
+			},
+			expectedVolNames: map[string]string{
+				"first":  "test1.qcow2.img",
+				"second": "test2.qcow2.img",
+				"third":  "test3.qcow2.img",
+				"fourth": "test4.qcow2.img",
+			},
+			shouldPass: true,
+		},
+		{
+			name:       "qcow2_mutli_volume_yes_img",
+			gadgetYAML: "gadget-multi.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Img: &[]imagedefinition.Img{
+					{
+						ImgName:   "test1.img",
+						ImgVolume: "first",
+					},
+					{
+						ImgName:   "test2.img",
+						ImgVolume: "second",
+					},
+					{
+						ImgName:   "test3.img",
+						ImgVolume: "third",
+					},
+					{
+						ImgName:   "test4.img",
+						ImgVolume: "fourth",
+					},
+				},
+				Qcow2: &[]imagedefinition.Qcow2{
+					{
+						Qcow2Name:   "test1.img",
+						Qcow2Volume: "first",
+					},
+					{
+						Qcow2Name:   "test2.img",
+						Qcow2Volume: "second",
+					},
+					{
+						Qcow2Name:   "test3.img",
+						Qcow2Volume: "third",
+					},
+					{
+						Qcow2Name:   "test4.img",
+						Qcow2Volume: "fourth",
+					},
+				},
+			},
+			expectedVolNames: map[string]string{
+				"first":  "test1.img",
+				"second": "test2.img",
+				"third":  "test3.img",
+				"fourth": "test4.img",
+			},
+			shouldPass: true,
+		},
+		{
+			name:       "qcow2_mutli_volume_img_for_different_volume",
+			gadgetYAML: "gadget-multi.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Img: &[]imagedefinition.Img{
+					{
+						ImgName:   "test1.img",
+						ImgVolume: "first",
+					},
+					{
+						ImgName:   "test2.img",
+						ImgVolume: "second",
+					},
+				},
+				Qcow2: &[]imagedefinition.Qcow2{
+					{
+						Qcow2Name:   "test3.qcow2",
+						Qcow2Volume: "third",
+					},
+					{
+						Qcow2Name:   "test4.qcow2",
+						Qcow2Volume: "fourth",
+					},
+				},
+			},
+			expectedVolNames: map[string]string{
+				"first":  "test1.img",
+				"second": "test2.img",
+				"third":  "test3.qcow2.img",
+				"fourth": "test4.qcow2.img",
+			},
+			shouldPass: true,
+		},
+		{
+			name:       "converted_one_volume_reuse_img",
+			gadgetYAML: "gadget_tree/meta/gadget.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Img: &[]imagedefinition.Img{
+					{
+						ImgName: "test.img",
+					},
+				},
+				Vmdk: &[]imagedefinition.Vmdk{
+					{
+						VmdkName: "test.vmdk",
+					},
+				},
+				Ova: &[]imagedefinition.Ova{
+					{
+						OvaName: "test.ova",
+					},
+				},
+			},
+			expectedVolNames: map[string]string{
+				"pc": "test.img",
+			},
+			shouldPass: true,
+		},
+		{
+			name:       "converted_multi_volume",
+			gadgetYAML: "gadget-multi.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Img: &[]imagedefinition.Img{
+					{
+						ImgName:   "test1.img",
+						ImgVolume: "first",
+					},
+				},
+				Vhd: &[]imagedefinition.Vhd{
+					{
+						VhdName:   "test1.vhd",
+						VhdVolume: "first",
+					},
+					{
+						VhdName:   "test2.vhd",
+						VhdVolume: "second",
+					},
+				},
+				Vhdx: &[]imagedefinition.Vhdx{
+					{
+						VhdxName:   "test2.vhdx",
+						VhdxVolume: "second",
+					},
+				},
+			},
+			expectedVolNames: map[string]string{
+				"first":  "test1.img",
+				"second": "test2.vhd.img",
+			},
+			shouldPass: true,
+		},
+		{
+			name:       "converted_multi_volume_no_volume",
+			gadgetYAML: "gadget-multi.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Vmdk: &[]imagedefinition.Vmdk{
+					{
+						VmdkName: "test.vmdk",
+					},
+				},
+			},
+			expectedVolNames: map[string]string{},
+			shouldPass:       false,
+		},
+		{
+			name:       "iso_multi_volume_no_volume",
+			gadgetYAML: "gadget-multi.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Iso: &imagedefinition.Iso{
+					IsoName: "test.iso",
+				},
+			},
+			expectedVolNames: map[string]string{},
+			shouldPass:       false,
+		},
+		{
+			name:       "iso_multi_volume",
+			gadgetYAML: "gadget-multi.yaml",
+			artifacts: &imagedefinition.Artifact{
+				Iso: &imagedefinition.Iso{
+					IsoName:   "test.iso",
+					IsoVolume: "first",
+				},
+			},
+			expectedVolNames: map[string]string{},
+			shouldPass:       true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			restoreCWD := testhelper.SaveCWD()
+			defer restoreCWD()
 
-	// capture stdout, calculate the states, and ensure they were printed
-	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
-	defer restoreStdout()
-	asserter.AssertErrNil(err, true)
+			var stateMachine ClassicStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
 
-	err = stateMachine.calculateStates()
-	asserter.AssertErrNil(err, true)
+			stateMachine.YamlFilePath = filepath.Join("testdata", tc.gadgetYAML)
+			stateMachine.ImageDef = imagedefinition.ImageDefinition{
+				Architecture: arch.GetHostArch(),
+				Series:       getHostSuite(),
+				Rootfs: &imagedefinition.Rootfs{
+					Archive: "ubuntu",
+				},
+				Customization: &imagedefinition.Customization{},
+				Artifacts:     tc.artifacts,
+			}
 
-	stateMachine.displayStates()
-	asserter.AssertErrNil(err, true)
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-	// restore stdout and examine what was printed
-	restoreStdout()
-	readStdout, err := io.ReadAll(stdout)
-	asserter.AssertErrNil(err, true)
+			// load gadget yaml
+			err = stateMachine.loadGadgetYaml()
+			asserter.AssertErrNil(err, true)
 
-	expectedStates := `Following states will be executed:
-[0] build_gadget_tree
-[1] prepare_gadget_tree
-[2] load_gadget_yaml
-[3] verify_artifact_names
-[4] germinate
-[5] create_chroot
-[6] upgrade_packages
-[7] install_packages
-[8] prepare_image
-[9] preseed_image
-[10] clean_rootfs
-[11] customize_sources_list
-[12] customize_fstab
-[13] perform_manual_customization
-[14] set_default_locale
-[15] populate_rootfs_contents
-[16] generate_disk_info
-[17] calculate_rootfs_size
-[18] populate_bootfs_contents
-[19] populate_prepare_partitions
-[20] make_disk
-[21] setup_bootloader
-[22] generate_package_manifest
-`
-	if !strings.Contains(string(readStdout), expectedStates) {
-		t.Errorf("Expected states to be printed in output:\n\"%s\"\n but got \n\"%s\"\n instead",
-			expectedStates, string(readStdout))
+			// verify artifact names
+			err = stateMachine.verifyArtifactNames()
+			if tc.shouldPass {
+				asserter.AssertErrNil(err, true)
+				if !reflect.DeepEqual(tc.expectedVolNames, stateMachine.VolumeNames) {
+					fmt.Println(tc.expectedVolNames)
+					fmt.Println(stateMachine.VolumeNames)
+					t.Errorf("Expected volume names does not match calculated volume names")
+				}
+			} else {
+				asserter.AssertErrContains(err, "Volume names must be specified for each image")
+			}
+		})
 	}
 }
 
-// TestClassicStateMachine_Setup_Fail_setConfDefDir tests a failure in the Setup() function when setting the configuration definition directory
-func TestClassicStateMachine_Setup_Fail_setConfDefDir(t *testing.T) {
+// TestBuildRootfsFromTasks unit tests the buildRootfsFromTasks function
+func TestBuildRootfsFromTasks(t *testing.T) {
+	t.Parallel()
 	asserter := helper.Asserter{T: t}
 	restoreCWD := testhelper.SaveCWD()
 	defer restoreCWD()
@@ -696,185 +2248,355 @@ func TestClassicStateMachine_Setup_Fail_setConfDefDir(t *testing.T) {
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 
-	tmpDirPath := filepath.Join(testhelper.DefaultTmpDir, "test_failed_set_conf_dir")
-	err := os.Mkdir(tmpDirPath, 0755)
-	t.Cleanup(func() {
-		os.RemoveAll(tmpDirPath)
-	})
-	asserter.AssertErrNil(err, true)
-
-	err = os.Chdir(tmpDirPath)
+	err := stateMachine.buildRootfsFromTasks()
 	asserter.AssertErrNil(err, true)
 
-	_ = os.RemoveAll(tmpDirPath)
-
-	err = stateMachine.Setup()
-	asserter.AssertErrContains(err, "unable to determine the configuration definition directory")
 	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
 }
 
-// TestFailedValidateInputClassic tests a failure in the Setup() function when validating common input
-func TestFailedValidateInputClassic(t *testing.T) {
-	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
-
-	// use both --until and --thru to trigger this failure
-	var stateMachine ClassicStateMachine
-	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.stateMachineFlags.Until = "until-test"
-	stateMachine.stateMachineFlags.Thru = "thru-test"
-
-	err := stateMachine.Setup()
-	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
-	asserter.AssertErrContains(err, "cannot specify both --until and --thru")
-}
+// TestExtractRootfsTar unit tests the extractRootfsTar function
+func TestExtractRootfsTar(t *testing.T) {
+	t.Parallel()
+	wd, _ := os.Getwd() // nolint: errcheck
+	testCases := []struct {
+		name          string
+		rootfsTar     string
+		SHA256sum     string
+		expectedFiles []string
+	}{
+		{
+			name:      "vanilla_tar",
+			rootfsTar: filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar"),
+			SHA256sum: "ec01fd8488b0f35d2ca69e6f82edfaecef5725da70913bab61240419ce574918",
+			expectedFiles: []string{
+				"test_tar1",
+				"test_tar2",
+			},
+		},
+		{
+			name:      "vanilla_tar respecting absolute path",
+			rootfsTar: filepath.Join(wd, "testdata", "rootfs_tarballs", "rootfs.tar"),
+			SHA256sum: "ec01fd8488b0f35d2ca69e6f82edfaecef5725da70913bab61240419ce574918",
+			expectedFiles: []string{
+				"test_tar1",
+				"test_tar2",
+			},
+		},
+		{
+			name:      "vanilla_tar relative path even with dot dot",
+			rootfsTar: filepath.Join("testdata", "../..", filepath.Base(wd), "testdata", "rootfs_tarballs", "rootfs.tar"),
+			SHA256sum: "ec01fd8488b0f35d2ca69e6f82edfaecef5725da70913bab61240419ce574918",
+			expectedFiles: []string{
+				"test_tar1",
+				"test_tar2",
+			},
+		},
+		{
+			name:      "gz",
+			rootfsTar: filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar.gz"),
+			SHA256sum: "29152fd9cadbc92f174815ec642ab3aea98f08f902a4f317ec037f8fe60e40c3",
+			expectedFiles: []string{
+				"test_tar_gz1",
+				"test_tar_gz2",
+			},
+		},
+		{
+			name:      "xz",
+			rootfsTar: filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar.xz"),
+			SHA256sum: "e3708f1d98ccea0e0c36843d9576580505ee36d523bfcf78b0f73a035ae9a14e",
+			expectedFiles: []string{
+				"test_tar_xz1",
+				"test_tar_xz2",
+			},
+		},
+		{
+			name:      "bz2",
+			rootfsTar: filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar.bz2"),
+			SHA256sum: "a1180a73b652d85d7330ef21d433b095363664f2f808363e67f798fae15abf0c",
+			expectedFiles: []string{
+				"test_tar_bz1",
+				"test_tar_bz2",
+			},
+		},
+		{
+			name:      "zst",
+			rootfsTar: filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar.zst"),
+			SHA256sum: "5fb00513f84e28225a3155fd78c59a6a923b222e1c125aab35bbfd4091281829",
+			expectedFiles: []string{
+				"test_tar_zstd1",
+				"test_tar_zstd2",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			restoreCWD := testhelper.SaveCWD()
+			defer restoreCWD()
 
-// TestFailedReadMetadataClassic tests a failed metadata read by passing --resume with no previous partial state machine run
-func TestFailedReadMetadataClassic(t *testing.T) {
-	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
+			var stateMachine ClassicStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.ImageDef = imagedefinition.ImageDefinition{
+				Architecture: arch.GetHostArch(),
+				Series:       getHostSuite(),
+				Rootfs: &imagedefinition.Rootfs{
+					Tarball: &imagedefinition.Tarball{
+						TarballURL: fmt.Sprintf("file://%s", tc.rootfsTar),
+					},
+				},
+			}
 
-	// start a --resume with no previous SM run
-	var stateMachine ClassicStateMachine
-	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.stateMachineFlags.Resume = true
-	stateMachine.stateMachineFlags.WorkDir = testDir
-	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
-		"test_amd64.yaml")
+			err := stateMachine.setConfDefDir(filepath.Join(wd, "image_definition.yaml"))
+			asserter.AssertErrNil(err, true)
 
-	err := stateMachine.Setup()
-	asserter.AssertErrContains(err, "error reading metadata file")
-	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
-}
+			err = stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
 
-// TestClassicStateMachine_Setup_Fail_makeTemporaryDirectories tests the Setup function
-// with makeTemporaryDirectories failing
-func TestClassicStateMachine_Setup_Fail_makeTemporaryDirectories(t *testing.T) {
-	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
+			t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-	var stateMachine ClassicStateMachine
-	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.stateMachineFlags.WorkDir = testDir
-	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
-		"test_amd64.yaml")
+			err = stateMachine.extractRootfsTar()
+			asserter.AssertErrNil(err, true)
 
-	// mock os.MkdirAll
-	osMkdirAll = mockMkdirAll
-	t.Cleanup(func() {
-		osMkdirAll = os.MkdirAll
-	})
-	err := stateMachine.Setup()
-	asserter.AssertErrContains(err, "Error creating work directory")
+			for _, testFile := range tc.expectedFiles {
+				_, err := os.Stat(filepath.Join(stateMachine.tempDirs.chroot, testFile))
+				if err != nil {
+					t.Errorf("File %s should be in chroot, but is missing", testFile)
+				}
+			}
+		})
+	}
 }
 
-// TestClassicStateMachine_Setup_Fail_determineOutputDirectory tests the Setup function
-// with determineOutputDirectory failing
-func TestClassicStateMachine_Setup_Fail_determineOutputDirectory(t *testing.T) {
+// TestFailedExtractRootfsTar tests failures in the extractRootfsTar function
+func TestFailedExtractRootfsTar(t *testing.T) {
 	asserter := helper.Asserter{T: t}
 	restoreCWD := testhelper.SaveCWD()
 	defer restoreCWD()
 
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
-		"test_amd64.yaml")
-	stateMachine.commonFlags.OutputDir = filepath.Join(testhelper.DefaultTmpDir, "test")
+	stateMachine.parent = &stateMachine
+	tarPath := filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar")
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: arch.GetHostArch(),
+		Series:       getHostSuite(),
+		Rootfs: &imagedefinition.Rootfs{
+			Tarball: &imagedefinition.Tarball{
+				TarballURL: fmt.Sprintf("file://%s", tarPath),
+				SHA256sum:  "fail",
+			},
+		},
+	}
 
-	// mock os.MkdirAll
-	osMkdirAll = mockMkdirAll
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+
+	// mock os.Mkdir
+	osMkdir = mockMkdir
 	t.Cleanup(func() {
-		osMkdirAll = os.MkdirAll
+		osMkdir = os.Mkdir
 	})
-	err := stateMachine.Setup()
-	asserter.AssertErrContains(err, "Error creating OutputDir")
+	err = stateMachine.extractRootfsTar()
+	asserter.AssertErrContains(err, "Failed to create chroot directory")
+	osMkdir = os.Mkdir
+
+	// clean up chroot directory
+	os.RemoveAll(stateMachine.tempDirs.chroot)
+
+	// now test with the incorrect SHA256sum
+	err = stateMachine.extractRootfsTar()
+	asserter.AssertErrContains(err, "Calculated SHA256 sum of rootfs tarball")
+
+	// clean up chroot directory
+	os.RemoveAll(stateMachine.tempDirs.chroot)
+
+	// use a tarball that doesn't exist to trigger a failure in computing
+	// the SHA256 sum
+	stateMachine.ImageDef.Rootfs.Tarball.TarballURL = "file:///fakefile"
+	err = stateMachine.extractRootfsTar()
+	asserter.AssertErrContains(err, "Error opening file \"/fakefile\" to calculate SHA256 sum")
+	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
 }
 
-// TestClassicStateMachine_DryRun tests a successful dry-run execution
-func TestClassicStateMachine_DryRun(t *testing.T) {
-	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
+// TestStateMachine_customizeCloudInit unit tests the customizeCloudInit method
+func TestStateMachine_customizeCloudInit(t *testing.T) {
+	testCases := []struct {
+		name                   string
+		cloudInitCustomization imagedefinition.CloudInit
+		wantMetaData           string
+		wantUserData           string
+		wantNetworkConfig      string
+	}{
+		{
+			name: "full cloudinit conf",
+			cloudInitCustomization: imagedefinition.CloudInit{
+				MetaData: `#cloud-config
 
-	workDir := "ubuntu-image-test-dry-run"
-	err := os.Mkdir(workDir, 0755)
-	asserter.AssertErrNil(err, true)
+foo: bar`,
+				UserData: `#cloud-config
 
-	t.Cleanup(func() { os.RemoveAll(workDir) })
+foo: baz`,
+				NetworkConfig: `#cloud-config
 
-	var stateMachine ClassicStateMachine
-	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.parent = &stateMachine
-	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
-		"test_amd64.yaml")
-	stateMachine.stateMachineFlags.WorkDir = workDir
-	stateMachine.commonFlags.DryRun = true
+foobar: foobar`,
+			},
+			wantMetaData: `#cloud-config
 
-	err = stateMachine.Setup()
-	asserter.AssertErrNil(err, true)
+foo: bar`,
+			wantUserData: `#cloud-config
 
-	files, err := osReadDir(workDir)
-	asserter.AssertErrNil(err, true)
+foo: baz`,
+			wantNetworkConfig: `#cloud-config
 
-	if len(files) != 0 {
-		t.Errorf("Some files were created in the workdir but should not. Created files: %s", files)
-	}
+foobar: foobar`,
+		},
+		{
+			name: "empty user data",
+			cloudInitCustomization: imagedefinition.CloudInit{
+				MetaData: `#cloud-config
 
-	err = stateMachine.Run()
-	asserter.AssertErrNil(err, true)
+foo: bar`,
+				UserData: "",
+				NetworkConfig: `#cloud-config
 
-	err = stateMachine.Teardown()
-	asserter.AssertErrNil(err, true)
-}
+foobar: foobar`,
+			},
+			wantMetaData: `#cloud-config
 
-// TestPrepareGadgetTree runs prepareGadgetTree() and ensures the gadget_tree files
-// are placed in the correct locations
-func TestPrepareGadgetTree(t *testing.T) {
-	t.Parallel()
-	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
+foo: bar`,
+			wantUserData: "",
+			wantNetworkConfig: `#cloud-config
 
-	var stateMachine ClassicStateMachine
-	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.parent = &stateMachine
-	stateMachine.ImageDef = imagedefinition.ImageDefinition{
-		Architecture: arch.GetHostArch(),
-		Series:       getHostSuite(),
-		Gadget:       &imagedefinition.Gadget{},
+foobar: foobar`,
+		},
+		{
+			name: "empty metadata",
+			cloudInitCustomization: imagedefinition.CloudInit{
+				UserData: "",
+				NetworkConfig: `#cloud-config
+
+foobar: foobar`,
+			},
+			wantMetaData: "",
+			wantUserData: "",
+			wantNetworkConfig: `#cloud-config
+
+foobar: foobar`,
+		},
+		{
+			name: "multiline user data",
+			cloudInitCustomization: imagedefinition.CloudInit{
+				UserData: `#cloud-config
+
+chpasswd:
+	expire: true
+	users:
+		- name: ubuntu
+		password: ubuntu
+		type: text
+`,
+			},
+			wantMetaData: "",
+			wantUserData: `#cloud-config
+
+chpasswd:
+	expire: true
+	users:
+		- name: ubuntu
+		password: ubuntu
+		type: text
+`,
+			wantNetworkConfig: "",
+		},
 	}
 
-	err := stateMachine.makeTemporaryDirectories()
-	asserter.AssertErrNil(err, true)
-	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	for i, tc := range testCases {
+		t.Run("test_customize_cloud_init_"+tc.name, func(t *testing.T) {
+			// Test setup
+			asserter := helper.Asserter{T: t}
+			restoreCWD := testhelper.SaveCWD()
+			defer restoreCWD()
 
-	// place a test gadget tree in the  scratch directory so we don't have to build one
-	gadgetDir := filepath.Join(stateMachine.tempDirs.scratch, "gadget")
-	err = os.MkdirAll(gadgetDir, 0755)
-	asserter.AssertErrNil(err, true)
+			var stateMachine ClassicStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			tmpDir, err := os.MkdirTemp("", "")
+			asserter.AssertErrNil(err, true)
+			t.Cleanup(func() {
+				if tmpErr := osRemoveAll(tmpDir); tmpErr != nil {
+					if err != nil {
+						err = fmt.Errorf("%s after previous error: %w", tmpErr, err)
+					} else {
+						err = tmpErr
+					}
+				}
+			})
+			stateMachine.tempDirs.chroot = tmpDir
 
-	gadgetSource := filepath.Join("testdata", "gadget_tree")
-	err = osutil.CopySpecialFile(gadgetSource, filepath.Join(gadgetDir, "install"))
-	asserter.AssertErrNil(err, true)
+			// this directory is expected to be present as it is installed by cloud-init
+			err = os.MkdirAll(path.Join(tmpDir, "etc/cloud/cloud.cfg.d"), 0777)
+			asserter.AssertErrNil(err, true)
 
-	err = stateMachine.prepareGadgetTree()
-	asserter.AssertErrNil(err, true)
+			stateMachine.ImageDef.Customization = &imagedefinition.Customization{
+				CloudInit: &testCases[i].cloudInitCustomization,
+			}
+
+			// Running function to test
+			err = stateMachine.customizeCloudInit()
+			asserter.AssertErrNil(err, true)
+
+			// Validation
+			seedPath := path.Join(tmpDir, "var/lib/cloud/seed/nocloud")
+
+			metaDataFile, err := os.Open(path.Join(seedPath, "meta-data"))
+			if tc.cloudInitCustomization.MetaData != "" {
+				asserter.AssertErrNil(err, false)
+
+				metaDataFileContent, err := io.ReadAll(metaDataFile)
+				asserter.AssertErrNil(err, false)
+
+				if string(metaDataFileContent) != tc.wantMetaData {
+					t.Errorf("un-expected meta-data content found: expected:\n%v\ngot:%v", tc.wantMetaData, string(metaDataFileContent))
+				}
+			} else {
+				asserter.AssertErrContains(err, "no such file or directory")
+			}
+
+			networkConfigFile, err := os.Open(path.Join(seedPath, "network-config"))
+			if tc.cloudInitCustomization.NetworkConfig != "" {
+				asserter.AssertErrNil(err, false)
+
+				networkConfigFileContent, err := io.ReadAll(networkConfigFile)
+				asserter.AssertErrNil(err, false)
+				if string(networkConfigFileContent) != tc.wantNetworkConfig {
+					t.Errorf("un-expected network-config found: expected:\n%v\ngot:%v", tc.wantNetworkConfig, string(networkConfigFileContent))
+				}
+			} else {
+				asserter.AssertErrContains(err, "no such file or directory")
+			}
+
+			userDataFile, err := os.Open(path.Join(seedPath, "user-data"))
+			if tc.cloudInitCustomization.UserData != "" {
+				asserter.AssertErrNil(err, false)
+
+				userDataFileContent, err := io.ReadAll(userDataFile)
+				asserter.AssertErrNil(err, false)
 
-	gadgetTreeFiles := []string{"grub.conf", "pc-boot.img", "meta/gadget.yaml"}
-	for _, file := range gadgetTreeFiles {
-		_, err := os.Stat(filepath.Join(stateMachine.tempDirs.unpack, "gadget", file))
-		if err != nil {
-			t.Errorf("File %s should be in unpack, but is missing", file)
-		}
+				if string(userDataFileContent) != tc.wantUserData {
+					t.Errorf("un-expected user-data content found: expected:\n%v\ngot:%v", tc.wantUserData, string(userDataFileContent))
+				}
+			} else {
+				asserter.AssertErrContains(err, "no such file or directory")
+			}
+
+			os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+		})
 	}
 }
 
-// TestPrepareGadgetTreePrebuilt tests the prepareGadgetTree function with prebuilt gadgets
-func TestPrepareGadgetTreePrebuilt(t *testing.T) {
-	t.Parallel()
+// TestStatemachine_customizeCloudInit_failed tests failure modes of customizeCloudInit method
+func TestStatemachine_customizeCloudInit_failed(t *testing.T) {
 	asserter := helper.Asserter{T: t}
 	restoreCWD := testhelper.SaveCWD()
 	defer restoreCWD()
@@ -882,743 +2604,1001 @@ func TestPrepareGadgetTreePrebuilt(t *testing.T) {
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 	stateMachine.parent = &stateMachine
-	stateMachine.ImageDef = imagedefinition.ImageDefinition{
-		Architecture: arch.GetHostArch(),
-		Series:       getHostSuite(),
-		Gadget: &imagedefinition.Gadget{
-			GadgetType: "prebuilt",
-			GadgetURL:  "testdata/gadget_tree/",
-		},
-	}
-
-	err := stateMachine.makeTemporaryDirectories()
+	tmpDir, err := os.MkdirTemp("", "")
 	asserter.AssertErrNil(err, true)
-	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	stateMachine.tempDirs.chroot = tmpDir
 
-	err = stateMachine.prepareGadgetTree()
-	asserter.AssertErrNil(err, true)
+	stateMachine.ImageDef.Customization = &imagedefinition.Customization{
+		CloudInit: &imagedefinition.CloudInit{
+			MetaData:      `foo: bar`,
+			NetworkConfig: `foobar: foobar`,
+			UserData: `#cloud-config
 
-	gadgetTreeFiles := []string{"grub.conf", "pc-boot.img", "meta/gadget.yaml"}
-	for _, file := range gadgetTreeFiles {
-		_, err := os.Stat(filepath.Join(stateMachine.tempDirs.unpack, "gadget", file))
-		if err != nil {
-			t.Errorf("File %s should be in unpack, but is missing", file)
-		}
+chpasswd:
+  expire: true
+  users:
+    - name: ubuntu
+      password: ubuntu
+      type: text
+`,
+		},
 	}
-}
 
-// TestFailedPrepareGadgetTree tests failures in the prepareGadgetTree function
-func TestFailedPrepareGadgetTree(t *testing.T) {
-	asserter := helper.Asserter{T: t}
-	var stateMachine ClassicStateMachine
-	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.parent = &stateMachine
-	stateMachine.ImageDef = imagedefinition.ImageDefinition{
-		Architecture: arch.GetHostArch(),
-		Series:       getHostSuite(),
-		Gadget:       &imagedefinition.Gadget{},
+	// Test if osCreate fails
+	fileList := []string{"meta-data", "user-data", "network-config", "90_dpkg.cfg"}
+	for _, file := range fileList {
+		t.Run("test_failed_customize_cloud_init_"+file, func(t *testing.T) {
+			// this directory is expected to be present as it is installed by cloud-init
+			cloudInitConfigDirPath := path.Join(tmpDir, "etc/cloud/cloud.cfg.d")
+			err = os.MkdirAll(cloudInitConfigDirPath, 0777)
+			asserter.AssertErrNil(err, true)
+			t.Cleanup(func() {
+				os.RemoveAll(cloudInitConfigDirPath)
+			})
+
+			osCreate = func(name string) (*os.File, error) {
+				if strings.Contains(name, file) {
+					return nil, errors.New("test error: failed to create file")
+				}
+				return os.Create(name) //nolint:gosec
+			}
+
+			err := stateMachine.customizeCloudInit()
+			asserter.AssertErrContains(err, "test error: failed to create file")
+		})
 	}
 
-	err := stateMachine.makeTemporaryDirectories()
-	asserter.AssertErrNil(err, true)
+	// Test if Write fails (file is read only)
+	for _, file := range fileList {
+		t.Run("test_failed_customize_cloud_init_"+file, func(t *testing.T) {
+			// this directory is expected to be present as it is installed by cloud-init
+			cloudInitConfigDirPath := path.Join(tmpDir, "etc/cloud/cloud.cfg.d")
+			err = os.MkdirAll(cloudInitConfigDirPath, 0777)
+			asserter.AssertErrNil(err, true)
+			t.Cleanup(func() {
+				os.RemoveAll(cloudInitConfigDirPath)
+			})
 
-	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+			osCreate = func(name string) (*os.File, error) {
+				if strings.Contains(name, file) {
+					fileReadWrite, err := os.Create(name) //nolint:gosec
+					asserter.AssertErrNil(err, true)
+					fileReadWrite.Close() //nolint:gosec
+					return os.Open(name)  //nolint:gosec
+				}
+				return os.Create(name) //nolint:gosec
+			}
 
-	// place a test gadget tree in the  scratch directory so we don't have to build one
-	gadgetDir := filepath.Join(stateMachine.tempDirs.scratch, "gadget")
-	err = os.MkdirAll(gadgetDir, 0755)
-	asserter.AssertErrNil(err, true)
+			err := stateMachine.customizeCloudInit()
+			if err == nil {
+				t.Errorf("expected error but got nil")
+			}
+		})
+	}
 
-	gadgetSource := filepath.Join("testdata", "gadget_tree")
-	err = osutil.CopySpecialFile(gadgetSource, filepath.Join(gadgetDir, "install"))
-	asserter.AssertErrNil(err, true)
+	// Test if os.MkdirAll fails
+	t.Run("test_failed_customize_cloud_init_mkdir", func(t *testing.T) {
+		// this directory is expected to be present as it is installed by cloud-init
+		cloudInitConfigDirPath := path.Join(tmpDir, "etc/cloud/cloud.cfg.d")
+		err = os.MkdirAll(cloudInitConfigDirPath, 0777)
+		asserter.AssertErrNil(err, true)
+		t.Cleanup(func() {
+			os.RemoveAll(cloudInitConfigDirPath)
+		})
 
-	// mock os.Mkdir
-	osMkdirAll = mockMkdirAll
-	t.Cleanup(func() {
-		osMkdirAll = os.MkdirAll
-	})
-	err = stateMachine.prepareGadgetTree()
-	asserter.AssertErrContains(err, "Error creating unpack directory")
-	osMkdirAll = os.MkdirAll
+		osMkdirAll = mockMkdirAll
+		t.Cleanup(func() {
+			osMkdirAll = os.MkdirAll
+		})
 
-	// mock os.ReadDir
-	osReadDir = mockReadDir
-	t.Cleanup(func() {
-		osReadDir = os.ReadDir
+		err := stateMachine.customizeCloudInit()
+		if err == nil {
+			t.Error()
+		}
 	})
-	err = stateMachine.prepareGadgetTree()
-	asserter.AssertErrContains(err, "Error reading gadget tree")
-	osReadDir = os.ReadDir
 
-	// mock osutil.CopySpecialFile
-	osutilCopySpecialFile = mockCopySpecialFile
-	t.Cleanup(func() {
-		osutilCopySpecialFile = osutil.CopySpecialFile
-	})
-	err = stateMachine.prepareGadgetTree()
-	asserter.AssertErrContains(err, "Error copying gadget tree")
-	osutilCopySpecialFile = osutil.CopySpecialFile
-}
+	// Test if yaml.Marshal fails
+	t.Run("test_failed_customize_cloud_init_yaml_marshal", func(t *testing.T) {
+		// this directory is expected to be present as it is installed by cloud-init
+		cloudInitConfigDirPath := path.Join(tmpDir, "etc/cloud/cloud.cfg.d")
+		err = os.MkdirAll(cloudInitConfigDirPath, 0777)
+		asserter.AssertErrNil(err, true)
+		t.Cleanup(func() {
+			os.RemoveAll(cloudInitConfigDirPath)
+		})
 
-// TestVerifyArtifactNames unit tests the verifyArtifactNames function
-func TestVerifyArtifactNames(t *testing.T) {
-	t.Parallel()
-	testCases := []struct {
-		name             string
-		gadgetYAML       string
-		artifacts        *imagedefinition.Artifact
-		img              *[]imagedefinition.Img
-		qcow2            *[]imagedefinition.Qcow2
-		expectedVolNames map[string]string
-		shouldPass       bool
-	}{
-		{
-			name:             "no artifact ",
-			gadgetYAML:       "gadget_tree/meta/gadget.yaml",
-			artifacts:        nil,
-			expectedVolNames: nil,
-			shouldPass:       true,
-		},
-		{
-			name:       "single_volume_specified",
-			gadgetYAML: "gadget_tree/meta/gadget.yaml",
-			artifacts: &imagedefinition.Artifact{
-				Img: &[]imagedefinition.Img{
-					{
-						ImgName:   "test1.img",
-						ImgVolume: "pc",
-					},
-				},
-			},
-			expectedVolNames: map[string]string{
-				"pc": "test1.img",
-			},
-			shouldPass: true,
-		},
-		{
-			name:       "single_volume_not_specified",
-			gadgetYAML: "gadget_tree/meta/gadget.yaml",
-			artifacts: &imagedefinition.Artifact{
-				Img: &[]imagedefinition.Img{
-					{
-						ImgName: "test-single.img",
-					},
-				},
-			},
-			expectedVolNames: map[string]string{
-				"pc": "test-single.img",
-			},
-			shouldPass: true,
-		},
-		{
-			name:       "mutli_volume_specified",
-			gadgetYAML: "gadget-multi.yaml",
-			artifacts: &imagedefinition.Artifact{
-				Img: &[]imagedefinition.Img{
-					{
-						ImgName:   "test1.img",
-						ImgVolume: "first",
-					},
-					{
-						ImgName:   "test2.img",
-						ImgVolume: "second",
-					},
-					{
-						ImgName:   "test3.img",
-						ImgVolume: "third",
-					},
-					{
-						ImgName:   "test4.img",
-						ImgVolume: "fourth",
-					},
-				},
-			},
-			expectedVolNames: map[string]string{
-				"first":  "test1.img",
-				"second": "test2.img",
-				"third":  "test3.img",
-				"fourth": "test4.img",
-			},
-			shouldPass: true,
-		},
+		yamlMarshal = mockMarshal
+		defer func() {
+			yamlMarshal = yaml.Marshal
+		}()
+
+		err := stateMachine.customizeCloudInit()
+		if err == nil {
+			t.Error()
+		}
+	})
+
+	// Test cloud-init customization is invalid
+	testCases := []struct {
+		name                   string
+		cloudInitCustomization imagedefinition.CloudInit
+	}{
 		{
-			name:       "mutli_volume_not_specified",
-			gadgetYAML: "gadget-multi.yaml",
-			artifacts: &imagedefinition.Artifact{
-				Img: &[]imagedefinition.Img{
-					{
-						ImgName: "test1.img",
-					},
-					{
-						ImgName: "test2.img",
-					},
-					{
-						ImgName: "test3.img",
-					},
-					{
-						ImgName: "test4.img",
-					},
-				},
+			name: "invalid userdata",
+			cloudInitCustomization: imagedefinition.CloudInit{
+				UserData: "foo: bar",
 			},
-			expectedVolNames: map[string]string{},
-			shouldPass:       false,
 		},
-		{
-			name:       "mutli_volume_some_specified",
-			gadgetYAML: "gadget-multi.yaml",
-			artifacts: &imagedefinition.Artifact{
-				Img: &[]imagedefinition.Img{
+	}
+
+	for i, tc := range testCases {
+		t.Run("test_failed_customize_cloud_init_invalid_config_"+tc.name, func(t *testing.T) {
+			// this directory is expected to be present as it is installed by cloud-init
+			cloudInitConfigDirPath := path.Join(tmpDir, "etc/cloud/cloud.cfg.d")
+			err = os.MkdirAll(cloudInitConfigDirPath, 0777)
+			asserter.AssertErrNil(err, true)
+			t.Cleanup(func() {
+				os.RemoveAll(cloudInitConfigDirPath)
+			})
+
+			stateMachine.ImageDef.Customization.CloudInit = &testCases[i].cloudInitCustomization
+
+			err := stateMachine.customizeCloudInit()
+			asserter.AssertErrContains(err, "is missing proper header")
+		})
+	}
+}
+
+// TestStateMachine_manualCustomization unit tests the manualCustomization function
+func TestStateMachine_manualCustomization(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: arch.GetHostArch(),
+		Series:       getHostSuite(),
+		Rootfs: &imagedefinition.Rootfs{
+			Archive: "ubuntu",
+		},
+		Customization: &imagedefinition.Customization{
+			Manual: &imagedefinition.Manual{
+				MakeDirs: []*imagedefinition.MakeDirs{
 					{
-						ImgName:   "test1.img",
-						ImgVolume: "first",
+						Path:        "/etc/foo/bar",
+						Permissions: 0755,
 					},
 					{
-						ImgName:   "test2.img",
-						ImgVolume: "second",
+						Path:        "/etc/baz/test",
+						Permissions: 0644,
 					},
+				},
+				CopyFile: []*imagedefinition.CopyFile{
 					{
-						ImgName: "test3.img",
+						Source: filepath.Join("testdata", "test_script"),
+						Dest:   "/test_copy_file",
 					},
+				},
+				TouchFile: []*imagedefinition.TouchFile{
 					{
-						ImgName: "test4.img",
+						TouchPath: "/test_touch_file",
 					},
 				},
-			},
-			expectedVolNames: map[string]string{},
-			shouldPass:       false,
-		},
-		{
-			name:       "mutli_volume_only_create_some_images",
-			gadgetYAML: "gadget-multi.yaml",
-			artifacts: &imagedefinition.Artifact{
-				Img: &[]imagedefinition.Img{
+				Execute: []*imagedefinition.Execute{
 					{
-						ImgName:   "test1.img",
-						ImgVolume: "first",
+						// the file we already copied creates a file /test_execute
+						ExecutePath: "/test_copy_file",
 					},
+				},
+				AddUser: []*imagedefinition.AddUser{
 					{
-						ImgName:   "test2.img",
-						ImgVolume: "second",
+						UserName: "testuser",
+						UserID:   "123456",
 					},
 				},
-			},
-			expectedVolNames: map[string]string{
-				"first":  "test1.img",
-				"second": "test2.img",
-			},
-			shouldPass: true,
-		},
-		{
-			name:       "qcow2_single_volume_no_img",
-			gadgetYAML: "gadget_tree/meta/gadget.yaml",
-			artifacts: &imagedefinition.Artifact{
-				Qcow2: &[]imagedefinition.Qcow2{
+				AddGroup: []*imagedefinition.AddGroup{
 					{
-						Qcow2Name:   "test1.qcow2",
-						Qcow2Volume: "pc",
+						GroupName: "testgroup",
+						GroupID:   "456789",
 					},
 				},
 			},
-			expectedVolNames: map[string]string{
-				"pc": "test1.qcow2.img",
-			},
-			shouldPass: true,
 		},
+	}
+
+	d, err := os.Getwd()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.setConfDefDir(filepath.Join(d, "image_definition.yaml"))
+	asserter.AssertErrNil(err, true)
+
+	err = stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	err = getBasicChroot(stateMachine.StateMachine)
+	asserter.AssertErrNil(err, true)
+
+	err = stateMachine.manualCustomization()
+	asserter.AssertErrNil(err, true)
+
+	// Check that the correct directories exist
+	testDirectories := []string{"/etc/foo/bar", "/etc/baz/test"}
+	for _, dirName := range testDirectories {
+		_, err := os.Stat(filepath.Join(stateMachine.tempDirs.chroot, dirName))
+		if err != nil {
+			t.Errorf("directory %s should exist, but it does not", dirName)
+		}
+	}
+
+	// Check that the correct files exist
+	testFiles := []string{"test_copy_file", "test_touch_file", "test_execute"}
+	for _, fileName := range testFiles {
+		_, err := os.Stat(filepath.Join(stateMachine.tempDirs.chroot, fileName))
+		if err != nil {
+			t.Errorf("file %s should exist, but it does not", fileName)
+		}
+	}
+
+	// Check that the test user exists with the correct uid
+	passwdFile := filepath.Join(stateMachine.tempDirs.chroot, "etc", "passwd")
+	passwdContents, err := os.ReadFile(passwdFile)
+	asserter.AssertErrNil(err, true)
+	if !strings.Contains(string(passwdContents), "testuser:x:123456") {
+		t.Errorf("Test user was not created in the chroot")
+	}
+
+	// Check that the test group exists with the correct gid
+	groupFile := filepath.Join(stateMachine.tempDirs.chroot, "etc", "group")
+	groupContents, err := os.ReadFile(groupFile)
+	asserter.AssertErrNil(err, true)
+	if !strings.Contains(string(groupContents), "testgroup:x:456789") {
+		t.Errorf("Test group was not created in the chroot")
+	}
+}
+
+// TestStateMachine_manualCustomization_fail tests failures in the manualCustomization function
+func TestStateMachine_manualCustomization_fail(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+
+	t.Run("test_failed_manual_customization", func(t *testing.T) {
+		asserter := helper.Asserter{T: t}
+		restoreCWD := testhelper.SaveCWD()
+		t.Cleanup(restoreCWD)
+
+		var stateMachine ClassicStateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		stateMachine.parent = &stateMachine
+
+		err := stateMachine.makeTemporaryDirectories()
+		asserter.AssertErrNil(err, true)
+
+		// mock helper.BackupAndCopyResolvConf
+		helperBackupAndCopyResolvConf = mockBackupAndCopyResolvConfFail
+		t.Cleanup(func() {
+			helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
+		})
+		err = stateMachine.manualCustomization()
+		asserter.AssertErrContains(err, "Error setting up /etc/resolv.conf")
+	})
+
+	tests := []struct {
+		name                 string
+		expectedErr          string
+		manualCustomizations *imagedefinition.Manual
+	}{
 		{
-			name:       "qcow2_single_volume_not_specified_no_img",
-			gadgetYAML: "gadget_tree/meta/gadget.yaml",
-			artifacts: &imagedefinition.Artifact{
-				Qcow2: &[]imagedefinition.Qcow2{
+			name:        "failing manualMakeDirs",
+			expectedErr: "not a directory",
+			manualCustomizations: &imagedefinition.Manual{
+				MakeDirs: []*imagedefinition.MakeDirs{
 					{
-						Qcow2Name: "test1.qcow2",
+						Path:        filepath.Join("/etc", "resolv.conf"),
+						Permissions: 0755,
 					},
 				},
 			},
-			expectedVolNames: map[string]string{
-				"pc": "test1.qcow2.img",
-			},
-			shouldPass: true,
 		},
 		{
-			name:       "qcow2_single_volume_yes_img",
-			gadgetYAML: "gadget_tree/meta/gadget.yaml",
-			artifacts: &imagedefinition.Artifact{
-				Img: &[]imagedefinition.Img{
-					{
-						ImgName:   "test1.img",
-						ImgVolume: "pc",
-					},
-				},
-				Qcow2: &[]imagedefinition.Qcow2{
+			name:        "failing manualCopyFile",
+			expectedErr: "cp: cannot stat 'this/path/does/not/exist'",
+			manualCustomizations: &imagedefinition.Manual{
+				CopyFile: []*imagedefinition.CopyFile{
 					{
-						Qcow2Name:   "test1.img",
-						Qcow2Volume: "pc",
+						Source: filepath.Join("this", "path", "does", "not", "exist"),
+						Dest:   filepath.Join("this", "path", "does", "not", "exist"),
 					},
 				},
 			},
-			expectedVolNames: map[string]string{
-				"pc": "test1.img",
-			},
-			shouldPass: true,
 		},
 		{
-			name:       "qcow2_mutli_volume_not_specified",
-			gadgetYAML: "gadget-multi.yaml",
-			artifacts: &imagedefinition.Artifact{
-				Qcow2: &[]imagedefinition.Qcow2{
-					{
-						Qcow2Name: "test1.img",
-					},
-					{
-						Qcow2Name: "test2.img",
-					},
-					{
-						Qcow2Name: "test3.img",
-					},
+			name:        "failing manualExecute",
+			expectedErr: "chroot: failed to run command",
+			manualCustomizations: &imagedefinition.Manual{
+				Execute: []*imagedefinition.Execute{
 					{
-						Qcow2Name: "test4.img",
+						ExecutePath: filepath.Join("this", "path", "does", "not", "exist"),
 					},
 				},
 			},
-			expectedVolNames: map[string]string{},
-			shouldPass:       false,
 		},
 		{
-			name:       "qcow2_mutli_volume_no_img",
-			gadgetYAML: "gadget-multi.yaml",
-			artifacts: &imagedefinition.Artifact{
-				Qcow2: &[]imagedefinition.Qcow2{
-					{
-						Qcow2Name:   "test1.qcow2",
-						Qcow2Volume: "first",
-					},
-					{
-						Qcow2Name:   "test2.qcow2",
-						Qcow2Volume: "second",
-					},
-					{
-						Qcow2Name:   "test3.qcow2",
-						Qcow2Volume: "third",
-					},
+			name:        "failing manualTouchFile",
+			expectedErr: "no such file or directory",
+			manualCustomizations: &imagedefinition.Manual{
+				TouchFile: []*imagedefinition.TouchFile{
 					{
-						Qcow2Name:   "test4.qcow2",
-						Qcow2Volume: "fourth",
+						TouchPath: filepath.Join("this", "path", "does", "not", "exist"),
 					},
 				},
 			},
-			expectedVolNames: map[string]string{
-				"first":  "test1.qcow2.img",
-				"second": "test2.qcow2.img",
-				"third":  "test3.qcow2.img",
-				"fourth": "test4.qcow2.img",
-			},
-			shouldPass: true,
 		},
 		{
-			name:       "qcow2_mutli_volume_yes_img",
-			gadgetYAML: "gadget-multi.yaml",
-			artifacts: &imagedefinition.Artifact{
-				Img: &[]imagedefinition.Img{
-					{
-						ImgName:   "test1.img",
-						ImgVolume: "first",
-					},
-					{
-						ImgName:   "test2.img",
-						ImgVolume: "second",
-					},
-					{
-						ImgName:   "test3.img",
-						ImgVolume: "third",
-					},
+			name:        "failing manualAddGroup",
+			expectedErr: "group 'root' already exists",
+			manualCustomizations: &imagedefinition.Manual{
+				AddGroup: []*imagedefinition.AddGroup{
 					{
-						ImgName:   "test4.img",
-						ImgVolume: "fourth",
+						GroupName: "root",
+						GroupID:   "0",
 					},
 				},
-				Qcow2: &[]imagedefinition.Qcow2{
-					{
-						Qcow2Name:   "test1.img",
-						Qcow2Volume: "first",
-					},
-					{
-						Qcow2Name:   "test2.img",
-						Qcow2Volume: "second",
-					},
-					{
-						Qcow2Name:   "test3.img",
-						Qcow2Volume: "third",
-					},
+			},
+		},
+		{
+			name:        "failing manualAddUser",
+			expectedErr: "user 'root' already exists",
+			manualCustomizations: &imagedefinition.Manual{
+				AddUser: []*imagedefinition.AddUser{
 					{
-						Qcow2Name:   "test4.img",
-						Qcow2Volume: "fourth",
+						UserName: "root",
+						UserID:   "0",
 					},
 				},
 			},
-			expectedVolNames: map[string]string{
-				"first":  "test1.img",
-				"second": "test2.img",
-				"third":  "test3.img",
-				"fourth": "test4.img",
+		},
+	}
+	asserter := helper.Asserter{T: t}
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: arch.GetHostArch(),
+		Series:       getHostSuite(),
+		Rootfs: &imagedefinition.Rootfs{
+			Archive: "ubuntu",
+		},
+	}
+
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	err = getBasicChroot(stateMachine.StateMachine)
+	asserter.AssertErrNil(err, true)
+
+	// create an /etc/resolv.conf in the chroot
+	err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.chroot, "etc"), 0755)
+	asserter.AssertErrNil(err, true)
+	_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "etc", "resolv.conf"))
+	asserter.AssertErrNil(err, true)
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			restoreCWD := testhelper.SaveCWD()
+			t.Cleanup(restoreCWD)
+
+			stateMachine.ImageDef.Customization = &imagedefinition.Customization{
+				Manual: tc.manualCustomizations,
+			}
+
+			err = stateMachine.manualCustomization()
+
+			if len(tc.expectedErr) == 0 {
+				asserter.AssertErrNil(err, true)
+			} else {
+				asserter.AssertErrContains(err, tc.expectedErr)
+			}
+		})
+	}
+}
+
+// TestPrepareClassicImage unit tests the prepareClassicImage function
+func TestPrepareClassicImage(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.Snaps = []string{"core20"}
+	stateMachine.commonFlags.Channel = "stable"
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: arch.GetHostArch(),
+		Customization: &imagedefinition.Customization{
+			ExtraSnaps: []*imagedefinition.Snap{
+				{
+					SnapName: "hello",
+					Channel:  "candidate",
+				},
+				{
+					SnapName: "lxd",
+					Channel:  "latest/stable",
+				},
+				{
+					SnapName: "core24",
+				},
+				{
+					SnapName: "core22",
+				},
 			},
-			shouldPass: true,
 		},
-		{
-			name:       "qcow2_mutli_volume_img_for_different_volume",
-			gadgetYAML: "gadget-multi.yaml",
-			artifacts: &imagedefinition.Artifact{
-				Img: &[]imagedefinition.Img{
-					{
-						ImgName:   "test1.img",
-						ImgVolume: "first",
-					},
-					{
-						ImgName:   "test2.img",
-						ImgVolume: "second",
-					},
+	}
+
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	err = stateMachine.prepareClassicImage()
+	asserter.AssertErrNil(err, true)
+
+	// check that the lxd and hello snaps, as well as lxd's base, core20
+	// were prepared in the correct location
+	snaps := map[string]string{"lxd": "stable", "hello": "candidate", "core20": "stable", "core22": "stable", "core24": "stable"}
+	for snapName, snapChannel := range snaps {
+		// reach out to the snap store to find the revision
+		// of the snap for the specified channel
+		snapStore := store.New(nil, nil)
+		snapSpec := store.SnapSpec{Name: snapName}
+		context := context.TODO()
+		snapInfo, err := snapStore.SnapInfo(context, snapSpec, nil)
+		asserter.AssertErrNil(err, true)
+
+		storeRevision := snapInfo.Channels["latest/"+snapChannel].Revision.N
+		snapFileName := fmt.Sprintf("%s_%d.snap", snapName, storeRevision)
+
+		snapPath := filepath.Join(stateMachine.tempDirs.chroot,
+			"var", "lib", "snapd", "seed", "snaps", snapFileName)
+		_, err = os.Stat(snapPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				t.Errorf("File %s should exist, but does not", snapPath)
+			}
+		}
+	}
+}
+
+// TestClassicSnapRevisions tests that if revisions are specified in the image definition
+// that the corresponding revisions are staged in the chroot
+func TestClassicSnapRevisions(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	if runtime.GOARCH != "amd64" {
+		t.Skip("Test for amd64 only")
+	}
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.Snaps = []string{"lxd"}
+	stateMachine.commonFlags.Channel = "stable"
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: arch.GetHostArch(),
+		Customization: &imagedefinition.Customization{
+			ExtraSnaps: []*imagedefinition.Snap{
+				{
+					SnapName:     "hello",
+					SnapRevision: 38,
 				},
-				Qcow2: &[]imagedefinition.Qcow2{
-					{
-						Qcow2Name:   "test3.qcow2",
-						Qcow2Volume: "third",
-					},
-					{
-						Qcow2Name:   "test4.qcow2",
-						Qcow2Volume: "fourth",
-					},
+				{
+					SnapName:     "ubuntu-image",
+					SnapRevision: 330,
+				},
+				{
+					SnapName:     "core20",
+					SnapRevision: 1852,
 				},
 			},
-			expectedVolNames: map[string]string{
-				"first":  "test1.img",
-				"second": "test2.img",
-				"third":  "test3.qcow2.img",
-				"fourth": "test4.qcow2.img",
-			},
-			shouldPass: true,
 		},
 	}
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			asserter := helper.Asserter{T: t}
-			restoreCWD := testhelper.SaveCWD()
-			defer restoreCWD()
 
-			var stateMachine ClassicStateMachine
-			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-			stateMachine.parent = &stateMachine
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
 
-			stateMachine.YamlFilePath = filepath.Join("testdata", tc.gadgetYAML)
-			stateMachine.ImageDef = imagedefinition.ImageDefinition{
-				Architecture: arch.GetHostArch(),
-				Series:       getHostSuite(),
-				Rootfs: &imagedefinition.Rootfs{
-					Archive: "ubuntu",
-				},
-				Customization: &imagedefinition.Customization{},
-				Artifacts:     tc.artifacts,
-			}
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-			err := stateMachine.makeTemporaryDirectories()
-			asserter.AssertErrNil(err, true)
-			t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	err = stateMachine.prepareClassicImage()
+	asserter.AssertErrNil(err, true)
 
-			// load gadget yaml
-			err = stateMachine.loadGadgetYaml()
-			asserter.AssertErrNil(err, true)
+	for _, snapInfo := range stateMachine.ImageDef.Customization.ExtraSnaps {
+		// compile a regex used to get revision numbers from seed.manifest
+		revRegex, err := regexp.Compile(fmt.Sprintf("%s_(.*?).snap\n", snapInfo.SnapName))
+		asserter.AssertErrNil(err, true)
+		seedData, err := os.ReadFile(filepath.Join(
+			stateMachine.tempDirs.chroot,
+			"var",
+			"lib",
+			"snapd",
+			"seed",
+			"seed.yaml",
+		))
+		asserter.AssertErrNil(err, true)
+		revString := revRegex.FindStringSubmatch(string(seedData))
+		if len(revString) != 2 {
+			t.Fatal("Error finding snap revision via regex")
+		}
+		seededRevision, err := strconv.Atoi(revString[1])
+		asserter.AssertErrNil(err, true)
 
-			// verify artifact names
-			err = stateMachine.verifyArtifactNames()
-			if tc.shouldPass {
-				asserter.AssertErrNil(err, true)
-				if !reflect.DeepEqual(tc.expectedVolNames, stateMachine.VolumeNames) {
-					fmt.Println(tc.expectedVolNames)
-					fmt.Println(stateMachine.VolumeNames)
-					t.Errorf("Expected volume names does not match calculated volume names")
-				}
-			} else {
-				asserter.AssertErrContains(err, "Volume names must be specified for each image")
-			}
-		})
+		if seededRevision != snapInfo.SnapRevision {
+			t.Errorf("Error, expected snap %s to "+
+				"be revision %d, but it was %d",
+				snapInfo.SnapName, snapInfo.SnapRevision, seededRevision)
+		}
 	}
 }
 
-// TestBuildRootfsFromTasks unit tests the buildRootfsFromTasks function
-func TestBuildRootfsFromTasks(t *testing.T) {
-	t.Parallel()
+// TestFailedPrepareClassicImage tests failures in the prepareClassicImage function
+func TestFailedPrepareClassicImage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
 	asserter := helper.Asserter{T: t}
 	restoreCWD := testhelper.SaveCWD()
 	defer restoreCWD()
 
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: arch.GetHostArch(),
+		Customization: &imagedefinition.Customization{
+			ExtraSnaps: []*imagedefinition.Snap{},
+		},
+	}
 
-	err := stateMachine.buildRootfsFromTasks()
+	err := stateMachine.makeTemporaryDirectories()
 	asserter.AssertErrNil(err, true)
 
-	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
-}
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-// TestExtractRootfsTar unit tests the extractRootfsTar function
-func TestExtractRootfsTar(t *testing.T) {
-	t.Parallel()
-	wd, _ := os.Getwd() // nolint: errcheck
-	testCases := []struct {
-		name          string
-		rootfsTar     string
-		SHA256sum     string
-		expectedFiles []string
-	}{
-		{
-			name:      "vanilla_tar",
-			rootfsTar: filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar"),
-			SHA256sum: "ec01fd8488b0f35d2ca69e6f82edfaecef5725da70913bab61240419ce574918",
-			expectedFiles: []string{
-				"test_tar1",
-				"test_tar2",
-			},
-		},
-		{
-			name:      "vanilla_tar respecting absolute path",
-			rootfsTar: filepath.Join(wd, "testdata", "rootfs_tarballs", "rootfs.tar"),
-			SHA256sum: "ec01fd8488b0f35d2ca69e6f82edfaecef5725da70913bab61240419ce574918",
-			expectedFiles: []string{
-				"test_tar1",
-				"test_tar2",
-			},
-		},
-		{
-			name:      "vanilla_tar relative path even with dot dot",
-			rootfsTar: filepath.Join("testdata", "../..", filepath.Base(wd), "testdata", "rootfs_tarballs", "rootfs.tar"),
-			SHA256sum: "ec01fd8488b0f35d2ca69e6f82edfaecef5725da70913bab61240419ce574918",
-			expectedFiles: []string{
-				"test_tar1",
-				"test_tar2",
-			},
-		},
-		{
-			name:      "gz",
-			rootfsTar: filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar.gz"),
-			SHA256sum: "29152fd9cadbc92f174815ec642ab3aea98f08f902a4f317ec037f8fe60e40c3",
-			expectedFiles: []string{
-				"test_tar_gz1",
-				"test_tar_gz2",
-			},
-		},
-		{
-			name:      "xz",
-			rootfsTar: filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar.xz"),
-			SHA256sum: "e3708f1d98ccea0e0c36843d9576580505ee36d523bfcf78b0f73a035ae9a14e",
-			expectedFiles: []string{
-				"test_tar_xz1",
-				"test_tar_xz2",
-			},
-		},
-		{
-			name:      "bz2",
-			rootfsTar: filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar.bz2"),
-			SHA256sum: "a1180a73b652d85d7330ef21d433b095363664f2f808363e67f798fae15abf0c",
-			expectedFiles: []string{
-				"test_tar_bz1",
-				"test_tar_bz2",
-			},
-		},
-		{
-			name:      "zst",
-			rootfsTar: filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar.zst"),
-			SHA256sum: "5fb00513f84e28225a3155fd78c59a6a923b222e1c125aab35bbfd4091281829",
-			expectedFiles: []string{
-				"test_tar_zstd1",
-				"test_tar_zstd2",
-			},
-		},
+	// include an invalid snap snap name to trigger a failure in
+	// parseSnapsAndChannels
+	stateMachine.Snaps = []string{"lxd=test=invalid=name"}
+	err = stateMachine.prepareClassicImage()
+	asserter.AssertErrContains(err, "Invalid syntax")
+
+	// try to include a nonexistent snap to trigger a failure
+	// in snapStore.SnapInfo
+	stateMachine.Snaps = []string{"test-this-snap-name-should-never-exist"}
+	err = stateMachine.prepareClassicImage()
+	asserter.AssertErrContains(err, "Error getting info for snap")
+
+	// mock image.Prepare
+	stateMachine.Snaps = []string{"hello", "core"}
+	imagePrepare = mockImagePrepare
+	t.Cleanup(func() {
+		imagePrepare = image.Prepare
+	})
+	err = stateMachine.prepareClassicImage()
+	asserter.AssertErrContains(err, "Error preparing image")
+	imagePrepare = image.Prepare
+
+	// Test with a model assertion file
+	stateMachine.ImageDef.ModelAssertion = filepath.Join("testdata", "modelAssertionClassic")
+	err = stateMachine.prepareClassicImage()
+	asserter.AssertErrNil(err, true)
+
+	path, err := filepath.Abs(filepath.Join("testdata", "modelAssertionClassic"))
+	asserter.AssertErrNil(err, true)
+	stateMachine.ImageDef.ModelAssertion = path
+	err = stateMachine.prepareClassicImage()
+	asserter.AssertErrNil(err, true)
+
+	stateMachine.ImageDef.ModelAssertion = ""
+	// preseed the chroot, create a state.json file to trigger a reset, and mock some related functions
+	err = stateMachine.prepareClassicImage()
+	asserter.AssertErrNil(err, true)
+	_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "var", "lib", "snapd", "state.json"))
+	asserter.AssertErrNil(err, true)
+
+	seedOpen = mockSeedOpen
+	t.Cleanup(func() {
+		seedOpen = seed.Open
+	})
+	err = stateMachine.prepareClassicImage()
+	asserter.AssertErrContains(err, "Error getting list of preseeded snaps")
+	seedOpen = seed.Open
+
+	// Setup the exec.Command mock
+	testCaseName = "TestFailedPrepareClassicImage"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() {
+		execCommand = exec.Command
+	})
+	err = stateMachine.prepareClassicImage()
+	asserter.AssertErrContains(err, "Error resetting preseeding")
+}
+
+// TestStateMachine_PopulateClassicRootfsContents runs the state machine through populate_rootfs_contents and examines
+// the rootfs to ensure at least some of the correct file are in place
+func TestStateMachine_PopulateClassicRootfsContents(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
 	}
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			asserter := helper.Asserter{T: t}
-			restoreCWD := testhelper.SaveCWD()
-			defer restoreCWD()
 
-			var stateMachine ClassicStateMachine
-			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-			stateMachine.parent = &stateMachine
-			stateMachine.ImageDef = imagedefinition.ImageDefinition{
-				Architecture: arch.GetHostArch(),
-				Series:       getHostSuite(),
-				Rootfs: &imagedefinition.Rootfs{
-					Tarball: &imagedefinition.Tarball{
-						TarballURL: fmt.Sprintf("file://%s", tc.rootfsTar),
-					},
-				},
-			}
+	if runtime.GOARCH != "amd64" {
+		t.Skip("Test for amd64 only")
+	}
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
 
-			err := stateMachine.setConfDefDir(filepath.Join(wd, "image_definition.yaml"))
-			asserter.AssertErrNil(err, true)
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: arch.GetHostArch(),
+		Series:       getHostSuite(),
+		Rootfs: &imagedefinition.Rootfs{
+			Archive: "ubuntu",
+		},
+		Customization: &imagedefinition.Customization{},
+	}
 
-			err = stateMachine.makeTemporaryDirectories()
-			asserter.AssertErrNil(err, true)
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
 
-			t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-			err = stateMachine.extractRootfsTar()
-			asserter.AssertErrNil(err, true)
+	err = getBasicChroot(stateMachine.StateMachine)
+	asserter.AssertErrNil(err, true)
 
-			for _, testFile := range tc.expectedFiles {
-				_, err := os.Stat(filepath.Join(stateMachine.tempDirs.chroot, testFile))
-				if err != nil {
-					t.Errorf("File %s should be in chroot, but is missing", testFile)
-				}
+	err = stateMachine.populateClassicRootfsContents()
+	asserter.AssertErrNil(err, true)
+
+	// check the files before Teardown
+	fileList := []string{filepath.Join("etc", "shadow"),
+		filepath.Join("etc", "systemd"),
+		filepath.Join("usr", "lib")}
+	for _, file := range fileList {
+		_, err := os.Stat(filepath.Join(stateMachine.tempDirs.rootfs, file))
+		if err != nil {
+			if os.IsNotExist(err) {
+				t.Errorf("File %s should exist, but does not", file)
 			}
-		})
+		}
+	}
+
+	// return when Customization.Fstab is not empty
+	stateMachine.ImageDef.Customization.Fstab = []*imagedefinition.Fstab{
+		{
+			Label:        "writable",
+			Mountpoint:   "/",
+			FSType:       "ext4",
+			MountOptions: "defaults",
+			Dump:         true,
+			FsckOrder:    1,
+		},
 	}
+
+	err = stateMachine.populateClassicRootfsContents()
+	asserter.AssertErrNil(err, true)
+
+	// return when no Customization
+	stateMachine.ImageDef.Customization = nil
+
+	err = stateMachine.populateClassicRootfsContents()
+	asserter.AssertErrNil(err, true)
 }
 
-// TestFailedExtractRootfsTar tests failures in the extractRootfsTar function
-func TestFailedExtractRootfsTar(t *testing.T) {
+// TestStateMachine_FailedPopulateClassicRootfsContents tests failed scenarios in populateClassicRootfsContents
+// this is accomplished by mocking functions
+func TestStateMachine_FailedPopulateClassicRootfsContents(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
 	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
-
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 	stateMachine.parent = &stateMachine
-	tarPath := filepath.Join("testdata", "rootfs_tarballs", "rootfs.tar")
 	stateMachine.ImageDef = imagedefinition.ImageDefinition{
 		Architecture: arch.GetHostArch(),
 		Series:       getHostSuite(),
 		Rootfs: &imagedefinition.Rootfs{
-			Tarball: &imagedefinition.Tarball{
-				TarballURL: fmt.Sprintf("file://%s", tarPath),
-				SHA256sum:  "fail",
-			},
+			Archive: "ubuntu",
 		},
+		Customization: &imagedefinition.Customization{},
 	}
 
 	err := stateMachine.makeTemporaryDirectories()
 	asserter.AssertErrNil(err, true)
 
-	// mock os.Mkdir
-	osMkdir = mockMkdir
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	err = getBasicChroot(stateMachine.StateMachine)
+	asserter.AssertErrNil(err, true)
+
+	// mock os.ReadDir
+	osReadDir = mockReadDir
 	t.Cleanup(func() {
-		osMkdir = os.Mkdir
+		osReadDir = os.ReadDir
 	})
-	err = stateMachine.extractRootfsTar()
-	asserter.AssertErrContains(err, "Failed to create chroot directory")
-	osMkdir = os.Mkdir
+	err = stateMachine.populateClassicRootfsContents()
+	asserter.AssertErrContains(err, "Error reading chroot dir")
+	osReadDir = os.ReadDir
 
-	// clean up chroot directory
-	os.RemoveAll(stateMachine.tempDirs.chroot)
+	// mock osutil.CopySpecialFile
+	osutilCopySpecialFile = mockCopySpecialFile
+	t.Cleanup(func() {
+		osutilCopySpecialFile = osutil.CopySpecialFile
+	})
+	err = stateMachine.populateClassicRootfsContents()
+	asserter.AssertErrContains(err, "Error copying rootfs")
+	osutilCopySpecialFile = osutil.CopySpecialFile
 
-	// now test with the incorrect SHA256sum
-	err = stateMachine.extractRootfsTar()
-	asserter.AssertErrContains(err, "Calculated SHA256 sum of rootfs tarball")
+	// mock os.WriteFile
+	osWriteFile = mockWriteFile
+	t.Cleanup(func() {
+		osWriteFile = os.WriteFile
+	})
+	err = stateMachine.populateClassicRootfsContents()
+	asserter.AssertErrContains(err, "Error writing to fstab")
+	osWriteFile = os.WriteFile
 
-	// clean up chroot directory
-	os.RemoveAll(stateMachine.tempDirs.chroot)
+	// mock os.ReadFile
+	osReadFile = mockReadFile
+	t.Cleanup(func() {
+		osReadFile = os.ReadFile
+	})
+	err = stateMachine.populateClassicRootfsContents()
+	asserter.AssertErrContains(err, "Error reading fstab")
+	osReadFile = os.ReadFile
 
-	// use a tarball that doesn't exist to trigger a failure in computing
-	// the SHA256 sum
-	stateMachine.ImageDef.Rootfs.Tarball.TarballURL = "file:///fakefile"
-	err = stateMachine.extractRootfsTar()
-	asserter.AssertErrContains(err, "Error opening file \"/fakefile\" to calculate SHA256 sum")
-	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+	// return when existing fstab contains LABEL=writable
+	//nolint:gosec,G306
+	err = os.WriteFile(filepath.Join(stateMachine.tempDirs.chroot, "etc", "fstab"),
+		[]byte("LABEL=writable\n"),
+		0644)
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.populateClassicRootfsContents()
+	asserter.AssertErrNil(err, true)
+
+	// create an /etc/resolv.conf.tmp in the chroot
+	err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.chroot, "etc"), 0755)
+	asserter.AssertErrNil(err, true)
+	_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "etc", "resolv.conf.tmp"))
+	asserter.AssertErrNil(err, true)
+
+	// mock helper.RestoreResolvConf
+	helperRestoreResolvConf = mockRestoreResolvConf
+	t.Cleanup(func() {
+		helperRestoreResolvConf = helper.RestoreResolvConf
+	})
+	err = stateMachine.populateClassicRootfsContents()
+	asserter.AssertErrContains(err, "Error restoring /etc/resolv.conf")
+	helperRestoreResolvConf = helper.RestoreResolvConf
 }
 
-// TestStateMachine_customizeCloudInit unit tests the customizeCloudInit method
-func TestStateMachine_customizeCloudInit(t *testing.T) {
+// TestSateMachine_customizeSourcesList tests functionality of the customizeSourcesList state function
+func TestSateMachine_customizeSourcesList(t *testing.T) {
+	series := getHostSuite()
 	testCases := []struct {
-		name                   string
-		cloudInitCustomization imagedefinition.CloudInit
-		wantMetaData           string
-		wantUserData           string
-		wantNetworkConfig      string
+		name                      string
+		deb822Format              bool
+		existingSourcesList       string
+		existingDeb822SourcesList string
+		customization             *imagedefinition.Customization
+		mockFuncs                 func() func()
+		expectedErr               string
+		expectedSourcesList       string
+		expectedDeb822SourcesList string
 	}{
 		{
-			name: "full cloudinit conf",
-			cloudInitCustomization: imagedefinition.CloudInit{
-				MetaData: `#cloud-config
-
-foo: bar`,
-				UserData: `#cloud-config
-
-foo: baz`,
-				NetworkConfig: `#cloud-config
-
-foobar: foobar`,
+			name:                "set default sources.list",
+			deb822Format:        false,
+			existingSourcesList: "deb http://ports.ubuntu.com/ubuntu-ports jammy main restricted",
+			customization:       &imagedefinition.Customization{},
+			expectedSourcesList: fmt.Sprintf(`# See http://help.ubuntu.com/community/UpgradeNotes for how to upgrade to
+# newer versions of the distribution.
+deb http://archive.ubuntu.com/ubuntu/ %s main restricted universe
+`, series),
+		},
+		{
+			name:                "set less components sources.list",
+			deb822Format:        false,
+			existingSourcesList: "deb http://ports.ubuntu.com/ubuntu-ports jammy main restricted",
+			customization: &imagedefinition.Customization{
+				Components: []string{"main"},
 			},
-			wantMetaData: `#cloud-config
-
-foo: bar`,
-			wantUserData: `#cloud-config
-
-foo: baz`,
-			wantNetworkConfig: `#cloud-config
-
-foobar: foobar`,
+			expectedSourcesList: fmt.Sprintf(`# See http://help.ubuntu.com/community/UpgradeNotes for how to upgrade to
+# newer versions of the distribution.
+deb http://archive.ubuntu.com/ubuntu/ %s main
+`, series),
+		},
+		{
+			name:                "set components and pocket sources.list",
+			deb822Format:        false,
+			existingSourcesList: "deb http://ports.ubuntu.com/ubuntu-ports jammy main restricted",
+			customization: &imagedefinition.Customization{
+				Components: []string{"main"},
+				Pocket:     "security",
+			},
+			expectedSourcesList: fmt.Sprintf(`# See http://help.ubuntu.com/community/UpgradeNotes for how to upgrade to
+# newer versions of the distribution.
+deb http://archive.ubuntu.com/ubuntu/ %[1]s main
+deb http://security.ubuntu.com/ubuntu/ %[1]s-security main
+`, series),
 		},
 		{
-			name: "empty user data",
-			cloudInitCustomization: imagedefinition.CloudInit{
-				MetaData: `#cloud-config
-
-foo: bar`,
-				UserData: "",
-				NetworkConfig: `#cloud-config
+			name:                "fail to write sources.list",
+			deb822Format:        false,
+			existingSourcesList: "deb http://ports.ubuntu.com/ubuntu-ports jammy main restricted",
+			customization: &imagedefinition.Customization{
+				Components: []string{"main"},
+				Pocket:     "security",
+			},
+			expectedSourcesList: "deb http://ports.ubuntu.com/ubuntu-ports jammy main restricted",
+			expectedErr:         "unable to open sources.list file",
+			mockFuncs: func() func() {
+				mock := testhelper.NewOSMock(
+					&testhelper.OSMockConf{
+						OpenFileThreshold: 0,
+					},
+				)
 
-foobar: foobar`,
+				osOpenFile = mock.OpenFile
+				return func() { osOpenFile = os.OpenFile }
 			},
-			wantMetaData: `#cloud-config
+		},
+		{
+			name:                "set default ubuntu.sources and commented sources.list",
+			deb822Format:        true,
+			existingSourcesList: "deb http://ports.ubuntu.com/ubuntu-ports jammy main restricted",
+			existingDeb822SourcesList: fmt.Sprintf(`Types: deb
+URIs: http://archive.ubuntu.com/
+Suites: %s
+Components: main universe restricted multiverse
+Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+`, series),
+			customization:       &imagedefinition.Customization{},
+			expectedSourcesList: imagedefinition.LegacySourcesListComment,
+			expectedDeb822SourcesList: fmt.Sprintf(`## Ubuntu distribution repository
+##
+## The following settings can be adjusted to configure which packages to use from Ubuntu.
+## Mirror your choices (except for URIs and Suites) in the security section below to
+## ensure timely security updates.
+##
+## Types: Append deb-src to enable the fetching of source package.
+## URIs: A URL to the repository (you may add multiple URLs)
+## Suites: The following additional suites can be configured
+##   <name>-updates   - Major bug fix updates produced after the final release of the
+##                      distribution.
+##   <name>-backports - software from this repository may not have been tested as
+##                      extensively as that contained in the main release, although it includes
+##                      newer versions of some applications which may provide useful features.
+##                      Also, please note that software in backports WILL NOT receive any review
+##                      or updates from the Ubuntu security team.
+## Components: Aside from main, the following components can be added to the list
+##   restricted  - Software that may not be under a free license, or protected by patents.
+##   universe    - Community maintained packages. Software in this repository receives maintenance
+##                 from volunteers in the Ubuntu community, or a 10 year security maintenance
+##                 commitment from Canonical when an Ubuntu Pro subscription is attached.
+##   multiverse  - Community maintained of restricted. Software from this repository is
+##                 ENTIRELY UNSUPPORTED by the Ubuntu team, and may not be under a free
+##                 licence. Please satisfy yourself as to your rights to use the software.
+##                 Also, please note that software in multiverse WILL NOT receive any
+##                 review or updates from the Ubuntu security team.
+##
+## See the sources.list(5) manual page for further settings.
+Types: deb
+URIs: http://archive.ubuntu.com/ubuntu/
+Suites: %[1]s
+Components: main restricted
+Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
 
-foo: bar`,
-			wantUserData: "",
-			wantNetworkConfig: `#cloud-config
+## Ubuntu security updates. Aside from URIs and Suites,
+## this should mirror your choices in the previous section.
+Types: deb
+URIs: http://security.ubuntu.com/ubuntu/
+Suites: %[1]s-security
+Components: main restricted
+Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
 
-foobar: foobar`,
+`, series),
 		},
 		{
-			name: "empty metadata",
-			cloudInitCustomization: imagedefinition.CloudInit{
-				UserData: "",
-				NetworkConfig: `#cloud-config
+			name:                "fail to write ubuntu.sources and commented sources.list",
+			deb822Format:        true,
+			existingSourcesList: "deb http://ports.ubuntu.com/ubuntu-ports jammy main restricted",
+			existingDeb822SourcesList: fmt.Sprintf(`Types: deb
+URIs: http://archive.ubuntu.com/
+Suites: %s
+Components: main universe restricted multiverse
+Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+`, series),
+			customization:       &imagedefinition.Customization{},
+			expectedSourcesList: "deb http://ports.ubuntu.com/ubuntu-ports jammy main restricted",
+			expectedDeb822SourcesList: fmt.Sprintf(`Types: deb
+URIs: http://archive.ubuntu.com/
+Suites: %s
+Components: main universe restricted multiverse
+Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+`, series),
+			expectedErr: "unable to open ubuntu.sources file",
+			mockFuncs: func() func() {
+				mock := testhelper.NewOSMock(
+					&testhelper.OSMockConf{
+						OpenFileThreshold: 0,
+					},
+				)
 
-foobar: foobar`,
+				osOpenFile = mock.OpenFile
+				return func() { osOpenFile = os.OpenFile }
 			},
-			wantMetaData: "",
-			wantUserData: "",
-			wantNetworkConfig: `#cloud-config
-
-foobar: foobar`,
 		},
 		{
-			name: "multiline user data",
-			cloudInitCustomization: imagedefinition.CloudInit{
-				UserData: `#cloud-config
+			name:                "fail to create sources.list.d",
+			deb822Format:        true,
+			existingSourcesList: "deb http://ports.ubuntu.com/ubuntu-ports jammy main restricted",
+			existingDeb822SourcesList: fmt.Sprintf(`Types: deb
+URIs: http://archive.ubuntu.com/
+Suites: %s
+Components: main universe restricted multiverse
+Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+`, series),
+			customization:       &imagedefinition.Customization{},
+			expectedSourcesList: "deb http://ports.ubuntu.com/ubuntu-ports jammy main restricted",
+			expectedDeb822SourcesList: fmt.Sprintf(`Types: deb
+URIs: http://archive.ubuntu.com/
+Suites: %s
+Components: main universe restricted multiverse
+Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+`, series),
+			expectedErr: "Error /etc/apt/sources.list.d directory",
+			mockFuncs: func() func() {
+				mock := testhelper.NewOSMock(
+					&testhelper.OSMockConf{
+						MkdirAllThreshold: 0,
+					},
+				)
 
-chpasswd:
-	expire: true
-	users:
-		- name: ubuntu
-		password: ubuntu
-		type: text
-`,
+				osMkdirAll = mock.MkdirAll
+				return func() { osMkdirAll = os.MkdirAll }
 			},
-			wantMetaData: "",
-			wantUserData: `#cloud-config
-
-chpasswd:
-	expire: true
-	users:
-		- name: ubuntu
-		password: ubuntu
-		type: text
-`,
-			wantNetworkConfig: "",
 		},
 	}
 
-	for i, tc := range testCases {
-		t.Run("test_customize_cloud_init_"+tc.name, func(t *testing.T) {
-			// Test setup
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
 			asserter := helper.Asserter{T: t}
 			restoreCWD := testhelper.SaveCWD()
 			defer restoreCWD()
@@ -1626,457 +3606,415 @@ chpasswd:
 			var stateMachine ClassicStateMachine
 			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 			stateMachine.parent = &stateMachine
-			tmpDir, err := os.MkdirTemp("", "")
+			stateMachine.ImageDef = imagedefinition.ImageDefinition{
+				Architecture: arch.GetHostArch(),
+				Series:       series,
+				Rootfs: &imagedefinition.Rootfs{
+					SourcesListDeb822: helper.BoolPtr(tc.deb822Format),
+				},
+				Customization: tc.customization,
+			}
+
+			err := helper.SetDefaults(&stateMachine.ImageDef)
 			asserter.AssertErrNil(err, true)
-			t.Cleanup(func() {
-				if tmpErr := osRemoveAll(tmpDir); tmpErr != nil {
-					if err != nil {
-						err = fmt.Errorf("%s after previous error: %w", tmpErr, err)
-					} else {
-						err = tmpErr
-					}
-				}
-			})
-			stateMachine.tempDirs.chroot = tmpDir
 
-			// this directory is expected to be present as it is installed by cloud-init
-			err = os.MkdirAll(path.Join(tmpDir, "etc/cloud/cloud.cfg.d"), 0777)
+			err = stateMachine.makeTemporaryDirectories()
 			asserter.AssertErrNil(err, true)
 
-			stateMachine.ImageDef.Customization = &imagedefinition.Customization{
-				CloudInit: &testCases[i].cloudInitCustomization,
-			}
+			t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-			// Running function to test
-			err = stateMachine.customizeCloudInit()
+			err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "sources.list.d"), 0644)
 			asserter.AssertErrNil(err, true)
 
-			// Validation
-			seedPath := path.Join(tmpDir, "var/lib/cloud/seed/nocloud")
+			sourcesListPath := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "sources.list")
+			deb822SourcesListPath := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "sources.list.d", "ubuntu.sources")
 
-			metaDataFile, err := os.Open(path.Join(seedPath, "meta-data"))
-			if tc.cloudInitCustomization.MetaData != "" {
-				asserter.AssertErrNil(err, false)
+			err = osWriteFile(sourcesListPath, []byte(tc.existingSourcesList), 0644)
+			asserter.AssertErrNil(err, true)
 
-				metaDataFileContent, err := io.ReadAll(metaDataFile)
-				asserter.AssertErrNil(err, false)
+			err = osWriteFile(deb822SourcesListPath, []byte(tc.existingDeb822SourcesList), 0644)
+			asserter.AssertErrNil(err, true)
 
-				if string(metaDataFileContent) != tc.wantMetaData {
-					t.Errorf("un-expected meta-data content found: expected:\n%v\ngot:%v", tc.wantMetaData, string(metaDataFileContent))
-				}
-			} else {
-				asserter.AssertErrContains(err, "no such file or directory")
+			if tc.mockFuncs != nil {
+				restoreMock := tc.mockFuncs()
+				t.Cleanup(restoreMock)
 			}
 
-			networkConfigFile, err := os.Open(path.Join(seedPath, "network-config"))
-			if tc.cloudInitCustomization.NetworkConfig != "" {
-				asserter.AssertErrNil(err, false)
-
-				networkConfigFileContent, err := io.ReadAll(networkConfigFile)
-				asserter.AssertErrNil(err, false)
-				if string(networkConfigFileContent) != tc.wantNetworkConfig {
-					t.Errorf("un-expected network-config found: expected:\n%v\ngot:%v", tc.wantNetworkConfig, string(networkConfigFileContent))
-				}
-			} else {
-				asserter.AssertErrContains(err, "no such file or directory")
+			err = stateMachine.customizeSourcesList()
+			if err != nil || len(tc.expectedErr) != 0 {
+				asserter.AssertErrContains(err, tc.expectedErr)
 			}
 
-			userDataFile, err := os.Open(path.Join(seedPath, "user-data"))
-			if tc.cloudInitCustomization.UserData != "" {
-				asserter.AssertErrNil(err, false)
+			sourcesListBytes, err := os.ReadFile(sourcesListPath)
+			asserter.AssertErrNil(err, true)
 
-				userDataFileContent, err := io.ReadAll(userDataFile)
-				asserter.AssertErrNil(err, false)
+			asserter.AssertEqual(tc.expectedSourcesList, string(sourcesListBytes))
 
-				if string(userDataFileContent) != tc.wantUserData {
-					t.Errorf("un-expected user-data content found: expected:\n%v\ngot:%v", tc.wantUserData, string(userDataFileContent))
-				}
-			} else {
-				asserter.AssertErrContains(err, "no such file or directory")
-			}
+			deb822SourcesListBytes, err := os.ReadFile(deb822SourcesListPath)
+			asserter.AssertErrNil(err, true)
 
-			os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			asserter.AssertEqual(tc.expectedDeb822SourcesList, string(deb822SourcesListBytes))
 		})
 	}
 }
 
-// TestStatemachine_customizeCloudInit_failed tests failure modes of customizeCloudInit method
-func TestStatemachine_customizeCloudInit_failed(t *testing.T) {
-	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
-
-	var stateMachine ClassicStateMachine
-	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.parent = &stateMachine
-	tmpDir, err := os.MkdirTemp("", "")
-	asserter.AssertErrNil(err, true)
-	t.Cleanup(func() { os.RemoveAll(tmpDir) })
-	stateMachine.tempDirs.chroot = tmpDir
-
-	stateMachine.ImageDef.Customization = &imagedefinition.Customization{
-		CloudInit: &imagedefinition.CloudInit{
-			MetaData:      `foo: bar`,
-			NetworkConfig: `foobar: foobar`,
-			UserData: `#cloud-config
-
-chpasswd:
-  expire: true
-  users:
-    - name: ubuntu
-      password: ubuntu
-      type: text
+// TestSateMachine_fixFstab tests functionality of the fixFstab function
+func TestSateMachine_fixFstab(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name          string
+		existingFstab string
+		expectedFstab string
+	}{
+		{
+			name:          "add entry to an existing but empty fstab",
+			existingFstab: "# UNCONFIGURED FSTAB",
+			expectedFstab: `LABEL=writable	/	ext4	discard,errors=remount-ro	0	1
+`,
+		},
+		{
+			name: "fix existing entry amongst several others",
+			existingFstab: `# /etc/fstab: static file system information.
+UUID=1565-1398	/	ext4	defaults	0	0
+#Here is another comment that should be left in place
+/dev/mapper/vgubuntu-swap_1	none	swap	sw	0	0
+`,
+			expectedFstab: `# /etc/fstab: static file system information.
+LABEL=writable	/	ext4	discard,errors=remount-ro	0	1
+#Here is another comment that should be left in place
+/dev/mapper/vgubuntu-swap_1	none	swap	sw	0	0
+`,
+		},
+		{
+			name: "fix existing entry amongst several others (with spaces)",
+			existingFstab: `# /etc/fstab: static file system information.
+UUID=1565-1398	/	ext4	defaults	0	0
+/dev/mapper/vgubuntu-swap_1	none  swap sw      0   0
+`,
+			expectedFstab: `# /etc/fstab: static file system information.
+LABEL=writable	/	ext4	discard,errors=remount-ro	0	1
+/dev/mapper/vgubuntu-swap_1	none	swap	sw	0	0
+`,
+		},
+		{
+			name: "fix only one root mount point",
+			existingFstab: `# /etc/fstab: static file system information.
+UUID=1565-1398	/	ext4	defaults	0	0
+UUID=1234-5678	/	ext4	defaults	0	0
+`,
+			expectedFstab: `# /etc/fstab: static file system information.
+LABEL=writable	/	ext4	discard,errors=remount-ro	0	1
+UUID=1234-5678	/	ext4	defaults	0	0
 `,
 		},
 	}
 
-	// Test if osCreate fails
-	fileList := []string{"meta-data", "user-data", "network-config", "90_dpkg.cfg"}
-	for _, file := range fileList {
-		t.Run("test_failed_customize_cloud_init_"+file, func(t *testing.T) {
-			// this directory is expected to be present as it is installed by cloud-init
-			cloudInitConfigDirPath := path.Join(tmpDir, "etc/cloud/cloud.cfg.d")
-			err = os.MkdirAll(cloudInitConfigDirPath, 0777)
-			asserter.AssertErrNil(err, true)
-			t.Cleanup(func() {
-				os.RemoveAll(cloudInitConfigDirPath)
-			})
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			restoreCWD := testhelper.SaveCWD()
+			defer restoreCWD()
 
-			osCreate = func(name string) (*os.File, error) {
-				if strings.Contains(name, file) {
-					return nil, errors.New("test error: failed to create file")
-				}
-				return os.Create(name) //nolint:gosec
+			var stateMachine ClassicStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.ImageDef = imagedefinition.ImageDefinition{
+				Architecture:  arch.GetHostArch(),
+				Series:        getHostSuite(),
+				Rootfs:        &imagedefinition.Rootfs{},
+				Customization: &imagedefinition.Customization{},
 			}
 
-			err := stateMachine.customizeCloudInit()
-			asserter.AssertErrContains(err, "test error: failed to create file")
-		})
-	}
-
-	// Test if Write fails (file is read only)
-	for _, file := range fileList {
-		t.Run("test_failed_customize_cloud_init_"+file, func(t *testing.T) {
-			// this directory is expected to be present as it is installed by cloud-init
-			cloudInitConfigDirPath := path.Join(tmpDir, "etc/cloud/cloud.cfg.d")
-			err = os.MkdirAll(cloudInitConfigDirPath, 0777)
+			// set the defaults for the imageDef
+			err := helper.SetDefaults(&stateMachine.ImageDef)
 			asserter.AssertErrNil(err, true)
-			t.Cleanup(func() {
-				os.RemoveAll(cloudInitConfigDirPath)
-			})
 
-			osCreate = func(name string) (*os.File, error) {
-				if strings.Contains(name, file) {
-					fileReadWrite, err := os.Create(name) //nolint:gosec
-					asserter.AssertErrNil(err, true)
-					fileReadWrite.Close() //nolint:gosec
-					return os.Open(name)  //nolint:gosec
-				}
-				return os.Create(name) //nolint:gosec
-			}
+			err = stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
 
-			err := stateMachine.customizeCloudInit()
-			if err == nil {
-				t.Errorf("expected error but got nil")
-			}
-		})
-	}
+			t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-	// Test if os.MkdirAll fails
-	t.Run("test_failed_customize_cloud_init_mkdir", func(t *testing.T) {
-		// this directory is expected to be present as it is installed by cloud-init
-		cloudInitConfigDirPath := path.Join(tmpDir, "etc/cloud/cloud.cfg.d")
-		err = os.MkdirAll(cloudInitConfigDirPath, 0777)
-		asserter.AssertErrNil(err, true)
-		t.Cleanup(func() {
-			os.RemoveAll(cloudInitConfigDirPath)
-		})
+			// create the <chroot>/etc directory
+			err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.rootfs, "etc"), 0644)
+			asserter.AssertErrNil(err, true)
 
-		osMkdirAll = mockMkdirAll
-		t.Cleanup(func() {
-			osMkdirAll = os.MkdirAll
-		})
+			fstabPath := filepath.Join(stateMachine.tempDirs.rootfs, "etc", "fstab")
 
-		err := stateMachine.customizeCloudInit()
-		if err == nil {
-			t.Error()
-		}
-	})
+			// simulate an already existing fstab file
+			if len(tc.existingFstab) != 0 {
+				err = osWriteFile(fstabPath, []byte(tc.existingFstab), 0644)
+				asserter.AssertErrNil(err, true)
+			}
 
-	// Test if yaml.Marshal fails
-	t.Run("test_failed_customize_cloud_init_yaml_marshal", func(t *testing.T) {
-		// this directory is expected to be present as it is installed by cloud-init
-		cloudInitConfigDirPath := path.Join(tmpDir, "etc/cloud/cloud.cfg.d")
-		err = os.MkdirAll(cloudInitConfigDirPath, 0777)
-		asserter.AssertErrNil(err, true)
-		t.Cleanup(func() {
-			os.RemoveAll(cloudInitConfigDirPath)
-		})
+			err = stateMachine.fixFstab()
+			asserter.AssertErrNil(err, true)
 
-		yamlMarshal = mockMarshal
-		defer func() {
-			yamlMarshal = yaml.Marshal
-		}()
+			fstabBytes, err := os.ReadFile(fstabPath)
+			asserter.AssertErrNil(err, true)
 
-		err := stateMachine.customizeCloudInit()
-		if err == nil {
-			t.Error()
-		}
-	})
+			if string(fstabBytes) != tc.expectedFstab {
+				t.Errorf("Expected fstab content \"%s\", but got \"%s\"",
+					tc.expectedFstab, string(fstabBytes))
+			}
+		})
+	}
+}
 
-	// Test cloud-init customization is invalid
+// TestGeneratePackageManifest tests if classic image manifest generation works
+func TestGeneratePackageManifest(t *testing.T) {
 	testCases := []struct {
-		name                   string
-		cloudInitCustomization imagedefinition.CloudInit
+		name            string
+		artifacts       *imagedefinition.Artifact
+		expectedContent []string
 	}{
 		{
-			name: "invalid userdata",
-			cloudInitCustomization: imagedefinition.CloudInit{
-				UserData: "foo: bar",
+			name: "TestGeneratePackageManifest",
+			artifacts: &imagedefinition.Artifact{
+				Manifest: &imagedefinition.Manifest{
+					ManifestName: "filesystem.manifest",
+				},
+			},
+			expectedContent: []string{"foo 1.2", "bar 1.4-1ubuntu4.1", "libbaz 0.1.3ubuntu2"},
+		},
+		{
+			name: "TestGeneratePackageManifestV2",
+			artifacts: &imagedefinition.Artifact{
+				ManifestV2: &imagedefinition.Manifest{
+					ManifestName: "filesystem.manifest",
+				},
 			},
+			expectedContent: []string{"foo\t1.2", "bar\t1.4-1ubuntu4.1", "libbaz\t0.1.3ubuntu2", "snap:snapd\tstable\t25939"},
 		},
 	}
 
-	for i, tc := range testCases {
-		t.Run("test_failed_customize_cloud_init_invalid_config_"+tc.name, func(t *testing.T) {
-			// this directory is expected to be present as it is installed by cloud-init
-			cloudInitConfigDirPath := path.Join(tmpDir, "etc/cloud/cloud.cfg.d")
-			err = os.MkdirAll(cloudInitConfigDirPath, 0777)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+
+			// Setup the exec.Command mock
+			testCaseName = tc.name
+			execCommand = fakeExecCommand
+			t.Cleanup(func() {
+				execCommand = exec.Command
+			})
+			// We need the output directory set for this
+			outputDir, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
+			asserter.AssertErrNil(err, true)
+			t.Cleanup(func() { os.RemoveAll(outputDir) })
+
+			var stateMachine ClassicStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.commonFlags.OutputDir = outputDir
+			stateMachine.ImageDef = imagedefinition.ImageDefinition{
+				Architecture: arch.GetHostArch(),
+				Series:       getHostSuite(),
+				Rootfs: &imagedefinition.Rootfs{
+					Archive: "ubuntu",
+				},
+				Customization: &imagedefinition.Customization{},
+				Artifacts:     tc.artifacts,
+			}
+			stateMachine.LocalPackages = []string{"libbaz"}
+			err = osMkdirAll(stateMachine.commonFlags.OutputDir, 0755)
 			asserter.AssertErrNil(err, true)
+			t.Cleanup(func() { os.RemoveAll(stateMachine.commonFlags.OutputDir) })
+
+			err = stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+			t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+			seedOpen = func(seedDir string, label string) (seed.Seed, error) {
+				return &mockSeed{
+					snaps: []*seed.Snap{
+						{
+							Path: "snapd_25939.snap",
+							SideInfo: &snap.SideInfo{
+								RealName: "snapd",
+								Revision: snap.R(25939),
+							},
+							Channel: "stable",
+						},
+					},
+					loadAssertionsFailure: seed.ErrNoAssertions,
+					loadMetaFailure:       nil,
+				}, nil
+			}
 			t.Cleanup(func() {
-				os.RemoveAll(cloudInitConfigDirPath)
+				seedOpen = seed.Open
 			})
 
-			stateMachine.ImageDef.Customization.CloudInit = &testCases[i].cloudInitCustomization
+			err = stateMachine.generatePackageManifest()
+			asserter.AssertErrNil(err, true)
 
-			err := stateMachine.customizeCloudInit()
-			asserter.AssertErrContains(err, "is missing proper header")
+			os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+			// Check if manifest file got generated and if it has expected contents
+			manifestPath := filepath.Join(stateMachine.commonFlags.OutputDir, "filesystem.manifest")
+			manifestBytes, err := os.ReadFile(manifestPath)
+			asserter.AssertErrNil(err, true)
+			// The order of packages shouldn't matter
+			examplePackages := tc.expectedContent
+			for _, pkg := range examplePackages {
+				if !strings.Contains(string(manifestBytes), pkg) {
+					t.Errorf("filesystem.manifest does not contain expected package: %s", pkg)
+				}
+			}
+			// packages removed but not purged must not be listed
+			if strings.Contains(string(manifestBytes), "removed") {
+				t.Errorf("filesystem.manifest contains a removed package: %s", string(manifestBytes))
+			}
+
+			// local packages are marked in a companion file, which is removed
+			// once there is no local package
+			localBytes, err := os.ReadFile(manifestPath + ".local")
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual("libbaz\n", string(localBytes))
+
+			stateMachine.LocalPackages = nil
+			err = stateMachine.generatePackageManifest()
+			asserter.AssertErrNil(err, true)
+			_, err = os.Stat(manifestPath + ".local")
+			if !os.IsNotExist(err) {
+				t.Errorf("filesystem.manifest.local should have been removed")
+			}
 		})
 	}
 }
 
-// TestStateMachine_manualCustomization unit tests the manualCustomization function
-func TestStateMachine_manualCustomization(t *testing.T) {
-	t.Parallel()
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
-	}
-
+// TestStateMachine_generateSBOM tests the SBOMs list the packages of the
+// rootfs with their source packages and licenses, and the seeded snaps
+func TestStateMachine_generateSBOM(t *testing.T) {
 	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
-
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 	stateMachine.parent = &stateMachine
-
 	stateMachine.ImageDef = imagedefinition.ImageDefinition{
-		Architecture: arch.GetHostArch(),
-		Series:       getHostSuite(),
-		Rootfs: &imagedefinition.Rootfs{
-			Archive: "ubuntu",
-		},
-		Customization: &imagedefinition.Customization{
-			Manual: &imagedefinition.Manual{
-				MakeDirs: []*imagedefinition.MakeDirs{
-					{
-						Path:        "/etc/foo/bar",
-						Permissions: 0755,
-					},
-					{
-						Path:        "/etc/baz/test",
-						Permissions: 0644,
-					},
-				},
-				CopyFile: []*imagedefinition.CopyFile{
-					{
-						Source: filepath.Join("testdata", "test_script"),
-						Dest:   "/test_copy_file",
-					},
-				},
-				TouchFile: []*imagedefinition.TouchFile{
-					{
-						TouchPath: "/test_touch_file",
-					},
-				},
-				Execute: []*imagedefinition.Execute{
-					{
-						// the file we already copied creates a file /test_execute
-						ExecutePath: "/test_copy_file",
-					},
-				},
-				AddUser: []*imagedefinition.AddUser{
-					{
-						UserName: "testuser",
-						UserID:   "123456",
-					},
-				},
-				AddGroup: []*imagedefinition.AddGroup{
-					{
-						GroupName: "testgroup",
-						GroupID:   "456789",
-					},
-				},
+		ImageName:    "ubuntu-server-amd64",
+		Revision:     3,
+		Architecture: "amd64",
+		Series:       "noble",
+		Artifacts: &imagedefinition.Artifact{
+			Sbom: &[]imagedefinition.Sbom{
+				{SbomName: "image.spdx.json", Format: "spdx"},
+				{SbomName: "image.cdx.json", Format: "cyclonedx"},
 			},
 		},
 	}
+	stateMachine.LocalPackages = []string{"libbar"}
+	stateMachine.tempDirs.rootfs = t.TempDir()
+	stateMachine.commonFlags.OutputDir = t.TempDir()
 
-	d, err := os.Getwd()
+	copyrightDir := filepath.Join(stateMachine.tempDirs.rootfs, "usr", "share", "doc", "foo")
+	err := os.MkdirAll(copyrightDir, 0755)
 	asserter.AssertErrNil(err, true)
-	err = stateMachine.setConfDefDir(filepath.Join(d, "image_definition.yaml"))
+	err = os.WriteFile(filepath.Join(copyrightDir, "copyright"), []byte(
+		"Format: https://www.debian.org/doc/packaging-manuals/copyright-format/1.0/\n"+
+			"Upstream-Name: foo\n\nFiles: *\nCopyright: 2024 Foo\nLicense: GPL-2+ or Artistic\n\n"+
+			"Files: debian/*\nLicense: MIT\n Permission is hereby granted\n"), 0644)
 	asserter.AssertErrNil(err, true)
-
-	err = stateMachine.makeTemporaryDirectories()
+	seedDir := filepath.Join(stateMachine.tempDirs.rootfs, "var", "lib", "snapd", "seed")
+	err = os.MkdirAll(seedDir, 0755)
 	asserter.AssertErrNil(err, true)
 
-	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	testCaseName = "TestStateMachine_generateSBOM"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() { execCommand = exec.Command })
+	seedOpen = func(seedDir string, label string) (seed.Seed, error) {
+		return &mockSeed{
+			snaps: []*seed.Snap{
+				{
+					Path:     filepath.Join(seedDir, "snaps", "snapd_25939.snap"),
+					SideInfo: &snap.SideInfo{RealName: "snapd", Revision: snap.R(25939)},
+					Channel:  "stable",
+				},
+			},
+			loadAssertionsFailure: seed.ErrNoAssertions,
+		}, nil
+	}
+	t.Cleanup(func() { seedOpen = seed.Open })
 
-	err = getBasicChroot(stateMachine.StateMachine)
+	err = stateMachine.generateSBOM()
 	asserter.AssertErrNil(err, true)
 
-	err = stateMachine.manualCustomization()
+	spdx, err := os.ReadFile(filepath.Join(stateMachine.commonFlags.OutputDir, "image.spdx.json"))
 	asserter.AssertErrNil(err, true)
-
-	// Check that the correct directories exist
-	testDirectories := []string{"/etc/foo/bar", "/etc/baz/test"}
-	for _, dirName := range testDirectories {
-		_, err := os.Stat(filepath.Join(stateMachine.tempDirs.chroot, dirName))
-		if err != nil {
-			t.Errorf("directory %s should exist, but it does not", dirName)
-		}
-	}
-
-	// Check that the correct files exist
-	testFiles := []string{"test_copy_file", "test_touch_file", "test_execute"}
-	for _, fileName := range testFiles {
-		_, err := os.Stat(filepath.Join(stateMachine.tempDirs.chroot, fileName))
-		if err != nil {
-			t.Errorf("file %s should exist, but it does not", fileName)
+	for _, expected := range []string{
+		`"spdxVersion": "SPDX-2.3"`,
+		`"referenceLocator": "pkg:deb/ubuntu/foo@1%3A1.2%2Bdfsg-1?arch=amd64&distro=noble"`,
+		`"referenceLocator": "pkg:deb/ubuntu/foo-src@1%3A1.2%2Bdfsg-1?arch=source&distro=noble"`,
+		`"licenseDeclared": "(LicenseRef-GPL-2-or-later OR LicenseRef-Artistic) AND LicenseRef-MIT"`,
+		`"spdxElementId": "SPDXRef-DebianBinary-foo-amd64-1-1.2-dfsg-1",
+      "relationshipType": "GENERATED_FROM",
+      "relatedSpdxElement": "SPDXRef-DebianSource-foo-src-1-1.2-dfsg-1"`,
+		`"comment": "Installed from a local .deb file"`,
+		`"SPDXID": "SPDXRef-Snap-snapd-25939"`,
+		`"comment": "Channel: stable"`,
+	} {
+		if !strings.Contains(string(spdx), expected) {
+			t.Errorf("Expected %s in the SPDX SBOM, got:\n%s", expected, spdx)
 		}
 	}
-
-	// Check that the test user exists with the correct uid
-	passwdFile := filepath.Join(stateMachine.tempDirs.chroot, "etc", "passwd")
-	passwdContents, err := os.ReadFile(passwdFile)
-	asserter.AssertErrNil(err, true)
-	if !strings.Contains(string(passwdContents), "testuser:x:123456") {
-		t.Errorf("Test user was not created in the chroot")
+	if strings.Contains(string(spdx), "removed") {
+		t.Errorf("The SPDX SBOM lists a removed package:\n%s", spdx)
 	}
 
-	// Check that the test group exists with the correct gid
-	groupFile := filepath.Join(stateMachine.tempDirs.chroot, "etc", "group")
-	groupContents, err := os.ReadFile(groupFile)
+	cyclonedx, err := os.ReadFile(filepath.Join(stateMachine.commonFlags.OutputDir, "image.cdx.json"))
 	asserter.AssertErrNil(err, true)
-	if !strings.Contains(string(groupContents), "testgroup:x:456789") {
-		t.Errorf("Test group was not created in the chroot")
+	for _, expected := range []string{
+		`"specVersion": "1.5"`,
+		`"purl": "pkg:deb/ubuntu/foo@1%3A1.2%2Bdfsg-1?arch=amd64&distro=noble"`,
+		`"name": "GPL-2+ or Artistic"`,
+		`"ancestors": [`,
+		`"value": "stable"`,
+	} {
+		if !strings.Contains(string(cyclonedx), expected) {
+			t.Errorf("Expected %s in the CycloneDX SBOM, got:\n%s", expected, cyclonedx)
+		}
 	}
 }
 
-// TestStateMachine_manualCustomization_fail tests failures in the manualCustomization function
-func TestStateMachine_manualCustomization_fail(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
-	}
-
-	t.Run("test_failed_manual_customization", func(t *testing.T) {
-		asserter := helper.Asserter{T: t}
-		restoreCWD := testhelper.SaveCWD()
-		t.Cleanup(restoreCWD)
-
-		var stateMachine ClassicStateMachine
-		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-		stateMachine.parent = &stateMachine
-
-		err := stateMachine.makeTemporaryDirectories()
-		asserter.AssertErrNil(err, true)
-
-		// mock helper.BackupAndCopyResolvConf
-		helperBackupAndCopyResolvConf = mockBackupAndCopyResolvConfFail
-		t.Cleanup(func() {
-			helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
-		})
-		err = stateMachine.manualCustomization()
-		asserter.AssertErrContains(err, "Error setting up /etc/resolv.conf")
-	})
-
-	tests := []struct {
-		name                 string
-		expectedErr          string
-		manualCustomizations *imagedefinition.Manual
-	}{
-		{
-			name:        "failing manualMakeDirs",
-			expectedErr: "not a directory",
-			manualCustomizations: &imagedefinition.Manual{
-				MakeDirs: []*imagedefinition.MakeDirs{
-					{
-						Path:        filepath.Join("/etc", "resolv.conf"),
-						Permissions: 0755,
-					},
-				},
-			},
-		},
-		{
-			name:        "failing manualCopyFile",
-			expectedErr: "cp: cannot stat 'this/path/does/not/exist'",
-			manualCustomizations: &imagedefinition.Manual{
-				CopyFile: []*imagedefinition.CopyFile{
-					{
-						Source: filepath.Join("this", "path", "does", "not", "exist"),
-						Dest:   filepath.Join("this", "path", "does", "not", "exist"),
-					},
-				},
-			},
-		},
-		{
-			name:        "failing manualExecute",
-			expectedErr: "chroot: failed to run command",
-			manualCustomizations: &imagedefinition.Manual{
-				Execute: []*imagedefinition.Execute{
-					{
-						ExecutePath: filepath.Join("this", "path", "does", "not", "exist"),
-					},
-				},
-			},
-		},
-		{
-			name:        "failing manualTouchFile",
-			expectedErr: "no such file or directory",
-			manualCustomizations: &imagedefinition.Manual{
-				TouchFile: []*imagedefinition.TouchFile{
-					{
-						TouchPath: filepath.Join("this", "path", "does", "not", "exist"),
-					},
-				},
-			},
-		},
-		{
-			name:        "failing manualAddGroup",
-			expectedErr: "group 'root' already exists",
-			manualCustomizations: &imagedefinition.Manual{
-				AddGroup: []*imagedefinition.AddGroup{
-					{
-						GroupName: "root",
-						GroupID:   "0",
-					},
-				},
-			},
-		},
-		{
-			name:        "failing manualAddUser",
-			expectedErr: "user 'root' already exists",
-			manualCustomizations: &imagedefinition.Manual{
-				AddUser: []*imagedefinition.AddUser{
-					{
-						UserName: "root",
-						UserID:   "0",
-					},
-				},
-			},
+// TestFailedGenerateSBOM tests failures generating SBOMs are reported
+func TestFailedGenerateSBOM(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Artifacts: &imagedefinition.Artifact{
+			Sbom: &[]imagedefinition.Sbom{{SbomName: "image.spdx.json", Format: "spdx"}},
 		},
 	}
-	asserter := helper.Asserter{T: t}
+	stateMachine.tempDirs.rootfs = t.TempDir()
+	stateMachine.commonFlags.OutputDir = t.TempDir()
+
+	testCaseName = "TestFailedGenerateSBOM"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() { execCommand = exec.Command })
+	err := stateMachine.generateSBOM()
+	asserter.AssertErrContains(err, "Error generating package list with command")
+
+	testCaseName = "TestStateMachine_generateSBOM"
+	err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.rootfs, "var", "lib", "snapd", "seed"), 0755)
+	asserter.AssertErrNil(err, true)
+	seedOpen = func(seedDir string, label string) (seed.Seed, error) {
+		return nil, fmt.Errorf("Test error")
+	}
+	t.Cleanup(func() { seedOpen = seed.Open })
+	err = stateMachine.generateSBOM()
+	asserter.AssertErrContains(err, "Error opening the seed file")
+
+	seedOpen = func(seedDir string, label string) (seed.Seed, error) {
+		return &mockSeed{loadAssertionsFailure: seed.ErrNoAssertions}, nil
+	}
+	osWriteFile = mockWriteFile
+	t.Cleanup(func() { osWriteFile = os.WriteFile })
+	err = stateMachine.generateSBOM()
+	asserter.AssertErrContains(err, "Error writing SBOM file")
+}
 
+// TestFailedGeneratePackageManifest tests if classic manifest generation failures are reported
+func TestFailedGeneratePackageManifest(t *testing.T) {
+	asserter := helper.Asserter{T: t}
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 	stateMachine.parent = &stateMachine
@@ -2086,517 +4024,605 @@ func TestStateMachine_manualCustomization_fail(t *testing.T) {
 		Rootfs: &imagedefinition.Rootfs{
 			Archive: "ubuntu",
 		},
+		Customization: &imagedefinition.Customization{},
+		Artifacts: &imagedefinition.Artifact{
+			Manifest: &imagedefinition.Manifest{
+				ManifestName: "filesystem.manifest",
+			},
+		},
 	}
 
-	err := stateMachine.makeTemporaryDirectories()
+	// We need the output directory set for this
+	outputDir, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
 	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(outputDir) })
+	stateMachine.commonFlags.OutputDir = outputDir
 
-	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	// Setup the exec.Command mock - version from the success test
+	testCaseName = "TestGeneratePackageManifest"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() {
+		execCommand = exec.Command
+	})
 
-	err = getBasicChroot(stateMachine.StateMachine)
-	asserter.AssertErrNil(err, true)
+	// Setup the mock for os.Create, making those fail
+	osCreate = mockCreate
+	t.Cleanup(func() {
+		osCreate = os.Create
+	})
 
-	// create an /etc/resolv.conf in the chroot
-	err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.chroot, "etc"), 0755)
-	asserter.AssertErrNil(err, true)
-	_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "etc", "resolv.conf"))
+	err = stateMachine.generatePackageManifest()
+	asserter.AssertErrContains(err, "Error creating manifest file")
+	osCreate = os.Create
+
+	// Setup the exec.Command mock - version from the fail test
+	testCaseName = "TestFailedGeneratePackageManifest"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() {
+		execCommand = exec.Command
+	})
+	err = stateMachine.generatePackageManifest()
+	asserter.AssertErrContains(err, "Error generating package list with command")
+}
+
+// TestFailedGeneratePackageManifestV2 tests if classic manifest generation failures are reported
+func TestFailedGeneratePackageManifestV2(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: arch.GetHostArch(),
+		Series:       getHostSuite(),
+		Rootfs: &imagedefinition.Rootfs{
+			Archive: "ubuntu",
+		},
+		Customization: &imagedefinition.Customization{},
+		Artifacts: &imagedefinition.Artifact{
+			ManifestV2: &imagedefinition.Manifest{
+				ManifestName: "filesystem.manifest",
+			},
+		},
+	}
+
+	// We need the output directory set for this
+	outputDir, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
 	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(outputDir) })
+	stateMachine.commonFlags.OutputDir = outputDir
 
-	for _, tc := range tests {
-		t.Run(tc.name, func(t *testing.T) {
-			asserter := helper.Asserter{T: t}
-			restoreCWD := testhelper.SaveCWD()
-			t.Cleanup(restoreCWD)
+	// Setup the mock for exec.Command - making those fail
+	testCaseName = "TestFailedGeneratePackageManifestV2"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() {
+		execCommand = exec.Command
+	})
+	err = stateMachine.generatePackageManifest()
+	asserter.AssertErrContains(err, "Error generating package list with command")
 
-			stateMachine.ImageDef.Customization = &imagedefinition.Customization{
-				Manual: tc.manualCustomizations,
-			}
+	// Setup the mock for exec.Command - making those succeed
+	testCaseName = "TestGeneratePackageManifestV2"
+	// Setup the mock for os.Create, making those fail
+	osCreate = mockCreate
+	t.Cleanup(func() {
+		osCreate = os.Create
+	})
+	err = stateMachine.generatePackageManifest()
+	asserter.AssertErrContains(err, "Error creating manifest file")
 
-			err = stateMachine.manualCustomization()
+	osCreate = os.Create
+	// Setup the mock seed - making those failed on seedOpen
+	seedOpen = func(seedDir string, label string) (seed.Seed, error) {
+		return nil, fmt.Errorf("fail")
+	}
+	t.Cleanup(func() {
+		seedOpen = seed.Open
+	})
+	err = stateMachine.generatePackageManifest()
+	asserter.AssertErrContains(err, "Error opening the seed file")
 
-			if len(tc.expectedErr) == 0 {
-				asserter.AssertErrNil(err, true)
-			} else {
-				asserter.AssertErrContains(err, tc.expectedErr)
-			}
-		})
+	// Setup the mock seed - making those failed on LoadAssertion
+	seedOpen = func(seedDir string, label string) (seed.Seed, error) {
+		return &mockSeed{
+			snaps: []*seed.Snap{
+				{},
+			},
+			loadAssertionsFailure: fmt.Errorf("fail"),
+			loadMetaFailure:       nil,
+		}, nil
 	}
-}
+	err = stateMachine.generatePackageManifest()
+	asserter.AssertErrContains(err, "Error loading assertions")
 
-// TestPrepareClassicImage unit tests the prepareClassicImage function
-func TestPrepareClassicImage(t *testing.T) {
-	t.Parallel()
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
+	// Setup the mock seed - making those failed on LoadMeta
+	seedOpen = func(seedDir string, label string) (seed.Seed, error) {
+		return &mockSeed{
+			snaps: []*seed.Snap{
+				{},
+			},
+			loadAssertionsFailure: nil,
+			loadMetaFailure:       fmt.Errorf("fail"),
+		}, nil
+	}
+	err = stateMachine.generatePackageManifest()
+	asserter.AssertErrContains(err, "Error loading meta-data")
+
+	// Setup the mock seed - making those failed on Iter callback (bad path)
+	seedOpen = func(seedDir string, label string) (seed.Seed, error) {
+		return &mockSeed{
+			snaps: []*seed.Snap{
+				{
+					Path: "snapd25939.snap",
+					SideInfo: &snap.SideInfo{
+						RealName: "snapd",
+						Revision: snap.R(25939),
+					},
+					Channel: "stable",
+				},
+			},
+			loadAssertionsFailure: seed.ErrNoAssertions,
+			loadMetaFailure:       nil,
+		}, nil
 	}
+	err = stateMachine.generatePackageManifest()
+	asserter.AssertErrContains(err, "Error parsing snap filename")
+}
 
+// TestGenerateFilelist tests if classic image filelist generation works
+func TestGenerateFilelist(t *testing.T) {
 	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
+
+	// Setup the exec.Command mock
+	testCaseName = "TestGenerateFilelist"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() {
+		execCommand = exec.Command
+	})
+	// We need the output directory set for this
+	outputDir, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(outputDir) })
 
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 	stateMachine.parent = &stateMachine
-	stateMachine.Snaps = []string{"core20"}
-	stateMachine.commonFlags.Channel = "stable"
+	stateMachine.commonFlags.OutputDir = outputDir
 	stateMachine.ImageDef = imagedefinition.ImageDefinition{
 		Architecture: arch.GetHostArch(),
-		Customization: &imagedefinition.Customization{
-			ExtraSnaps: []*imagedefinition.Snap{
-				{
-					SnapName: "hello",
-					Channel:  "candidate",
-				},
-				{
-					SnapName: "lxd",
-					Channel:  "latest/stable",
-				},
-				{
-					SnapName: "core24",
-				},
-				{
-					SnapName: "core22",
-				},
+		Series:       getHostSuite(),
+		Rootfs: &imagedefinition.Rootfs{
+			Archive: "ubuntu",
+		},
+		Customization: &imagedefinition.Customization{},
+		Artifacts: &imagedefinition.Artifact{
+			Filelist: &imagedefinition.Filelist{
+				FilelistName: "filesystem.filelist",
 			},
 		},
 	}
-
-	err := stateMachine.makeTemporaryDirectories()
+	err = osMkdirAll(stateMachine.commonFlags.OutputDir, 0755)
 	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(stateMachine.commonFlags.OutputDir) })
 
-	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
-
-	err = stateMachine.prepareClassicImage()
+	err = stateMachine.generateFilelist()
 	asserter.AssertErrNil(err, true)
 
-	// check that the lxd and hello snaps, as well as lxd's base, core20
-	// were prepared in the correct location
-	snaps := map[string]string{"lxd": "stable", "hello": "candidate", "core20": "stable", "core22": "stable", "core24": "stable"}
-	for snapName, snapChannel := range snaps {
-		// reach out to the snap store to find the revision
-		// of the snap for the specified channel
-		snapStore := store.New(nil, nil)
-		snapSpec := store.SnapSpec{Name: snapName}
-		context := context.TODO()
-		snapInfo, err := snapStore.SnapInfo(context, snapSpec, nil)
-		asserter.AssertErrNil(err, true)
-
-		storeRevision := snapInfo.Channels["latest/"+snapChannel].Revision.N
-		snapFileName := fmt.Sprintf("%s_%d.snap", snapName, storeRevision)
-
-		snapPath := filepath.Join(stateMachine.tempDirs.chroot,
-			"var", "lib", "snapd", "seed", "snaps", snapFileName)
-		_, err = os.Stat(snapPath)
-		if err != nil {
-			if os.IsNotExist(err) {
-				t.Errorf("File %s should exist, but does not", snapPath)
-			}
-		}
-	}
+	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+	// Check if filelist file got generated
+	filelistPath := filepath.Join(stateMachine.commonFlags.OutputDir, "filesystem.filelist")
+	_, err = os.Stat(filelistPath)
+	asserter.AssertErrNil(err, true)
 }
 
-// TestClassicSnapRevisions tests that if revisions are specified in the image definition
-// that the corresponding revisions are staged in the chroot
-func TestClassicSnapRevisions(t *testing.T) {
-	t.Parallel()
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
-	}
-	if runtime.GOARCH != "amd64" {
-		t.Skip("Test for amd64 only")
-	}
+// TestFailedGenerateFilelist tests if classic filelist generation failures are reported
+func TestFailedGenerateFilelist(t *testing.T) {
 	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
+
+	// Setup the exec.Command mock - version from the success test
+	testCaseName = "TestGenerateFilelist"
+	execCommand = fakeExecCommand
+	defer func() {
+		execCommand = exec.Command
+	}()
+	// Setup the mock for os.Create, making those fail
+	osCreate = mockCreate
+	defer func() {
+		osCreate = os.Create
+	}()
 
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 	stateMachine.parent = &stateMachine
-	stateMachine.Snaps = []string{"lxd"}
-	stateMachine.commonFlags.Channel = "stable"
 	stateMachine.ImageDef = imagedefinition.ImageDefinition{
 		Architecture: arch.GetHostArch(),
-		Customization: &imagedefinition.Customization{
-			ExtraSnaps: []*imagedefinition.Snap{
-				{
-					SnapName:     "hello",
-					SnapRevision: 38,
-				},
-				{
-					SnapName:     "ubuntu-image",
-					SnapRevision: 330,
-				},
-				{
-					SnapName:     "core20",
-					SnapRevision: 1852,
-				},
+		Series:       getHostSuite(),
+		Rootfs: &imagedefinition.Rootfs{
+			Archive: "ubuntu",
+		},
+		Customization: &imagedefinition.Customization{},
+		Artifacts: &imagedefinition.Artifact{
+			Filelist: &imagedefinition.Filelist{
+				FilelistName: "filesystem.filelist",
 			},
 		},
 	}
 
-	err := stateMachine.makeTemporaryDirectories()
+	// We need the output directory set for this
+	outputDir, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
 	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(outputDir) })
+	stateMachine.commonFlags.OutputDir = outputDir
 
-	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	// Setup the exec.Command mock - version from the success test
+	testCaseName = "TestGenerateFilelist"
+	execCommand = fakeExecCommand
+	defer func() {
+		execCommand = exec.Command
+	}()
 
-	err = stateMachine.prepareClassicImage()
-	asserter.AssertErrNil(err, true)
+	// Setup the mock for os.Create, making those fail
+	osCreate = mockCreate
+	defer func() {
+		osCreate = os.Create
+	}()
 
-	for _, snapInfo := range stateMachine.ImageDef.Customization.ExtraSnaps {
-		// compile a regex used to get revision numbers from seed.manifest
-		revRegex, err := regexp.Compile(fmt.Sprintf("%s_(.*?).snap\n", snapInfo.SnapName))
-		asserter.AssertErrNil(err, true)
-		seedData, err := os.ReadFile(filepath.Join(
-			stateMachine.tempDirs.chroot,
-			"var",
-			"lib",
-			"snapd",
-			"seed",
-			"seed.yaml",
-		))
-		asserter.AssertErrNil(err, true)
-		revString := revRegex.FindStringSubmatch(string(seedData))
-		if len(revString) != 2 {
-			t.Fatal("Error finding snap revision via regex")
-		}
-		seededRevision, err := strconv.Atoi(revString[1])
-		asserter.AssertErrNil(err, true)
+	err = stateMachine.generateFilelist()
+	asserter.AssertErrContains(err, "Error creating filelist")
+	osCreate = os.Create
 
-		if seededRevision != snapInfo.SnapRevision {
-			t.Errorf("Error, expected snap %s to "+
-				"be revision %d, but it was %d",
-				snapInfo.SnapName, snapInfo.SnapRevision, seededRevision)
-		}
-	}
+	// Setup the exec.Command mock - version from the fail test
+	testCaseName = "TestFailedGenerateFilelist"
+	execCommand = fakeExecCommand
+	defer func() {
+		execCommand = exec.Command
+	}()
+	err = stateMachine.generateFilelist()
+	asserter.AssertErrContains(err, "Error generating file list with command")
 }
 
-// TestFailedPrepareClassicImage tests failures in the prepareClassicImage function
-func TestFailedPrepareClassicImage(t *testing.T) {
+// TestSuccessfulClassicRun runs through a full classic state machine run and ensures
+// it is successful. It creates a .img and a .qcow2 file, ensures they are the
+// correct file types, it mounts the resulting .img and ensures grub was updated
+func TestSuccessfulClassicRun(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping test in short mode.")
 	}
+
 	asserter := helper.Asserter{T: t}
 	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
+	t.Cleanup(restoreCWD)
+
+	// We need the output directory set for this
+	outputDir, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(outputDir) })
 
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 	stateMachine.parent = &stateMachine
-	stateMachine.ImageDef = imagedefinition.ImageDefinition{
-		Architecture: arch.GetHostArch(),
-		Customization: &imagedefinition.Customization{
-			ExtraSnaps: []*imagedefinition.Snap{},
-		},
-	}
+	stateMachine.commonFlags.Debug = true
+	stateMachine.commonFlags.Size = "3G"
+	stateMachine.commonFlags.OutputDir = outputDir
+	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
+		"test_amd64.yaml")
 
-	err := stateMachine.makeTemporaryDirectories()
+	err = stateMachine.Setup()
 	asserter.AssertErrNil(err, true)
 
 	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-	// include an invalid snap snap name to trigger a failure in
-	// parseSnapsAndChannels
-	stateMachine.Snaps = []string{"lxd=test=invalid=name"}
-	err = stateMachine.prepareClassicImage()
-	asserter.AssertErrContains(err, "Invalid syntax")
+	err = stateMachine.Run()
+	asserter.AssertErrNil(err, true)
 
-	// try to include a nonexistent snap to trigger a failure
-	// in snapStore.SnapInfo
-	stateMachine.Snaps = []string{"test-this-snap-name-should-never-exist"}
-	err = stateMachine.prepareClassicImage()
-	asserter.AssertErrContains(err, "Error getting info for snap")
+	t.Cleanup(func() {
+		err = stateMachine.Teardown()
+		asserter.AssertErrNil(err, true)
+	})
+
+	testHelperCheckPPAInstalled(t, &asserter, stateMachine.tempDirs.chroot)
+	testHelperCheckSnapInstalled(t, &asserter, stateMachine.tempDirs.chroot)
+
+	artifacts := map[string]string{
+		"pc-amd64.img":            "DOS/MBR boot sector",
+		"pc-amd64.qcow2":          `QEMU QCOW2? Image \(v3\)`,
+		"filesystem-manifest.txt": "text",
+		"filesystem-filelist.txt": "text",
+	}
+	testHelperCheckArtifacts(t, &asserter, stateMachine.commonFlags.OutputDir, artifacts)
+
+	// create a directory in which to mount the rootfs
+	mountDir := filepath.Join(stateMachine.tempDirs.scratch, "loopback")
+	bootUEFIDir := filepath.Join(mountDir, "boot", "efi")
+	var setupImageCmds []*exec.Cmd
+	var teardownImageCmds []*exec.Cmd
 
-	// mock image.Prepare
-	stateMachine.Snaps = []string{"hello", "core"}
-	imagePrepare = mockImagePrepare
 	t.Cleanup(func() {
-		imagePrepare = image.Prepare
+		for _, teardownCmd := range teardownImageCmds {
+			if tmpErr := teardownCmd.Run(); tmpErr != nil {
+				if err != nil {
+					err = fmt.Errorf("%s after previous error: %w", tmpErr, err)
+				} else {
+					err = tmpErr
+				}
+			}
+		}
 	})
-	err = stateMachine.prepareClassicImage()
-	asserter.AssertErrContains(err, "Error preparing image")
-	imagePrepare = image.Prepare
 
-	// Test with a model assertion file
-	stateMachine.ImageDef.ModelAssertion = filepath.Join("testdata", "modelAssertionClassic")
-	err = stateMachine.prepareClassicImage()
-	asserter.AssertErrNil(err, true)
+	imgPath := filepath.Join(stateMachine.commonFlags.OutputDir, "pc-amd64.img")
 
-	path, err := filepath.Abs(filepath.Join("testdata", "modelAssertionClassic"))
-	asserter.AssertErrNil(err, true)
-	stateMachine.ImageDef.ModelAssertion = path
-	err = stateMachine.prepareClassicImage()
+	// set up the loopback device
+	loopUsed, losetupDetachCmd, err := associateLoopDevice(imgPath, stateMachine.SectorSize)
 	asserter.AssertErrNil(err, true)
 
-	stateMachine.ImageDef.ModelAssertion = ""
-	// preseed the chroot, create a state.json file to trigger a reset, and mock some related functions
-	err = stateMachine.prepareClassicImage()
-	asserter.AssertErrNil(err, true)
-	_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "var", "lib", "snapd", "state.json"))
-	asserter.AssertErrNil(err, true)
+	teardownImageCmds = append(teardownImageCmds, losetupDetachCmd)
+
+	setupImageCmds = append(setupImageCmds,
+		//nolint:gosec,G204
+		exec.Command("mount", fmt.Sprintf("%sp3", loopUsed), mountDir), // with this example the rootfs is partition 3 mountDir
+		//nolint:gosec,G204
+		exec.Command("mount", fmt.Sprintf("%sp2", loopUsed), bootUEFIDir), // with this example the boot partition is partition 2
+	)
+
+	teardownImageCmds = append([]*exec.Cmd{
+		//nolint:gosec,G204
+		exec.Command("mount", "--make-rprivate", mountDir),
+		//nolint:gosec,G204
+		exec.Command("umount", "--recursive", mountDir),
+	}, teardownImageCmds...,
+	)
+
+	// set up the mountpoints
+	mountPoints := []mountPoint{
+		{
+			src:      "devtmpfs-build",
+			basePath: mountDir,
+			relpath:  "/dev",
+			typ:      "devtmpfs",
+		},
+		{
+			src:      "devpts-build",
+			basePath: mountDir,
+			relpath:  "/dev/pts",
+			typ:      "devpts",
+			opts:     []string{"nodev", "nosuid"},
+		},
+		{
+			src:      "proc-build",
+			basePath: mountDir,
+			relpath:  "/proc",
+			typ:      "proc",
+		},
+		{
+			src:      "sysfs-build",
+			basePath: mountDir,
+			relpath:  "/sys",
+			typ:      "sysfs",
+		},
+	}
+	for _, mp := range mountPoints {
+		mountCmds, umountCmds, err := mp.getMountCmd()
+		if err != nil {
+			t.Errorf("Error preparing mountpoint \"%s\": \"%s\"",
+				mp.relpath,
+				err.Error(),
+			)
+		}
+		setupImageCmds = append(setupImageCmds, mountCmds...)
+		teardownImageCmds = append(umountCmds, teardownImageCmds...)
+	}
 
-	seedOpen = mockSeedOpen
-	t.Cleanup(func() {
-		seedOpen = seed.Open
-	})
-	err = stateMachine.prepareClassicImage()
-	asserter.AssertErrContains(err, "Error getting list of preseeded snaps")
-	seedOpen = seed.Open
+	teardownImageCmds = append([]*exec.Cmd{execCommand("udevadm", "settle")}, teardownImageCmds...)
 
-	// Setup the exec.Command mock
-	testCaseName = "TestFailedPrepareClassicImage"
-	execCommand = fakeExecCommand
-	t.Cleanup(func() {
-		execCommand = exec.Command
-	})
-	err = stateMachine.prepareClassicImage()
-	asserter.AssertErrContains(err, "Error resetting preseeding")
+	// now run all the commands to mount the image
+	for _, cmd := range setupImageCmds {
+		outPut := helper.SetCommandOutput(cmd, true)
+		err := cmd.Run()
+		if err != nil {
+			t.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
+				cmd.String(), err.Error(), outPut.String())
+		}
+	}
+
+	testHelperCheckMakeDirs(t, mountDir)
+	testHelperCheckAddUser(t, &asserter, mountDir)
+	testHelperCheckGrubConfig(t, mountDir)
+	testHelperCheckUEFIConfig(t, mountDir)
+	testHelperCheckCleanedFiles(t, mountDir)
+	testHelperCheckLocaleFile(t, &asserter, mountDir)
+	testHelperCheckSourcesList(t, &asserter, mountDir)
 }
 
-// TestStateMachine_PopulateClassicRootfsContents runs the state machine through populate_rootfs_contents and examines
-// the rootfs to ensure at least some of the correct file are in place
-func TestStateMachine_PopulateClassicRootfsContents(t *testing.T) {
-	t.Parallel()
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
+func testHelperCheckPPAInstalled(t *testing.T, asserter *helper.Asserter, chroot string) {
+	t.Helper()
+	files := []string{
+		filepath.Join(chroot, "usr", "bin", "hello-ubuntu-image-public"),
+		filepath.Join(chroot, "usr", "bin", "hello-ubuntu-image-private"),
 	}
-
-	if runtime.GOARCH != "amd64" {
-		t.Skip("Test for amd64 only")
+	for _, file := range files {
+		_, err := os.Stat(file)
+		asserter.AssertErrNil(err, true)
 	}
-	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
+}
 
-	var stateMachine ClassicStateMachine
-	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.parent = &stateMachine
-	stateMachine.ImageDef = imagedefinition.ImageDefinition{
-		Architecture: arch.GetHostArch(),
-		Series:       getHostSuite(),
-		Rootfs: &imagedefinition.Rootfs{
-			Archive: "ubuntu",
-		},
-		Customization: &imagedefinition.Customization{},
+func testHelperCheckSnapInstalled(t *testing.T, asserter *helper.Asserter, chroot string) {
+	t.Helper()
+	type snapList struct {
+		Snaps []struct {
+			Name    string `yaml:"name"`
+			Channel string `yaml:"channel"`
+		} `yaml:"snaps"`
 	}
 
-	err := stateMachine.makeTemporaryDirectories()
-	asserter.AssertErrNil(err, true)
-
-	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	seedYaml := filepath.Join(chroot,
+		"var", "lib", "snapd", "seed", "seed.yaml")
 
-	err = getBasicChroot(stateMachine.StateMachine)
+	seedFile, err := os.Open(seedYaml)
 	asserter.AssertErrNil(err, true)
+	defer seedFile.Close()
 
-	err = stateMachine.populateClassicRootfsContents()
+	var seededSnaps snapList
+	err = yaml.NewDecoder(seedFile).Decode(&seededSnaps)
 	asserter.AssertErrNil(err, true)
 
-	// check the files before Teardown
-	fileList := []string{filepath.Join("etc", "shadow"),
-		filepath.Join("etc", "systemd"),
-		filepath.Join("usr", "lib")}
-	for _, file := range fileList {
-		_, err := os.Stat(filepath.Join(stateMachine.tempDirs.rootfs, file))
+	expectedSnapChannels := map[string]string{
+		"hello":  "candidate",
+		"core20": "stable",
+	}
+
+	for _, seededSnap := range seededSnaps.Snaps {
+		channel, found := expectedSnapChannels[seededSnap.Name]
+		if found {
+			if channel != seededSnap.Channel {
+				t.Errorf("Expected snap %s to be pre-seeded with channel %s, but got %s",
+					seededSnap.Name, channel, seededSnap.Channel)
+			}
+		}
+	}
+}
+
+func testHelperCheckArtifacts(t *testing.T, asserter *helper.Asserter, outputDir string, artifacts map[string]string) {
+	t.Helper()
+	for artifact, fileType := range artifacts {
+		fullPath := filepath.Join(outputDir, artifact)
+		_, err := os.Stat(fullPath)
 		if err != nil {
 			if os.IsNotExist(err) {
-				t.Errorf("File %s should exist, but does not", file)
+				t.Errorf("File \"%s\" should exist, but does not", fullPath)
 			}
 		}
+
+		// check it is the expected file type
+		fileCommand := *exec.Command("file", fullPath)
+		cmdOutput, err := fileCommand.CombinedOutput()
+		asserter.AssertErrNil(err, true)
+
+		fileTypeRegex := regexp.MustCompile(fileType)
+
+		if !fileTypeRegex.Match([]byte(cmdOutput)) {
+			t.Errorf("File \"%s\" is the wrong file type. Expected \"%s\" but got \"%s\"",
+				fullPath, fileType, string(cmdOutput))
+		}
 	}
+}
 
-	// return when Customization.Fstab is not empty
-	stateMachine.ImageDef.Customization.Fstab = []*imagedefinition.Fstab{
-		{
-			Label:        "writable",
-			Mountpoint:   "/",
-			FSType:       "ext4",
-			MountOptions: "defaults",
-			Dump:         true,
-			FsckOrder:    1,
-		},
+func testHelperCheckMakeDirs(t *testing.T, mountDir string) {
+	t.Helper()
+	addedDir := filepath.Join(mountDir, "etc", "foo", "bar")
+	_, err := os.Stat(addedDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			t.Errorf("Directory \"%s\" should exist, but does not", addedDir)
+		}
 	}
+}
 
-	err = stateMachine.populateClassicRootfsContents()
+func testHelperCheckAddUser(t *testing.T, asserter *helper.Asserter, mountDir string) {
+	t.Helper()
+	shadowPath := filepath.Join(mountDir, "etc", "shadow")
+	shadowFile, err := os.Open(shadowPath)
 	asserter.AssertErrNil(err, true)
+	defer shadowFile.Close()
+	ubuntu2Found := false
+	ubuntu2Line := ""
 
-	// return when no Customization
-	stateMachine.ImageDef.Customization = nil
-
-	err = stateMachine.populateClassicRootfsContents()
-	asserter.AssertErrNil(err, true)
-}
+	scanner := bufio.NewScanner(shadowFile)
 
-// TestStateMachine_FailedPopulateClassicRootfsContents tests failed scenarios in populateClassicRootfsContents
-// this is accomplished by mocking functions
-func TestStateMachine_FailedPopulateClassicRootfsContents(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
-	}
-	asserter := helper.Asserter{T: t}
-	var stateMachine ClassicStateMachine
-	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.parent = &stateMachine
-	stateMachine.ImageDef = imagedefinition.ImageDefinition{
-		Architecture: arch.GetHostArch(),
-		Series:       getHostSuite(),
-		Rootfs: &imagedefinition.Rootfs{
-			Archive: "ubuntu",
-		},
-		Customization: &imagedefinition.Customization{},
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "ubuntu2") {
+			ubuntu2Line = scanner.Text()
+			ubuntu2Found = true
+			break
+		}
 	}
 
-	err := stateMachine.makeTemporaryDirectories()
-	asserter.AssertErrNil(err, true)
+	if !ubuntu2Found {
+		t.Error("ubuntu2 user not created")
+	}
 
-	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	expire := strings.Split(ubuntu2Line, ":")[2]
 
-	err = getBasicChroot(stateMachine.StateMachine)
-	asserter.AssertErrNil(err, true)
+	if expire != "0" {
+		t.Error("ubuntu2 user password should be expired")
+	}
+}
 
-	// mock os.ReadDir
-	osReadDir = mockReadDir
-	t.Cleanup(func() {
-		osReadDir = os.ReadDir
-	})
-	err = stateMachine.populateClassicRootfsContents()
-	asserter.AssertErrContains(err, "Error reading chroot dir")
-	osReadDir = os.ReadDir
+func testHelperCheckGrubConfig(t *testing.T, mountDir string) {
+	t.Helper()
+	grubCfg := filepath.Join(mountDir, "boot", "grub", "grub.cfg")
+	_, err := os.Stat(grubCfg)
+	if err != nil {
+		if os.IsNotExist(err) {
+			t.Errorf("File \"%s\" should exist, but does not", grubCfg)
+		}
+	}
+}
 
-	// mock osutil.CopySpecialFile
-	osutilCopySpecialFile = mockCopySpecialFile
-	t.Cleanup(func() {
-		osutilCopySpecialFile = osutil.CopySpecialFile
-	})
-	err = stateMachine.populateClassicRootfsContents()
-	asserter.AssertErrContains(err, "Error copying rootfs")
-	osutilCopySpecialFile = osutil.CopySpecialFile
+func testHelperCheckUEFIConfig(t *testing.T, mountDir string) {
+	t.Helper()
+	uefiFiles := []string{
+		filepath.Join(mountDir, "boot", "efi", "EFI", "BOOT"),
+		filepath.Join(mountDir, "boot", "efi", "EFI", "ubuntu", "grub.cfg"),
+	}
+	for _, f := range uefiFiles {
+		_, err := os.Stat(f)
+		if err != nil {
+			if os.IsNotExist(err) {
+				t.Errorf("File/Directory \"%s\" should exist, but does not", f)
+			}
+		}
+	}
+}
 
-	// mock os.WriteFile
-	osWriteFile = mockWriteFile
-	t.Cleanup(func() {
-		osWriteFile = os.WriteFile
-	})
-	err = stateMachine.populateClassicRootfsContents()
-	asserter.AssertErrContains(err, "Error writing to fstab")
-	osWriteFile = os.WriteFile
+func testHelperCheckCleanedFiles(t *testing.T, mountDir string) {
+	t.Helper()
+	cleaned := []string{
+		filepath.Join(mountDir, "var", "lib", "dbus", "machine-id"),
+		filepath.Join(mountDir, "etc", "ssh", "ssh_host_rsa_key"),
+		filepath.Join(mountDir, "etc", "ssh", "ssh_host_rsa_key.pub"),
+		filepath.Join(mountDir, "etc", "ssh", "ssh_host_ecdsa_key"),
+		filepath.Join(mountDir, "etc", "ssh", "ssh_host_ecdsa_key.pub"),
+		filepath.Join(mountDir, "usr", "sbin", "policy-rc.d"),
+		filepath.Join(mountDir, "sbin", "start-stop-daemon.REAL"),
+		filepath.Join(mountDir, "sbin", "initctl.REAL"),
+	}
+	for _, file := range cleaned {
+		_, err := os.Stat(file)
+		if !os.IsNotExist(err) {
+			t.Errorf("File %s should not exist, but does", file)
+		}
+	}
 
-	// mock os.ReadFile
-	osReadFile = mockReadFile
-	t.Cleanup(func() {
-		osReadFile = os.ReadFile
-	})
-	err = stateMachine.populateClassicRootfsContents()
-	asserter.AssertErrContains(err, "Error reading fstab")
-	osReadFile = os.ReadFile
+	truncated := []string{
+		filepath.Join(mountDir, "etc", "machine-id"),
+	}
+	for _, file := range truncated {
+		fileInfo, err := os.Stat(file)
+		if os.IsNotExist(err) {
+			t.Errorf("File %s should exist, but does not", file)
+		}
 
-	// return when existing fstab contains LABEL=writable
-	//nolint:gosec,G306
-	err = os.WriteFile(filepath.Join(stateMachine.tempDirs.chroot, "etc", "fstab"),
-		[]byte("LABEL=writable\n"),
-		0644)
-	asserter.AssertErrNil(err, true)
-	err = stateMachine.populateClassicRootfsContents()
-	asserter.AssertErrNil(err, true)
+		if fileInfo.Size() != 0 {
+			t.Errorf("File %s should be empty, but it is not. Size: %v", file, fileInfo.Size())
+		}
+	}
+}
 
-	// create an /etc/resolv.conf.tmp in the chroot
-	err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.chroot, "etc"), 0755)
-	asserter.AssertErrNil(err, true)
-	_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "etc", "resolv.conf.tmp"))
+func testHelperCheckLocaleFile(t *testing.T, asserter *helper.Asserter, mountDir string) {
+	t.Helper()
+	localeFile := filepath.Join(mountDir, "etc", "default", "locale")
+	localeBytes, err := os.ReadFile(localeFile)
 	asserter.AssertErrNil(err, true)
-
-	// mock helper.RestoreResolvConf
-	helperRestoreResolvConf = mockRestoreResolvConf
-	t.Cleanup(func() {
-		helperRestoreResolvConf = helper.RestoreResolvConf
-	})
-	err = stateMachine.populateClassicRootfsContents()
-	asserter.AssertErrContains(err, "Error restoring /etc/resolv.conf")
-	helperRestoreResolvConf = helper.RestoreResolvConf
+	if !strings.Contains(string(localeBytes), "LANG=C.UTF-8") {
+		t.Errorf("Expected LANG=C.UTF-8 in %s, but got %s", localeFile, string(localeBytes))
+	}
 }
 
-// TestSateMachine_customizeSourcesList tests functionality of the customizeSourcesList state function
-func TestSateMachine_customizeSourcesList(t *testing.T) {
-	series := getHostSuite()
-	testCases := []struct {
-		name                      string
-		deb822Format              bool
-		existingSourcesList       string
-		existingDeb822SourcesList string
-		customization             *imagedefinition.Customization
-		mockFuncs                 func() func()
-		expectedErr               string
-		expectedSourcesList       string
-		expectedDeb822SourcesList string
-	}{
-		{
-			name:                "set default sources.list",
-			deb822Format:        false,
-			existingSourcesList: "deb http://ports.ubuntu.com/ubuntu-ports jammy main restricted",
-			customization:       &imagedefinition.Customization{},
-			expectedSourcesList: fmt.Sprintf(`# See http://help.ubuntu.com/community/UpgradeNotes for how to upgrade to
-# newer versions of the distribution.
-deb http://archive.ubuntu.com/ubuntu/ %s main restricted universe
-`, series),
-		},
-		{
-			name:                "set less components sources.list",
-			deb822Format:        false,
-			existingSourcesList: "deb http://ports.ubuntu.com/ubuntu-ports jammy main restricted",
-			customization: &imagedefinition.Customization{
-				Components: []string{"main"},
-			},
-			expectedSourcesList: fmt.Sprintf(`# See http://help.ubuntu.com/community/UpgradeNotes for how to upgrade to
-# newer versions of the distribution.
-deb http://archive.ubuntu.com/ubuntu/ %s main
-`, series),
-		},
-		{
-			name:                "set components and pocket sources.list",
-			deb822Format:        false,
-			existingSourcesList: "deb http://ports.ubuntu.com/ubuntu-ports jammy main restricted",
-			customization: &imagedefinition.Customization{
-				Components: []string{"main"},
-				Pocket:     "security",
-			},
-			expectedSourcesList: fmt.Sprintf(`# See http://help.ubuntu.com/community/UpgradeNotes for how to upgrade to
-# newer versions of the distribution.
-deb http://archive.ubuntu.com/ubuntu/ %[1]s main
-deb http://security.ubuntu.com/ubuntu/ %[1]s-security main
-`, series),
-		},
-		{
-			name:                "fail to write sources.list",
-			deb822Format:        false,
-			existingSourcesList: "deb http://ports.ubuntu.com/ubuntu-ports jammy main restricted",
-			customization: &imagedefinition.Customization{
-				Components: []string{"main"},
-				Pocket:     "security",
-			},
-			expectedSourcesList: "deb http://ports.ubuntu.com/ubuntu-ports jammy main restricted",
-			expectedErr:         "unable to open sources.list file",
-			mockFuncs: func() func() {
-				mock := testhelper.NewOSMock(
-					&testhelper.OSMockConf{
-						OpenFileThreshold: 0,
-					},
-				)
-
-				osOpenFile = mock.OpenFile
-				return func() { osOpenFile = os.OpenFile }
-			},
-		},
-		{
-			name:                "set default ubuntu.sources and commented sources.list",
-			deb822Format:        true,
-			existingSourcesList: "deb http://ports.ubuntu.com/ubuntu-ports jammy main restricted",
-			existingDeb822SourcesList: fmt.Sprintf(`Types: deb
-URIs: http://archive.ubuntu.com/
-Suites: %s
-Components: main universe restricted multiverse
-Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
-`, series),
-			customization:       &imagedefinition.Customization{},
-			expectedSourcesList: imagedefinition.LegacySourcesListComment,
-			expectedDeb822SourcesList: fmt.Sprintf(`## Ubuntu distribution repository
+// testHelperCheckSourcesList checks if components and pocket correctly setup in /etc/apt/sources.list.d/ubuntu.sources
+func testHelperCheckSourcesList(t *testing.T, asserter *helper.Asserter, mountDir string) {
+	t.Helper()
+	aptDeb822SourcesListBytes, err := os.ReadFile(filepath.Join(mountDir, "etc", "apt", "sources.list.d", "ubuntu.sources"))
+	asserter.AssertErrNil(err, true)
+	wantAptDeb822SourcesList := `## Ubuntu distribution repository
 ##
 ## The following settings can be adjusted to configure which packages to use from Ubuntu.
 ## Mirror your choices (except for URIs and Suites) in the security section below to
@@ -2626,84 +4652,177 @@ Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
 ## See the sources.list(5) manual page for further settings.
 Types: deb
 URIs: http://archive.ubuntu.com/ubuntu/
-Suites: %[1]s
-Components: main restricted
+Suites: jammy jammy-updates jammy-proposed
+Components: main universe restricted
 Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
 
 ## Ubuntu security updates. Aside from URIs and Suites,
 ## this should mirror your choices in the previous section.
 Types: deb
 URIs: http://security.ubuntu.com/ubuntu/
-Suites: %[1]s-security
-Components: main restricted
+Suites: jammy-security
+Components: main universe restricted
 Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
 
-`, series),
+`
+	asserter.AssertEqual(wantAptDeb822SourcesList, string(aptDeb822SourcesListBytes))
+
+	// check if components and pocket correctly setup in /etc/apt/sources.list
+	aptSourcesListBytes, err := os.ReadFile(filepath.Join(mountDir, "etc", "apt", "sources.list"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(imagedefinition.LegacySourcesListComment, string(aptSourcesListBytes))
+}
+
+// TestSuccessfulClassicRunNoArtifact runs through a full classic state machine run without artifact
+func TestSuccessfulClassicRunNoArtifact(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	t.Cleanup(restoreCWD)
+
+	// We need the output directory set for this
+	outputDir, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(outputDir) })
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.Debug = true
+	stateMachine.commonFlags.Size = "3G"
+	stateMachine.commonFlags.OutputDir = outputDir
+	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
+		"test_no_artifact.yaml")
+
+	err = stateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	err = stateMachine.Run()
+	asserter.AssertErrNil(err, true)
+
+	t.Cleanup(func() {
+		err = stateMachine.Teardown()
+		asserter.AssertErrNil(err, true)
+	})
+
+	// make sure packages were successfully installed from public and private ppas
+	testHelperCheckPPAInstalled(t, &asserter, stateMachine.tempDirs.chroot)
+
+	// make sure snaps from the correct channel were installed
+	testHelperCheckSnapInstalled(t, &asserter, stateMachine.tempDirs.chroot)
+}
+
+func TestSuccessfulRootfsGeneration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	t.Cleanup(restoreCWD)
+
+	// We need the output directory set for this
+	outputDir, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(outputDir) })
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.Debug = true
+	stateMachine.commonFlags.Size = "3G"
+	stateMachine.commonFlags.OutputDir = outputDir
+	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
+		"test_rootfs_tarball.yaml")
+
+	err = stateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	err = stateMachine.Run()
+	asserter.AssertErrNil(err, true)
+
+	t.Cleanup(func() {
+		err = stateMachine.Teardown()
+		asserter.AssertErrNil(err, true)
+	})
+
+	// make sure all the artifacts were created and are the correct file types
+	artifacts := map[string]string{
+		"rootfs.tar": "tar archive",
+	}
+	for artifact, fileType := range artifacts {
+		fullPath := filepath.Join(stateMachine.commonFlags.OutputDir, artifact)
+		_, err := os.Stat(fullPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				t.Errorf("File \"%s\" should exist, but does not", fullPath)
+			}
+		}
+
+		// check it is the expected file type
+		fileCommand := *exec.Command("file", fullPath)
+		cmdOutput, err := fileCommand.CombinedOutput()
+		asserter.AssertErrNil(err, true)
+		if !strings.Contains(string(cmdOutput), fileType) {
+			t.Errorf("File \"%s\" is the wrong file type. Expected \"%s\" but got \"%s\"",
+				fullPath, fileType, string(cmdOutput))
+		}
+	}
+}
+
+// TestGerminate tests the germinate state and ensures some necessary packages are included
+func TestGerminate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	testCases := []struct {
+		name             string
+		flavor           string
+		seedURLs         []string
+		seedNames        []string
+		expectedPackages []string
+		expectedSnaps    []string
+		vcs              bool
+	}{
+		{
+			"git",
+			"ubuntu",
+			[]string{"git://git.launchpad.net/~ubuntu-core-dev/ubuntu-seeds/+git/"},
+			[]string{"server", "minimal", "standard", "cloud-image"},
+			[]string{"python3", "sudo", "cloud-init", "ubuntu-server"},
+			[]string{},
+			true,
 		},
 		{
-			name:                "fail to write ubuntu.sources and commented sources.list",
-			deb822Format:        true,
-			existingSourcesList: "deb http://ports.ubuntu.com/ubuntu-ports jammy main restricted",
-			existingDeb822SourcesList: fmt.Sprintf(`Types: deb
-URIs: http://archive.ubuntu.com/
-Suites: %s
-Components: main universe restricted multiverse
-Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
-`, series),
-			customization:       &imagedefinition.Customization{},
-			expectedSourcesList: "deb http://ports.ubuntu.com/ubuntu-ports jammy main restricted",
-			expectedDeb822SourcesList: fmt.Sprintf(`Types: deb
-URIs: http://archive.ubuntu.com/
-Suites: %s
-Components: main universe restricted multiverse
-Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
-`, series),
-			expectedErr: "unable to open ubuntu.sources file",
-			mockFuncs: func() func() {
-				mock := testhelper.NewOSMock(
-					&testhelper.OSMockConf{
-						OpenFileThreshold: 0,
-					},
-				)
-
-				osOpenFile = mock.OpenFile
-				return func() { osOpenFile = os.OpenFile }
-			},
+			"http",
+			"ubuntu",
+			[]string{"https://people.canonical.com/~ubuntu-archive/seeds/"},
+			[]string{"server", "minimal", "standard", "cloud-image", "desktop"},
+			[]string{"python3", "sudo", "cloud-init", "ubuntu-server"},
+			[]string{"thunderbird"},
+			false,
 		},
 		{
-			name:                "fail to create sources.list.d",
-			deb822Format:        true,
-			existingSourcesList: "deb http://ports.ubuntu.com/ubuntu-ports jammy main restricted",
-			existingDeb822SourcesList: fmt.Sprintf(`Types: deb
-URIs: http://archive.ubuntu.com/
-Suites: %s
-Components: main universe restricted multiverse
-Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
-`, series),
-			customization:       &imagedefinition.Customization{},
-			expectedSourcesList: "deb http://ports.ubuntu.com/ubuntu-ports jammy main restricted",
-			expectedDeb822SourcesList: fmt.Sprintf(`Types: deb
-URIs: http://archive.ubuntu.com/
-Suites: %s
-Components: main universe restricted multiverse
-Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
-`, series),
-			expectedErr: "Error /etc/apt/sources.list.d directory",
-			mockFuncs: func() func() {
-				mock := testhelper.NewOSMock(
-					&testhelper.OSMockConf{
-						MkdirAllThreshold: 0,
-					},
-				)
-
-				osMkdirAll = mock.MkdirAll
-				return func() { osMkdirAll = os.MkdirAll }
+			"bzr+git",
+			"ubuntu",
+			[]string{"http://bazaar.launchpad.net/~ubuntu-mate-dev/ubuntu-seeds/",
+				"git://git.launchpad.net/~ubuntu-core-dev/ubuntu-seeds/+git/",
+				"https://people.canonical.com/~ubuntu-archive/seeds/",
 			},
+			[]string{"desktop", "desktop-common", "standard", "minimal"},
+			[]string{"xorg", "wget", "ubuntu-minimal"},
+			[]string{"thunderbird"},
+			true,
 		},
 	}
-
 	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
+		t.Run("test_germinate_"+tc.name, func(t *testing.T) {
 			asserter := helper.Asserter{T: t}
 			restoreCWD := testhelper.SaveCWD()
 			defer restoreCWD()
@@ -2711,111 +4830,307 @@ Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
 			var stateMachine ClassicStateMachine
 			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 			stateMachine.parent = &stateMachine
-			stateMachine.ImageDef = imagedefinition.ImageDefinition{
-				Architecture: arch.GetHostArch(),
+
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+
+			t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+			hostArch := arch.GetHostArch()
+			series := "noble"
+			imageDef := imagedefinition.ImageDefinition{
+				Architecture: hostArch,
 				Series:       series,
 				Rootfs: &imagedefinition.Rootfs{
-					SourcesListDeb822: helper.BoolPtr(tc.deb822Format),
+					Flavor: tc.flavor,
+					Mirror: "http://archive.ubuntu.com/ubuntu/",
+					Seed: &imagedefinition.Seed{
+						SeedURLs:   tc.seedURLs,
+						SeedBranch: series,
+						Names:      tc.seedNames,
+						Vcs:        helper.BoolPtr(tc.vcs),
+					},
 				},
-				Customization: tc.customization,
 			}
 
-			err := helper.SetDefaults(&stateMachine.ImageDef)
+			stateMachine.ImageDef = imageDef
+
+			err = stateMachine.germinate()
 			asserter.AssertErrNil(err, true)
 
-			err = stateMachine.makeTemporaryDirectories()
-			asserter.AssertErrNil(err, true)
+			// spot check some packages that should remain seeded for a long time
+			testHelperCheckGerminatedPackages(t, tc.expectedPackages, stateMachine.Packages)
+			// spot check some snaps that should remain seeded for a long time
+			testHelperCheckGerminatedSnaps(t, tc.expectedSnaps, stateMachine.Snaps)
+		})
+	}
+}
+
+func testHelperCheckGerminatedPackages(t *testing.T, expectedPackages []string, gotPackages []string) {
+	for _, expectedPackage := range expectedPackages {
+		found := false
+		for _, seedPackage := range gotPackages {
+			if expectedPackage == seedPackage {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected to find %s in list of packages: %v",
+				expectedPackage, gotPackages)
+		}
+	}
+}
+
+func testHelperCheckGerminatedSnaps(t *testing.T, expectedSnaps []string, gotSnaps []string) {
+	for _, expectedSnap := range expectedSnaps {
+		found := false
+		for _, seedSnap := range gotSnaps {
+			snapName := strings.Split(seedSnap, "=")[0]
+			if expectedSnap == snapName {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected to find %s in list of snaps: %v",
+				expectedSnap, gotSnaps)
+		}
+	}
+}
+
+// TestFailedGerminate mocks function calls to test
+// failure cases in the germinate state
+func TestFailedGerminate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+
+	// create a valid imageDefinition
+	hostArch := arch.GetHostArch()
+	hostSuite := getHostSuite()
+	imageDef := imagedefinition.ImageDefinition{
+		Architecture: hostArch,
+		Series:       hostSuite,
+		Rootfs: &imagedefinition.Rootfs{
+			Flavor: "ubuntu",
+			Mirror: "http://archive.ubuntu.com/ubuntu/",
+			Seed: &imagedefinition.Seed{
+				SeedURLs:   []string{"git://git.launchpad.net/~ubuntu-core-dev/ubuntu-seeds/+git/"},
+				SeedBranch: hostSuite,
+				Names:      []string{"server", "minimal", "standard", "cloud-image"},
+				Vcs:        helper.BoolPtr(true),
+			},
+		},
+	}
+	stateMachine.ImageDef = imageDef
+
+	// mock os.Mkdir
+	osMkdir = mockMkdir
+	t.Cleanup(func() {
+		osMkdir = os.Mkdir
+	})
+	err = stateMachine.germinate()
+	asserter.AssertErrContains(err, "Error creating germinate directory")
+	osMkdir = os.Mkdir
+
+	// Setup the exec.Command mock
+	testCaseName = "TestFailedGerminate"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() {
+		execCommand = exec.Command
+	})
+	err = stateMachine.germinate()
+	asserter.AssertErrContains(err, "Error running germinate command")
+	execCommand = exec.Command
+
+	// mock os.Open
+	osOpen = mockOpen
+	t.Cleanup(func() {
+		osOpen = os.Open
+	})
+	err = stateMachine.germinate()
+	asserter.AssertErrContains(err, "Error opening seed file")
+	osOpen = os.Open
+
+	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+}
+
+// TestBuildGadgetTreeGit tests the successful build of a gadget tree
+func TestBuildGadgetTreeGit(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-			t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	// test the directory method
+	d, err := os.Getwd()
+	asserter.AssertErrNil(err, true)
+	sourcePath := filepath.Join(d, "testdata", "gadget_source")
+	sourcePath = "file://" + sourcePath
+	imageDef := imagedefinition.ImageDefinition{
+		Architecture: arch.GetHostArch(),
+		Series:       getHostSuite(),
+		Gadget: &imagedefinition.Gadget{
+			GadgetURL:  sourcePath,
+			GadgetType: "directory",
+		},
+	}
 
-			err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "sources.list.d"), 0644)
-			asserter.AssertErrNil(err, true)
+	stateMachine.ImageDef = imageDef
 
-			sourcesListPath := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "sources.list")
-			deb822SourcesListPath := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "sources.list.d", "ubuntu.sources")
+	err = stateMachine.buildGadgetTree()
+	asserter.AssertErrNil(err, true)
 
-			err = osWriteFile(sourcesListPath, []byte(tc.existingSourcesList), 0644)
-			asserter.AssertErrNil(err, true)
+	// test the git method
+	imageDef = imagedefinition.ImageDefinition{
+		Architecture: arch.GetHostArch(),
+		Series:       getHostSuite(),
+		Gadget: &imagedefinition.Gadget{
+			GadgetURL:    "https://github.com/snapcore/pc-gadget",
+			GadgetType:   "git",
+			GadgetBranch: "classic",
+		},
+	}
 
-			err = osWriteFile(deb822SourcesListPath, []byte(tc.existingDeb822SourcesList), 0644)
-			asserter.AssertErrNil(err, true)
+	stateMachine.ImageDef = imageDef
 
-			if tc.mockFuncs != nil {
-				restoreMock := tc.mockFuncs()
-				t.Cleanup(restoreMock)
-			}
+	err = stateMachine.buildGadgetTree()
+	asserter.AssertErrNil(err, true)
+}
 
-			err = stateMachine.customizeSourcesList()
-			if err != nil || len(tc.expectedErr) != 0 {
-				asserter.AssertErrContains(err, tc.expectedErr)
-			}
+// TestBuildGadgetTreeDirectory tests the successful build of a gadget tree
+func TestBuildGadgetTreeDirectory(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	asserter := helper.Asserter{T: t}
+	saveCWD := testhelper.SaveCWD()
+	defer saveCWD()
 
-			sourcesListBytes, err := os.ReadFile(sourcesListPath)
-			asserter.AssertErrNil(err, true)
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
 
-			asserter.AssertEqual(tc.expectedSourcesList, string(sourcesListBytes))
+	// need workdir set up for this
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-			deb822SourcesListBytes, err := os.ReadFile(deb822SourcesListPath)
-			asserter.AssertErrNil(err, true)
+	// git clone the gadget into a /tmp dir
+	gadgetDir, err := os.MkdirTemp("", "pc-gadget-")
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(gadgetDir) })
+	gitCloneCommand := *exec.Command(
+		"git",
+		"clone",
+		"--depth",
+		"1",
+		"--branch",
+		"classic",
+		"https://github.com/snapcore/pc-gadget",
+		gadgetDir,
+	)
+	err = gitCloneCommand.Run()
+	asserter.AssertErrNil(err, true)
 
-			asserter.AssertEqual(tc.expectedDeb822SourcesList, string(deb822SourcesListBytes))
-		})
+	// now set up the image definition to build from this directory
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: arch.GetHostArch(),
+		Series:       getHostSuite(),
+		Gadget: &imagedefinition.Gadget{
+			GadgetURL:  fmt.Sprintf("file://%s", gadgetDir),
+			GadgetType: "directory",
+		},
 	}
+
+	err = stateMachine.buildGadgetTree()
+	asserter.AssertErrNil(err, true)
+
+	// now make sure the gadget.yaml is in the expected location
+	// this was a bug reported by the CPC team
+	err = stateMachine.prepareGadgetTree()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.loadGadgetYaml()
+	asserter.AssertErrNil(err, true)
 }
 
-// TestSateMachine_fixFstab tests functionality of the fixFstab function
-func TestSateMachine_fixFstab(t *testing.T) {
-	t.Parallel()
+func TestStateMachine_buildGadgetTree_paths(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	asserter := helper.Asserter{T: t}
+	// git clone the gadget into a /tmp dir
+	originGadgetDir, err := os.MkdirTemp("", "pc-gadget-")
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() {
+		err = os.RemoveAll(originGadgetDir)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	gitCloneCommand := *exec.Command(
+		"git",
+		"clone",
+		"--depth",
+		"1",
+		"--branch",
+		"classic",
+		"https://github.com/snapcore/pc-gadget",
+		originGadgetDir,
+	)
+	err = gitCloneCommand.Run()
+	asserter.AssertErrNil(err, true)
+
+	tmpDir, err := os.MkdirTemp("", "")
+	t.Cleanup(func() {
+		err := osRemoveAll(tmpDir)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
 	testCases := []struct {
-		name          string
-		existingFstab string
-		expectedFstab string
+		name      string
+		gadgetDir string
 	}{
 		{
-			name:          "add entry to an existing but empty fstab",
-			existingFstab: "# UNCONFIGURED FSTAB",
-			expectedFstab: `LABEL=writable	/	ext4	discard,errors=remount-ro	0	1
-`,
-		},
-		{
-			name: "fix existing entry amongst several others",
-			existingFstab: `# /etc/fstab: static file system information.
-UUID=1565-1398	/	ext4	defaults	0	0
-#Here is another comment that should be left in place
-/dev/mapper/vgubuntu-swap_1	none	swap	sw	0	0
-`,
-			expectedFstab: `# /etc/fstab: static file system information.
-LABEL=writable	/	ext4	discard,errors=remount-ro	0	1
-#Here is another comment that should be left in place
-/dev/mapper/vgubuntu-swap_1	none	swap	sw	0	0
-`,
+			name:      "gadget URL poiting to an absolute dir",
+			gadgetDir: originGadgetDir,
 		},
 		{
-			name: "fix existing entry amongst several others (with spaces)",
-			existingFstab: `# /etc/fstab: static file system information.
-UUID=1565-1398	/	ext4	defaults	0	0
-/dev/mapper/vgubuntu-swap_1	none  swap sw      0   0
-`,
-			expectedFstab: `# /etc/fstab: static file system information.
-LABEL=writable	/	ext4	discard,errors=remount-ro	0	1
-/dev/mapper/vgubuntu-swap_1	none	swap	sw	0	0
-`,
+			name:      "gadget URL pointing to an absolute sub dir",
+			gadgetDir: filepath.Join(tmpDir, "a", "b"),
 		},
 		{
-			name: "fix only one root mount point",
-			existingFstab: `# /etc/fstab: static file system information.
-UUID=1565-1398	/	ext4	defaults	0	0
-UUID=1234-5678	/	ext4	defaults	0	0
-`,
-			expectedFstab: `# /etc/fstab: static file system information.
-LABEL=writable	/	ext4	discard,errors=remount-ro	0	1
-UUID=1234-5678	/	ext4	defaults	0	0
-`,
+			name:      "gadget URL pointing to a relative sub dir",
+			gadgetDir: filepath.Join("a", "b"),
 		},
 	}
 
 	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
+		t.Run("test_build_gadget_tree_paths_"+tc.name, func(t *testing.T) {
 			asserter := helper.Asserter{T: t}
 			restoreCWD := testhelper.SaveCWD()
 			defer restoreCWD()
@@ -2823,367 +5138,248 @@ UUID=1234-5678	/	ext4	defaults	0	0
 			var stateMachine ClassicStateMachine
 			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 			stateMachine.parent = &stateMachine
-			stateMachine.ImageDef = imagedefinition.ImageDefinition{
-				Architecture:  arch.GetHostArch(),
-				Series:        getHostSuite(),
-				Rootfs:        &imagedefinition.Rootfs{},
-				Customization: &imagedefinition.Customization{},
-			}
-
-			// set the defaults for the imageDef
-			err := helper.SetDefaults(&stateMachine.ImageDef)
-			asserter.AssertErrNil(err, true)
 
-			err = stateMachine.makeTemporaryDirectories()
+			err := stateMachine.makeTemporaryDirectories()
 			asserter.AssertErrNil(err, true)
+			t.Cleanup(func() {
+				err := os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+				if err != nil {
+					t.Error(err)
+				}
+			})
 
-			t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
-
-			// create the <chroot>/etc directory
-			err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.rootfs, "etc"), 0644)
-			asserter.AssertErrNil(err, true)
+			// move the original gadget dir to the desire location to test it will be found
+			if originGadgetDir != tc.gadgetDir {
+				fullGadgetDir := tc.gadgetDir
+				if !filepath.IsAbs(tc.gadgetDir) {
+					fullGadgetDir = filepath.Join(tmpDir, tc.gadgetDir)
+				}
 
-			fstabPath := filepath.Join(stateMachine.tempDirs.rootfs, "etc", "fstab")
+				err = os.MkdirAll(filepath.Dir(fullGadgetDir), 0777)
+				asserter.AssertErrNil(err, true)
 
-			// simulate an already existing fstab file
-			if len(tc.existingFstab) != 0 {
-				err = osWriteFile(fstabPath, []byte(tc.existingFstab), 0644)
+				err = os.Rename(originGadgetDir, fullGadgetDir)
 				asserter.AssertErrNil(err, true)
+				// move it back once the test is done
+				t.Cleanup(func() {
+					err := os.Rename(fullGadgetDir, originGadgetDir)
+					if err != nil {
+						t.Error(err)
+					}
+				})
 			}
 
-			err = stateMachine.fixFstab()
+			// now set up the image definition to build from this directory
+			stateMachine.ImageDef = imagedefinition.ImageDefinition{
+				Architecture: arch.GetHostArch(),
+				Series:       getHostSuite(),
+				Gadget: &imagedefinition.Gadget{
+					GadgetURL:  fmt.Sprintf("file://%s", tc.gadgetDir),
+					GadgetType: "directory",
+				},
+			}
+
+			err = stateMachine.setConfDefDir(filepath.Join(tmpDir, "image_definition.yaml"))
 			asserter.AssertErrNil(err, true)
 
-			fstabBytes, err := os.ReadFile(fstabPath)
+			err = stateMachine.buildGadgetTree()
+			asserter.AssertErrNil(err, true)
+
+			// now make sure the gadget.yaml is in the expected location
+			// this was a bug reported by the CPC team
+			err = stateMachine.prepareGadgetTree()
+			asserter.AssertErrNil(err, true)
+			err = stateMachine.loadGadgetYaml()
 			asserter.AssertErrNil(err, true)
-
-			if string(fstabBytes) != tc.expectedFstab {
-				t.Errorf("Expected fstab content \"%s\", but got \"%s\"",
-					tc.expectedFstab, string(fstabBytes))
-			}
 		})
 	}
 }
 
-// TestGeneratePackageManifest tests if classic image manifest generation works
-func TestGeneratePackageManifest(t *testing.T) {
+// TestGadgetGadgetTargets tests using alternate make targets with gadget builds
+func TestGadgetGadgetTargets(t *testing.T) {
 	testCases := []struct {
-		name            string
-		artifacts       *imagedefinition.Artifact
-		expectedContent []string
+		name           string
+		target         string
+		expectedOutput string
 	}{
 		{
-			name: "TestGeneratePackageManifest",
-			artifacts: &imagedefinition.Artifact{
-				Manifest: &imagedefinition.Manifest{
-					ManifestName: "filesystem.manifest",
-				},
-			},
-			expectedContent: []string{"foo 1.2", "bar 1.4-1ubuntu4.1", "libbaz 0.1.3ubuntu2"},
+			"default",
+			"",
+			"make target test1",
 		},
 		{
-			name: "TestGeneratePackageManifestV2",
-			artifacts: &imagedefinition.Artifact{
-				ManifestV2: &imagedefinition.Manifest{
-					ManifestName: "filesystem.manifest",
-				},
-			},
-			expectedContent: []string{"foo\t1.2", "bar\t1.4-1ubuntu4.1", "libbaz\t0.1.3ubuntu2", "snap:snapd\tstable\t25939"},
+			"test2",
+			"test2",
+			"make target test2",
 		},
 	}
-
 	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
+		t.Run("test_gadget_make_targets_"+tc.name, func(t *testing.T) {
 			asserter := helper.Asserter{T: t}
-
-			// Setup the exec.Command mock
-			testCaseName = tc.name
-			execCommand = fakeExecCommand
-			t.Cleanup(func() {
-				execCommand = exec.Command
-			})
-			// We need the output directory set for this
-			outputDir, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
-			asserter.AssertErrNil(err, true)
-			t.Cleanup(func() { os.RemoveAll(outputDir) })
+			restoreCWD := testhelper.SaveCWD()
+			defer restoreCWD()
 
 			var stateMachine ClassicStateMachine
 			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 			stateMachine.parent = &stateMachine
-			stateMachine.commonFlags.OutputDir = outputDir
-			stateMachine.ImageDef = imagedefinition.ImageDefinition{
+			stateMachine.commonFlags.Debug = true
+
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
+
+			wd, err := os.Getwd()
+			asserter.AssertErrNil(err, true)
+			gadgetSrc := filepath.Join(wd, "testdata", "gadget_source")
+			imageDef := imagedefinition.ImageDefinition{
 				Architecture: arch.GetHostArch(),
 				Series:       getHostSuite(),
-				Rootfs: &imagedefinition.Rootfs{
-					Archive: "ubuntu",
+				Gadget: &imagedefinition.Gadget{
+					GadgetURL:    fmt.Sprintf("file://%s", gadgetSrc),
+					GadgetType:   "directory",
+					GadgetTarget: tc.target,
 				},
-				Customization: &imagedefinition.Customization{},
-				Artifacts:     tc.artifacts,
 			}
-			err = osMkdirAll(stateMachine.commonFlags.OutputDir, 0755)
-			asserter.AssertErrNil(err, true)
-			t.Cleanup(func() { os.RemoveAll(stateMachine.commonFlags.OutputDir) })
+			stateMachine.ImageDef = imageDef
 
-			err = stateMachine.makeTemporaryDirectories()
+			// capture stdout, build the gadget tree, and make
+			// sure the expected output matches the make target
+			stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+			defer restoreStdout()
 			asserter.AssertErrNil(err, true)
-			t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
-
-			seedOpen = func(seedDir string, label string) (seed.Seed, error) {
-				return &mockSeed{
-					snaps: []*seed.Snap{
-						{
-							Path: "snapd_25939.snap",
-							SideInfo: &snap.SideInfo{
-								RealName: "snapd",
-								Revision: snap.R(25939),
-							},
-							Channel: "stable",
-						},
-					},
-					loadAssertionsFailure: seed.ErrNoAssertions,
-					loadMetaFailure:       nil,
-				}, nil
-			}
-			t.Cleanup(func() {
-				seedOpen = seed.Open
-			})
 
-			err = stateMachine.generatePackageManifest()
+			err = stateMachine.buildGadgetTree()
 			asserter.AssertErrNil(err, true)
 
-			os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
-			// Check if manifest file got generated and if it has expected contents
-			manifestPath := filepath.Join(stateMachine.commonFlags.OutputDir, "filesystem.manifest")
-			manifestBytes, err := os.ReadFile(manifestPath)
+			// restore stdout and examine what was printed
+			restoreStdout()
+			readStdout, err := io.ReadAll(stdout)
 			asserter.AssertErrNil(err, true)
-			// The order of packages shouldn't matter
-			examplePackages := tc.expectedContent
-			for _, pkg := range examplePackages {
-				if !strings.Contains(string(manifestBytes), pkg) {
-					t.Errorf("filesystem.manifest does not contain expected package: %s", pkg)
-				}
+			if !strings.Contains(string(readStdout), tc.expectedOutput) {
+				t.Errorf("Expected make output\n\"%s\"\nto contain the string \"%s\"",
+					string(readStdout),
+					tc.expectedOutput,
+				)
 			}
 		})
 	}
 }
 
-// TestFailedGeneratePackageManifest tests if classic manifest generation failures are reported
-func TestFailedGeneratePackageManifest(t *testing.T) {
+// TestFailedBuildGadgetTree tests failures in the  buildGadgetTree function
+func TestFailedBuildGadgetTree(t *testing.T) {
 	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 	stateMachine.parent = &stateMachine
-	stateMachine.ImageDef = imagedefinition.ImageDefinition{
-		Architecture: arch.GetHostArch(),
-		Series:       getHostSuite(),
-		Rootfs: &imagedefinition.Rootfs{
-			Archive: "ubuntu",
-		},
-		Customization: &imagedefinition.Customization{},
-		Artifacts: &imagedefinition.Artifact{
-			Manifest: &imagedefinition.Manifest{
-				ManifestName: "filesystem.manifest",
-			},
-		},
-	}
 
-	// We need the output directory set for this
-	outputDir, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
+	err := stateMachine.makeTemporaryDirectories()
 	asserter.AssertErrNil(err, true)
-	t.Cleanup(func() { os.RemoveAll(outputDir) })
-	stateMachine.commonFlags.OutputDir = outputDir
-
-	// Setup the exec.Command mock - version from the success test
-	testCaseName = "TestGeneratePackageManifest"
-	execCommand = fakeExecCommand
-	t.Cleanup(func() {
-		execCommand = exec.Command
-	})
-
-	// Setup the mock for os.Create, making those fail
-	osCreate = mockCreate
-	t.Cleanup(func() {
-		osCreate = os.Create
-	})
-
-	err = stateMachine.generatePackageManifest()
-	asserter.AssertErrContains(err, "Error creating manifest file")
-	osCreate = os.Create
 
-	// Setup the exec.Command mock - version from the fail test
-	testCaseName = "TestFailedGeneratePackageManifest"
-	execCommand = fakeExecCommand
+	// mock os.MkdirAll
+	osMkdir = mockMkdir
 	t.Cleanup(func() {
-		execCommand = exec.Command
+		osMkdir = os.Mkdir
 	})
-	err = stateMachine.generatePackageManifest()
-	asserter.AssertErrContains(err, "Error generating package list with command")
-}
+	err = stateMachine.buildGadgetTree()
+	asserter.AssertErrContains(err, "Error creating scratch/gadget")
+	osMkdir = os.Mkdir
 
-// TestFailedGeneratePackageManifestV2 tests if classic manifest generation failures are reported
-func TestFailedGeneratePackageManifestV2(t *testing.T) {
-	asserter := helper.Asserter{T: t}
-	var stateMachine ClassicStateMachine
-	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.parent = &stateMachine
-	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+	// try to clone a repo that doesn't exist
+	imageDef := imagedefinition.ImageDefinition{
 		Architecture: arch.GetHostArch(),
 		Series:       getHostSuite(),
-		Rootfs: &imagedefinition.Rootfs{
-			Archive: "ubuntu",
-		},
-		Customization: &imagedefinition.Customization{},
-		Artifacts: &imagedefinition.Artifact{
-			ManifestV2: &imagedefinition.Manifest{
-				ManifestName: "filesystem.manifest",
-			},
+		Gadget: &imagedefinition.Gadget{
+			GadgetURL:  "http://fakerepo.git",
+			GadgetType: "git",
 		},
 	}
+	stateMachine.ImageDef = imageDef
 
-	// We need the output directory set for this
-	outputDir, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
-	asserter.AssertErrNil(err, true)
-	t.Cleanup(func() { os.RemoveAll(outputDir) })
-	stateMachine.commonFlags.OutputDir = outputDir
-
-	// Setup the mock for exec.Command - making those fail
-	testCaseName = "TestFailedGeneratePackageManifestV2"
-	execCommand = fakeExecCommand
-	t.Cleanup(func() {
-		execCommand = exec.Command
-	})
-	err = stateMachine.generatePackageManifest()
-	asserter.AssertErrContains(err, "Error generating package list with command")
-
-	// Setup the mock for exec.Command - making those succeed
-	testCaseName = "TestGeneratePackageManifestV2"
-	// Setup the mock for os.Create, making those fail
-	osCreate = mockCreate
-	t.Cleanup(func() {
-		osCreate = os.Create
-	})
-	err = stateMachine.generatePackageManifest()
-	asserter.AssertErrContains(err, "Error creating manifest file")
-
-	osCreate = os.Create
-	// Setup the mock seed - making those failed on seedOpen
-	seedOpen = func(seedDir string, label string) (seed.Seed, error) {
-		return nil, fmt.Errorf("fail")
-	}
-	t.Cleanup(func() {
-		seedOpen = seed.Open
-	})
-	err = stateMachine.generatePackageManifest()
-	asserter.AssertErrContains(err, "Error opening the seed file")
-
-	// Setup the mock seed - making those failed on LoadAssertion
-	seedOpen = func(seedDir string, label string) (seed.Seed, error) {
-		return &mockSeed{
-			snaps: []*seed.Snap{
-				{},
-			},
-			loadAssertionsFailure: fmt.Errorf("fail"),
-			loadMetaFailure:       nil,
-		}, nil
-	}
-	err = stateMachine.generatePackageManifest()
-	asserter.AssertErrContains(err, "Error loading assertions")
-
-	// Setup the mock seed - making those failed on LoadMeta
-	seedOpen = func(seedDir string, label string) (seed.Seed, error) {
-		return &mockSeed{
-			snaps: []*seed.Snap{
-				{},
-			},
-			loadAssertionsFailure: nil,
-			loadMetaFailure:       fmt.Errorf("fail"),
-		}, nil
+	err = stateMachine.buildGadgetTree()
+	asserter.AssertErrContains(err, "Error cloning gadget repository")
+
+	// try to copy a file that doesn't exist
+	imageDef = imagedefinition.ImageDefinition{
+		Architecture: arch.GetHostArch(),
+		Series:       getHostSuite(),
+		Gadget: &imagedefinition.Gadget{
+			GadgetURL:  "file:///fake/file/that/does/not/exist",
+			GadgetType: "directory",
+		},
 	}
-	err = stateMachine.generatePackageManifest()
-	asserter.AssertErrContains(err, "Error loading meta-data")
+	stateMachine.ImageDef = imageDef
 
-	// Setup the mock seed - making those failed on Iter callback (bad path)
-	seedOpen = func(seedDir string, label string) (seed.Seed, error) {
-		return &mockSeed{
-			snaps: []*seed.Snap{
-				{
-					Path: "snapd25939.snap",
-					SideInfo: &snap.SideInfo{
-						RealName: "snapd",
-						Revision: snap.R(25939),
-					},
-					Channel: "stable",
-				},
-			},
-			loadAssertionsFailure: seed.ErrNoAssertions,
-			loadMetaFailure:       nil,
-		}, nil
+	err = stateMachine.buildGadgetTree()
+	asserter.AssertErrContains(err, "Error reading gadget tree")
+
+	// mock osutil.CopySpecialFile and run with /tmp as the gadget source
+	imageDef = imagedefinition.ImageDefinition{
+		Architecture: arch.GetHostArch(),
+		Series:       getHostSuite(),
+		Gadget: &imagedefinition.Gadget{
+			GadgetURL:  "file:///tmp",
+			GadgetType: "directory",
+		},
 	}
-	err = stateMachine.generatePackageManifest()
-	asserter.AssertErrContains(err, "Error parsing snap filename")
-}
+	stateMachine.ImageDef = imageDef
 
-// TestGenerateFilelist tests if classic image filelist generation works
-func TestGenerateFilelist(t *testing.T) {
-	asserter := helper.Asserter{T: t}
+	// mock osutil.CopySpecialFile
+	osutilCopySpecialFile = mockCopySpecialFile
+	t.Cleanup(func() {
+		osutilCopySpecialFile = osutil.CopySpecialFile
+	})
+	err = stateMachine.buildGadgetTree()
+	asserter.AssertErrContains(err, "Error copying gadget source")
+	osutilCopySpecialFile = osutil.CopySpecialFile
 
-	// Setup the exec.Command mock
-	testCaseName = "TestGenerateFilelist"
+	// run a "make" command that will fail by mocking exec.Command
+	testCaseName = "TestFailedBuildGadgetTree"
 	execCommand = fakeExecCommand
 	t.Cleanup(func() {
 		execCommand = exec.Command
 	})
-	// We need the output directory set for this
-	outputDir, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
+	wd, err := os.Getwd()
 	asserter.AssertErrNil(err, true)
-	t.Cleanup(func() { os.RemoveAll(outputDir) })
-
-	var stateMachine ClassicStateMachine
-	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.parent = &stateMachine
-	stateMachine.commonFlags.OutputDir = outputDir
-	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+	sourcePath := filepath.Join(wd, "testdata", "gadget_source")
+	sourcePath = "file://" + sourcePath
+	imageDef = imagedefinition.ImageDefinition{
 		Architecture: arch.GetHostArch(),
 		Series:       getHostSuite(),
-		Rootfs: &imagedefinition.Rootfs{
-			Archive: "ubuntu",
-		},
-		Customization: &imagedefinition.Customization{},
-		Artifacts: &imagedefinition.Artifact{
-			Filelist: &imagedefinition.Filelist{
-				FilelistName: "filesystem.filelist",
-			},
+		Gadget: &imagedefinition.Gadget{
+			GadgetURL:  sourcePath,
+			GadgetType: "directory",
 		},
 	}
-	err = osMkdirAll(stateMachine.commonFlags.OutputDir, 0755)
-	asserter.AssertErrNil(err, true)
-	t.Cleanup(func() { os.RemoveAll(stateMachine.commonFlags.OutputDir) })
+	stateMachine.ImageDef = imageDef
 
-	err = stateMachine.generateFilelist()
-	asserter.AssertErrNil(err, true)
+	err = stateMachine.buildGadgetTree()
+	asserter.AssertErrContains(err, "Error running \"make\" in gadget source")
+
+	// foreign architectures without a qemu static binary cannot be built in a chroot
+	unsupportedArch := "s390x"
+	if arch.GetHostArch() == unsupportedArch {
+		unsupportedArch = "riscv64"
+	}
+	stateMachine.ImageDef.Architecture = unsupportedArch
+	stateMachine.ImageDef.Gadget.BuildInChroot = helper.BoolPtr(true)
+
+	err = stateMachine.buildGadgetTree()
+	asserter.AssertErrContains(err, "unsupported architecture for building the gadget in a chroot")
 
 	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
-	// Check if filelist file got generated
-	filelistPath := filepath.Join(stateMachine.commonFlags.OutputDir, "filesystem.filelist")
-	_, err = os.Stat(filelistPath)
-	asserter.AssertErrNil(err, true)
 }
 
-// TestFailedGenerateFilelist tests if classic filelist generation failures are reported
-func TestFailedGenerateFilelist(t *testing.T) {
+// TestCreateChroot runs the createChroot step and spot checks that some
+// expected files in the chroot exist
+func TestCreateChroot(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
 	asserter := helper.Asserter{T: t}
-
-	// Setup the exec.Command mock - version from the success test
-	testCaseName = "TestGenerateFilelist"
-	execCommand = fakeExecCommand
-	defer func() {
-		execCommand = exec.Command
-	}()
-	// Setup the mock for os.Create, making those fail
-	osCreate = mockCreate
-	defer func() {
-		osCreate = os.Create
-	}()
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
 
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
@@ -3192,900 +5388,949 @@ func TestFailedGenerateFilelist(t *testing.T) {
 		Architecture: arch.GetHostArch(),
 		Series:       getHostSuite(),
 		Rootfs: &imagedefinition.Rootfs{
-			Archive: "ubuntu",
-		},
-		Customization: &imagedefinition.Customization{},
-		Artifacts: &imagedefinition.Artifact{
-			Filelist: &imagedefinition.Filelist{
-				FilelistName: "filesystem.filelist",
-			},
+			Pocket:            "proposed",
+			SourcesListDeb822: helper.BoolPtr(true),
 		},
 	}
 
-	// We need the output directory set for this
-	outputDir, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
+	err := helper.SetDefaults(&stateMachine.ImageDef)
 	asserter.AssertErrNil(err, true)
-	t.Cleanup(func() { os.RemoveAll(outputDir) })
-	stateMachine.commonFlags.OutputDir = outputDir
 
-	// Setup the exec.Command mock - version from the success test
-	testCaseName = "TestGenerateFilelist"
-	execCommand = fakeExecCommand
-	defer func() {
-		execCommand = exec.Command
-	}()
+	err = stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
 
-	// Setup the mock for os.Create, making those fail
-	osCreate = mockCreate
-	defer func() {
-		osCreate = os.Create
-	}()
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-	err = stateMachine.generateFilelist()
-	asserter.AssertErrContains(err, "Error creating filelist")
-	osCreate = os.Create
+	err = stateMachine.createChroot()
+	asserter.AssertErrNil(err, true)
 
-	// Setup the exec.Command mock - version from the fail test
-	testCaseName = "TestFailedGenerateFilelist"
-	execCommand = fakeExecCommand
-	defer func() {
-		execCommand = exec.Command
-	}()
-	err = stateMachine.generateFilelist()
-	asserter.AssertErrContains(err, "Error generating file list with command")
-}
+	expectedFiles := []string{
+		"etc",
+		"home",
+		"boot",
+		"var",
+	}
+	for _, expectedFile := range expectedFiles {
+		fullPath := filepath.Join(stateMachine.tempDirs.chroot, expectedFile)
+		_, err := os.Stat(fullPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				t.Errorf("File \"%s\" should exist, but does not", fullPath)
+			}
+		}
+	}
 
-// TestSuccessfulClassicRun runs through a full classic state machine run and ensures
-// it is successful. It creates a .img and a .qcow2 file, ensures they are the
-// correct file types, it mounts the resulting .img and ensures grub was updated
-func TestSuccessfulClassicRun(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
+	// check that the hostname is set correctly
+	hostnameFile := filepath.Join(stateMachine.tempDirs.chroot, "etc", "hostname")
+	hostnameData, err := os.ReadFile(hostnameFile)
+	asserter.AssertErrNil(err, true)
+	if string(hostnameData) != "ubuntu\n" {
+		t.Errorf("Expected hostname to be \"ubuntu\", but is \"%s\"", string(hostnameData))
 	}
 
-	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	t.Cleanup(restoreCWD)
+	// check that the resolv.conf file was truncated
+	resolvConfFile := filepath.Join(stateMachine.tempDirs.chroot, "etc", "resolv.conf")
+	resolvConfData, err := os.ReadFile(resolvConfFile)
+	asserter.AssertErrNil(err, true)
+	if string(resolvConfData) != "" {
+		t.Errorf("Expected resolv.conf to be empty, but is \"%s\"", string(resolvConfData))
+	}
 
-	// We need the output directory set for this
-	outputDir, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
+	// check if components and pocket correctly setup in /etc/apt/sources.list.d/ubuntu.sources
+	aptDeb822SourcesListBytes, err := os.ReadFile(filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "sources.list.d", "ubuntu.sources"))
 	asserter.AssertErrNil(err, true)
-	t.Cleanup(func() { os.RemoveAll(outputDir) })
+	wantAptDeb822SourcesList := `## Ubuntu distribution repository
+##
+## The following settings can be adjusted to configure which packages to use from Ubuntu.
+## Mirror your choices (except for URIs and Suites) in the security section below to
+## ensure timely security updates.
+##
+## Types: Append deb-src to enable the fetching of source package.
+## URIs: A URL to the repository (you may add multiple URLs)
+## Suites: The following additional suites can be configured
+##   <name>-updates   - Major bug fix updates produced after the final release of the
+##                      distribution.
+##   <name>-backports - software from this repository may not have been tested as
+##                      extensively as that contained in the main release, although it includes
+##                      newer versions of some applications which may provide useful features.
+##                      Also, please note that software in backports WILL NOT receive any review
+##                      or updates from the Ubuntu security team.
+## Components: Aside from main, the following components can be added to the list
+##   restricted  - Software that may not be under a free license, or protected by patents.
+##   universe    - Community maintained packages. Software in this repository receives maintenance
+##                 from volunteers in the Ubuntu community, or a 10 year security maintenance
+##                 commitment from Canonical when an Ubuntu Pro subscription is attached.
+##   multiverse  - Community maintained of restricted. Software from this repository is
+##                 ENTIRELY UNSUPPORTED by the Ubuntu team, and may not be under a free
+##                 licence. Please satisfy yourself as to your rights to use the software.
+##                 Also, please note that software in multiverse WILL NOT receive any
+##                 review or updates from the Ubuntu security team.
+##
+## See the sources.list(5) manual page for further settings.
+Types: deb
+URIs: http://archive.ubuntu.com/ubuntu/
+Suites: noble noble-updates noble-proposed
+Components: main restricted
+Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+
+## Ubuntu security updates. Aside from URIs and Suites,
+## this should mirror your choices in the previous section.
+Types: deb
+URIs: http://security.ubuntu.com/ubuntu/
+Suites: noble-security
+Components: main restricted
+Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+
+`
+	asserter.AssertEqual(wantAptDeb822SourcesList, string(aptDeb822SourcesListBytes))
+}
+
+// TestFailedCreateChroot tests failure cases in createChroot
+func TestFailedCreateChroot(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
 
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 	stateMachine.parent = &stateMachine
-	stateMachine.commonFlags.Debug = true
-	stateMachine.commonFlags.Size = "3G"
-	stateMachine.commonFlags.OutputDir = outputDir
-	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
-		"test_amd64.yaml")
-
-	err = stateMachine.Setup()
-	asserter.AssertErrNil(err, true)
-
-	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: arch.GetHostArch(),
+		Series:       getHostSuite(),
+		Rootfs: &imagedefinition.Rootfs{
+			SourcesListDeb822: helper.BoolPtr(false),
+		},
+	}
 
-	err = stateMachine.Run()
+	err := stateMachine.makeTemporaryDirectories()
 	asserter.AssertErrNil(err, true)
 
+	// mock os.Mkdir
+	osMkdir = mockMkdir
 	t.Cleanup(func() {
-		err = stateMachine.Teardown()
-		asserter.AssertErrNil(err, true)
+		osMkdir = os.Mkdir
 	})
+	err = stateMachine.createChroot()
+	asserter.AssertErrContains(err, "Failed to create chroot")
+	osMkdir = os.Mkdir
 
-	testHelperCheckPPAInstalled(t, &asserter, stateMachine.tempDirs.chroot)
-	testHelperCheckSnapInstalled(t, &asserter, stateMachine.tempDirs.chroot)
-
-	artifacts := map[string]string{
-		"pc-amd64.img":            "DOS/MBR boot sector",
-		"pc-amd64.qcow2":          `QEMU QCOW2? Image \(v3\)`,
-		"filesystem-manifest.txt": "text",
-		"filesystem-filelist.txt": "text",
-	}
-	testHelperCheckArtifacts(t, &asserter, stateMachine.commonFlags.OutputDir, artifacts)
-
-	// create a directory in which to mount the rootfs
-	mountDir := filepath.Join(stateMachine.tempDirs.scratch, "loopback")
-	bootUEFIDir := filepath.Join(mountDir, "boot", "efi")
-	var setupImageCmds []*exec.Cmd
-	var teardownImageCmds []*exec.Cmd
-
+	// Setup the exec.Command mock
+	testCaseName = "TestFailedCreateChroot"
+	execCommand = fakeExecCommand
 	t.Cleanup(func() {
-		for _, teardownCmd := range teardownImageCmds {
-			if tmpErr := teardownCmd.Run(); tmpErr != nil {
-				if err != nil {
-					err = fmt.Errorf("%s after previous error: %w", tmpErr, err)
-				} else {
-					err = tmpErr
-				}
-			}
-		}
+		execCommand = exec.Command
 	})
+	err = stateMachine.createChroot()
+	asserter.AssertErrContains(err, "Error running debootstrap command")
+	execCommand = exec.Command
 
-	imgPath := filepath.Join(stateMachine.commonFlags.OutputDir, "pc-amd64.img")
+	// Check if failure of open hostname file is detected
 
-	// set up the loopback device
-	loopUsed, losetupDetachCmd, err := associateLoopDevice(imgPath, stateMachine.SectorSize)
+	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+	err = stateMachine.makeTemporaryDirectories()
 	asserter.AssertErrNil(err, true)
 
-	teardownImageCmds = append(teardownImageCmds, losetupDetachCmd)
+	// Prepare a fallthrough debootstrap
+	testCaseName = "TestFailedCreateChrootNoHostname"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() {
+		execCommand = exec.Command
+	})
+	osOpenFile = mockOpenFile
+	t.Cleanup(func() {
+		osOpenFile = os.OpenFile
+	})
 
-	setupImageCmds = append(setupImageCmds,
-		//nolint:gosec,G204
-		exec.Command("mount", fmt.Sprintf("%sp3", loopUsed), mountDir), // with this example the rootfs is partition 3 mountDir
-		//nolint:gosec,G204
-		exec.Command("mount", fmt.Sprintf("%sp2", loopUsed), bootUEFIDir), // with this example the boot partition is partition 2
-	)
+	err = stateMachine.createChroot()
+	asserter.AssertErrContains(err, "unable to open hostname file")
 
-	teardownImageCmds = append([]*exec.Cmd{
-		//nolint:gosec,G204
-		exec.Command("mount", "--make-rprivate", mountDir),
-		//nolint:gosec,G204
-		exec.Command("umount", "--recursive", mountDir),
-	}, teardownImageCmds...,
-	)
+	osOpenFile = os.OpenFile
+	execCommand = exec.Command
 
-	// set up the mountpoints
-	mountPoints := []mountPoint{
-		{
-			src:      "devtmpfs-build",
-			basePath: mountDir,
-			relpath:  "/dev",
-			typ:      "devtmpfs",
-		},
-		{
-			src:      "devpts-build",
-			basePath: mountDir,
-			relpath:  "/dev/pts",
-			typ:      "devpts",
-			opts:     []string{"nodev", "nosuid"},
-		},
-		{
-			src:      "proc-build",
-			basePath: mountDir,
-			relpath:  "/proc",
-			typ:      "proc",
-		},
-		{
-			src:      "sysfs-build",
-			basePath: mountDir,
-			relpath:  "/sys",
-			typ:      "sysfs",
-		},
-	}
-	for _, mp := range mountPoints {
-		mountCmds, umountCmds, err := mp.getMountCmd()
-		if err != nil {
-			t.Errorf("Error preparing mountpoint \"%s\": \"%s\"",
-				mp.relpath,
-				err.Error(),
-			)
-		}
-		setupImageCmds = append(setupImageCmds, mountCmds...)
-		teardownImageCmds = append(umountCmds, teardownImageCmds...)
-	}
+	// Check if failure of truncation is detected
 
-	teardownImageCmds = append([]*exec.Cmd{execCommand("udevadm", "settle")}, teardownImageCmds...)
+	// Clean the work directory
+	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+	err = stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
 
-	// now run all the commands to mount the image
-	for _, cmd := range setupImageCmds {
-		outPut := helper.SetCommandOutput(cmd, true)
-		err := cmd.Run()
-		if err != nil {
-			t.Errorf("Error running command \"%s\". Error is \"%s\". Output is: \n%s",
-				cmd.String(), err.Error(), outPut.String())
-		}
-	}
+	// Prepare a fallthrough debootstrap
+	testCaseName = "TestFailedCreateChrootSkip"
+	osTruncate = mockTruncate
+	t.Cleanup(func() {
+		osTruncate = os.Truncate
+	})
+	err = stateMachine.createChroot()
+	asserter.AssertErrContains(err, "Error truncating resolv.conf")
+	osTruncate = os.Truncate
+	execCommand = exec.Command
 
-	testHelperCheckMakeDirs(t, mountDir)
-	testHelperCheckAddUser(t, &asserter, mountDir)
-	testHelperCheckGrubConfig(t, mountDir)
-	testHelperCheckUEFIConfig(t, mountDir)
-	testHelperCheckCleanedFiles(t, mountDir)
-	testHelperCheckLocaleFile(t, &asserter, mountDir)
-	testHelperCheckSourcesList(t, &asserter, mountDir)
+	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
 }
 
-func testHelperCheckPPAInstalled(t *testing.T, asserter *helper.Asserter, chroot string) {
-	t.Helper()
-	files := []string{
-		filepath.Join(chroot, "usr", "bin", "hello-ubuntu-image-public"),
-		filepath.Join(chroot, "usr", "bin", "hello-ubuntu-image-private"),
-	}
-	for _, file := range files {
-		_, err := os.Stat(file)
-		asserter.AssertErrNil(err, true)
-	}
-}
+// TestStateMachine_installPackages_checkcmds checks commands to install packages order is ok
+func TestStateMachine_installPackages_checkcmds(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Debug = true
+	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.OutputDir = testhelper.DefaultTmpDir
 
-func testHelperCheckSnapInstalled(t *testing.T, asserter *helper.Asserter, chroot string) {
-	t.Helper()
-	type snapList struct {
-		Snaps []struct {
-			Name    string `yaml:"name"`
-			Channel string `yaml:"channel"`
-		} `yaml:"snaps"`
-	}
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	err = os.MkdirAll(stateMachine.tempDirs.chroot, 0755)
+	asserter.AssertErrNil(err, true)
 
-	seedYaml := filepath.Join(chroot,
-		"var", "lib", "snapd", "seed", "seed.yaml")
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-	seedFile, err := os.Open(seedYaml)
+	// create an /usr/sbin/policy-rc.d in the chroot
+	err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.chroot, "usr", "sbin"), 0755)
+	asserter.AssertErrNil(err, true)
+	_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "usr", "sbin", "policy-rc.d"))
 	asserter.AssertErrNil(err, true)
-	defer seedFile.Close()
 
-	var seededSnaps snapList
-	err = yaml.NewDecoder(seedFile).Decode(&seededSnaps)
+	// create an /sbin/start-stop-daemon in the chroot
+	err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.chroot, "sbin"), 0755)
+	asserter.AssertErrNil(err, true)
+	_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "sbin", "start-stop-daemon"))
 	asserter.AssertErrNil(err, true)
 
-	expectedSnapChannels := map[string]string{
-		"hello":  "candidate",
-		"core20": "stable",
-	}
+	// create an /sbin/initctl in the chroot
+	_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "sbin", "initctl"))
+	asserter.AssertErrNil(err, true)
 
-	for _, seededSnap := range seededSnaps.Snaps {
-		channel, found := expectedSnapChannels[seededSnap.Name]
-		if found {
-			if channel != seededSnap.Channel {
-				t.Errorf("Expected snap %s to be pre-seeded with channel %s, but got %s",
-					seededSnap.Name, channel, seededSnap.Channel)
-			}
-		}
+	// Mock helper.Divert* functions
+	mock := func(targetDir string, debug bool) (func() error, func(error) error) {
+		return func() error { return nil }, func(error) error { return nil }
 	}
-}
-
-func testHelperCheckArtifacts(t *testing.T, asserter *helper.Asserter, outputDir string, artifacts map[string]string) {
-	t.Helper()
-	for artifact, fileType := range artifacts {
-		fullPath := filepath.Join(outputDir, artifact)
-		_, err := os.Stat(fullPath)
-		if err != nil {
-			if os.IsNotExist(err) {
-				t.Errorf("File \"%s\" should exist, but does not", fullPath)
-			}
-		}
-
-		// check it is the expected file type
-		fileCommand := *exec.Command("file", fullPath)
-		cmdOutput, err := fileCommand.CombinedOutput()
-		asserter.AssertErrNil(err, true)
+	helperDivertPolicyRcD = mock
+	helperDivertStartStopDaemon = mock
+	helperDivertInitctl = mock
+	t.Cleanup(func() {
+		helperDivertPolicyRcD = helper.DivertPolicyRcD
+		helperDivertStartStopDaemon = helper.DivertStartStopDaemon
+		helperDivertInitctl = helper.DivertInitctl
+	})
 
-		fileTypeRegex := regexp.MustCompile(fileType)
+	mockCmder := NewMockExecCommand()
 
-		if !fileTypeRegex.Match([]byte(cmdOutput)) {
-			t.Errorf("File \"%s\" is the wrong file type. Expected \"%s\" but got \"%s\"",
-				fullPath, fileType, string(cmdOutput))
-		}
-	}
-}
+	execCommand = mockCmder.Command
+	t.Cleanup(func() { execCommand = exec.Command })
 
-func testHelperCheckMakeDirs(t *testing.T, mountDir string) {
-	t.Helper()
-	addedDir := filepath.Join(mountDir, "etc", "foo", "bar")
-	_, err := os.Stat(addedDir)
-	if err != nil {
-		if os.IsNotExist(err) {
-			t.Errorf("Directory \"%s\" should exist, but does not", addedDir)
-		}
-	}
-}
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
 
-func testHelperCheckAddUser(t *testing.T, asserter *helper.Asserter, mountDir string) {
-	t.Helper()
-	shadowPath := filepath.Join(mountDir, "etc", "shadow")
-	shadowFile, err := os.Open(shadowPath)
+	helperBackupAndCopyResolvConf = mockBackupAndCopyResolvConfSuccess
+	t.Cleanup(func() {
+		helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
+	})
+
+	err = stateMachine.installPackages()
 	asserter.AssertErrNil(err, true)
-	defer shadowFile.Close()
-	ubuntu2Found := false
-	ubuntu2Line := ""
 
-	scanner := bufio.NewScanner(shadowFile)
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
 
-	for scanner.Scan() {
-		if strings.HasPrefix(scanner.Text(), "ubuntu2") {
-			ubuntu2Line = scanner.Text()
-			ubuntu2Found = true
-			break
-		}
+	expectedCmds := []*regexp.Regexp{
+		regexp.MustCompile("^mount -t devtmpfs devtmpfs-build /var/tmp.*/chroot/dev$"),
+		regexp.MustCompile("^mount -t devpts devpts-build -o nodev,nosuid /var/tmp.*/chroot/dev/pts$"),
+		regexp.MustCompile("^mount -t proc proc-build /var/tmp.*/chroot/proc$"),
+		regexp.MustCompile("^mount -t sysfs sysfs-build /var/tmp.*/chroot/sys$"),
+		regexp.MustCompile("^mount --bind .*/scratch/run.* .*/chroot/run$"),
+		regexp.MustCompile("^chroot /var/tmp.*/chroot apt update$"),
+		regexp.MustCompile("^chroot /var/tmp.*/chroot apt --assume-yes --quiet --option=Dpkg::options::=--force-unsafe-io --option=Dpkg::Options::=--force-confold install$"),
+		regexp.MustCompile("^udevadm settle$"),
+		regexp.MustCompile("^mount --make-rprivate /var/tmp.*/chroot/run$"),
+		regexp.MustCompile("^umount --recursive /var/tmp.*/chroot/run$"),
+		regexp.MustCompile("^mount --make-rprivate /var/tmp.*/chroot/sys$"),
+		regexp.MustCompile("^umount --recursive /var/tmp.*/chroot/sys$"),
+		regexp.MustCompile("^mount --make-rprivate /var/tmp.*/chroot/proc$"),
+		regexp.MustCompile("^umount --recursive /var/tmp.*/chroot/proc$"),
+		regexp.MustCompile("^mount --make-rprivate /var/tmp.*/chroot/dev/pts$"),
+		regexp.MustCompile("^umount --recursive /var/tmp.*/chroot/dev/pts$"),
+		regexp.MustCompile("^mount --make-rprivate /var/tmp.*/chroot/dev$"),
+		regexp.MustCompile("^umount --recursive /var/tmp.*/chroot/dev$"),
 	}
 
-	if !ubuntu2Found {
-		t.Error("ubuntu2 user not created")
+	gotCmds := strings.Split(strings.TrimSpace(string(readStdout)), "\n")
+	if len(expectedCmds) != len(gotCmds) {
+		t.Fatalf("%v commands to be executed, expected %v commands. Got: %v", len(gotCmds), len(expectedCmds), gotCmds)
 	}
 
-	expire := strings.Split(ubuntu2Line, ":")[2]
-
-	if expire != "0" {
-		t.Error("ubuntu2 user password should be expired")
-	}
-}
+	for i, gotCmd := range gotCmds {
+		expected := expectedCmds[i]
 
-func testHelperCheckGrubConfig(t *testing.T, mountDir string) {
-	t.Helper()
-	grubCfg := filepath.Join(mountDir, "boot", "grub", "grub.cfg")
-	_, err := os.Stat(grubCfg)
-	if err != nil {
-		if os.IsNotExist(err) {
-			t.Errorf("File \"%s\" should exist, but does not", grubCfg)
+		if !expected.Match([]byte(gotCmd)) {
+			t.Errorf("Cmd \"%v\" not matching. Expected %v\n", gotCmd, expected.String())
 		}
 	}
 }
 
-func testHelperCheckUEFIConfig(t *testing.T, mountDir string) {
-	t.Helper()
-	uefiFiles := []string{
-		filepath.Join(mountDir, "boot", "efi", "EFI", "BOOT"),
-		filepath.Join(mountDir, "boot", "efi", "EFI", "ubuntu", "grub.cfg"),
-	}
-	for _, f := range uefiFiles {
-		_, err := os.Stat(f)
-		if err != nil {
-			if os.IsNotExist(err) {
-				t.Errorf("File/Directory \"%s\" should exist, but does not", f)
-			}
-		}
-	}
-}
+// TestStateMachine_buildGadgetTreeInChroot_checkcmds checks commands to build
+// a foreign architecture gadget in a chroot are run in the right order
+func TestStateMachine_buildGadgetTreeInChroot_checkcmds(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Debug = true
+	stateMachine.parent = &stateMachine
 
-func testHelperCheckCleanedFiles(t *testing.T, mountDir string) {
-	t.Helper()
-	cleaned := []string{
-		filepath.Join(mountDir, "var", "lib", "dbus", "machine-id"),
-		filepath.Join(mountDir, "etc", "ssh", "ssh_host_rsa_key"),
-		filepath.Join(mountDir, "etc", "ssh", "ssh_host_rsa_key.pub"),
-		filepath.Join(mountDir, "etc", "ssh", "ssh_host_ecdsa_key"),
-		filepath.Join(mountDir, "etc", "ssh", "ssh_host_ecdsa_key.pub"),
-		filepath.Join(mountDir, "usr", "sbin", "policy-rc.d"),
-		filepath.Join(mountDir, "sbin", "start-stop-daemon.REAL"),
-		filepath.Join(mountDir, "sbin", "initctl.REAL"),
-	}
-	for _, file := range cleaned {
-		_, err := os.Stat(file)
-		if !os.IsNotExist(err) {
-			t.Errorf("File %s should not exist, but does", file)
-		}
+	foreignArch := "arm64"
+	if arch.GetHostArch() == foreignArch {
+		foreignArch = "armhf"
 	}
+	// the built gadget tree replaces the install directory of the source
+	gadgetSource := t.TempDir()
+	err := os.MkdirAll(filepath.Join(gadgetSource, "install"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(gadgetSource, "install", "gadget.yaml"), []byte("volumes:\n"), 0644)
+	asserter.AssertErrNil(err, true)
 
-	truncated := []string{
-		filepath.Join(mountDir, "etc", "machine-id"),
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: foreignArch,
+		Series:       "noble",
+		Gadget: &imagedefinition.Gadget{
+			GadgetURL:     "file://" + gadgetSource,
+			GadgetType:    "directory",
+			GadgetTarget:  "test",
+			BuildInChroot: helper.BoolPtr(true),
+			BuildDeps:     []string{"gcc"},
+		},
+		Rootfs: &imagedefinition.Rootfs{
+			Mirror: "http://ports.ubuntu.com/",
+		},
 	}
-	for _, file := range truncated {
-		fileInfo, err := os.Stat(file)
-		if os.IsNotExist(err) {
-			t.Errorf("File %s should exist, but does not", file)
-		}
 
-		if fileInfo.Size() != 0 {
-			t.Errorf("File %s should be empty, but it is not. Size: %v", file, fileInfo.Size())
+	err = stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	mockCmder := NewMockExecCommand()
+	var makeCmd *exec.Cmd
+	execCommand = func(cmd string, args ...string) *exec.Cmd {
+		mockCmd := mockCmder.Command(cmd, args...)
+		if cmd == "chroot" && len(args) > 1 && args[1] == "make" {
+			makeCmd = mockCmd
 		}
+		return mockCmd
 	}
-}
+	t.Cleanup(func() { execCommand = exec.Command })
 
-func testHelperCheckLocaleFile(t *testing.T, asserter *helper.Asserter, mountDir string) {
-	t.Helper()
-	localeFile := filepath.Join(mountDir, "etc", "default", "locale")
-	localeBytes, err := os.ReadFile(localeFile)
-	asserter.AssertErrNil(err, true)
-	if !strings.Contains(string(localeBytes), "LANG=C.UTF-8") {
-		t.Errorf("Expected LANG=C.UTF-8 in %s, but got %s", localeFile, string(localeBytes))
+	helperBackupAndCopyResolvConf = mockBackupAndCopyResolvConfSuccess
+	t.Cleanup(func() {
+		helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
+	})
+
+	var copiedFiles []string
+	osutilCopyFile = func(src string, dst string, flags osutil.CopyFlag) error {
+		copiedFiles = append(copiedFiles, src+" "+dst)
+		return nil
 	}
-}
+	t.Cleanup(func() { osutilCopyFile = osutil.CopyFile })
 
-// testHelperCheckSourcesList checks if components and pocket correctly setup in /etc/apt/sources.list.d/ubuntu.sources
-func testHelperCheckSourcesList(t *testing.T, asserter *helper.Asserter, mountDir string) {
-	t.Helper()
-	aptDeb822SourcesListBytes, err := os.ReadFile(filepath.Join(mountDir, "etc", "apt", "sources.list.d", "ubuntu.sources"))
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
 	asserter.AssertErrNil(err, true)
-	wantAptDeb822SourcesList := `## Ubuntu distribution repository
-##
-## The following settings can be adjusted to configure which packages to use from Ubuntu.
-## Mirror your choices (except for URIs and Suites) in the security section below to
-## ensure timely security updates.
-##
-## Types: Append deb-src to enable the fetching of source package.
-## URIs: A URL to the repository (you may add multiple URLs)
-## Suites: The following additional suites can be configured
-##   <name>-updates   - Major bug fix updates produced after the final release of the
-##                      distribution.
-##   <name>-backports - software from this repository may not have been tested as
-##                      extensively as that contained in the main release, although it includes
-##                      newer versions of some applications which may provide useful features.
-##                      Also, please note that software in backports WILL NOT receive any review
-##                      or updates from the Ubuntu security team.
-## Components: Aside from main, the following components can be added to the list
-##   restricted  - Software that may not be under a free license, or protected by patents.
-##   universe    - Community maintained packages. Software in this repository receives maintenance
-##                 from volunteers in the Ubuntu community, or a 10 year security maintenance
-##                 commitment from Canonical when an Ubuntu Pro subscription is attached.
-##   multiverse  - Community maintained of restricted. Software from this repository is
-##                 ENTIRELY UNSUPPORTED by the Ubuntu team, and may not be under a free
-##                 licence. Please satisfy yourself as to your rights to use the software.
-##                 Also, please note that software in multiverse WILL NOT receive any
-##                 review or updates from the Ubuntu security team.
-##
-## See the sources.list(5) manual page for further settings.
-Types: deb
-URIs: http://archive.ubuntu.com/ubuntu/
-Suites: jammy jammy-updates jammy-proposed
-Components: main universe restricted
-Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+	t.Cleanup(func() { restoreStdout() })
 
-## Ubuntu security updates. Aside from URIs and Suites,
-## this should mirror your choices in the previous section.
-Types: deb
-URIs: http://security.ubuntu.com/ubuntu/
-Suites: jammy-security
-Components: main universe restricted
-Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+	err = stateMachine.buildGadgetTree()
+	asserter.AssertErrNil(err, true)
 
-`
-	asserter.AssertEqual(wantAptDeb822SourcesList, string(aptDeb822SourcesListBytes))
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
 
-	// check if components and pocket correctly setup in /etc/apt/sources.list
-	aptSourcesListBytes, err := os.ReadFile(filepath.Join(mountDir, "etc", "apt", "sources.list"))
+	gadgetTree := filepath.Join(stateMachine.tempDirs.scratch, "gadget", "install")
+	_, err = os.Stat(filepath.Join(gadgetTree, "gadget.yaml"))
 	asserter.AssertErrNil(err, true)
-	asserter.AssertEqual(imagedefinition.LegacySourcesListComment, string(aptSourcesListBytes))
-}
+	_, err = os.Stat(filepath.Join(gadgetTree, "install"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected the built gadget tree not to be nested in %s", gadgetTree)
+	}
 
-// TestSuccessfulClassicRunNoArtifact runs through a full classic state machine run without artifact
-func TestSuccessfulClassicRunNoArtifact(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
+	// only the variables needed by the build are passed to the chroot
+	asserter.AssertEqual([]string{
+		"ARCH=" + foreignArch,
+		"SERIES=noble",
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"LANG=C.UTF-8",
+	}, makeCmd.Env)
+
+	qemuStatic := getQemuStaticForArch(foreignArch)
+	asserter.AssertEqual([]string{
+		filepath.Join("/usr/bin", qemuStatic) + " " +
+			filepath.Join(stateMachine.tempDirs.scratch, "gadget-chroot", "usr", "bin", qemuStatic),
+	}, copiedFiles)
+
+	expectedCmds := []*regexp.Regexp{
+		regexp.MustCompile("^debootstrap --arch " + foreignArch + " --variant=minbase --foreign noble /var/tmp.*/gadget-chroot http://ports.ubuntu.com/$"),
+		regexp.MustCompile("^chroot /var/tmp.*/gadget-chroot /debootstrap/debootstrap --second-stage$"),
+		regexp.MustCompile("^mount -t devtmpfs devtmpfs-build /var/tmp.*/gadget-chroot/dev$"),
+		regexp.MustCompile("^mount -t devpts devpts-build -o nodev,nosuid /var/tmp.*/gadget-chroot/dev/pts$"),
+		regexp.MustCompile("^mount -t proc proc-build /var/tmp.*/gadget-chroot/proc$"),
+		regexp.MustCompile("^mount -t sysfs sysfs-build /var/tmp.*/gadget-chroot/sys$"),
+		regexp.MustCompile("^mount --bind .*/scratch/run.* .*/gadget-chroot/run$"),
+		regexp.MustCompile("^chroot /var/tmp.*/gadget-chroot apt update$"),
+		regexp.MustCompile("^chroot /var/tmp.*/gadget-chroot apt --assume-yes --quiet --option=Dpkg::options::=--force-unsafe-io --option=Dpkg::Options::=--force-confold --no-install-recommends install make gcc$"),
+		regexp.MustCompile("^chroot /var/tmp.*/gadget-chroot make -C /build/gadget test$"),
+		regexp.MustCompile("^udevadm settle$"),
+		regexp.MustCompile("^mount --make-rprivate /var/tmp.*/gadget-chroot/run$"),
+		regexp.MustCompile("^umount --recursive /var/tmp.*/gadget-chroot/run$"),
+		regexp.MustCompile("^mount --make-rprivate /var/tmp.*/gadget-chroot/sys$"),
+		regexp.MustCompile("^umount --recursive /var/tmp.*/gadget-chroot/sys$"),
+		regexp.MustCompile("^mount --make-rprivate /var/tmp.*/gadget-chroot/proc$"),
+		regexp.MustCompile("^umount --recursive /var/tmp.*/gadget-chroot/proc$"),
+		regexp.MustCompile("^mount --make-rprivate /var/tmp.*/gadget-chroot/dev/pts$"),
+		regexp.MustCompile("^umount --recursive /var/tmp.*/gadget-chroot/dev/pts$"),
+		regexp.MustCompile("^mount --make-rprivate /var/tmp.*/gadget-chroot/dev$"),
+		regexp.MustCompile("^umount --recursive /var/tmp.*/gadget-chroot/dev$"),
 	}
 
-	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	t.Cleanup(restoreCWD)
+	gotCmds := strings.Split(strings.TrimSpace(string(readStdout)), "\n")
+	if len(expectedCmds) != len(gotCmds) {
+		t.Fatalf("%v commands to be executed, expected %v commands. Got: %v", len(gotCmds), len(expectedCmds), gotCmds)
+	}
 
-	// We need the output directory set for this
-	outputDir, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
-	asserter.AssertErrNil(err, true)
-	t.Cleanup(func() { os.RemoveAll(outputDir) })
+	for i, gotCmd := range gotCmds {
+		expected := expectedCmds[i]
+
+		if !expected.Match([]byte(gotCmd)) {
+			t.Errorf("Cmd \"%v\" not matching. Expected %v\n", gotCmd, expected.String())
+		}
+	}
+}
 
+// TestStateMachine_installPackages_pinned checks pinned versions and held
+// packages are passed to apt
+func TestStateMachine_installPackages_pinned(t *testing.T) {
+	asserter := helper.Asserter{T: t}
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.parent = &stateMachine
 	stateMachine.commonFlags.Debug = true
-	stateMachine.commonFlags.Size = "3G"
-	stateMachine.commonFlags.OutputDir = outputDir
-	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
-		"test_no_artifact.yaml")
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Customization: &imagedefinition.Customization{
+			ExtraPackages: []*imagedefinition.Package{
+				{PackageName: "hello", Version: "2.10*", Hold: helper.BoolPtr(true)},
+				{PackageName: "vim"},
+			},
+		},
+	}
 
-	err = stateMachine.Setup()
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	err = os.MkdirAll(stateMachine.tempDirs.chroot, 0755)
 	asserter.AssertErrNil(err, true)
-
 	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-	err = stateMachine.Run()
-	asserter.AssertErrNil(err, true)
+	mockCmder := NewMockExecCommand()
+	execCommand = func(cmd string, args ...string) *exec.Cmd {
+		if len(args) > 2 && args[1] == "apt-cache" {
+			return exec.Command("printf", " hello | 2.10-3 | http://archive.ubuntu.com/ubuntu noble/main amd64 Packages\n")
+		}
+		return mockCmder.Command(cmd, args...)
+	}
+	t.Cleanup(func() { execCommand = exec.Command })
 
+	helperBackupAndCopyResolvConf = mockBackupAndCopyResolvConfSuccess
 	t.Cleanup(func() {
-		err = stateMachine.Teardown()
-		asserter.AssertErrNil(err, true)
+		helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
 	})
 
-	// make sure packages were successfully installed from public and private ppas
-	testHelperCheckPPAInstalled(t, &asserter, stateMachine.tempDirs.chroot)
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
 
-	// make sure snaps from the correct channel were installed
-	testHelperCheckSnapInstalled(t, &asserter, stateMachine.tempDirs.chroot)
-}
+	err = stateMachine.installPackages()
+	asserter.AssertErrNil(err, true)
 
-func TestSuccessfulRootfsGeneration(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+
+	expectedCmds := []*regexp.Regexp{
+		regexp.MustCompile("^chroot /var/tmp.*/chroot apt update$"),
+		regexp.MustCompile("^chroot /var/tmp.*/chroot apt --assume-yes --quiet --option=Dpkg::options::=--force-unsafe-io --option=Dpkg::Options::=--force-confold install hello=2.10-3 vim$"),
+		regexp.MustCompile("^chroot /var/tmp.*/chroot apt-mark hold hello$"),
 	}
-	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	t.Cleanup(restoreCWD)
 
-	// We need the output directory set for this
-	outputDir, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-")
-	asserter.AssertErrNil(err, true)
-	t.Cleanup(func() { os.RemoveAll(outputDir) })
+	gotCmds := make([]string, 0)
+	for _, cmd := range strings.Split(strings.TrimSpace(string(readStdout)), "\n") {
+		if strings.HasPrefix(cmd, "chroot ") {
+			gotCmds = append(gotCmds, cmd)
+		}
+	}
+	if len(expectedCmds) != len(gotCmds) {
+		t.Fatalf("%v commands to be executed, expected %v commands. Got: %v", len(gotCmds), len(expectedCmds), gotCmds)
+	}
+
+	for i, gotCmd := range gotCmds {
+		expected := expectedCmds[i]
+
+		if !expected.Match([]byte(gotCmd)) {
+			t.Errorf("Cmd \"%v\" not matching. Expected %v\n", gotCmd, expected.String())
+		}
+	}
+
+	// unavailable versions are reported
+	stateMachine.Packages = nil
+	stateMachine.ImageDef.Customization.ExtraPackages[0].Version = "3.0"
+	err = stateMachine.installPackages()
+	asserter.AssertErrContains(err, "Version 3.0 of package hello is not available")
+}
 
+// TestStateMachine_installPackages_localDebs checks local .deb files are copied
+// in the chroot and installed alongside the other packages
+func TestStateMachine_installPackages_localDebs(t *testing.T) {
+	asserter := helper.Asserter{T: t}
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.parent = &stateMachine
 	stateMachine.commonFlags.Debug = true
-	stateMachine.commonFlags.Size = "3G"
-	stateMachine.commonFlags.OutputDir = outputDir
-	stateMachine.Args.ImageDefinition = filepath.Join("testdata", "image_definitions",
-		"test_rootfs_tarball.yaml")
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Customization: &imagedefinition.Customization{
+			ExtraPackages: []*imagedefinition.Package{
+				{PackageName: "vim"},
+			},
+			ExtraDebs: []*imagedefinition.Deb{
+				{Path: "debs/internal-tool_1.0_amd64.deb"},
+			},
+		},
+	}
 
-	err = stateMachine.Setup()
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	err = os.MkdirAll(stateMachine.tempDirs.chroot, 0755)
 	asserter.AssertErrNil(err, true)
-
 	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-	err = stateMachine.Run()
+	stateMachine.ConfDefPath = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "conf")
+	err = os.MkdirAll(filepath.Join(stateMachine.ConfDefPath, "debs"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(stateMachine.ConfDefPath, "debs", "internal-tool_1.0_amd64.deb"), []byte("deb"), 0644)
 	asserter.AssertErrNil(err, true)
 
+	mockCmder := NewMockExecCommand()
+	execCommand = func(cmd string, args ...string) *exec.Cmd {
+		if cmd == "dpkg-deb" {
+			return exec.Command("echo", "internal-tool")
+		}
+		return mockCmder.Command(cmd, args...)
+	}
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	helperBackupAndCopyResolvConf = mockBackupAndCopyResolvConfSuccess
 	t.Cleanup(func() {
-		err = stateMachine.Teardown()
-		asserter.AssertErrNil(err, true)
+		helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
 	})
 
-	// make sure all the artifacts were created and are the correct file types
-	artifacts := map[string]string{
-		"rootfs.tar": "tar archive",
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
+
+	err = stateMachine.installPackages()
+	asserter.AssertErrNil(err, true)
+
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+
+	expectedCmds := []*regexp.Regexp{
+		regexp.MustCompile("^chroot /var/tmp.*/chroot apt update$"),
+		regexp.MustCompile("^chroot /var/tmp.*/chroot apt --assume-yes --quiet --option=Dpkg::options::=--force-unsafe-io --option=Dpkg::Options::=--force-confold install vim /var/cache/ubuntu-image/debs/internal-tool_1.0_amd64.deb$"),
 	}
-	for artifact, fileType := range artifacts {
-		fullPath := filepath.Join(stateMachine.commonFlags.OutputDir, artifact)
-		_, err := os.Stat(fullPath)
-		if err != nil {
-			if os.IsNotExist(err) {
-				t.Errorf("File \"%s\" should exist, but does not", fullPath)
-			}
+
+	gotCmds := make([]string, 0)
+	for _, cmd := range strings.Split(strings.TrimSpace(string(readStdout)), "\n") {
+		if strings.HasPrefix(cmd, "chroot ") {
+			gotCmds = append(gotCmds, cmd)
 		}
+	}
+	if len(expectedCmds) != len(gotCmds) {
+		t.Fatalf("%v commands to be executed, expected %v commands. Got: %v", len(gotCmds), len(expectedCmds), gotCmds)
+	}
 
-		// check it is the expected file type
-		fileCommand := *exec.Command("file", fullPath)
-		cmdOutput, err := fileCommand.CombinedOutput()
-		asserter.AssertErrNil(err, true)
-		if !strings.Contains(string(cmdOutput), fileType) {
-			t.Errorf("File \"%s\" is the wrong file type. Expected \"%s\" but got \"%s\"",
-				fullPath, fileType, string(cmdOutput))
+	for i, gotCmd := range gotCmds {
+		expected := expectedCmds[i]
+
+		if !expected.Match([]byte(gotCmd)) {
+			t.Errorf("Cmd \"%v\" not matching. Expected %v\n", gotCmd, expected.String())
 		}
 	}
-}
 
-// TestGerminate tests the germinate state and ensures some necessary packages are included
-func TestGerminate(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
+	asserter.AssertEqual([]string{"internal-tool"}, stateMachine.LocalPackages)
+
+	// the local .deb files are not left in the chroot
+	_, err = os.Stat(filepath.Join(stateMachine.tempDirs.chroot, "var", "cache", "ubuntu-image"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Local .deb files should have been removed from the chroot")
 	}
-	testCases := []struct {
-		name             string
-		flavor           string
-		seedURLs         []string
-		seedNames        []string
-		expectedPackages []string
-		expectedSnaps    []string
-		vcs              bool
-	}{
-		{
-			"git",
-			"ubuntu",
-			[]string{"git://git.launchpad.net/~ubuntu-core-dev/ubuntu-seeds/+git/"},
-			[]string{"server", "minimal", "standard", "cloud-image"},
-			[]string{"python3", "sudo", "cloud-init", "ubuntu-server"},
-			[]string{},
-			true,
-		},
-		{
-			"http",
-			"ubuntu",
-			[]string{"https://people.canonical.com/~ubuntu-archive/seeds/"},
-			[]string{"server", "minimal", "standard", "cloud-image", "desktop"},
-			[]string{"python3", "sudo", "cloud-init", "ubuntu-server"},
-			[]string{"thunderbird"},
-			false,
-		},
-		{
-			"bzr+git",
-			"ubuntu",
-			[]string{"http://bazaar.launchpad.net/~ubuntu-mate-dev/ubuntu-seeds/",
-				"git://git.launchpad.net/~ubuntu-core-dev/ubuntu-seeds/+git/",
-				"https://people.canonical.com/~ubuntu-archive/seeds/",
+
+	// missing .deb files are reported
+	stateMachine.Packages = nil
+	stateMachine.ImageDef.Customization.ExtraDebs[0].Path = "debs/missing.deb"
+	err = stateMachine.installPackages()
+	asserter.AssertErrContains(err, "Error copying")
+
+	execCommand = func(cmd string, args ...string) *exec.Cmd {
+		return exec.Command("false")
+	}
+	stateMachine.Packages = nil
+	err = stateMachine.installPackages()
+	asserter.AssertErrContains(err, "Error reading the package name of")
+}
+
+// TestStateMachine_removePackages checks packages are removed with the right apt commands
+func TestStateMachine_removePackages(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Debug = true
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Customization: &imagedefinition.Customization{
+			RemovePackages: []*imagedefinition.RemovePackage{
+				{PackageName: "nano"},
+				{PackageName: "snapd", Purge: helper.BoolPtr(true), Autoremove: helper.BoolPtr(true)},
+				{PackageName: "ed", Purge: helper.BoolPtr(false)},
+				{PackageName: "lxd-installer", Purge: helper.BoolPtr(true), Autoremove: helper.BoolPtr(true)},
 			},
-			[]string{"desktop", "desktop-common", "standard", "minimal"},
-			[]string{"xorg", "wget", "ubuntu-minimal"},
-			[]string{"thunderbird"},
-			true,
 		},
 	}
-	for _, tc := range testCases {
-		t.Run("test_germinate_"+tc.name, func(t *testing.T) {
-			asserter := helper.Asserter{T: t}
-			restoreCWD := testhelper.SaveCWD()
-			defer restoreCWD()
 
-			var stateMachine ClassicStateMachine
-			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-			stateMachine.parent = &stateMachine
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	err = os.MkdirAll(stateMachine.tempDirs.chroot, 0755)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-			err := stateMachine.makeTemporaryDirectories()
-			asserter.AssertErrNil(err, true)
+	mockCmder := NewMockExecCommand()
+	execCommand = mockCmder.Command
+	t.Cleanup(func() { execCommand = exec.Command })
 
-			t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	helperBackupAndCopyResolvConf = mockBackupAndCopyResolvConfSuccess
+	t.Cleanup(func() {
+		helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
+	})
 
-			hostArch := arch.GetHostArch()
-			series := "noble"
-			imageDef := imagedefinition.ImageDefinition{
-				Architecture: hostArch,
-				Series:       series,
-				Rootfs: &imagedefinition.Rootfs{
-					Flavor: tc.flavor,
-					Mirror: "http://archive.ubuntu.com/ubuntu/",
-					Seed: &imagedefinition.Seed{
-						SeedURLs:   tc.seedURLs,
-						SeedBranch: series,
-						Names:      tc.seedNames,
-						Vcs:        helper.BoolPtr(tc.vcs),
-					},
-				},
-			}
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
 
-			stateMachine.ImageDef = imageDef
+	err = stateMachine.removePackages()
+	asserter.AssertErrNil(err, true)
 
-			err = stateMachine.germinate()
-			asserter.AssertErrNil(err, true)
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
 
-			// spot check some packages that should remain seeded for a long time
-			testHelperCheckGerminatedPackages(t, tc.expectedPackages, stateMachine.Packages)
-			// spot check some snaps that should remain seeded for a long time
-			testHelperCheckGerminatedSnaps(t, tc.expectedSnaps, stateMachine.Snaps)
-		})
+	expectedCmds := []*regexp.Regexp{
+		regexp.MustCompile("^chroot /var/tmp.*/chroot apt --assume-yes --quiet --option=Dpkg::options::=--force-unsafe-io --option=Dpkg::Options::=--force-confold remove nano ed$"),
+		regexp.MustCompile("^chroot /var/tmp.*/chroot apt --assume-yes --quiet --option=Dpkg::options::=--force-unsafe-io --option=Dpkg::Options::=--force-confold purge --autoremove snapd lxd-installer$"),
 	}
-}
 
-func testHelperCheckGerminatedPackages(t *testing.T, expectedPackages []string, gotPackages []string) {
-	for _, expectedPackage := range expectedPackages {
-		found := false
-		for _, seedPackage := range gotPackages {
-			if expectedPackage == seedPackage {
-				found = true
-			}
-		}
-		if !found {
-			t.Errorf("Expected to find %s in list of packages: %v",
-				expectedPackage, gotPackages)
+	gotCmds := make([]string, 0)
+	for _, cmd := range strings.Split(strings.TrimSpace(string(readStdout)), "\n") {
+		if strings.HasPrefix(cmd, "chroot ") {
+			gotCmds = append(gotCmds, cmd)
 		}
 	}
-}
+	if len(expectedCmds) != len(gotCmds) {
+		t.Fatalf("%v commands to be executed, expected %v commands. Got: %v", len(gotCmds), len(expectedCmds), gotCmds)
+	}
 
-func testHelperCheckGerminatedSnaps(t *testing.T, expectedSnaps []string, gotSnaps []string) {
-	for _, expectedSnap := range expectedSnaps {
-		found := false
-		for _, seedSnap := range gotSnaps {
-			snapName := strings.Split(seedSnap, "=")[0]
-			if expectedSnap == snapName {
-				found = true
-			}
-		}
-		if !found {
-			t.Errorf("Expected to find %s in list of snaps: %v",
-				expectedSnap, gotSnaps)
+	for i, gotCmd := range gotCmds {
+		expected := expectedCmds[i]
+
+		if !expected.Match([]byte(gotCmd)) {
+			t.Errorf("Cmd \"%v\" not matching. Expected %v\n", gotCmd, expected.String())
 		}
 	}
 }
 
-// TestFailedGerminate mocks function calls to test
-// failure cases in the germinate state
-func TestFailedGerminate(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
-	}
+// TestStateMachine_installPackages_checkcmds checks commands to install packages order is ok when failing
+func TestStateMachine_installPackages_checkcmds_failing(t *testing.T) {
 	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
-
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Debug = true
 	stateMachine.parent = &stateMachine
+	stateMachine.commonFlags.OutputDir = testhelper.DefaultTmpDir
 
 	err := stateMachine.makeTemporaryDirectories()
 	asserter.AssertErrNil(err, true)
 
-	// create a valid imageDefinition
-	hostArch := arch.GetHostArch()
-	hostSuite := getHostSuite()
-	imageDef := imagedefinition.ImageDefinition{
-		Architecture: hostArch,
-		Series:       hostSuite,
-		Rootfs: &imagedefinition.Rootfs{
-			Flavor: "ubuntu",
-			Mirror: "http://archive.ubuntu.com/ubuntu/",
-			Seed: &imagedefinition.Seed{
-				SeedURLs:   []string{"git://git.launchpad.net/~ubuntu-core-dev/ubuntu-seeds/+git/"},
-				SeedBranch: hostSuite,
-				Names:      []string{"server", "minimal", "standard", "cloud-image"},
-				Vcs:        helper.BoolPtr(true),
-			},
-		},
-	}
-	stateMachine.ImageDef = imageDef
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-	// mock os.Mkdir
-	osMkdir = mockMkdir
-	t.Cleanup(func() {
-		osMkdir = os.Mkdir
-	})
-	err = stateMachine.germinate()
-	asserter.AssertErrContains(err, "Error creating germinate directory")
-	osMkdir = os.Mkdir
+	mockCmder := NewMockExecCommand()
 
-	// Setup the exec.Command mock
-	testCaseName = "TestFailedGerminate"
-	execCommand = fakeExecCommand
+	execCommand = mockCmder.Command
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
+
+	helperBackupAndCopyResolvConf = mockBackupAndCopyResolvConfSuccess
 	t.Cleanup(func() {
-		execCommand = exec.Command
+		helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
 	})
-	err = stateMachine.germinate()
-	asserter.AssertErrContains(err, "Error running germinate command")
-	execCommand = exec.Command
 
-	// mock os.Open
-	osOpen = mockOpen
+	osMkdirTemp = mockMkdirTemp
 	t.Cleanup(func() {
-		osOpen = os.Open
+		osMkdirTemp = os.MkdirTemp
 	})
-	err = stateMachine.germinate()
-	asserter.AssertErrContains(err, "Error opening seed file")
-	osOpen = os.Open
-
-	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
-}
-
-// TestBuildGadgetTreeGit tests the successful build of a gadget tree
-func TestBuildGadgetTreeGit(t *testing.T) {
-	t.Parallel()
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
-	}
-	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
 
-	var stateMachine ClassicStateMachine
-	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.parent = &stateMachine
+	err = stateMachine.installPackages()
+	asserter.AssertErrContains(err, "Test error")
 
-	err := stateMachine.makeTemporaryDirectories()
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
 	asserter.AssertErrNil(err, true)
 
-	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	gotCmds := strings.Split(strings.TrimSpace(string(readStdout)), "\n")
+	// Clean empty commands
+	for i, cmd := range gotCmds {
+		if len(cmd) == 0 {
+			copy(gotCmds[i:], gotCmds[i+1:])
+			gotCmds[len(gotCmds)-1] = ""
+			gotCmds = gotCmds[:len(gotCmds)-1]
+		}
+	}
 
-	// test the directory method
-	d, err := os.Getwd()
-	asserter.AssertErrNil(err, true)
-	sourcePath := filepath.Join(d, "testdata", "gadget_source")
-	sourcePath = "file://" + sourcePath
-	imageDef := imagedefinition.ImageDefinition{
-		Architecture: arch.GetHostArch(),
-		Series:       getHostSuite(),
-		Gadget: &imagedefinition.Gadget{
-			GadgetURL:  sourcePath,
-			GadgetType: "directory",
-		},
+	if len(gotCmds) != 0 {
+		t.Fatalf("%v commands to be executed, expected no commands. Got: %v", len(gotCmds), gotCmds)
 	}
+}
 
-	stateMachine.ImageDef = imageDef
+func checkDivert(t *testing.T, fn func() error, divert *func(string, bool) (func() error, func(error) error)) {
+	asserter := helper.Asserter{T: t}
 
-	err = stateMachine.buildGadgetTree()
-	asserter.AssertErrNil(err, true)
+	divertSaved := *divert
+	defer func() {
+		*divert = divertSaved
+	}()
 
-	// test the git method
-	imageDef = imagedefinition.ImageDefinition{
-		Architecture: arch.GetHostArch(),
-		Series:       getHostSuite(),
-		Gadget: &imagedefinition.Gadget{
-			GadgetURL:    "https://github.com/snapcore/pc-gadget",
-			GadgetType:   "git",
-			GadgetBranch: "classic",
-		},
+	*divert = func(targetDir string, debug bool) (func() error, func(error) error) {
+		return func() error { return fmt.Errorf("divert") }, func(err error) error { return err }
 	}
+	err := fn()
+	asserter.AssertErrContains(err, "divert")
 
-	stateMachine.ImageDef = imageDef
-
-	err = stateMachine.buildGadgetTree()
-	asserter.AssertErrNil(err, true)
+	*divert = func(targetDir string, debug bool) (func() error, func(error) error) {
+		return func() error { return nil }, func(err error) error { return errors.Join(err, fmt.Errorf("undivert")) }
+	}
+	err = fn()
+	asserter.AssertErrContains(err, "undivert")
 }
 
-// TestBuildGadgetTreeDirectory tests the successful build of a gadget tree
-func TestBuildGadgetTreeDirectory(t *testing.T) {
-	t.Parallel()
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
-	}
+// TestStateMachine_installPackages_fail tests failure cases in installPackages
+func TestStateMachine_installPackages_fail(t *testing.T) {
 	asserter := helper.Asserter{T: t}
-	saveCWD := testhelper.SaveCWD()
-	defer saveCWD()
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
 
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: arch.GetHostArch(),
+		Series:       getHostSuite(),
+		Rootfs:       &imagedefinition.Rootfs{},
+		Customization: &imagedefinition.Customization{
+			ExtraPackages: []*imagedefinition.Package{
+				{
+					PackageName: "test1",
+				},
+			},
+		},
+	}
 
-	// need workdir set up for this
 	err := stateMachine.makeTemporaryDirectories()
 	asserter.AssertErrNil(err, true)
+
 	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-	// git clone the gadget into a /tmp dir
-	gadgetDir, err := os.MkdirTemp("", "pc-gadget-")
+	// create an /etc/resolv.conf in the chroot
+	err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.chroot, "etc"), 0755)
 	asserter.AssertErrNil(err, true)
-	t.Cleanup(func() { os.RemoveAll(gadgetDir) })
-	gitCloneCommand := *exec.Command(
-		"git",
-		"clone",
-		"--depth",
-		"1",
-		"--branch",
-		"classic",
-		"https://github.com/snapcore/pc-gadget",
-		gadgetDir,
-	)
-	err = gitCloneCommand.Run()
+	_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "etc", "resolv.conf"))
 	asserter.AssertErrNil(err, true)
 
-	// now set up the image definition to build from this directory
-	stateMachine.ImageDef = imagedefinition.ImageDefinition{
-		Architecture: arch.GetHostArch(),
-		Series:       getHostSuite(),
-		Gadget: &imagedefinition.Gadget{
-			GadgetURL:  fmt.Sprintf("file://%s", gadgetDir),
-			GadgetType: "directory",
-		},
-	}
+	// create files to be diverted in the chroot
+	err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.chroot, "usr", "sbin"), 0755)
+	asserter.AssertErrNil(err, true)
+	_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "usr", "sbin", "policy-rc.d"))
+	asserter.AssertErrNil(err, true)
+	err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.chroot, "sbin"), 0755)
+	asserter.AssertErrNil(err, true)
+	_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "sbin", "start-stop-daemon"))
+	asserter.AssertErrNil(err, true)
+	_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "sbin", "initctl"))
+	asserter.AssertErrNil(err, true)
+
+	osMkdirTemp = mockMkdirTemp
+	t.Cleanup(func() {
+		osMkdirTemp = os.MkdirTemp
+	})
+	err = stateMachine.installPackages()
+	asserter.AssertErrContains(err, "Error making temporary directory for mountpoint")
+	osMkdirTemp = os.MkdirTemp
+
+	// Setup the exec.Command mock
+	testCaseName = "TestStateMachine_installPackages_fail"
+	execCommand = fakeExecCommand
+	t.Cleanup(func() {
+		execCommand = exec.Command
+	})
+	err = stateMachine.installPackages()
+	asserter.AssertErrContains(err, "Error running command")
+	execCommand = exec.Command
+
+	// delete the backed up resolv.conf to trigger another backup
+	err = os.Remove(filepath.Join(stateMachine.tempDirs.chroot, "etc", "resolv.conf.tmp"))
+	asserter.AssertErrNil(err, true)
+	// mock helper.BackupAndCopyResolvConf
+	helperBackupAndCopyResolvConf = mockBackupAndCopyResolvConfFail
+	t.Cleanup(func() {
+		helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
+	})
+	err = stateMachine.installPackages()
+	asserter.AssertErrContains(err, "Error setting up /etc/resolv.conf")
+	helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
+
+	execCommand = func(string, ...string) *exec.Cmd { return exec.Command("true") }
+	t.Cleanup(func() { execCommand = exec.Command })
 
-	err = stateMachine.buildGadgetTree()
-	asserter.AssertErrNil(err, true)
+	helperBackupAndCopyResolvConf = mockBackupAndCopyResolvConfSuccess
+	t.Cleanup(func() {
+		helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
+	})
 
-	// now make sure the gadget.yaml is in the expected location
-	// this was a bug reported by the CPC team
-	err = stateMachine.prepareGadgetTree()
-	asserter.AssertErrNil(err, true)
-	err = stateMachine.loadGadgetYaml()
-	asserter.AssertErrNil(err, true)
+	// Mock helper.Divert* functions
+	mock := func(string, bool) (func() error, func(error) error) {
+		return func() error { return nil }, func(err error) error { return err }
+	}
+	helperDivertPolicyRcD = mock
+	helperDivertStartStopDaemon = mock
+	helperDivertInitctl = mock
+	t.Cleanup(func() {
+		helperDivertPolicyRcD = helper.DivertPolicyRcD
+		helperDivertStartStopDaemon = helper.DivertStartStopDaemon
+		helperDivertInitctl = helper.DivertInitctl
+	})
+
+	checkDivert(t, stateMachine.installPackages, &helperDivertPolicyRcD)
+	checkDivert(t, stateMachine.installPackages, &helperDivertStartStopDaemon)
+	checkDivert(t, stateMachine.installPackages, &helperDivertInitctl)
 }
 
-func TestStateMachine_buildGadgetTree_paths(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
-	}
+// Test_generateMountPointCmds_fail tests when generateMountPointCmds fails
+func Test_generateMountPointCmds_fail(t *testing.T) {
 	asserter := helper.Asserter{T: t}
-	// git clone the gadget into a /tmp dir
-	originGadgetDir, err := os.MkdirTemp("", "pc-gadget-")
-	asserter.AssertErrNil(err, true)
+
+	tmpDirPath := filepath.Join(testhelper.DefaultTmpDir, "test_failed_set_conf_dir")
+	err := os.Mkdir(tmpDirPath, 0755)
 	t.Cleanup(func() {
-		err = os.RemoveAll(originGadgetDir)
-		if err != nil {
-			t.Error(err)
-		}
+		os.RemoveAll(tmpDirPath)
 	})
-	gitCloneCommand := *exec.Command(
-		"git",
-		"clone",
-		"--depth",
-		"1",
-		"--branch",
-		"classic",
-		"https://github.com/snapcore/pc-gadget",
-		originGadgetDir,
-	)
-	err = gitCloneCommand.Run()
 	asserter.AssertErrNil(err, true)
 
-	tmpDir, err := os.MkdirTemp("", "")
-	t.Cleanup(func() {
-		err := osRemoveAll(tmpDir)
-		if err != nil {
-			t.Error(err)
-		}
-	})
+	mountPoints := []*mountPoint{
+		{
+			src:      "devtmpfs-build",
+			basePath: tmpDirPath,
+			relpath:  "/dev",
+			typ:      "devtmpfs",
+		},
+		{
+			src:      "doesnotexists",
+			basePath: "/doesnotexists",
+			relpath:  "/doesnotexists",
+			typ:      "devpts",
+			bind:     true,
+			opts:     []string{"nodev", "nosuid"},
+		},
+	}
+
+	gotAllMountCmds, gotAllUmountCmds, err := generateMountPointCmds(mountPoints, tmpDirPath)
+	asserter.AssertErrContains(err, "Error preparing mountpoint")
+	asserter.AssertEqual(nil, gotAllMountCmds)
+	asserter.AssertEqual(nil, gotAllUmountCmds)
+}
 
+// TestCustomizeFstab tests functionality of the customizeFstab function
+func TestCustomizeFstab(t *testing.T) {
 	testCases := []struct {
-		name      string
-		gadgetDir string
+		name          string
+		fstab         []*imagedefinition.Fstab
+		expectedFstab string
+		existingFstab string
 	}{
 		{
-			name:      "gadget URL poiting to an absolute dir",
-			gadgetDir: originGadgetDir,
+			name: "one entry to an empty fstab",
+			fstab: []*imagedefinition.Fstab{
+				{
+					Label:        "writable",
+					Mountpoint:   "/",
+					FSType:       "ext4",
+					MountOptions: "defaults",
+					Dump:         true,
+					FsckOrder:    1,
+				},
+			},
+			expectedFstab: `LABEL=writable	/	ext4	defaults	1	1
+`,
 		},
 		{
-			name:      "gadget URL pointing to an absolute sub dir",
-			gadgetDir: filepath.Join(tmpDir, "a", "b"),
+			name: "one entry to a non-empty fstab",
+			fstab: []*imagedefinition.Fstab{
+				{
+					Label:        "writable",
+					Mountpoint:   "/",
+					FSType:       "ext4",
+					MountOptions: "defaults",
+					Dump:         true,
+					FsckOrder:    1,
+				},
+			},
+			expectedFstab: `LABEL=writable	/	ext4	defaults	1	1
+`,
+			existingFstab: `LABEL=xxx / ext4 discard,errors=remount-ro 0 1`,
 		},
 		{
-			name:      "gadget URL pointing to a relative sub dir",
-			gadgetDir: filepath.Join("a", "b"),
+			name: "two entries",
+			fstab: []*imagedefinition.Fstab{
+				{
+					Label:        "writable",
+					Mountpoint:   "/",
+					FSType:       "ext4",
+					MountOptions: "defaults",
+					Dump:         false,
+					FsckOrder:    1,
+				},
+				{
+					Label:        "system-boot",
+					Mountpoint:   "/boot/firmware",
+					FSType:       "vfat",
+					MountOptions: "defaults",
+					Dump:         false,
+					FsckOrder:    1,
+				},
+			},
+			expectedFstab: `LABEL=writable	/	ext4	defaults	0	1
+LABEL=system-boot	/boot/firmware	vfat	defaults	0	1
+`,
 		},
 	}
 
 	for _, tc := range testCases {
-		t.Run("test_build_gadget_tree_paths_"+tc.name, func(t *testing.T) {
+		t.Run(tc.name, func(t *testing.T) {
 			asserter := helper.Asserter{T: t}
 			restoreCWD := testhelper.SaveCWD()
 			defer restoreCWD()
@@ -4093,83 +6338,134 @@ func TestStateMachine_buildGadgetTree_paths(t *testing.T) {
 			var stateMachine ClassicStateMachine
 			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 			stateMachine.parent = &stateMachine
-
-			err := stateMachine.makeTemporaryDirectories()
-			asserter.AssertErrNil(err, true)
-			t.Cleanup(func() {
-				err := os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
-				if err != nil {
-					t.Error(err)
-				}
-			})
-
-			// move the original gadget dir to the desire location to test it will be found
-			if originGadgetDir != tc.gadgetDir {
-				fullGadgetDir := tc.gadgetDir
-				if !filepath.IsAbs(tc.gadgetDir) {
-					fullGadgetDir = filepath.Join(tmpDir, tc.gadgetDir)
-				}
-
-				err = os.MkdirAll(filepath.Dir(fullGadgetDir), 0777)
-				asserter.AssertErrNil(err, true)
-
-				err = os.Rename(originGadgetDir, fullGadgetDir)
-				asserter.AssertErrNil(err, true)
-				// move it back once the test is done
-				t.Cleanup(func() {
-					err := os.Rename(fullGadgetDir, originGadgetDir)
-					if err != nil {
-						t.Error(err)
-					}
-				})
-			}
-
-			// now set up the image definition to build from this directory
 			stateMachine.ImageDef = imagedefinition.ImageDefinition{
 				Architecture: arch.GetHostArch(),
 				Series:       getHostSuite(),
-				Gadget: &imagedefinition.Gadget{
-					GadgetURL:  fmt.Sprintf("file://%s", tc.gadgetDir),
-					GadgetType: "directory",
+				Rootfs:       &imagedefinition.Rootfs{},
+				Customization: &imagedefinition.Customization{
+					Fstab: tc.fstab,
 				},
 			}
 
-			err = stateMachine.setConfDefDir(filepath.Join(tmpDir, "image_definition.yaml"))
+			// set the defaults for the imageDef
+			err := helper.SetDefaults(&stateMachine.ImageDef)
 			asserter.AssertErrNil(err, true)
 
-			err = stateMachine.buildGadgetTree()
+			err = stateMachine.makeTemporaryDirectories()
 			asserter.AssertErrNil(err, true)
 
-			// now make sure the gadget.yaml is in the expected location
-			// this was a bug reported by the CPC team
-			err = stateMachine.prepareGadgetTree()
+			// create the <chroot>/etc directory
+			err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.chroot, "etc"), 0644)
 			asserter.AssertErrNil(err, true)
-			err = stateMachine.loadGadgetYaml()
+
+			fstabPath := filepath.Join(stateMachine.tempDirs.chroot, "etc", "fstab")
+
+			// simulate an already existing fstab file
+			if len(tc.existingFstab) != 0 {
+				err = osWriteFile(fstabPath, []byte(tc.existingFstab), 0644)
+				asserter.AssertErrNil(err, true)
+			}
+
+			// customize the fstab, ensure no errors, and check the contents
+			err = stateMachine.customizeFstab()
 			asserter.AssertErrNil(err, true)
+
+			fstabBytes, err := os.ReadFile(fstabPath)
+			asserter.AssertErrNil(err, true)
+
+			if string(fstabBytes) != tc.expectedFstab {
+				t.Errorf("Expected fstab contents \"%s\", but got \"%s\"",
+					tc.expectedFstab, string(fstabBytes))
+			}
 		})
 	}
 }
 
-// TestGadgetGadgetTargets tests using alternate make targets with gadget builds
-func TestGadgetGadgetTargets(t *testing.T) {
+// TestStateMachine_customizeFstab_fail tests failures in the customizeFstab function
+func TestStateMachine_customizeFstab_fail(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: arch.GetHostArch(),
+		Series:       getHostSuite(),
+		Rootfs:       &imagedefinition.Rootfs{},
+		Customization: &imagedefinition.Customization{
+			Fstab: []*imagedefinition.Fstab{
+				{
+					Label:        "writable",
+					Mountpoint:   "/",
+					FSType:       "ext4",
+					MountOptions: "defaults",
+					Dump:         false,
+					FsckOrder:    1,
+				},
+			},
+		},
+	}
+
+	osOpenFile = mockOpenFile
+	t.Cleanup(func() {
+		osOpenFile = os.OpenFile
+	})
+	err := stateMachine.customizeFstab()
+	asserter.AssertErrContains(err, "Error opening fstab")
+}
+
+// TestGenerateRootfsTarball tests that a rootfs tarball is generated
+// when appropriate
+func TestGenerateRootfsTarball(t *testing.T) {
 	testCases := []struct {
-		name           string
-		target         string
-		expectedOutput string
+		name     string // the name will double as the compression type
+		tarPath  string
+		fileType string
+		// Define an interval since we cannot predict the exact
+		// size of the resulting archive due to changing atime/ctime
+		minArchiveSize int64
+		maxArchiveSize int64
 	}{
 		{
-			"default",
-			"",
-			"make target test1",
+			name:           "uncompressed",
+			tarPath:        "test_generate_rootfs_tarball.tar",
+			fileType:       "tar archive",
+			minArchiveSize: 61440,
+			maxArchiveSize: 61440, // 92160 without --sparse option
 		},
 		{
-			"test2",
-			"test2",
-			"make target test2",
+			name:           "bzip2",
+			tarPath:        "test_generate_rootfs_tarball.tar.bz2",
+			fileType:       "bzip2 compressed data",
+			minArchiveSize: 32100,
+			maxArchiveSize: 32300,
+		},
+		{
+			name:           "gzip",
+			tarPath:        "test_generate_rootfs_tarball.tar.gz",
+			fileType:       "gzip compressed data",
+			minArchiveSize: 31700,
+			maxArchiveSize: 32000,
+		},
+		{
+			name:           "xz",
+			tarPath:        "test_generate_rootfs_tarball.tar.xz",
+			fileType:       "XZ compressed data",
+			minArchiveSize: 31700,
+			maxArchiveSize: 31910,
+		},
+		{
+			name:           "zstd",
+			tarPath:        "test_generate_rootfs_tarball.tar.zst",
+			fileType:       "Zstandard compressed data",
+			minArchiveSize: 31400,
+			maxArchiveSize: 31700,
 		},
 	}
 	for _, tc := range testCases {
-		t.Run("test_gadget_make_targets_"+tc.name, func(t *testing.T) {
+		t.Run(tc.name, func(t *testing.T) {
 			asserter := helper.Asserter{T: t}
 			restoreCWD := testhelper.SaveCWD()
 			defer restoreCWD()
@@ -4177,50 +6473,77 @@ func TestGadgetGadgetTargets(t *testing.T) {
 			var stateMachine ClassicStateMachine
 			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 			stateMachine.parent = &stateMachine
-			stateMachine.commonFlags.Debug = true
+			stateMachine.ImageDef = imagedefinition.ImageDefinition{
+				Architecture: arch.GetHostArch(),
+				Series:       getHostSuite(),
+				Rootfs:       &imagedefinition.Rootfs{},
+				Artifacts: &imagedefinition.Artifact{
+					RootfsTar: &imagedefinition.RootfsTar{
+						RootfsTarName: tc.tarPath,
+						Compression:   tc.name,
+					},
+				},
+			}
 
 			err := stateMachine.makeTemporaryDirectories()
 			asserter.AssertErrNil(err, true)
+			stateMachine.commonFlags.OutputDir = stateMachine.stateMachineFlags.WorkDir
 
-			wd, err := os.Getwd()
+			t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+			// Copy a rootfs so the tar is not empty
+			rootfsSource := filepath.Join("testdata", "rootfs", "root")
+			err = osutilCopyFile(rootfsSource, stateMachine.stateMachineFlags.WorkDir, osutil.CopyFlagPreserveAll)
 			asserter.AssertErrNil(err, true)
-			gadgetSrc := filepath.Join(wd, "testdata", "gadget_source")
-			imageDef := imagedefinition.ImageDefinition{
-				Architecture: arch.GetHostArch(),
-				Series:       getHostSuite(),
-				Gadget: &imagedefinition.Gadget{
-					GadgetURL:    fmt.Sprintf("file://%s", gadgetSrc),
-					GadgetType:   "directory",
-					GadgetTarget: tc.target,
-				},
+
+			// Make sure the root dir contains a sparse file
+			sparseFilePath := filepath.Join(stateMachine.tempDirs.rootfs, "bin", "sparseablefile")
+			sparseFilePathTemp := filepath.Join(stateMachine.tempDirs.rootfs, "bin", "sparseablefiletmp")
+			sparsifyOutputStep1, err := exec.Command("cp", "--sparse=always", sparseFilePath, sparseFilePathTemp).CombinedOutput()
+			if err != nil {
+				t.Error(string(sparsifyOutputStep1))
+				asserter.AssertErrNil(err, true)
+			}
+			sparsifyOutputStep2, err := exec.Command("mv", sparseFilePathTemp, sparseFilePath).CombinedOutput()
+			if err != nil {
+				t.Error(string(sparsifyOutputStep2))
+				asserter.AssertErrNil(err, true)
 			}
-			stateMachine.ImageDef = imageDef
 
-			// capture stdout, build the gadget tree, and make
-			// sure the expected output matches the make target
-			stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
-			defer restoreStdout()
+			err = stateMachine.generateRootfsTarball()
 			asserter.AssertErrNil(err, true)
 
-			err = stateMachine.buildGadgetTree()
+			// make sure tar archive exists and is the correct compression type
+			_, err = os.Stat(filepath.Join(stateMachine.stateMachineFlags.WorkDir, tc.tarPath))
+			if err != nil {
+				t.Errorf("File %s should be in workdir, but is missing", tc.tarPath)
+			}
+
+			fullPath := filepath.Join(stateMachine.commonFlags.OutputDir, tc.tarPath)
+			fileCommand := exec.Command("file", fullPath)
+			cmdOutput, err := fileCommand.CombinedOutput()
 			asserter.AssertErrNil(err, true)
+			if !strings.Contains(string(cmdOutput), tc.fileType) {
+				t.Errorf("File \"%s\" is the wrong file type. Expected \"%s\" but got \"%s\"",
+					fullPath, tc.fileType, string(cmdOutput))
+			}
 
-			// restore stdout and examine what was printed
-			restoreStdout()
-			readStdout, err := io.ReadAll(stdout)
+			fileInfo, err := os.Stat(fullPath)
 			asserter.AssertErrNil(err, true)
-			if !strings.Contains(string(readStdout), tc.expectedOutput) {
-				t.Errorf("Expected make output\n\"%s\"\nto contain the string \"%s\"",
-					string(readStdout),
-					tc.expectedOutput,
-				)
+
+			if fileInfo.Size() < tc.minArchiveSize {
+				asserter.Errorf("Archive too small.\ngot: %d\nwant a minimum of: %d", fileInfo.Size(), tc.minArchiveSize)
+			}
+
+			if fileInfo.Size() > tc.maxArchiveSize {
+				asserter.Errorf("Archive too big.\ngot: %d\nwant a maximum of: %d", fileInfo.Size(), tc.maxArchiveSize)
 			}
 		})
 	}
 }
 
-// TestFailedBuildGadgetTree tests failures in the  buildGadgetTree function
-func TestFailedBuildGadgetTree(t *testing.T) {
+// TestFailedMakeQcow2Img tests failures in the makeQcow2Img function
+func TestFailedMakeQcow2Img(t *testing.T) {
 	asserter := helper.Asserter{T: t}
 	restoreCWD := testhelper.SaveCWD()
 	defer restoreCWD()
@@ -4228,99 +6551,131 @@ func TestFailedBuildGadgetTree(t *testing.T) {
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 	stateMachine.parent = &stateMachine
-
-	err := stateMachine.makeTemporaryDirectories()
-	asserter.AssertErrNil(err, true)
-
-	// mock os.MkdirAll
-	osMkdir = mockMkdir
-	t.Cleanup(func() {
-		osMkdir = os.Mkdir
-	})
-	err = stateMachine.buildGadgetTree()
-	asserter.AssertErrContains(err, "Error creating scratch/gadget")
-	osMkdir = os.Mkdir
-
-	// try to clone a repo that doesn't exist
-	imageDef := imagedefinition.ImageDefinition{
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
 		Architecture: arch.GetHostArch(),
 		Series:       getHostSuite(),
-		Gadget: &imagedefinition.Gadget{
-			GadgetURL:  "http://fakerepo.git",
-			GadgetType: "git",
+		Artifacts: &imagedefinition.Artifact{
+			Qcow2: &[]imagedefinition.Qcow2{
+				{
+					Qcow2Name: "test.qcow2",
+				},
+			},
 		},
 	}
-	stateMachine.ImageDef = imageDef
 
-	err = stateMachine.buildGadgetTree()
-	asserter.AssertErrContains(err, "Error cloning gadget repository")
+	// Setup the exec.Command mock
+	testCaseName = "TestFailedMakeQcow2Image"
+	execCommand = fakeExecCommand
+	defer func() {
+		execCommand = exec.Command
+	}()
 
-	// try to copy a file that doesn't exist
-	imageDef = imagedefinition.ImageDefinition{
-		Architecture: arch.GetHostArch(),
-		Series:       getHostSuite(),
-		Gadget: &imagedefinition.Gadget{
-			GadgetURL:  "file:///fake/file/that/does/not/exist",
-			GadgetType: "directory",
-		},
-	}
-	stateMachine.ImageDef = imageDef
+	err := stateMachine.makeQcow2Img()
+	asserter.AssertErrContains(err, "Error running command")
+	asserter.AssertErrContains(err, "qemu-img convert")
+}
 
-	err = stateMachine.buildGadgetTree()
-	asserter.AssertErrContains(err, "Error reading gadget tree")
+// TestPreseedResetChroot tests that calling prepareClassicImage on a
+// preseeded chroot correctly resets the chroot and preseeds over it
+func TestPreseedResetChroot(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
 
-	// mock osutil.CopySpecialFile and run with /tmp as the gadget source
-	imageDef = imagedefinition.ImageDefinition{
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.Snaps = []string{"lxd"}
+	stateMachine.commonFlags.Channel = "stable"
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
 		Architecture: arch.GetHostArch(),
 		Series:       getHostSuite(),
-		Gadget: &imagedefinition.Gadget{
-			GadgetURL:  "file:///tmp",
-			GadgetType: "directory",
+		Rootfs: &imagedefinition.Rootfs{
+			Archive: "ubuntu",
+		},
+		Customization: &imagedefinition.Customization{
+			ExtraPackages: []*imagedefinition.Package{
+				{
+					PackageName: "squashfs-tools",
+				},
+				{
+					PackageName: "snapd",
+				},
+			},
+			ExtraSnaps: []*imagedefinition.Snap{
+				{
+					SnapName: "hello",
+				},
+				{
+					SnapName: "core",
+				},
+				{
+					SnapName: "core20",
+				},
+				{
+					SnapName: "core24",
+				},
+			},
 		},
 	}
-	stateMachine.ImageDef = imageDef
 
-	// mock osutil.CopySpecialFile
-	osutilCopySpecialFile = mockCopySpecialFile
-	t.Cleanup(func() {
-		osutilCopySpecialFile = osutil.CopySpecialFile
-	})
-	err = stateMachine.buildGadgetTree()
-	asserter.AssertErrContains(err, "Error copying gadget source")
-	osutilCopySpecialFile = osutil.CopySpecialFile
+	err := helper.SetDefaults(&stateMachine.ImageDef)
+	asserter.AssertErrNil(err, true)
+
+	err = stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	err = getBasicChroot(stateMachine.StateMachine)
+	asserter.AssertErrNil(err, true)
+
+	// install the packages that snap-preseed needs
+	err = stateMachine.installPackages()
+	asserter.AssertErrNil(err, true)
+
+	// first call prepareClassicImage to eventually preseed it
+	err = stateMachine.prepareClassicImage()
+	asserter.AssertErrNil(err, true)
 
-	// run a "make" command that will fail by mocking exec.Command
-	testCaseName = "TestFailedBuildGadgetTree"
-	execCommand = fakeExecCommand
-	t.Cleanup(func() {
-		execCommand = exec.Command
-	})
-	wd, err := os.Getwd()
+	// now preseed the chroot
+	err = stateMachine.preseedClassicImage()
 	asserter.AssertErrNil(err, true)
-	sourcePath := filepath.Join(wd, "testdata", "gadget_source")
-	sourcePath = "file://" + sourcePath
-	imageDef = imagedefinition.ImageDefinition{
+
+	// set up a new set of snaps to be installed
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
 		Architecture: arch.GetHostArch(),
-		Series:       getHostSuite(),
-		Gadget: &imagedefinition.Gadget{
-			GadgetURL:  sourcePath,
-			GadgetType: "directory",
+		Customization: &imagedefinition.Customization{
+			ExtraSnaps: []*imagedefinition.Snap{
+				{
+					SnapName: "ubuntu-image",
+				},
+			},
 		},
 	}
-	stateMachine.ImageDef = imageDef
 
-	err = stateMachine.buildGadgetTree()
-	asserter.AssertErrContains(err, "Error running \"make\" in gadget source")
+	// call prepareClassicImage again to trigger the reset
+	err = stateMachine.prepareClassicImage()
+	asserter.AssertErrNil(err, true)
 
-	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+	// make sure the snaps from both prepares are present
+	expectedSnaps := []string{"lxd", "hello", "ubuntu-image"}
+	for _, expectedSnap := range expectedSnaps {
+		snapGlobs, err := filepath.Glob(filepath.Join(stateMachine.tempDirs.chroot,
+			"var", "lib", "snapd", "seed", "snaps", fmt.Sprintf("%s*.snap", expectedSnap)))
+		asserter.AssertErrNil(err, true)
+		if len(snapGlobs) == 0 {
+			t.Errorf("expected snap %s to exist in the chroot but it does not", expectedSnap)
+		}
+	}
 }
 
-// TestCreateChroot runs the createChroot step and spot checks that some
-// expected files in the chroot exist
-func TestCreateChroot(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
-	}
+// TestStateMachine_setupBootloader_fail tests failures in the setupBootloader function
+func TestStateMachine_setupBootloader_fail(t *testing.T) {
 	asserter := helper.Asserter{T: t}
 	restoreCWD := testhelper.SaveCWD()
 	defer restoreCWD()
@@ -4331,109 +6686,175 @@ func TestCreateChroot(t *testing.T) {
 	stateMachine.ImageDef = imagedefinition.ImageDefinition{
 		Architecture: arch.GetHostArch(),
 		Series:       getHostSuite(),
-		Rootfs: &imagedefinition.Rootfs{
-			Pocket:            "proposed",
-			SourcesListDeb822: helper.BoolPtr(true),
-		},
+		Gadget:       &imagedefinition.Gadget{},
 	}
 
-	err := helper.SetDefaults(&stateMachine.ImageDef)
+	// set up work dir
+	err := stateMachine.makeTemporaryDirectories()
 	asserter.AssertErrNil(err, true)
 
-	err = stateMachine.makeTemporaryDirectories()
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	// place a test gadget tree in the scratch directory so we don't
+	// have to build one
+	gadgetDir := filepath.Join(stateMachine.tempDirs.scratch, "gadget")
+	err = os.MkdirAll(gadgetDir, 0755)
 	asserter.AssertErrNil(err, true)
 
-	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	gadgetSource := filepath.Join("testdata", "gadget_tree")
+	gadgetDest := filepath.Join(gadgetDir, "install")
+	err = osutil.CopySpecialFile(gadgetSource, gadgetDest)
+	asserter.AssertErrNil(err, true)
+	// also copy gadget.yaml to the root of the scratch/gadget dir
+	err = osutil.CopyFile(
+		filepath.Join(gadgetDest, "meta", "gadget.yaml"),
+		filepath.Join(gadgetDest, "gadget.yaml"),
+		osutil.CopyFlagDefault,
+	)
+	asserter.AssertErrNil(err, true)
 
-	err = stateMachine.createChroot()
+	err = stateMachine.prepareGadgetTree()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.loadGadgetYaml()
 	asserter.AssertErrNil(err, true)
 
-	expectedFiles := []string{
-		"etc",
-		"home",
-		"boot",
-		"var",
-	}
-	for _, expectedFile := range expectedFiles {
-		fullPath := filepath.Join(stateMachine.tempDirs.chroot, expectedFile)
-		_, err := os.Stat(fullPath)
-		if err != nil {
-			if os.IsNotExist(err) {
-				t.Errorf("File \"%s\" should exist, but does not", fullPath)
-			}
-		}
+	// Test that setupBootloader fails when missing volume
+	stateMachine.RootfsPartNum = -1
+	stateMachine.RootfsVolName = ""
+	err = stateMachine.setupBootloader()
+	asserter.AssertErrContains(err, "no volume to setup bootloader for")
+
+	// prepare state in such a way that the rootfs/bootfs partition was found in
+	// earlier steps
+	stateMachine.RootfsPartNum = 3
+	stateMachine.BootPartNum = 2
+	stateMachine.RootfsVolName = "pc"
+
+	// test invalid architecture
+	stateMachine.ImageDef.Architecture = ""
+	err = stateMachine.setupBootloader()
+	asserter.AssertErrContains(err, "unable to identify the arch")
+	stateMachine.ImageDef.Architecture = arch.GetHostArch()
+
+	osMkdir = mockMkdir
+	t.Cleanup(func() {
+		osMkdir = os.Mkdir
+	})
+
+	err = stateMachine.setupBootloader()
+	asserter.AssertErrContains(err, "Error creating scratch/loopback")
+}
+
+// TestStateMachine_setupBootloader_warning tests that a warning is thrown if the
+// bootloader specified in gadget.yaml is not supported
+func TestStateMachine_setupBootloader_warning(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: arch.GetHostArch(),
+		Series:       getHostSuite(),
+		Gadget:       &imagedefinition.Gadget{},
 	}
 
-	// check that the hostname is set correctly
-	hostnameFile := filepath.Join(stateMachine.tempDirs.chroot, "etc", "hostname")
-	hostnameData, err := os.ReadFile(hostnameFile)
+	err := stateMachine.makeTemporaryDirectories()
 	asserter.AssertErrNil(err, true)
-	if string(hostnameData) != "ubuntu\n" {
-		t.Errorf("Expected hostname to be \"ubuntu\", but is \"%s\"", string(hostnameData))
-	}
 
-	// check that the resolv.conf file was truncated
-	resolvConfFile := filepath.Join(stateMachine.tempDirs.chroot, "etc", "resolv.conf")
-	resolvConfData, err := os.ReadFile(resolvConfFile)
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	// place a test gadget tree in the scratch directory so we don't
+	// have to build one
+	gadgetDir := filepath.Join(stateMachine.tempDirs.scratch, "gadget")
+	err = os.MkdirAll(gadgetDir, 0755)
 	asserter.AssertErrNil(err, true)
-	if string(resolvConfData) != "" {
-		t.Errorf("Expected resolv.conf to be empty, but is \"%s\"", string(resolvConfData))
-	}
 
-	// check if components and pocket correctly setup in /etc/apt/sources.list.d/ubuntu.sources
-	aptDeb822SourcesListBytes, err := os.ReadFile(filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "sources.list.d", "ubuntu.sources"))
+	gadgetSource := filepath.Join("testdata", "gadget_tree")
+	gadgetDest := filepath.Join(gadgetDir, "install")
+	err = osutil.CopySpecialFile(gadgetSource, gadgetDest)
+	asserter.AssertErrNil(err, true)
+	// also copy gadget.yaml to the root of the scratch/gadget dir
+	err = osutil.CopyFile(
+		filepath.Join(gadgetDest, "meta", "gadget.yaml"),
+		filepath.Join(gadgetDest, "gadget.yaml"),
+		osutil.CopyFlagDefault,
+	)
+	asserter.AssertErrNil(err, true)
+	// parse gadget.yaml
+	err = stateMachine.prepareGadgetTree()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.loadGadgetYaml()
 	asserter.AssertErrNil(err, true)
-	wantAptDeb822SourcesList := `## Ubuntu distribution repository
-##
-## The following settings can be adjusted to configure which packages to use from Ubuntu.
-## Mirror your choices (except for URIs and Suites) in the security section below to
-## ensure timely security updates.
-##
-## Types: Append deb-src to enable the fetching of source package.
-## URIs: A URL to the repository (you may add multiple URLs)
-## Suites: The following additional suites can be configured
-##   <name>-updates   - Major bug fix updates produced after the final release of the
-##                      distribution.
-##   <name>-backports - software from this repository may not have been tested as
-##                      extensively as that contained in the main release, although it includes
-##                      newer versions of some applications which may provide useful features.
-##                      Also, please note that software in backports WILL NOT receive any review
-##                      or updates from the Ubuntu security team.
-## Components: Aside from main, the following components can be added to the list
-##   restricted  - Software that may not be under a free license, or protected by patents.
-##   universe    - Community maintained packages. Software in this repository receives maintenance
-##                 from volunteers in the Ubuntu community, or a 10 year security maintenance
-##                 commitment from Canonical when an Ubuntu Pro subscription is attached.
-##   multiverse  - Community maintained of restricted. Software from this repository is
-##                 ENTIRELY UNSUPPORTED by the Ubuntu team, and may not be under a free
-##                 licence. Please satisfy yourself as to your rights to use the software.
-##                 Also, please note that software in multiverse WILL NOT receive any
-##                 review or updates from the Ubuntu security team.
-##
-## See the sources.list(5) manual page for further settings.
-Types: deb
-URIs: http://archive.ubuntu.com/ubuntu/
-Suites: noble noble-updates noble-proposed
-Components: main restricted
-Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
 
-## Ubuntu security updates. Aside from URIs and Suites,
-## this should mirror your choices in the previous section.
-Types: deb
-URIs: http://security.ubuntu.com/ubuntu/
-Suites: noble-security
-Components: main restricted
-Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+	testCases := []struct {
+		name           string
+		rootfsPartNum  int
+		bootPartNum    int
+		rootfsVolName  string
+		bootloaderName string
+		wantWarning    string
+	}{
+		{
+			name:           "unknown bootloader",
+			rootfsPartNum:  3,
+			bootPartNum:    1,
+			rootfsVolName:  "pc",
+			bootloaderName: "test",
+			wantWarning:    "WARNING: setting up bootloader test not yet supported",
+		},
+		{
+			name:           "no rootfs part num",
+			rootfsPartNum:  -1,
+			bootPartNum:    1,
+			rootfsVolName:  "pc",
+			bootloaderName: "grub",
+			wantWarning:    "WARNING: Skipping GRUB installation because no data partition was found.",
+		},
+		{
+			name:           "no bootfs part num",
+			rootfsPartNum:  3,
+			bootPartNum:    -1,
+			rootfsVolName:  "pc",
+			bootloaderName: "grub",
+			wantWarning:    "WARNING: Skipping GRUB installation because no boot partition was found.",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stateMachine.RootfsPartNum = tc.rootfsPartNum
+			stateMachine.RootfsVolName = tc.rootfsVolName
+			stateMachine.BootPartNum = tc.bootPartNum
+
+			// set the bootloader for the volume to "test"
+			stateMachine.GadgetInfo.Volumes["pc"].Bootloader = tc.bootloaderName
+			stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+			defer restoreStdout()
+			asserter.AssertErrNil(err, true)
 
-`
-	asserter.AssertEqual(wantAptDeb822SourcesList, string(aptDeb822SourcesListBytes))
+			err = stateMachine.setupBootloader()
+			asserter.AssertErrNil(err, true)
+
+			// restore stdout and examine what was printed
+			restoreStdout()
+			readStdout, err := io.ReadAll(stdout)
+			asserter.AssertErrNil(err, true)
+			if !strings.Contains(string(readStdout), tc.wantWarning) {
+				t.Errorf("Warning: %s not printed", tc.wantWarning)
+			}
+		})
+	}
 }
 
-// TestFailedCreateChroot tests failure cases in createChroot
-func TestFailedCreateChroot(t *testing.T) {
+// TestPreseedClassicImage unit tests the prepareClassicImage function
+func TestPreseedClassicImage(t *testing.T) {
+	t.Parallel()
 	if testing.Short() {
 		t.Skip("skipping test in short mode.")
 	}
+
 	asserter := helper.Asserter{T: t}
 	restoreCWD := testhelper.SaveCWD()
 	defer restoreCWD()
@@ -4441,1510 +6862,1916 @@ func TestFailedCreateChroot(t *testing.T) {
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 	stateMachine.parent = &stateMachine
+	stateMachine.Snaps = []string{"lxd"}
+	stateMachine.commonFlags.Channel = "stable"
 	stateMachine.ImageDef = imagedefinition.ImageDefinition{
 		Architecture: arch.GetHostArch(),
 		Series:       getHostSuite(),
 		Rootfs: &imagedefinition.Rootfs{
-			SourcesListDeb822: helper.BoolPtr(false),
+			Archive: "ubuntu",
+		},
+		Customization: &imagedefinition.Customization{
+			ExtraPackages: []*imagedefinition.Package{
+				{
+					PackageName: "squashfs-tools",
+				},
+				{
+					PackageName: "snapd",
+				},
+			},
+			ExtraSnaps: []*imagedefinition.Snap{
+				{
+					SnapName: "hello",
+				},
+				{
+					SnapName: "core",
+				},
+				{
+					SnapName: "core20",
+				},
+			},
 		},
 	}
 
-	err := stateMachine.makeTemporaryDirectories()
+	err := helper.SetDefaults(&stateMachine.ImageDef)
 	asserter.AssertErrNil(err, true)
 
-	// mock os.Mkdir
-	osMkdir = mockMkdir
-	t.Cleanup(func() {
-		osMkdir = os.Mkdir
-	})
-	err = stateMachine.createChroot()
-	asserter.AssertErrContains(err, "Failed to create chroot")
-	osMkdir = os.Mkdir
-
-	// Setup the exec.Command mock
-	testCaseName = "TestFailedCreateChroot"
-	execCommand = fakeExecCommand
-	t.Cleanup(func() {
-		execCommand = exec.Command
-	})
-	err = stateMachine.createChroot()
-	asserter.AssertErrContains(err, "Error running debootstrap command")
-	execCommand = exec.Command
-
-	// Check if failure of open hostname file is detected
-
-	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
 	err = stateMachine.makeTemporaryDirectories()
 	asserter.AssertErrNil(err, true)
 
-	// Prepare a fallthrough debootstrap
-	testCaseName = "TestFailedCreateChrootNoHostname"
-	execCommand = fakeExecCommand
-	t.Cleanup(func() {
-		execCommand = exec.Command
-	})
-	osOpenFile = mockOpenFile
-	t.Cleanup(func() {
-		osOpenFile = os.OpenFile
-	})
-
-	err = stateMachine.createChroot()
-	asserter.AssertErrContains(err, "unable to open hostname file")
-
-	osOpenFile = os.OpenFile
-	execCommand = exec.Command
+	err = getBasicChroot(stateMachine.StateMachine)
+	asserter.AssertErrNil(err, true)
 
-	// Check if failure of truncation is detected
+	// install the packages that snap-preseed needs
+	err = stateMachine.installPackages()
+	asserter.AssertErrNil(err, true)
 
-	// Clean the work directory
-	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
-	err = stateMachine.makeTemporaryDirectories()
+	// first call prepareClassicImage
+	err = stateMachine.prepareClassicImage()
 	asserter.AssertErrNil(err, true)
 
-	// Prepare a fallthrough debootstrap
-	testCaseName = "TestFailedCreateChrootSkip"
-	osTruncate = mockTruncate
-	t.Cleanup(func() {
-		osTruncate = os.Truncate
-	})
-	err = stateMachine.createChroot()
-	asserter.AssertErrContains(err, "Error truncating resolv.conf")
-	osTruncate = os.Truncate
-	execCommand = exec.Command
+	// now preseed the chroot
+	err = stateMachine.preseedClassicImage()
+	asserter.AssertErrNil(err, true)
 
-	os.RemoveAll(stateMachine.stateMachineFlags.WorkDir)
+	// make sure the snaps are fully preseeded
+	expectedSnaps := []string{"lxc", "lxd", "hello"}
+	for _, expectedSnap := range expectedSnaps {
+		snapPath := filepath.Join(stateMachine.tempDirs.chroot, "snap", "bin", expectedSnap)
+		_, err := os.Stat(snapPath)
+		if err != nil {
+			t.Errorf("File %s should be in chroot, but is missing", snapPath)
+		}
+	}
 }
 
-// TestStateMachine_installPackages_checkcmds checks commands to install packages order is ok
-func TestStateMachine_installPackages_checkcmds(t *testing.T) {
+// TestFailedPreseedClassicImage tests failures in the preseedClassicImage function
+func TestFailedPreseedClassicImage(t *testing.T) {
 	asserter := helper.Asserter{T: t}
+	restoreCWD := testhelper.SaveCWD()
+	defer restoreCWD()
+
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.commonFlags.Debug = true
 	stateMachine.parent = &stateMachine
-	stateMachine.commonFlags.OutputDir = testhelper.DefaultTmpDir
 
 	err := stateMachine.makeTemporaryDirectories()
 	asserter.AssertErrNil(err, true)
-	err = os.MkdirAll(stateMachine.tempDirs.chroot, 0755)
-	asserter.AssertErrNil(err, true)
 
 	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-	// create an /usr/sbin/policy-rc.d in the chroot
-	err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.chroot, "usr", "sbin"), 0755)
-	asserter.AssertErrNil(err, true)
-	_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "usr", "sbin", "policy-rc.d"))
-	asserter.AssertErrNil(err, true)
-
-	// create an /sbin/start-stop-daemon in the chroot
-	err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.chroot, "sbin"), 0755)
-	asserter.AssertErrNil(err, true)
-	_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "sbin", "start-stop-daemon"))
-	asserter.AssertErrNil(err, true)
-
-	// create an /sbin/initctl in the chroot
-	_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "sbin", "initctl"))
-	asserter.AssertErrNil(err, true)
-
-	// Mock helper.Divert* functions
-	mock := func(targetDir string, debug bool) (func() error, func(error) error) {
-		return func() error { return nil }, func(error) error { return nil }
-	}
-	helperDivertPolicyRcD = mock
-	helperDivertStartStopDaemon = mock
-	helperDivertInitctl = mock
+	// mock os.MkdirAll
+	osMkdirAll = mockMkdirAll
 	t.Cleanup(func() {
-		helperDivertPolicyRcD = helper.DivertPolicyRcD
-		helperDivertStartStopDaemon = helper.DivertStartStopDaemon
-		helperDivertInitctl = helper.DivertInitctl
+		osMkdirAll = os.MkdirAll
 	})
+	err = stateMachine.preseedClassicImage()
+	asserter.AssertErrContains(err, "Error creating mountpoint")
+	osMkdirAll = os.MkdirAll
 
-	mockCmder := NewMockExecCommand()
-
-	execCommand = mockCmder.Command
-	t.Cleanup(func() { execCommand = exec.Command })
-
-	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
-	asserter.AssertErrNil(err, true)
-	t.Cleanup(func() { restoreStdout() })
-
-	helperBackupAndCopyResolvConf = mockBackupAndCopyResolvConfSuccess
+	testCaseName = "TestFailedPreseedClassicImage"
+	execCommand = fakeExecCommand
 	t.Cleanup(func() {
-		helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
+		execCommand = exec.Command
 	})
+	err = stateMachine.preseedClassicImage()
+	asserter.AssertErrContains(err, "Error running command")
+	execCommand = exec.Command
+}
 
-	err = stateMachine.installPackages()
-	asserter.AssertErrNil(err, true)
+// TestStateMachine_defaultLocale tests that the default locale is set
+func TestStateMachine_defaultLocale(t *testing.T) {
+	testCases := []struct {
+		name           string
+		localeContents string
+		localeExpected string
+	}{
+		{
+			"no_locale",
+			"",
+			"# Default Ubuntu locale\nLANG=C.UTF-8\n",
+		},
+		{
+			"locale_set",
+			"LANG=en_US.UTF-8\n",
+			"LANG=en_US.UTF-8\n",
+		},
+		{
+			"locale_set_non_lang",
+			"LC_ALL=en_US.UTF-8\n",
+			"LC_ALL=en_US.UTF-8\n",
+		},
+		{
+			"locale_set_with_comment",
+			"# some comment\nLANG=en_US.UTF-8\n",
+			"# some comment\nLANG=en_US.UTF-8\n",
+		},
+		{
+			"no_locale_with_comment",
+			"# some comment\n",
+			"# Default Ubuntu locale\nLANG=C.UTF-8\n",
+		},
+		{
+			"no_locale_with_comment_locale",
+			"# LANG=en_US.UTF-8",
+			"# Default Ubuntu locale\nLANG=C.UTF-8\n",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			var stateMachine ClassicStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
 
-	restoreStdout()
-	readStdout, err := io.ReadAll(stdout)
-	asserter.AssertErrNil(err, true)
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
 
-	expectedCmds := []*regexp.Regexp{
-		regexp.MustCompile("^mount -t devtmpfs devtmpfs-build /var/tmp.*/chroot/dev$"),
-		regexp.MustCompile("^mount -t devpts devpts-build -o nodev,nosuid /var/tmp.*/chroot/dev/pts$"),
-		regexp.MustCompile("^mount -t proc proc-build /var/tmp.*/chroot/proc$"),
-		regexp.MustCompile("^mount -t sysfs sysfs-build /var/tmp.*/chroot/sys$"),
-		regexp.MustCompile("^mount --bind .*/scratch/run.* .*/chroot/run$"),
-		regexp.MustCompile("^chroot /var/tmp.*/chroot apt update$"),
-		regexp.MustCompile("^chroot /var/tmp.*/chroot apt --assume-yes --quiet --option=Dpkg::options::=--force-unsafe-io --option=Dpkg::Options::=--force-confold install$"),
-		regexp.MustCompile("^udevadm settle$"),
-		regexp.MustCompile("^mount --make-rprivate /var/tmp.*/chroot/run$"),
-		regexp.MustCompile("^umount --recursive /var/tmp.*/chroot/run$"),
-		regexp.MustCompile("^mount --make-rprivate /var/tmp.*/chroot/sys$"),
-		regexp.MustCompile("^umount --recursive /var/tmp.*/chroot/sys$"),
-		regexp.MustCompile("^mount --make-rprivate /var/tmp.*/chroot/proc$"),
-		regexp.MustCompile("^umount --recursive /var/tmp.*/chroot/proc$"),
-		regexp.MustCompile("^mount --make-rprivate /var/tmp.*/chroot/dev/pts$"),
-		regexp.MustCompile("^umount --recursive /var/tmp.*/chroot/dev/pts$"),
-		regexp.MustCompile("^mount --make-rprivate /var/tmp.*/chroot/dev$"),
-		regexp.MustCompile("^umount --recursive /var/tmp.*/chroot/dev$"),
-	}
+			t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+			// create the <chroot>/etc/default directory
+			defaultPath := filepath.Join(stateMachine.tempDirs.chroot, "etc", "default")
+			err = os.MkdirAll(defaultPath, 0744)
+			asserter.AssertErrNil(err, true)
 
-	gotCmds := strings.Split(strings.TrimSpace(string(readStdout)), "\n")
-	if len(expectedCmds) != len(gotCmds) {
-		t.Fatalf("%v commands to be executed, expected %v commands. Got: %v", len(gotCmds), len(expectedCmds), gotCmds)
-	}
+			// create the <chroot>/etc/default/locale file
+			localePath := filepath.Join(defaultPath, "locale")
+			err = os.WriteFile(localePath, []byte(tc.localeContents), 0600)
+			asserter.AssertErrNil(err, true)
 
-	for i, gotCmd := range gotCmds {
-		expected := expectedCmds[i]
+			// call the function under test
+			err = stateMachine.setDefaultLocale()
+			asserter.AssertErrNil(err, true)
 
-		if !expected.Match([]byte(gotCmd)) {
-			t.Errorf("Cmd \"%v\" not matching. Expected %v\n", gotCmd, expected.String())
-		}
+			// read the locale file and make sure it matches the expected contents
+			localeBytes, err := os.ReadFile(localePath)
+			asserter.AssertErrNil(err, true)
+
+			if string(localeBytes) != tc.localeExpected {
+				t.Errorf("Expected locale contents \"%s\", but got \"%s\"",
+					tc.localeExpected, string(localeBytes))
+			}
+		})
 	}
 }
 
-// TestStateMachine_installPackages_checkcmds checks commands to install packages order is ok when failing
-func TestStateMachine_installPackages_checkcmds_failing(t *testing.T) {
+// TestStateMachine_defaultLocaleFailures tests failures in the setDefaultLocale function
+func TestStateMachine_defaultLocaleFailures(t *testing.T) {
 	asserter := helper.Asserter{T: t}
+
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.commonFlags.Debug = true
 	stateMachine.parent = &stateMachine
-	stateMachine.commonFlags.OutputDir = testhelper.DefaultTmpDir
 
 	err := stateMachine.makeTemporaryDirectories()
 	asserter.AssertErrNil(err, true)
 
 	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-	mockCmder := NewMockExecCommand()
-
-	execCommand = mockCmder.Command
-	t.Cleanup(func() { execCommand = exec.Command })
-
-	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
-	asserter.AssertErrNil(err, true)
-	t.Cleanup(func() { restoreStdout() })
-
-	helperBackupAndCopyResolvConf = mockBackupAndCopyResolvConfSuccess
+	// check failure in MkDirAll
+	osMkdirAll = mockMkdirAll
 	t.Cleanup(func() {
-		helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
+		osMkdirAll = os.MkdirAll
 	})
+	err = stateMachine.setDefaultLocale()
+	asserter.AssertErrContains(err, "Error creating default directory")
+	osMkdirAll = os.MkdirAll
 
-	osMkdirTemp = mockMkdirTemp
+	// check failure in WriteFile
+	osWriteFile = mockWriteFile
 	t.Cleanup(func() {
-		osMkdirTemp = os.MkdirTemp
+		osWriteFile = os.WriteFile
 	})
-
-	err = stateMachine.installPackages()
-	asserter.AssertErrContains(err, "Test error")
-
-	restoreStdout()
-	readStdout, err := io.ReadAll(stdout)
-	asserter.AssertErrNil(err, true)
-
-	gotCmds := strings.Split(strings.TrimSpace(string(readStdout)), "\n")
-	// Clean empty commands
-	for i, cmd := range gotCmds {
-		if len(cmd) == 0 {
-			copy(gotCmds[i:], gotCmds[i+1:])
-			gotCmds[len(gotCmds)-1] = ""
-			gotCmds = gotCmds[:len(gotCmds)-1]
-		}
-	}
-
-	if len(gotCmds) != 0 {
-		t.Fatalf("%v commands to be executed, expected no commands. Got: %v", len(gotCmds), gotCmds)
-	}
+	err = stateMachine.setDefaultLocale()
+	asserter.AssertErrContains(err, "Error writing to locale file")
+	osWriteFile = os.WriteFile
 }
 
-func checkDivert(t *testing.T, fn func() error, divert *func(string, bool) (func() error, func(error) error)) {
-	asserter := helper.Asserter{T: t}
-
-	divertSaved := *divert
-	defer func() {
-		*divert = divertSaved
-	}()
-
-	*divert = func(targetDir string, debug bool) (func() error, func(error) error) {
-		return func() error { return fmt.Errorf("divert") }, func(err error) error { return err }
-	}
-	err := fn()
-	asserter.AssertErrContains(err, "divert")
-
-	*divert = func(targetDir string, debug bool) (func() error, func(error) error) {
-		return func() error { return nil }, func(err error) error { return errors.Join(err, fmt.Errorf("undivert")) }
+func TestClassicStateMachine_cleanRootfs_real_rootfs(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
 	}
-	err = fn()
-	asserter.AssertErrContains(err, "undivert")
-}
-
-// TestStateMachine_installPackages_fail tests failure cases in installPackages
-func TestStateMachine_installPackages_fail(t *testing.T) {
 	asserter := helper.Asserter{T: t}
 	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
+	t.Cleanup(restoreCWD)
 
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 	stateMachine.parent = &stateMachine
+	stateMachine.Snaps = []string{"lxd"}
+	stateMachine.commonFlags.Channel = "stable"
+	stateMachine.commonFlags.Debug = true
 	stateMachine.ImageDef = imagedefinition.ImageDefinition{
 		Architecture: arch.GetHostArch(),
 		Series:       getHostSuite(),
-		Rootfs:       &imagedefinition.Rootfs{},
+		Rootfs: &imagedefinition.Rootfs{
+			Archive: "ubuntu",
+		},
 		Customization: &imagedefinition.Customization{
 			ExtraPackages: []*imagedefinition.Package{
 				{
-					PackageName: "test1",
+					PackageName: "squashfs-tools",
+				},
+				{
+					PackageName: "snapd",
 				},
 			},
 		},
 	}
 
-	err := stateMachine.makeTemporaryDirectories()
+	err := helper.SetDefaults(&stateMachine.ImageDef)
+	asserter.AssertErrNil(err, true)
+
+	err = stateMachine.makeTemporaryDirectories()
 	asserter.AssertErrNil(err, true)
 
 	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-	// create an /etc/resolv.conf in the chroot
-	err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.chroot, "etc"), 0755)
-	asserter.AssertErrNil(err, true)
-	_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "etc", "resolv.conf"))
+	err = getBasicChroot(stateMachine.StateMachine)
 	asserter.AssertErrNil(err, true)
 
-	// create files to be diverted in the chroot
-	err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.chroot, "usr", "sbin"), 0755)
-	asserter.AssertErrNil(err, true)
-	_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "usr", "sbin", "policy-rc.d"))
-	asserter.AssertErrNil(err, true)
-	err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.chroot, "sbin"), 0755)
-	asserter.AssertErrNil(err, true)
-	_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "sbin", "start-stop-daemon"))
+	// install the packages that snap-preseed needs
+	err = stateMachine.installPackages()
 	asserter.AssertErrNil(err, true)
-	_, err = os.Create(filepath.Join(stateMachine.tempDirs.chroot, "sbin", "initctl"))
+
+	err = stateMachine.cleanRootfs()
 	asserter.AssertErrNil(err, true)
 
-	osMkdirTemp = mockMkdirTemp
-	t.Cleanup(func() {
-		osMkdirTemp = os.MkdirTemp
-	})
-	err = stateMachine.installPackages()
-	asserter.AssertErrContains(err, "Error making temporary directory for mountpoint")
-	osMkdirTemp = os.MkdirTemp
+	// Check cleaned files were removed
+	cleaned := []string{
+		filepath.Join(stateMachine.tempDirs.chroot, "var", "lib", "dbus", "machine-id"),
+		filepath.Join(stateMachine.tempDirs.chroot, "etc", "ssh", "ssh_host_rsa_key"),
+		filepath.Join(stateMachine.tempDirs.chroot, "etc", "ssh", "ssh_host_rsa_key.pub"),
+		filepath.Join(stateMachine.tempDirs.chroot, "etc", "ssh", "ssh_host_ecdsa_key"),
+		filepath.Join(stateMachine.tempDirs.chroot, "etc", "ssh", "ssh_host_ecdsa_key.pub"),
+		filepath.Join(stateMachine.tempDirs.chroot, "dev", "stderr"),
+		filepath.Join(stateMachine.tempDirs.chroot, "dev", "stdin"),
+		filepath.Join(stateMachine.tempDirs.chroot, "dev", "stdout"),
+		filepath.Join(stateMachine.tempDirs.chroot, "dev", "fd"),
+		filepath.Join(stateMachine.tempDirs.chroot, "sys", "kernel", "security"),
+		filepath.Join(stateMachine.tempDirs.chroot, "sys", "fs", "cgroup"),
+		filepath.Join(stateMachine.tempDirs.chroot, "run", "mount", "utab.lock"),
+		filepath.Join(stateMachine.tempDirs.chroot, "run", "lock"),
+	}
+	for _, file := range cleaned {
+		_, err := os.Stat(file)
+		if !os.IsNotExist(err) {
+			t.Errorf("File %s should not exist, but does", file)
+		}
+	}
+
+	truncated := []string{
+		filepath.Join(stateMachine.tempDirs.chroot, "etc", "machine-id"),
+	}
+	for _, file := range truncated {
+		fileInfo, err := os.Stat(file)
+		if os.IsNotExist(err) {
+			t.Errorf("File %s should exist, but does not", file)
+		}
+
+		if fileInfo.Size() != 0 {
+			t.Errorf("File %s should be empty, but it is not. Size: %v", file, fileInfo.Size())
+		}
+	}
+}
+
+func TestClassicStateMachine_cleanRootfs(t *testing.T) {
+	sampleContent := "test"
+	sampleSize := int64(len(sampleContent))
+
+	testCases := []struct {
+		name                 string
+		mockFuncs            func() func()
+		expectedErr          string
+		initialRootfsContent []string
+		wantRootfsContent    map[string]int64 // name: size
+	}{
+		{
+			name: "success",
+			initialRootfsContent: []string{
+				filepath.Join("etc", "machine-id"),
+				filepath.Join("var", "lib", "dbus", "machine-id"),
+				filepath.Join("etc", "udev", "rules.d", "test-persistent-net.rules"),
+				filepath.Join("etc", "udev", "rules.d", "test2-persistent-net.rules"),
+				filepath.Join("var", "cache", "debconf", "test-old"),
+				filepath.Join("var", "lib", "dpkg", "testdpkg-old"),
+				filepath.Join("dev", "stderr"),
+				filepath.Join("dev", "stdin"),
+				filepath.Join("dev", "stdout"),
+				filepath.Join("sys", "kernel", "security"),
+				filepath.Join("run", "mount", "utab.lock"),
+			},
+			wantRootfsContent: map[string]int64{
+				filepath.Join("etc", "machine-id"):                                    0,
+				filepath.Join("etc", "udev", "rules.d", "test-persistent-net.rules"):  0,
+				filepath.Join("etc", "udev", "rules.d", "test2-persistent-net.rules"): 0,
+			},
+		},
+		{
+			name: "fail to clean files",
+			mockFuncs: func() func() {
+				mock := testhelper.NewOSMock(
+					&testhelper.OSMockConf{},
+				)
+
+				osRemoveAll = mock.RemoveAll
+				return func() { osRemoveAll = os.RemoveAll }
+			},
+			expectedErr: "Error removing",
+			initialRootfsContent: []string{
+				filepath.Join("etc", "machine-id"),
+				filepath.Join("var", "lib", "dbus", "machine-id"),
+				filepath.Join("etc", "udev", "rules.d", "test-persistent-net.rules"),
+				filepath.Join("var", "cache", "debconf", "test-old"),
+				filepath.Join("var", "lib", "dpkg", "testdpkg-old"),
+				filepath.Join("dev", "stderr"),
+				filepath.Join("dev", "stdin"),
+				filepath.Join("dev", "stdout"),
+				filepath.Join("sys", "kernel", "security"),
+				filepath.Join("run", "mount", "utab.lock"),
+			},
+			wantRootfsContent: map[string]int64{
+				filepath.Join("etc", "machine-id"):                                   sampleSize,
+				filepath.Join("var", "lib", "dbus", "machine-id"):                    sampleSize,
+				filepath.Join("etc", "udev", "rules.d", "test-persistent-net.rules"): sampleSize,
+				filepath.Join("var", "cache", "debconf", "test-old"):                 sampleSize,
+				filepath.Join("var", "lib", "dpkg", "testdpkg-old"):                  sampleSize,
+				filepath.Join("dev", "stderr"):                                       sampleSize,
+				filepath.Join("dev", "stdin"):                                        sampleSize,
+				filepath.Join("dev", "stdout"):                                       sampleSize,
+				filepath.Join("sys", "kernel", "security"):                           sampleSize,
+				filepath.Join("run", "mount", "utab.lock"):                           sampleSize,
+			},
+		},
+		{
+			name: "fail to truncate files",
+			mockFuncs: func() func() {
+				mock := testhelper.NewOSMock(
+					&testhelper.OSMockConf{},
+				)
+
+				osTruncate = mock.Truncate
+				return func() { osTruncate = os.Truncate }
+			},
+			expectedErr: "Error truncating",
+			initialRootfsContent: []string{
+				filepath.Join("etc", "machine-id"),
+				filepath.Join("var", "lib", "dbus", "machine-id"),
+				filepath.Join("etc", "udev", "rules.d", "test-persistent-net.rules"),
+			},
+			wantRootfsContent: map[string]int64{
+				filepath.Join("etc", "machine-id"):                                   sampleSize,
+				filepath.Join("etc", "udev", "rules.d", "test-persistent-net.rules"): sampleSize,
+			},
+		},
+	}
 
-	// Setup the exec.Command mock
-	testCaseName = "TestStateMachine_installPackages_fail"
-	execCommand = fakeExecCommand
-	t.Cleanup(func() {
-		execCommand = exec.Command
-	})
-	err = stateMachine.installPackages()
-	asserter.AssertErrContains(err, "Error running command")
-	execCommand = exec.Command
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			stateMachine := &ClassicStateMachine{}
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = stateMachine
 
-	// delete the backed up resolv.conf to trigger another backup
-	err = os.Remove(filepath.Join(stateMachine.tempDirs.chroot, "etc", "resolv.conf.tmp"))
-	asserter.AssertErrNil(err, true)
-	// mock helper.BackupAndCopyResolvConf
-	helperBackupAndCopyResolvConf = mockBackupAndCopyResolvConfFail
-	t.Cleanup(func() {
-		helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
-	})
-	err = stateMachine.installPackages()
-	asserter.AssertErrContains(err, "Error setting up /etc/resolv.conf")
-	helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
+			err := stateMachine.makeTemporaryDirectories()
+			asserter.AssertErrNil(err, true)
 
-	execCommand = func(string, ...string) *exec.Cmd { return exec.Command("true") }
-	t.Cleanup(func() { execCommand = exec.Command })
+			t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-	helperBackupAndCopyResolvConf = mockBackupAndCopyResolvConfSuccess
-	t.Cleanup(func() {
-		helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf
-	})
+			if tc.mockFuncs != nil {
+				restoreMock := tc.mockFuncs()
+				t.Cleanup(restoreMock)
+			}
 
-	// Mock helper.Divert* functions
-	mock := func(string, bool) (func() error, func(error) error) {
-		return func() error { return nil }, func(err error) error { return err }
-	}
-	helperDivertPolicyRcD = mock
-	helperDivertStartStopDaemon = mock
-	helperDivertInitctl = mock
-	t.Cleanup(func() {
-		helperDivertPolicyRcD = helper.DivertPolicyRcD
-		helperDivertStartStopDaemon = helper.DivertStartStopDaemon
-		helperDivertInitctl = helper.DivertInitctl
-	})
+			for _, path := range tc.initialRootfsContent {
+				// create dir if necessary
+				fullPath := filepath.Join(stateMachine.tempDirs.chroot, path)
+				err = os.MkdirAll(filepath.Dir(fullPath), 0777)
+				asserter.AssertErrNil(err, true)
 
-	checkDivert(t, stateMachine.installPackages, &helperDivertPolicyRcD)
-	checkDivert(t, stateMachine.installPackages, &helperDivertStartStopDaemon)
-	checkDivert(t, stateMachine.installPackages, &helperDivertInitctl)
-}
+				err := os.WriteFile(fullPath, []byte(sampleContent), 0600)
+				asserter.AssertErrNil(err, true)
+			}
 
-// Test_generateMountPointCmds_fail tests when generateMountPointCmds fails
-func Test_generateMountPointCmds_fail(t *testing.T) {
-	asserter := helper.Asserter{T: t}
+			err = stateMachine.cleanRootfs()
+			if err != nil || len(tc.expectedErr) != 0 {
+				asserter.AssertErrContains(err, tc.expectedErr)
+			}
 
-	tmpDirPath := filepath.Join(testhelper.DefaultTmpDir, "test_failed_set_conf_dir")
-	err := os.Mkdir(tmpDirPath, 0755)
-	t.Cleanup(func() {
-		os.RemoveAll(tmpDirPath)
-	})
-	asserter.AssertErrNil(err, true)
+			for path, size := range tc.wantRootfsContent {
+				fullPath := filepath.Join(stateMachine.tempDirs.chroot, path)
+				s, err := os.Stat(fullPath)
+				if os.IsNotExist(err) {
+					t.Errorf("File %s should exist, but does not", path)
+				}
 
-	mountPoints := []*mountPoint{
-		{
-			src:      "devtmpfs-build",
-			basePath: tmpDirPath,
-			relpath:  "/dev",
-			typ:      "devtmpfs",
-		},
-		{
-			src:      "doesnotexists",
-			basePath: "/doesnotexists",
-			relpath:  "/doesnotexists",
-			typ:      "devpts",
-			bind:     true,
-			opts:     []string{"nodev", "nosuid"},
-		},
+				if s.Size() != size {
+					t.Errorf("File size of %s is not matching: want %d, got %d", path, size, s.Size())
+				}
+			}
+		})
 	}
-
-	gotAllMountCmds, gotAllUmountCmds, err := generateMountPointCmds(mountPoints, tmpDirPath)
-	asserter.AssertErrContains(err, "Error preparing mountpoint")
-	asserter.AssertEqual(nil, gotAllMountCmds)
-	asserter.AssertEqual(nil, gotAllUmountCmds)
 }
 
-// TestCustomizeFstab tests functionality of the customizeFstab function
-func TestCustomizeFstab(t *testing.T) {
-	testCases := []struct {
-		name          string
-		fstab         []*imagedefinition.Fstab
-		expectedFstab string
-		existingFstab string
+func Test_addUniqueSnaps(t *testing.T) {
+	type args struct {
+		currentSnaps []string
+		newSnaps     []string
+	}
+	tests := []struct {
+		name string
+		args args
+		want []string
 	}{
 		{
-			name: "one entry to an empty fstab",
-			fstab: []*imagedefinition.Fstab{
-				{
-					Label:        "writable",
-					Mountpoint:   "/",
-					FSType:       "ext4",
-					MountOptions: "defaults",
-					Dump:         true,
-					FsckOrder:    1,
+			name: "no duplicate",
+			args: args{
+				currentSnaps: []string{
+					"a",
+					"b",
+				},
+				newSnaps: []string{
+					"c",
+					"d",
 				},
 			},
-			expectedFstab: `LABEL=writable	/	ext4	defaults	1	1
-`,
+			want: []string{
+				"a",
+				"b",
+				"c",
+				"d",
+			},
 		},
 		{
-			name: "one entry to a non-empty fstab",
-			fstab: []*imagedefinition.Fstab{
-				{
-					Label:        "writable",
-					Mountpoint:   "/",
-					FSType:       "ext4",
-					MountOptions: "defaults",
-					Dump:         true,
-					FsckOrder:    1,
+			name: "current empty",
+			args: args{
+				currentSnaps: nil,
+				newSnaps: []string{
+					"c",
+					"d",
 				},
 			},
-			expectedFstab: `LABEL=writable	/	ext4	defaults	1	1
-`,
-			existingFstab: `LABEL=xxx / ext4 discard,errors=remount-ro 0 1`,
+			want: []string{
+				"c",
+				"d",
+			},
 		},
 		{
-			name: "two entries",
-			fstab: []*imagedefinition.Fstab{
+			name: "new empty",
+			args: args{
+				currentSnaps: []string{
+					"a",
+					"b",
+				},
+				newSnaps: nil,
+			},
+			want: []string{
+				"a",
+				"b",
+			},
+		},
+		{
+			name: "with duplicates, conserve order",
+			args: args{
+				currentSnaps: []string{
+					"a",
+					"b",
+					"e",
+					"f",
+				},
+				newSnaps: []string{
+					"c",
+					"d",
+					"e",
+					"f",
+				},
+			},
+			want: []string{
+				"a",
+				"b",
+				"e",
+				"f",
+				"c",
+				"d",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			got := addUniqueSnaps(tt.args.currentSnaps, tt.args.newSnaps)
+			asserter.AssertEqual(tt.want, got)
+		})
+	}
+}
+
+// TestStateMachine_aptPreferences tests that apt preferences are written
+// before installing packages and that only the kept ones are left afterwards
+func TestStateMachine_aptPreferences(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Customization: &imagedefinition.Customization{
+			AptPreferences: []*imagedefinition.AptPreference{
 				{
-					Label:        "writable",
-					Mountpoint:   "/",
-					FSType:       "ext4",
-					MountOptions: "defaults",
-					Dump:         false,
-					FsckOrder:    1,
+					Name:        "ubuntu-image",
+					Package:     "*",
+					Pin:         "release o=LP-PPA-canonical-foundations-ubuntu-image",
+					PinPriority: 1001,
 				},
 				{
-					Label:        "system-boot",
-					Mountpoint:   "/boot/firmware",
-					FSType:       "vfat",
-					MountOptions: "defaults",
-					Dump:         false,
-					FsckOrder:    1,
+					Name:        "no-snapd",
+					Package:     "snapd",
+					Pin:         "release *",
+					PinPriority: -1,
+					KeepEnabled: helper.BoolPtr(true),
 				},
 			},
-			expectedFstab: `LABEL=writable	/	ext4	defaults	0	1
-LABEL=system-boot	/boot/firmware	vfat	defaults	0	1
-`,
 		},
 	}
 
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			asserter := helper.Asserter{T: t}
-			restoreCWD := testhelper.SaveCWD()
-			defer restoreCWD()
-
-			var stateMachine ClassicStateMachine
-			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-			stateMachine.parent = &stateMachine
-			stateMachine.ImageDef = imagedefinition.ImageDefinition{
-				Architecture: arch.GetHostArch(),
-				Series:       getHostSuite(),
-				Rootfs:       &imagedefinition.Rootfs{},
-				Customization: &imagedefinition.Customization{
-					Fstab: tc.fstab,
-				},
-			}
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-			// set the defaults for the imageDef
-			err := helper.SetDefaults(&stateMachine.ImageDef)
-			asserter.AssertErrNil(err, true)
+	err = stateMachine.setAptPreferences()
+	asserter.AssertErrNil(err, true)
 
-			err = stateMachine.makeTemporaryDirectories()
-			asserter.AssertErrNil(err, true)
+	preferencesD := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "preferences.d")
+	gotContent, err := os.ReadFile(filepath.Join(preferencesD, "ubuntu-image"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("Package: *\nPin: release o=LP-PPA-canonical-foundations-ubuntu-image\nPin-Priority: 1001\n", string(gotContent))
 
-			// create the <chroot>/etc directory
-			err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.chroot, "etc"), 0644)
-			asserter.AssertErrNil(err, true)
+	gotContent, err = os.ReadFile(filepath.Join(preferencesD, "no-snapd"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("Package: snapd\nPin: release *\nPin-Priority: -1\n", string(gotContent))
 
-			fstabPath := filepath.Join(stateMachine.tempDirs.chroot, "etc", "fstab")
+	err = stateMachine.cleanAptPreferences()
+	asserter.AssertErrNil(err, true)
 
-			// simulate an already existing fstab file
-			if len(tc.existingFstab) != 0 {
-				err = osWriteFile(fstabPath, []byte(tc.existingFstab), 0644)
-				asserter.AssertErrNil(err, true)
-			}
+	_, err = os.Stat(filepath.Join(preferencesD, "ubuntu-image"))
+	if !os.IsNotExist(err) {
+		t.Errorf("apt preferences file ubuntu-image should have been removed")
+	}
+	_, err = os.Stat(filepath.Join(preferencesD, "no-snapd"))
+	asserter.AssertErrNil(err, true)
 
-			// customize the fstab, ensure no errors, and check the contents
-			err = stateMachine.customizeFstab()
-			asserter.AssertErrNil(err, true)
+	// mock the failures
+	osRemoveAll = mockRemoveAll
+	t.Cleanup(func() {
+		osRemoveAll = os.RemoveAll
+	})
+	err = stateMachine.cleanAptPreferences()
+	asserter.AssertErrContains(err, "Error removing apt preferences file")
+	osRemoveAll = os.RemoveAll
 
-			fstabBytes, err := os.ReadFile(fstabPath)
-			asserter.AssertErrNil(err, true)
+	osWriteFile = mockWriteFile
+	t.Cleanup(func() {
+		osWriteFile = os.WriteFile
+	})
+	err = stateMachine.setAptPreferences()
+	asserter.AssertErrContains(err, "Error writing apt preferences file")
+	osWriteFile = os.WriteFile
 
-			if string(fstabBytes) != tc.expectedFstab {
-				t.Errorf("Expected fstab contents \"%s\", but got \"%s\"",
-					tc.expectedFstab, string(fstabBytes))
-			}
-		})
-	}
+	osMkdirAll = mockMkdirAll
+	t.Cleanup(func() {
+		osMkdirAll = os.MkdirAll
+	})
+	err = stateMachine.setAptPreferences()
+	asserter.AssertErrContains(err, "Error creating apt preferences.d directory")
+	osMkdirAll = os.MkdirAll
 }
 
-// TestStateMachine_customizeFstab_fail tests failures in the customizeFstab function
-func TestStateMachine_customizeFstab_fail(t *testing.T) {
+// TestStateMachine_extraRepositories tests that third-party repositories are
+// added to the chroot and removed once packages are installed
+func TestStateMachine_extraRepositories(t *testing.T) {
 	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
-
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 	stateMachine.parent = &stateMachine
 	stateMachine.ImageDef = imagedefinition.ImageDefinition{
-		Architecture: arch.GetHostArch(),
-		Series:       getHostSuite(),
-		Rootfs:       &imagedefinition.Rootfs{},
+		Rootfs: &imagedefinition.Rootfs{
+			SourcesListDeb822: helper.BoolPtr(false),
+		},
 		Customization: &imagedefinition.Customization{
-			Fstab: []*imagedefinition.Fstab{
+			ExtraRepositories: []*imagedefinition.Repository{
 				{
-					Label:        "writable",
-					Mountpoint:   "/",
-					FSType:       "ext4",
-					MountOptions: "defaults",
-					Dump:         false,
-					FsckOrder:    1,
+					Name:        "artifactory",
+					URIs:        []string{"https://artifactory.example.com/ubuntu"},
+					Suites:      []string{"jammy"},
+					Components:  []string{"main"},
+					KeepEnabled: helper.BoolPtr(false),
+				},
+				{
+					Name:        "kept",
+					URIs:        []string{"https://example.com/ubuntu"},
+					Suites:      []string{"jammy"},
+					KeepEnabled: helper.BoolPtr(true),
 				},
 			},
 		},
 	}
 
-	osOpenFile = mockOpenFile
-	t.Cleanup(func() {
-		osOpenFile = os.OpenFile
-	})
-	err := stateMachine.customizeFstab()
-	asserter.AssertErrContains(err, "Error opening fstab")
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+
+	err = stateMachine.addExtraRepositories()
+	asserter.AssertErrNil(err, true)
+
+	sourcesListD := filepath.Join(stateMachine.tempDirs.chroot, "etc", "apt", "sources.list.d")
+	gotContent, err := os.ReadFile(filepath.Join(sourcesListD, "artifactory.list"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("deb https://artifactory.example.com/ubuntu jammy main\n", string(gotContent))
+
+	err = stateMachine.cleanExtraRepositories()
+	asserter.AssertErrNil(err, true)
+
+	_, err = os.Stat(filepath.Join(sourcesListD, "artifactory.list"))
+	if !os.IsNotExist(err) {
+		t.Errorf("artifactory.list should have been removed")
+	}
+	_, err = os.Stat(filepath.Join(sourcesListD, "kept.list"))
+	asserter.AssertErrNil(err, true)
+
+	// a missing key file makes the state fail
+	stateMachine.ImageDef.Customization.ExtraRepositories[0].KeyFile = "missing.asc"
+	err = stateMachine.addExtraRepositories()
+	asserter.AssertErrContains(err, "Error reading signing key for repository")
+
+	stateMachine.ImageDef.Customization.ExtraRepositories[0].KeepEnabled = nil
+	err = stateMachine.cleanExtraRepositories()
+	asserter.AssertErrContains(err, imagedefinition.ErrKeepEnabledNil.Error())
 }
 
-// TestGenerateRootfsTarball tests that a rootfs tarball is generated
-// when appropriate
-func TestGenerateRootfsTarball(t *testing.T) {
-	testCases := []struct {
-		name     string // the name will double as the compression type
-		tarPath  string
-		fileType string
-		// Define an interval since we cannot predict the exact
-		// size of the resulting archive due to changing atime/ctime
-		minArchiveSize int64
-		maxArchiveSize int64
-	}{
-		{
-			name:           "uncompressed",
-			tarPath:        "test_generate_rootfs_tarball.tar",
-			fileType:       "tar archive",
-			minArchiveSize: 61440,
-			maxArchiveSize: 61440, // 92160 without --sparse option
-		},
-		{
-			name:           "bzip2",
-			tarPath:        "test_generate_rootfs_tarball.tar.bz2",
-			fileType:       "bzip2 compressed data",
-			minArchiveSize: 32100,
-			maxArchiveSize: 32300,
-		},
-		{
-			name:           "gzip",
-			tarPath:        "test_generate_rootfs_tarball.tar.gz",
-			fileType:       "gzip compressed data",
-			minArchiveSize: 31700,
-			maxArchiveSize: 32000,
-		},
-		{
-			name:           "xz",
-			tarPath:        "test_generate_rootfs_tarball.tar.xz",
-			fileType:       "XZ compressed data",
-			minArchiveSize: 31700,
-			maxArchiveSize: 31910,
-		},
-		{
-			name:           "zstd",
-			tarPath:        "test_generate_rootfs_tarball.tar.zst",
-			fileType:       "Zstandard compressed data",
-			minArchiveSize: 31400,
-			maxArchiveSize: 31700,
+// TestStateMachine_customizeSystemd checks units are managed offline with
+// systemctl and that unknown units are reported
+func TestStateMachine_customizeSystemd(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Debug = true
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Customization: &imagedefinition.Customization{
+			Systemd: &imagedefinition.Systemd{
+				Enable:        []string{"ssh", "getty@ttyS0.service"},
+				Disable:       []string{"unattended-upgrades.service"},
+				Mask:          []string{"apt-daily.timer"},
+				DefaultTarget: "multi-user.target",
+			},
 		},
 	}
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			asserter := helper.Asserter{T: t}
-			restoreCWD := testhelper.SaveCWD()
-			defer restoreCWD()
 
-			var stateMachine ClassicStateMachine
-			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-			stateMachine.parent = &stateMachine
-			stateMachine.ImageDef = imagedefinition.ImageDefinition{
-				Architecture: arch.GetHostArch(),
-				Series:       getHostSuite(),
-				Rootfs:       &imagedefinition.Rootfs{},
-				Artifacts: &imagedefinition.Artifact{
-					RootfsTar: &imagedefinition.RootfsTar{
-						RootfsTarName: tc.tarPath,
-						Compression:   tc.name,
-					},
-				},
-			}
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-			err := stateMachine.makeTemporaryDirectories()
-			asserter.AssertErrNil(err, true)
-			stateMachine.commonFlags.OutputDir = stateMachine.stateMachineFlags.WorkDir
+	for _, unitFile := range []string{
+		filepath.Join("usr", "lib", "systemd", "system", "ssh.service"),
+		filepath.Join("usr", "lib", "systemd", "system", "getty@.service"),
+		filepath.Join("lib", "systemd", "system", "unattended-upgrades.service"),
+		filepath.Join("usr", "lib", "systemd", "system", "apt-daily.timer"),
+		filepath.Join("etc", "systemd", "system", "multi-user.target"),
+	} {
+		unitPath := filepath.Join(stateMachine.tempDirs.chroot, unitFile)
+		err = os.MkdirAll(filepath.Dir(unitPath), 0755)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(unitPath, []byte("[Unit]\n"), 0644)
+		asserter.AssertErrNil(err, true)
+	}
 
-			t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	mockCmder := NewMockExecCommand()
+	execCommand = mockCmder.Command
+	t.Cleanup(func() { execCommand = exec.Command })
 
-			// Copy a rootfs so the tar is not empty
-			rootfsSource := filepath.Join("testdata", "rootfs", "root")
-			err = osutilCopyFile(rootfsSource, stateMachine.stateMachineFlags.WorkDir, osutil.CopyFlagPreserveAll)
-			asserter.AssertErrNil(err, true)
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
 
-			// Make sure the root dir contains a sparse file
-			sparseFilePath := filepath.Join(stateMachine.tempDirs.rootfs, "bin", "sparseablefile")
-			sparseFilePathTemp := filepath.Join(stateMachine.tempDirs.rootfs, "bin", "sparseablefiletmp")
-			sparsifyOutputStep1, err := exec.Command("cp", "--sparse=always", sparseFilePath, sparseFilePathTemp).CombinedOutput()
-			if err != nil {
-				t.Error(string(sparsifyOutputStep1))
-				asserter.AssertErrNil(err, true)
-			}
-			sparsifyOutputStep2, err := exec.Command("mv", sparseFilePathTemp, sparseFilePath).CombinedOutput()
-			if err != nil {
-				t.Error(string(sparsifyOutputStep2))
-				asserter.AssertErrNil(err, true)
-			}
+	err = stateMachine.customizeSystemd()
+	asserter.AssertErrNil(err, true)
 
-			err = stateMachine.generateRootfsTarball()
-			asserter.AssertErrNil(err, true)
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
 
-			// make sure tar archive exists and is the correct compression type
-			_, err = os.Stat(filepath.Join(stateMachine.stateMachineFlags.WorkDir, tc.tarPath))
-			if err != nil {
-				t.Errorf("File %s should be in workdir, but is missing", tc.tarPath)
-			}
+	expectedCmds := []*regexp.Regexp{
+		regexp.MustCompile("^systemctl --root=/var/tmp.*/chroot enable ssh getty@ttyS0.service$"),
+		regexp.MustCompile("^systemctl --root=/var/tmp.*/chroot disable unattended-upgrades.service$"),
+		regexp.MustCompile("^systemctl --root=/var/tmp.*/chroot mask apt-daily.timer$"),
+		regexp.MustCompile("^systemctl --root=/var/tmp.*/chroot set-default multi-user.target$"),
+	}
 
-			fullPath := filepath.Join(stateMachine.commonFlags.OutputDir, tc.tarPath)
-			fileCommand := exec.Command("file", fullPath)
-			cmdOutput, err := fileCommand.CombinedOutput()
-			asserter.AssertErrNil(err, true)
-			if !strings.Contains(string(cmdOutput), tc.fileType) {
-				t.Errorf("File \"%s\" is the wrong file type. Expected \"%s\" but got \"%s\"",
-					fullPath, tc.fileType, string(cmdOutput))
-			}
+	gotCmds := make([]string, 0)
+	for _, cmd := range strings.Split(strings.TrimSpace(string(readStdout)), "\n") {
+		if strings.HasPrefix(cmd, "systemctl ") {
+			gotCmds = append(gotCmds, cmd)
+		}
+	}
+	if len(expectedCmds) != len(gotCmds) {
+		t.Fatalf("%v commands to be executed, expected %v commands. Got: %v", len(gotCmds), len(expectedCmds), gotCmds)
+	}
 
-			fileInfo, err := os.Stat(fullPath)
-			asserter.AssertErrNil(err, true)
+	for i, gotCmd := range gotCmds {
+		expected := expectedCmds[i]
 
-			if fileInfo.Size() < tc.minArchiveSize {
-				asserter.Errorf("Archive too small.\ngot: %d\nwant a minimum of: %d", fileInfo.Size(), tc.minArchiveSize)
-			}
+		if !expected.Match([]byte(gotCmd)) {
+			t.Errorf("Cmd \"%v\" not matching. Expected %v\n", gotCmd, expected.String())
+		}
+	}
+
+	// units missing from the rootfs are reported before running any command
+	stateMachine.ImageDef.Customization.Systemd.Enable = []string{"ssh", "missing.service"}
+	stateMachine.ImageDef.Customization.Systemd.DefaultTarget = "graphical.target"
+	err = stateMachine.customizeSystemd()
+	asserter.AssertErrContains(err, "The following systemd units do not exist in the rootfs: missing.service, graphical.target")
 
-			if fileInfo.Size() > tc.maxArchiveSize {
-				asserter.Errorf("Archive too big.\ngot: %d\nwant a maximum of: %d", fileInfo.Size(), tc.maxArchiveSize)
-			}
-		})
+	// systemctl failures are reported
+	stateMachine.ImageDef.Customization.Systemd.Enable = []string{"ssh"}
+	stateMachine.ImageDef.Customization.Systemd.DefaultTarget = ""
+	execCommand = func(string, ...string) *exec.Cmd {
+		return exec.Command("false")
 	}
+	err = stateMachine.customizeSystemd()
+	asserter.AssertErrContains(err, "Error running command")
 }
 
-// TestFailedMakeQcow2Img tests failures in the makeQcow2Img function
-func TestFailedMakeQcow2Img(t *testing.T) {
+// TestStateMachine_customizeBootloader checks the GRUB settings are written
+// only for images that may boot with GRUB
+func TestStateMachine_customizeBootloader(t *testing.T) {
 	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
-
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
 	stateMachine.parent = &stateMachine
 	stateMachine.ImageDef = imagedefinition.ImageDefinition{
-		Architecture: arch.GetHostArch(),
-		Series:       getHostSuite(),
-		Artifacts: &imagedefinition.Artifact{
-			Qcow2: &[]imagedefinition.Qcow2{
-				{
-					Qcow2Name: "test.qcow2",
-				},
+		Customization: &imagedefinition.Customization{
+			Bootloader: &imagedefinition.Bootloader{
+				CmdlineAppend: []string{"console=ttyS0"},
 			},
 		},
 	}
+	stateMachine.GadgetInfo = &gadget.Info{
+		Volumes: map[string]*gadget.Volume{
+			"pc": {Bootloader: "grub"},
+		},
+	}
 
-	// Setup the exec.Command mock
-	testCaseName = "TestFailedMakeQcow2Image"
-	execCommand = fakeExecCommand
-	defer func() {
-		execCommand = exec.Command
-	}()
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-	err := stateMachine.makeQcow2Img()
-	asserter.AssertErrContains(err, "Error running command")
-	asserter.AssertErrContains(err, "qemu-img convert")
-}
+	grubCfgPath := filepath.Join(stateMachine.tempDirs.chroot, "etc", "default", "grub.d", "90-ubuntu-image.cfg")
 
-// TestPreseedResetChroot tests that calling prepareClassicImage on a
-// preseeded chroot correctly resets the chroot and preseeds over it
-func TestPreseedResetChroot(t *testing.T) {
-	t.Parallel()
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
+	err = stateMachine.customizeBootloader()
+	asserter.AssertErrNil(err, true)
+	grubCfg, err := os.ReadFile(grubCfgPath)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(generateGrubCustomization(stateMachine.ImageDef.Customization.Bootloader), string(grubCfg))
+
+	// nothing is written for piboot images
+	err = os.Remove(grubCfgPath)
+	asserter.AssertErrNil(err, true)
+	stateMachine.GadgetInfo.Volumes["pc"].Bootloader = "piboot"
+	err = stateMachine.customizeBootloader()
+	asserter.AssertErrNil(err, true)
+	_, err = os.Stat(grubCfgPath)
+	if !os.IsNotExist(err) {
+		t.Errorf("%s should not have been written for a piboot image", grubCfgPath)
 	}
-	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
 
+	// failures are reported
+	stateMachine.GadgetInfo = nil
+	osWriteFile = mockWriteFile
+	t.Cleanup(func() {
+		osWriteFile = os.WriteFile
+	})
+	err = stateMachine.customizeBootloader()
+	asserter.AssertErrContains(err, "Error writing GRUB configuration")
+	osWriteFile = os.WriteFile
+
+	osMkdirAll = mockMkdirAll
+	t.Cleanup(func() {
+		osMkdirAll = os.MkdirAll
+	})
+	err = stateMachine.customizeBootloader()
+	asserter.AssertErrContains(err, "Error creating")
+	osMkdirAll = os.MkdirAll
+}
+
+// TestStateMachine_customizeSystem checks the hostname, timezone, locale and keyboard
+// are set in the chroot
+func TestStateMachine_customizeSystem(t *testing.T) {
+	asserter := helper.Asserter{T: t}
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Debug = true
 	stateMachine.parent = &stateMachine
-	stateMachine.Snaps = []string{"lxd"}
-	stateMachine.commonFlags.Channel = "stable"
 	stateMachine.ImageDef = imagedefinition.ImageDefinition{
-		Architecture: arch.GetHostArch(),
-		Series:       getHostSuite(),
-		Rootfs: &imagedefinition.Rootfs{
-			Archive: "ubuntu",
-		},
 		Customization: &imagedefinition.Customization{
-			ExtraPackages: []*imagedefinition.Package{
-				{
-					PackageName: "squashfs-tools",
-				},
-				{
-					PackageName: "snapd",
-				},
-			},
-			ExtraSnaps: []*imagedefinition.Snap{
-				{
-					SnapName: "hello",
-				},
-				{
-					SnapName: "core",
-				},
-				{
-					SnapName: "core20",
-				},
-				{
-					SnapName: "core24",
+			System: &imagedefinition.System{
+				Hostname: "kiosk",
+				Timezone: "Europe/Paris",
+				Locale:   "fr_FR.UTF-8",
+				Locales:  []string{"en_US.UTF-8"},
+				Keyboard: &imagedefinition.Keyboard{
+					Layout:  "fr",
+					Model:   "pc105",
+					Variant: "oss",
 				},
 			},
 		},
 	}
 
-	err := helper.SetDefaults(&stateMachine.ImageDef)
+	err := stateMachine.makeTemporaryDirectories()
 	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-	err = stateMachine.makeTemporaryDirectories()
+	chroot := stateMachine.tempDirs.chroot
+	for path, content := range map[string]string{
+		supportedLocalesFile:              "en_US.UTF-8 UTF-8\nfr_FR.UTF-8 UTF-8\n",
+		zoneinfoPath("Europe/Paris"):      "TZif",
+		filepath.Join("etc", "hostname"):  "ubuntu\n",
+		filepath.Join("etc", "localtime"): "UTC",
+	} {
+		err = os.MkdirAll(filepath.Dir(filepath.Join(chroot, path)), 0755)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(filepath.Join(chroot, path), []byte(content), 0644)
+		asserter.AssertErrNil(err, true)
+	}
+
+	mockCmder := NewMockExecCommand()
+	execCommand = mockCmder.Command
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
 	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
 
-	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	err = stateMachine.customizeSystem()
+	asserter.AssertErrNil(err, true)
 
-	err = getBasicChroot(stateMachine.StateMachine)
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
 	asserter.AssertErrNil(err, true)
 
-	// install the packages that snap-preseed needs
-	err = stateMachine.installPackages()
+	localeGenCmd := regexp.MustCompile("(?m)^chroot /var/tmp.*/chroot locale-gen en_US.UTF-8 fr_FR.UTF-8$")
+	if !localeGenCmd.Match(readStdout) {
+		t.Errorf("Expected locale-gen to be run, got: %s", string(readStdout))
+	}
+
+	for path, expected := range map[string]string{
+		filepath.Join("etc", "hostname"):          "kiosk\n",
+		filepath.Join("etc", "timezone"):          "Europe/Paris\n",
+		filepath.Join("etc", "default", "locale"): "LANG=fr_FR.UTF-8\n",
+	} {
+		content, err := os.ReadFile(filepath.Join(chroot, path))
+		asserter.AssertErrNil(err, true)
+		asserter.AssertEqual(expected, string(content))
+	}
+
+	localtime, err := os.Readlink(filepath.Join(chroot, "etc", "localtime"))
 	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("/usr/share/zoneinfo/Europe/Paris", localtime)
 
-	// first call prepareClassicImage to eventually preseed it
-	err = stateMachine.prepareClassicImage()
+	keyboard, err := os.ReadFile(filepath.Join(chroot, "etc", "default", "keyboard"))
 	asserter.AssertErrNil(err, true)
+	if !strings.Contains(string(keyboard), "XKBLAYOUT=\"fr\"\nXKBVARIANT=\"oss\"\n") {
+		t.Errorf("Unexpected keyboard configuration:\n%s", string(keyboard))
+	}
 
-	// now preseed the chroot
-	err = stateMachine.preseedClassicImage()
+	// the default locale is not overwritten by set_default_locale
+	err = stateMachine.setDefaultLocale()
+	asserter.AssertErrNil(err, true)
+	locale, err := os.ReadFile(filepath.Join(chroot, "etc", "default", "locale"))
 	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("LANG=fr_FR.UTF-8\n", string(locale))
 
-	// set up a new set of snaps to be installed
+	// unknown locales and timezones are reported before changing anything
+	stateMachine.ImageDef.Customization.System.Locales = []string{"xx_XX.UTF-8"}
+	err = stateMachine.customizeSystem()
+	asserter.AssertErrContains(err, "The following locales are not supported in the rootfs: xx_XX.UTF-8")
+
+	stateMachine.ImageDef.Customization.System.Timezone = "Europe/Atlantis"
+	err = stateMachine.customizeSystem()
+	asserter.AssertErrContains(err, "The timezone \"Europe/Atlantis\" does not exist in the rootfs")
+	stateMachine.ImageDef.Customization.System.Timezone = "Europe/Paris"
+	stateMachine.ImageDef.Customization.System.Locales = nil
+
+	osWriteFile = mockWriteFile
+	t.Cleanup(func() {
+		osWriteFile = os.WriteFile
+	})
+	err = stateMachine.customizeSystem()
+	asserter.AssertErrContains(err, "Error writing hostname")
+	osWriteFile = os.WriteFile
+
+	osSymlink = mockSymlink
+	t.Cleanup(func() {
+		osSymlink = os.Symlink
+	})
+	err = stateMachine.customizeSystem()
+	asserter.AssertErrContains(err, "Error setting the timezone")
+	osSymlink = os.Symlink
+}
+
+// TestStateMachine_setDebconfSelections checks debconf selections are fed to
+// debconf-set-selections in the chroot
+func TestStateMachine_setDebconfSelections(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.tempDirs.chroot = "fakedir"
 	stateMachine.ImageDef = imagedefinition.ImageDefinition{
-		Architecture: arch.GetHostArch(),
 		Customization: &imagedefinition.Customization{
-			ExtraSnaps: []*imagedefinition.Snap{
+			Debconf: []*imagedefinition.Debconf{
 				{
-					SnapName: "ubuntu-image",
+					Package:  "keyboard-configuration",
+					Question: "keyboard-configuration/layoutcode",
+					Type:     "string",
+					Value:    "fr",
+				},
+				{
+					Package:  "ttf-mscorefonts-installer",
+					Question: "msttcorefonts/accepted-mscorefonts-eula",
+					Type:     "boolean",
+					Value:    "true",
 				},
 			},
 		},
 	}
 
-	// call prepareClassicImage again to trigger the reset
-	err = stateMachine.prepareClassicImage()
+	mockCmder := NewMockRunCommand()
+	runCmd = mockCmder.runCmd
+	t.Cleanup(func() { runCmd = helper.RunCmd })
+
+	err := stateMachine.setDebconfSelections()
 	asserter.AssertErrNil(err, true)
 
-	// make sure the snaps from both prepares are present
-	expectedSnaps := []string{"lxd", "hello", "ubuntu-image"}
-	for _, expectedSnap := range expectedSnaps {
-		snapGlobs, err := filepath.Glob(filepath.Join(stateMachine.tempDirs.chroot,
-			"var", "lib", "snapd", "seed", "snaps", fmt.Sprintf("%s*.snap", expectedSnap)))
-		asserter.AssertErrNil(err, true)
-		if len(snapGlobs) == 0 {
-			t.Errorf("expected snap %s to exist in the chroot but it does not", expectedSnap)
-		}
+	if len(mockCmder.cmds) != 1 {
+		t.Fatalf("%v commands to be executed, expected 1", len(mockCmder.cmds))
 	}
+	asserter.AssertEqual("/usr/sbin/chroot fakedir debconf-set-selections", mockCmder.cmds[0].String())
+	stdin, err := io.ReadAll(mockCmder.cmds[0].Stdin)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("keyboard-configuration keyboard-configuration/layoutcode string fr\n"+
+		"ttf-mscorefonts-installer msttcorefonts/accepted-mscorefonts-eula boolean true\n", string(stdin))
 }
 
-// TestStateMachine_setupBootloader_fail tests failures in the setupBootloader function
-func TestStateMachine_setupBootloader_fail(t *testing.T) {
+// TestStateMachine_makeInstallerLayers checks each installer layer is built in an
+// overlay of the previous ones and squashed on its own
+func TestStateMachine_makeInstallerLayers(t *testing.T) {
 	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
-
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Debug = true
 	stateMachine.parent = &stateMachine
 	stateMachine.ImageDef = imagedefinition.ImageDefinition{
-		Architecture: arch.GetHostArch(),
-		Series:       getHostSuite(),
-		Gadget:       &imagedefinition.Gadget{},
+		Class: "installer",
+		Rootfs: &imagedefinition.Rootfs{
+			Seed: &imagedefinition.Seed{
+				Names: []string{"minimal", "standard", "live"},
+			},
+		},
+		Customization: &imagedefinition.Customization{
+			Installer: &imagedefinition.Installer{
+				Layers: []string{"minimal", "minimal.standard", "minimal.standard.live"},
+			},
+		},
 	}
 
-	// set up work dir
 	err := stateMachine.makeTemporaryDirectories()
 	asserter.AssertErrNil(err, true)
-
+	stateMachine.commonFlags.OutputDir = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "output")
 	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-	// place a test gadget tree in the scratch directory so we don't
-	// have to build one
-	gadgetDir := filepath.Join(stateMachine.tempDirs.scratch, "gadget")
-	err = os.MkdirAll(gadgetDir, 0755)
-	asserter.AssertErrNil(err, true)
-
-	gadgetSource := filepath.Join("testdata", "gadget_tree")
-	gadgetDest := filepath.Join(gadgetDir, "install")
-	err = osutil.CopySpecialFile(gadgetSource, gadgetDest)
-	asserter.AssertErrNil(err, true)
-	// also copy gadget.yaml to the root of the scratch/gadget dir
-	err = osutil.CopyFile(
-		filepath.Join(gadgetDest, "meta", "gadget.yaml"),
-		filepath.Join(gadgetDest, "gadget.yaml"),
-		osutil.CopyFlagDefault,
-	)
-	asserter.AssertErrNil(err, true)
-
-	err = stateMachine.prepareGadgetTree()
-	asserter.AssertErrNil(err, true)
-	err = stateMachine.loadGadgetYaml()
+	germinateDir := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "germinate")
+	err = os.MkdirAll(germinateDir, 0755)
 	asserter.AssertErrNil(err, true)
+	for seed, content := range map[string]string{
+		"standard.seed": "Package | Source | Why\n---\nbash-completion | bash-completion | standard seed\nman-db | man-db | standard seed\n",
+		"live.seed":     "Package | Source | Why\n---\ncasper | casper | live seed\n",
+	} {
+		err = os.WriteFile(filepath.Join(germinateDir, seed), []byte(content), 0644)
+		asserter.AssertErrNil(err, true)
+	}
 
-	// Test that setupBootloader fails when missing volume
-	stateMachine.RootfsPartNum = -1
-	stateMachine.RootfsVolName = ""
-	err = stateMachine.setupBootloader()
-	asserter.AssertErrContains(err, "no volume to setup bootloader for")
-
-	// prepare state in such a way that the rootfs/bootfs partition was found in
-	// earlier steps
-	stateMachine.RootfsPartNum = 3
-	stateMachine.BootPartNum = 2
-	stateMachine.RootfsVolName = "pc"
-
-	// test invalid architecture
-	stateMachine.ImageDef.Architecture = ""
-	err = stateMachine.setupBootloader()
-	asserter.AssertErrContains(err, "unable to identify the arch")
-	stateMachine.ImageDef.Architecture = arch.GetHostArch()
+	mockCmder := NewMockExecCommand()
+	execCommand = mockCmder.Command
+	t.Cleanup(func() { execCommand = exec.Command })
+	helperBackupAndCopyResolvConf = mockBackupAndCopyResolvConfSuccess
+	t.Cleanup(func() { helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf })
+	helperRestoreResolvConf = mockRestoreResolvConfSuccess
+	t.Cleanup(func() { helperRestoreResolvConf = helper.RestoreResolvConf })
+
+	// files the packages of a layer create for this machine must not be shipped
+	layers := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "installer-layers")
+	generatedFiles := []string{
+		filepath.Join("etc", "ssh", "ssh_host_ed25519_key"),
+		filepath.Join("etc", "ssh", "ssh_host_ed25519_key.pub"),
+		filepath.Join("var", "cache", "debconf", "config.dat-old"),
+		filepath.Join("var", "lib", "dpkg", "status-old"),
+		filepath.Join("var", "lib", "apt", "lists", "archive.ubuntu.com_ubuntu_dists_noble_InRelease"),
+	}
+	for _, file := range append(generatedFiles, filepath.Join("etc", "ssh", "sshd_config")) {
+		path := filepath.Join(layers, "minimal.standard", "upper", file)
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(path, []byte("test"), 0600)
+		asserter.AssertErrNil(err, true)
+	}
 
-	osMkdir = mockMkdir
-	t.Cleanup(func() {
-		osMkdir = os.Mkdir
-	})
+	// nor the layers and preseeds of a previous build
+	previousFiles := []string{
+		filepath.Join("casper", "minimal.standard.desktop.squashfs"),
+		filepath.Join("preseed", "old.seed"),
+		"autoinstall.yaml",
+	}
+	for _, file := range previousFiles {
+		path := filepath.Join(stateMachine.commonFlags.OutputDir, file)
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(path, []byte("test"), 0644)
+		asserter.AssertErrNil(err, true)
+	}
 
-	err = stateMachine.setupBootloader()
-	asserter.AssertErrContains(err, "Error creating scratch/loopback")
-}
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
 
-// TestStateMachine_setupBootloader_warning tests that a warning is thrown if the
-// bootloader specified in gadget.yaml is not supported
-func TestStateMachine_setupBootloader_warning(t *testing.T) {
-	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
+	err = stateMachine.makeInstallerLayers()
+	asserter.AssertErrNil(err, true)
 
-	var stateMachine ClassicStateMachine
-	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.parent = &stateMachine
-	stateMachine.ImageDef = imagedefinition.ImageDefinition{
-		Architecture: arch.GetHostArch(),
-		Series:       getHostSuite(),
-		Gadget:       &imagedefinition.Gadget{},
+	for _, file := range generatedFiles {
+		_, err = os.Stat(filepath.Join(layers, "minimal.standard", "upper", file))
+		if !os.IsNotExist(err) {
+			t.Errorf("File %s should have been removed from the layer, but was not", file)
+		}
+	}
+	_, err = os.Stat(filepath.Join(layers, "minimal.standard", "upper", "etc", "ssh", "sshd_config"))
+	asserter.AssertErrNil(err, true)
+	for _, file := range previousFiles {
+		_, err = os.Stat(filepath.Join(stateMachine.commonFlags.OutputDir, file))
+		if !os.IsNotExist(err) {
+			t.Errorf("File %s of a previous build should have been removed, but was not", file)
+		}
 	}
 
-	err := stateMachine.makeTemporaryDirectories()
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
 	asserter.AssertErrNil(err, true)
 
-	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
-
-	// place a test gadget tree in the scratch directory so we don't
-	// have to build one
-	gadgetDir := filepath.Join(stateMachine.tempDirs.scratch, "gadget")
-	err = os.MkdirAll(gadgetDir, 0755)
-	asserter.AssertErrNil(err, true)
+	rootfs := stateMachine.tempDirs.rootfs
+	casper := filepath.Join(stateMachine.commonFlags.OutputDir, "casper")
+	expectedCmds := []string{
+		fmt.Sprintf("mksquashfs %s %s/minimal.squashfs -noappend -comp xz -xattrs", rootfs, casper),
+		fmt.Sprintf("mount -t overlay overlay -o lowerdir=%s,upperdir=%s/minimal.standard/upper,workdir=%s/minimal.standard/work %s/minimal.standard/merged", rootfs, layers, layers, layers),
+		fmt.Sprintf("chroot %s/minimal.standard/merged apt update", layers),
+		fmt.Sprintf("chroot %s/minimal.standard/merged apt --assume-yes --quiet --option=Dpkg::options::=--force-unsafe-io --option=Dpkg::Options::=--force-confold install bash-completion man-db", layers),
+		fmt.Sprintf("chroot %s/minimal.standard/merged apt clean", layers),
+		fmt.Sprintf("umount %s/minimal.standard/merged", layers),
+		fmt.Sprintf("mksquashfs %s/minimal.standard/upper %s/minimal.standard.squashfs -noappend -comp xz -xattrs", layers, casper),
+		fmt.Sprintf("mount -t overlay overlay -o lowerdir=%s/minimal.standard/upper:%s,upperdir=%s/minimal.standard.live/upper,workdir=%s/minimal.standard.live/work %s/minimal.standard.live/merged", layers, rootfs, layers, layers, layers),
+		fmt.Sprintf("chroot %s/minimal.standard.live/merged apt --assume-yes --quiet --option=Dpkg::options::=--force-unsafe-io --option=Dpkg::Options::=--force-confold install casper", layers),
+		fmt.Sprintf("mksquashfs %s/minimal.standard.live/upper %s/minimal.standard.live.squashfs -noappend -comp xz -xattrs", layers, casper),
+	}
+	for _, expected := range expectedCmds {
+		if !strings.Contains(string(readStdout), expected+"\n") {
+			t.Errorf("Expected command \"%s\" to be run, got:\n%s", expected, readStdout)
+		}
+	}
 
-	gadgetSource := filepath.Join("testdata", "gadget_tree")
-	gadgetDest := filepath.Join(gadgetDir, "install")
-	err = osutil.CopySpecialFile(gadgetSource, gadgetDest)
-	asserter.AssertErrNil(err, true)
-	// also copy gadget.yaml to the root of the scratch/gadget dir
-	err = osutil.CopyFile(
-		filepath.Join(gadgetDest, "meta", "gadget.yaml"),
-		filepath.Join(gadgetDest, "gadget.yaml"),
-		osutil.CopyFlagDefault,
-	)
+	// without layers, the rootfs is squashed in the default casper image
+	stateMachine.ImageDef.Customization.Installer = nil
+	stdout, restoreStdout, err = helper.CaptureStd(&os.Stdout)
 	asserter.AssertErrNil(err, true)
-	// parse gadget.yaml
-	err = stateMachine.prepareGadgetTree()
+	err = stateMachine.makeInstallerLayers()
 	asserter.AssertErrNil(err, true)
-	err = stateMachine.loadGadgetYaml()
+	restoreStdout()
+	readStdout, err = io.ReadAll(stdout)
 	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(fmt.Sprintf("mksquashfs %s %s/filesystem.squashfs -noappend -comp xz -xattrs\n", rootfs, casper), string(readStdout))
+}
 
-	testCases := []struct {
-		name           string
-		rootfsPartNum  int
-		bootPartNum    int
-		rootfsVolName  string
-		bootloaderName string
-		wantWarning    string
-	}{
-		{
-			name:           "unknown bootloader",
-			rootfsPartNum:  3,
-			bootPartNum:    1,
-			rootfsVolName:  "pc",
-			bootloaderName: "test",
-			wantWarning:    "WARNING: setting up bootloader test not yet supported",
-		},
-		{
-			name:           "no rootfs part num",
-			rootfsPartNum:  -1,
-			bootPartNum:    1,
-			rootfsVolName:  "pc",
-			bootloaderName: "grub",
-			wantWarning:    "WARNING: Skipping GRUB installation because no data partition was found.",
-		},
-		{
-			name:           "no bootfs part num",
-			rootfsPartNum:  3,
-			bootPartNum:    -1,
-			rootfsVolName:  "pc",
-			bootloaderName: "grub",
-			wantWarning:    "WARNING: Skipping GRUB installation because no boot partition was found.",
+// TestStateMachine_copyInstallerPreseeds checks preseeds and autoinstall files are
+// copied where the installers look for them
+func TestStateMachine_copyInstallerPreseeds(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ConfDefPath = t.TempDir()
+	stateMachine.commonFlags.OutputDir = t.TempDir()
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Class: "installer",
+		Customization: &imagedefinition.Customization{
+			Installer: &imagedefinition.Installer{
+				Preseeds: []string{"preseeds/ubuntu.seed", "autoinstall.yaml"},
+			},
 		},
 	}
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			stateMachine.RootfsPartNum = tc.rootfsPartNum
-			stateMachine.RootfsVolName = tc.rootfsVolName
-			stateMachine.BootPartNum = tc.bootPartNum
 
-			// set the bootloader for the volume to "test"
-			stateMachine.GadgetInfo.Volumes["pc"].Bootloader = tc.bootloaderName
-			stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
-			defer restoreStdout()
-			asserter.AssertErrNil(err, true)
+	err := os.MkdirAll(filepath.Join(stateMachine.ConfDefPath, "preseeds"), 0755)
+	asserter.AssertErrNil(err, true)
+	for file, content := range map[string]string{
+		"preseeds/ubuntu.seed": "d-i debian-installer/locale string en_US\n",
+		"autoinstall.yaml":     "autoinstall:\n  version: 1\n",
+	} {
+		err = os.WriteFile(filepath.Join(stateMachine.ConfDefPath, file), []byte(content), 0644)
+		asserter.AssertErrNil(err, true)
+	}
 
-			err = stateMachine.setupBootloader()
-			asserter.AssertErrNil(err, true)
+	err = stateMachine.copyInstallerPreseeds()
+	asserter.AssertErrNil(err, true)
 
-			// restore stdout and examine what was printed
-			restoreStdout()
-			readStdout, err := io.ReadAll(stdout)
-			asserter.AssertErrNil(err, true)
-			if !strings.Contains(string(readStdout), tc.wantWarning) {
-				t.Errorf("Warning: %s not printed", tc.wantWarning)
-			}
-		})
+	for file, expected := range map[string]string{
+		"preseed/ubuntu.seed": "d-i debian-installer/locale string en_US\n",
+		"autoinstall.yaml":    "autoinstall:\n  version: 1\n",
+	} {
+		content, err := os.ReadFile(filepath.Join(stateMachine.commonFlags.OutputDir, file))
+		asserter.AssertErrNil(err, true)
+		asserter.AssertEqual(expected, string(content))
 	}
-}
 
-// TestPreseedClassicImage unit tests the prepareClassicImage function
-func TestPreseedClassicImage(t *testing.T) {
-	t.Parallel()
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
-	}
+	stateMachine.ImageDef.Customization.Installer.Preseeds = []string{"missing.seed"}
+	err = stateMachine.copyInstallerPreseeds()
+	asserter.AssertErrContains(err, "Error copying preseed missing.seed")
+}
 
+// TestStateMachine_makeISO checks the casper content, boot images and xorriso
+// invocation used to create an ISO
+func TestStateMachine_makeISO(t *testing.T) {
 	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
-
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Debug = true
 	stateMachine.parent = &stateMachine
-	stateMachine.Snaps = []string{"lxd"}
-	stateMachine.commonFlags.Channel = "stable"
 	stateMachine.ImageDef = imagedefinition.ImageDefinition{
-		Architecture: arch.GetHostArch(),
-		Series:       getHostSuite(),
-		Rootfs: &imagedefinition.Rootfs{
-			Archive: "ubuntu",
+		DisplayName: "Ubuntu Server 24.04 LTS amd64 Live Image",
+		Artifacts: &imagedefinition.Artifact{
+			Iso: &imagedefinition.Iso{
+				IsoName: "ubuntu.iso",
+			},
 		},
 		Customization: &imagedefinition.Customization{
-			ExtraPackages: []*imagedefinition.Package{
-				{
-					PackageName: "squashfs-tools",
-				},
-				{
-					PackageName: "snapd",
-				},
+			Bootloader: &imagedefinition.Bootloader{
+				CmdlineAppend: []string{"console=ttyS0"},
 			},
-			ExtraSnaps: []*imagedefinition.Snap{
-				{
-					SnapName: "hello",
-				},
-				{
-					SnapName: "core",
-				},
-				{
-					SnapName: "core20",
+		},
+	}
+	stateMachine.GadgetInfo = &gadget.Info{
+		Volumes: map[string]*gadget.Volume{
+			"pc": {
+				Structure: []gadget.VolumeStructure{
+					{Name: "mbr", Role: "mbr"},
+					{Name: "BIOS Boot", Role: gadget.SystemBoot},
+					{Name: "EFI System", Role: gadget.SystemBoot, Filesystem: "vfat"},
+					{Name: "rootfs", Role: gadget.SystemData, Filesystem: "ext4"},
 				},
 			},
 		},
 	}
 
-	err := helper.SetDefaults(&stateMachine.ImageDef)
+	err := stateMachine.makeTemporaryDirectories()
 	asserter.AssertErrNil(err, true)
+	stateMachine.commonFlags.OutputDir = filepath.Join(stateMachine.stateMachineFlags.WorkDir, "output")
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-	err = stateMachine.makeTemporaryDirectories()
+	rootfs := stateMachine.tempDirs.rootfs
+	err = os.MkdirAll(filepath.Join(rootfs, "boot"), 0755)
+	asserter.AssertErrNil(err, true)
+	for _, file := range []string{"vmlinuz-6.8.0-31-generic", "initrd.img-6.8.0-31-generic"} {
+		err = os.WriteFile(filepath.Join(rootfs, "boot", file), []byte(file), 0644)
+		asserter.AssertErrNil(err, true)
+	}
+	err = os.Symlink("vmlinuz-6.8.0-31-generic", filepath.Join(rootfs, "boot", "vmlinuz"))
+	asserter.AssertErrNil(err, true)
+	err = os.Symlink("/boot/initrd.img-6.8.0-31-generic", filepath.Join(rootfs, "boot", "initrd.img"))
 	asserter.AssertErrNil(err, true)
 
-	err = getBasicChroot(stateMachine.StateMachine)
+	// casper is not installed in the rootfs, so the initrd booting the live
+	// system is built in an overlay. Mock what installing casper creates
+	liveLayer := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "iso-live")
+	for _, dir := range []string{isoCasperScriptsDir, "boot"} {
+		err = os.MkdirAll(filepath.Join(liveLayer, "upper", dir), 0755)
+		asserter.AssertErrNil(err, true)
+	}
+	err = os.WriteFile(filepath.Join(liveLayer, "upper", "boot", "initrd.img-6.8.0-31-generic"), []byte("live"), 0644)
 	asserter.AssertErrNil(err, true)
 
-	// install the packages that snap-preseed needs
-	err = stateMachine.installPackages()
+	// the ESP built from the gadget is copied to get the EFI image of the ISO
+	gadgetESPImg := filepath.Join(stateMachine.tempDirs.volumes, "pc", "part2.img")
+	err = os.MkdirAll(filepath.Dir(gadgetESPImg), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(gadgetESPImg, []byte("esp"), 0644)
 	asserter.AssertErrNil(err, true)
 
-	// first call prepareClassicImage
-	err = stateMachine.prepareClassicImage()
+	mockCmder := NewMockExecCommand()
+	execCommand = mockCmder.Command
+	t.Cleanup(func() { execCommand = exec.Command })
+	helperBackupAndCopyResolvConf = mockBackupAndCopyResolvConfSuccess
+	t.Cleanup(func() { helperBackupAndCopyResolvConf = helper.BackupAndCopyResolvConf })
+	helperRestoreResolvConf = mockRestoreResolvConfSuccess
+	t.Cleanup(func() { helperRestoreResolvConf = helper.RestoreResolvConf })
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
 	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
 
-	// now preseed the chroot
-	err = stateMachine.preseedClassicImage()
+	err = stateMachine.makeISO()
 	asserter.AssertErrNil(err, true)
 
-	// make sure the snaps are fully preseeded
-	expectedSnaps := []string{"lxc", "lxd", "hello"}
-	for _, expectedSnap := range expectedSnaps {
-		snapPath := filepath.Join(stateMachine.tempDirs.chroot, "snap", "bin", expectedSnap)
-		_, err := os.Stat(snapPath)
-		if err != nil {
-			t.Errorf("File %s should be in chroot, but is missing", snapPath)
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+
+	isoDir := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "iso")
+	efiDir := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "iso-efi")
+	espImg := filepath.Join(efiDir, "efi.img")
+	grafts := fmt.Sprintf("/casper/initrd=%s/upper/boot/initrd.img-6.8.0-31-generic /casper/vmlinuz=%s/boot/vmlinuz-6.8.0-31-generic", liveLayer, rootfs)
+	expectedCmds := []string{
+		fmt.Sprintf("mount -t overlay overlay -o lowerdir=%s,upperdir=%s/upper,workdir=%s/work %s/merged", rootfs, liveLayer, liveLayer, liveLayer),
+		fmt.Sprintf("chroot %s/merged apt --assume-yes --quiet --option=Dpkg::options::=--force-unsafe-io --option=Dpkg::Options::=--force-confold install casper", liveLayer),
+		fmt.Sprintf("mksquashfs %s %s/casper/filesystem.squashfs -noappend -comp xz -xattrs", rootfs, isoDir),
+		fmt.Sprintf("mmd -D s -i %s ::EFI ::EFI/BOOT ::EFI/ubuntu", espImg),
+		fmt.Sprintf("mcopy -o -i %s %s/grub.cfg ::EFI/BOOT/grub.cfg", espImg, efiDir),
+		fmt.Sprintf("mcopy -o -i %s %s/grub.cfg ::EFI/ubuntu/grub.cfg", espImg, efiDir),
+		fmt.Sprintf("xorriso -as mkisofs -r -J -joliet-long -iso-level 3 -V Ubuntu Server 24.04 LTS amd64 Li -o %s/ubuntu.iso -append_partition 2 0xef %s -appended_part_as_gpt -e --interval:appended_partition_2:all:: -no-emul-boot -graft-points %s %s", stateMachine.commonFlags.OutputDir, espImg, isoDir, grafts),
+	}
+	for _, expected := range expectedCmds {
+		if !strings.Contains(string(readStdout), expected+"\n") {
+			t.Errorf("Expected command \"%s\" to be run, got:\n%s", expected, readStdout)
 		}
 	}
-}
+	if !strings.Contains(string(readStdout), "the ISO will only boot with UEFI") {
+		t.Errorf("Expected a warning about the missing BIOS support, got:\n%s", readStdout)
+	}
 
-// TestFailedPreseedClassicImage tests failures in the preseedClassicImage function
-func TestFailedPreseedClassicImage(t *testing.T) {
-	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	defer restoreCWD()
+	diskInfo, err := os.ReadFile(filepath.Join(isoDir, ".disk", "info"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("Ubuntu Server 24.04 LTS amd64 Live Image\n", string(diskInfo))
+	grubCfg, err := os.ReadFile(filepath.Join(isoDir, "boot", "grub", "grub.cfg"))
+	asserter.AssertErrNil(err, true)
+	if !strings.Contains(string(grubCfg), "linux\t/casper/vmlinuz console=ttyS0 ---\n") {
+		t.Errorf("Unexpected ISO grub configuration:\n%s", grubCfg)
+	}
 
-	var stateMachine ClassicStateMachine
-	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.parent = &stateMachine
+	// the GRUB of the EFI image finds the ISO and loads its configuration
+	esp, err := os.ReadFile(espImg)
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("esp", string(esp))
+	efiGrubCfg, err := os.ReadFile(filepath.Join(efiDir, "grub.cfg"))
+	asserter.AssertErrNil(err, true)
+	for _, line := range []string{"search --set=root --file /.disk/info\n", "configfile $prefix/grub.cfg\n"} {
+		if !strings.Contains(string(efiGrubCfg), line) {
+			t.Errorf("Expected \"%s\" in the ISO EFI grub configuration, got:\n%s", line, efiGrubCfg)
+		}
+	}
 
-	err := stateMachine.makeTemporaryDirectories()
+	// installer images reuse the casper layers and preseeds, and BIOS
+	// boot is enabled when the GRUB modules are in the rootfs
+	stateMachine.ImageDef.Class = "installer"
+	stateMachine.ImageDef.Artifacts.Iso.VolumeID = "UBUNTU"
+
+	// their layers must provide casper
+	err = stateMachine.makeISO()
+	asserter.AssertErrContains(err, "the casper boot scripts usr/share/initramfs-tools/scripts/casper were not found")
+	err = os.MkdirAll(filepath.Join(rootfs, isoCasperScriptsDir), 0755)
+	asserter.AssertErrNil(err, true)
+	grafts = fmt.Sprintf("/casper/initrd=%s/boot/initrd.img-6.8.0-31-generic /casper/vmlinuz=%s/boot/vmlinuz-6.8.0-31-generic", rootfs, rootfs)
+	casperDir := filepath.Join(stateMachine.commonFlags.OutputDir, "casper")
+	err = os.MkdirAll(casperDir, 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(casperDir, "minimal.squashfs"), []byte(""), 0644)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(stateMachine.commonFlags.OutputDir, "autoinstall.yaml"), []byte(""), 0644)
+	asserter.AssertErrNil(err, true)
+	grubBIOSDir := filepath.Join(rootfs, "usr", "lib", "grub", "i386-pc")
+	err = os.MkdirAll(grubBIOSDir, 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(grubBIOSDir, "boot_hybrid.img"), []byte(""), 0644)
 	asserter.AssertErrNil(err, true)
 
-	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	stdout, restoreStdout, err = helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.makeISO()
+	asserter.AssertErrNil(err, true)
+	restoreStdout()
+	readStdout, err = io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
 
-	// mock os.MkdirAll
-	osMkdirAll = mockMkdirAll
-	t.Cleanup(func() {
-		osMkdirAll = os.MkdirAll
-	})
-	err = stateMachine.preseedClassicImage()
-	asserter.AssertErrContains(err, "Error creating mountpoint")
-	osMkdirAll = os.MkdirAll
+	expectedCmds = []string{
+		fmt.Sprintf("grub-mkimage -d %s -O i386-pc-eltorito -p /boot/grub -o %s/boot/grub/i386-pc/eltorito.img biosdisk iso9660 part_gpt part_msdos", grubBIOSDir, isoDir),
+		fmt.Sprintf("xorriso -as mkisofs -r -J -joliet-long -iso-level 3 -V UBUNTU -o %s/ubuntu.iso --grub2-mbr %s/boot_hybrid.img -partition_offset 16 --mbr-force-bootable -append_partition 2 0xef %s -appended_part_as_gpt -b boot/grub/i386-pc/eltorito.img -no-emul-boot -boot-load-size 4 -boot-info-table --grub2-boot-info -eltorito-alt-boot -e --interval:appended_partition_2:all:: -no-emul-boot -graft-points %s %s /casper/minimal.squashfs=%s/minimal.squashfs /autoinstall.yaml=%s/autoinstall.yaml", stateMachine.commonFlags.OutputDir, grubBIOSDir, espImg, isoDir, grafts, casperDir, stateMachine.commonFlags.OutputDir),
+	}
+	for _, expected := range expectedCmds {
+		if !strings.Contains(string(readStdout), expected+"\n") {
+			t.Errorf("Expected command \"%s\" to be run, got:\n%s", expected, readStdout)
+		}
+	}
+	if strings.Contains(string(readStdout), "mksquashfs") {
+		t.Errorf("Expected the installer layers to be reused, got:\n%s", readStdout)
+	}
+	_, err = os.Stat(filepath.Join(isoDir, "boot", "grub", "i386-pc", "boot_hybrid.img"))
+	asserter.AssertErrNil(err, true)
 
-	testCaseName = "TestFailedPreseedClassicImage"
-	execCommand = fakeExecCommand
-	t.Cleanup(func() {
-		execCommand = exec.Command
-	})
-	err = stateMachine.preseedClassicImage()
-	asserter.AssertErrContains(err, "Error running command")
-	execCommand = exec.Command
+	// an ESP is required to boot the ISO
+	stateMachine.GadgetInfo.Volumes["pc"].Structure = stateMachine.GadgetInfo.Volumes["pc"].Structure[:2]
+	err = stateMachine.makeISO()
+	asserter.AssertErrContains(err, "No EFI system partition found in volume pc")
 }
 
-// TestStateMachine_defaultLocale tests that the default locale is set
-func TestStateMachine_defaultLocale(t *testing.T) {
-	testCases := []struct {
-		name           string
-		localeContents string
-		localeExpected string
-	}{
-		{
-			"no_locale",
-			"",
-			"# Default Ubuntu locale\nLANG=C.UTF-8\n",
-		},
-		{
-			"locale_set",
-			"LANG=en_US.UTF-8\n",
-			"LANG=en_US.UTF-8\n",
-		},
-		{
-			"locale_set_non_lang",
-			"LC_ALL=en_US.UTF-8\n",
-			"LC_ALL=en_US.UTF-8\n",
-		},
-		{
-			"locale_set_with_comment",
-			"# some comment\nLANG=en_US.UTF-8\n",
-			"# some comment\nLANG=en_US.UTF-8\n",
-		},
-		{
-			"no_locale_with_comment",
-			"# some comment\n",
-			"# Default Ubuntu locale\nLANG=C.UTF-8\n",
-		},
-		{
-			"no_locale_with_comment_locale",
-			"# LANG=en_US.UTF-8",
-			"# Default Ubuntu locale\nLANG=C.UTF-8\n",
+// TestStateMachine_generateRootfsSquashfs checks the squashfs of the rootfs is
+// created with the requested options, along with its manifest and size files
+func TestStateMachine_generateRootfsSquashfs(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Debug = true
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Artifacts: &imagedefinition.Artifact{
+			Squashfs: &imagedefinition.Squashfs{
+				SquashfsName: "livecd.ubuntu-server.squashfs",
+				Compression:  "zstd",
+				BlockSize:    "1M",
+				Exclude:      []string{"/var/cache/apt/archives/*.deb", "var/lib/apt/lists/*"},
+			},
 		},
 	}
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			asserter := helper.Asserter{T: t}
-			var stateMachine ClassicStateMachine
-			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-			stateMachine.parent = &stateMachine
 
-			err := stateMachine.makeTemporaryDirectories()
-			asserter.AssertErrNil(err, true)
+	err := stateMachine.makeTemporaryDirectories()
+	asserter.AssertErrNil(err, true)
+	stateMachine.commonFlags.OutputDir = t.TempDir()
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-			t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	rootfs := stateMachine.tempDirs.rootfs
+	err = os.MkdirAll(filepath.Join(rootfs, "etc"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(rootfs, "etc", "hostname"), []byte("ubuntu\n"), 0644)
+	asserter.AssertErrNil(err, true)
 
-			// create the <chroot>/etc/default directory
-			defaultPath := filepath.Join(stateMachine.tempDirs.chroot, "etc", "default")
-			err = os.MkdirAll(defaultPath, 0744)
-			asserter.AssertErrNil(err, true)
+	mockCmder := NewMockExecCommand()
+	execCommand = mockCmder.Command
+	t.Cleanup(func() { execCommand = exec.Command })
 
-			// create the <chroot>/etc/default/locale file
-			localePath := filepath.Join(defaultPath, "locale")
-			err = os.WriteFile(localePath, []byte(tc.localeContents), 0600)
-			asserter.AssertErrNil(err, true)
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
 
-			// call the function under test
-			err = stateMachine.setDefaultLocale()
-			asserter.AssertErrNil(err, true)
+	err = stateMachine.generateRootfsSquashfs()
+	asserter.AssertErrNil(err, true)
 
-			// read the locale file and make sure it matches the expected contents
-			localeBytes, err := os.ReadFile(localePath)
-			asserter.AssertErrNil(err, true)
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
 
-			if string(localeBytes) != tc.localeExpected {
-				t.Errorf("Expected locale contents \"%s\", but got \"%s\"",
-					tc.localeExpected, string(localeBytes))
-			}
-		})
+	outputDir := stateMachine.commonFlags.OutputDir
+	expected := fmt.Sprintf("mksquashfs %s %s/livecd.ubuntu-server.squashfs -noappend -comp zstd -xattrs -b 1M -wildcards -e var/cache/apt/archives/*.deb var/lib/apt/lists/*\n", rootfs, outputDir)
+	if !strings.Contains(string(readStdout), expected) {
+		t.Errorf("Expected command \"%s\" to be run, got:\n%s", expected, readStdout)
 	}
+
+	_, err = os.Stat(filepath.Join(outputDir, "livecd.ubuntu-server.manifest"))
+	asserter.AssertErrNil(err, true)
+	rootfsSize, err := helper.Du(rootfs)
+	asserter.AssertErrNil(err, true)
+	size, err := os.ReadFile(filepath.Join(outputDir, "livecd.ubuntu-server.size"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(fmt.Sprintf("%d\n", rootfsSize), string(size))
 }
 
-// TestStateMachine_defaultLocaleFailures tests failures in the setDefaultLocale function
-func TestStateMachine_defaultLocaleFailures(t *testing.T) {
+// TestStateMachine_makeConvertedImages checks the qemu-img invocations
+// converting raw images to the vmdk, vhd and vhdx formats
+func TestStateMachine_makeConvertedImages(t *testing.T) {
 	asserter := helper.Asserter{T: t}
-
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Debug = true
 	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Artifacts: &imagedefinition.Artifact{
+			Vmdk: &[]imagedefinition.Vmdk{{VmdkName: "ubuntu.vmdk", VmdkVolume: "pc"}},
+			Vhd: &[]imagedefinition.Vhd{
+				{VhdName: "ubuntu.vhd", VhdVolume: "pc"},
+				{VhdName: "other.vhd", VhdVolume: "other"},
+			},
+			Vhdx: &[]imagedefinition.Vhdx{{VhdxName: "ubuntu.vhdx", VhdxVolume: "pc"}},
+		},
+	}
+	stateMachine.GadgetInfo = &gadget.Info{
+		Volumes: map[string]*gadget.Volume{
+			"pc":    {Schema: "gpt"},
+			"other": {Schema: "mbr"},
+		},
+	}
+	stateMachine.VolumeNames = map[string]string{
+		"pc":    "pc.img",
+		"other": "other.img",
+	}
 
 	err := stateMachine.makeTemporaryDirectories()
 	asserter.AssertErrNil(err, true)
-
+	outputDir := t.TempDir()
+	stateMachine.commonFlags.OutputDir = outputDir
 	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-	// check failure in MkDirAll
-	osMkdirAll = mockMkdirAll
-	t.Cleanup(func() {
-		osMkdirAll = os.MkdirAll
-	})
-	err = stateMachine.setDefaultLocale()
-	asserter.AssertErrContains(err, "Error creating default directory")
-	osMkdirAll = os.MkdirAll
+	// only the first image is aligned to 1 MiB
+	err = os.WriteFile(filepath.Join(outputDir, "pc.img"), make([]byte, 2*quantity.SizeMiB), 0644)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(outputDir, "other.img"), make([]byte, quantity.SizeMiB+512), 0644)
+	asserter.AssertErrNil(err, true)
 
-	// check failure in WriteFile
-	osWriteFile = mockWriteFile
-	t.Cleanup(func() {
-		osWriteFile = os.WriteFile
-	})
-	err = stateMachine.setDefaultLocale()
-	asserter.AssertErrContains(err, "Error writing to locale file")
-	osWriteFile = os.WriteFile
-}
+	mockCmder := NewMockExecCommand()
+	execCommand = mockCmder.Command
+	t.Cleanup(func() { execCommand = exec.Command })
 
-func TestClassicStateMachine_cleanRootfs_real_rootfs(t *testing.T) {
-	t.Parallel()
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
+
+	err = stateMachine.makeVmdkImg()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.makeVhdImg()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.makeVhdxImg()
+	asserter.AssertErrNil(err, true)
+
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+
+	alignedImg := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "other.img.aligned")
+	expectedCmds := []string{
+		fmt.Sprintf("qemu-img convert -f raw -O vmdk -o subformat=streamOptimized %s/pc.img %s/ubuntu.vmdk", outputDir, outputDir),
+		fmt.Sprintf("qemu-img convert -f raw -O vpc -o subformat=fixed,force_size %s/pc.img %s/ubuntu.vhd", outputDir, outputDir),
+		fmt.Sprintf("cp --sparse=always %s/other.img %s", outputDir, alignedImg),
+		fmt.Sprintf("qemu-img resize -f raw %s %d", alignedImg, 2*quantity.SizeMiB),
+		fmt.Sprintf("qemu-img convert -f raw -O vpc -o subformat=fixed,force_size %s %s/other.vhd", alignedImg, outputDir),
+		fmt.Sprintf("qemu-img convert -f raw -O vhdx -o subformat=dynamic %s/pc.img %s/ubuntu.vhdx", outputDir, outputDir),
 	}
-	asserter := helper.Asserter{T: t}
-	restoreCWD := testhelper.SaveCWD()
-	t.Cleanup(restoreCWD)
+	for _, expected := range expectedCmds {
+		if !strings.Contains(string(readStdout), expected+"\n") {
+			t.Errorf("Expected command \"%s\" to be run, got:\n%s", expected, readStdout)
+		}
+	}
+	// the backup GPT header only needs to be moved on GPT disks
+	if strings.Contains(string(readStdout), "sgdisk") {
+		t.Errorf("Unexpected sgdisk command on an MBR disk:\n%s", readStdout)
+	}
+
+	err = os.Remove(filepath.Join(outputDir, "pc.img"))
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.makeVhdImg()
+	asserter.AssertErrContains(err, "Error getting size of")
+}
 
+// TestStateMachine_makeOva checks OVA packages are made of an OVF descriptor,
+// a manifest and a stream-optimized disk
+func TestStateMachine_makeOva(t *testing.T) {
+	asserter := helper.Asserter{T: t}
 	var stateMachine ClassicStateMachine
 	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-	stateMachine.parent = &stateMachine
-	stateMachine.Snaps = []string{"lxd"}
-	stateMachine.commonFlags.Channel = "stable"
 	stateMachine.commonFlags.Debug = true
+	stateMachine.parent = &stateMachine
 	stateMachine.ImageDef = imagedefinition.ImageDefinition{
-		Architecture: arch.GetHostArch(),
-		Series:       getHostSuite(),
-		Rootfs: &imagedefinition.Rootfs{
-			Archive: "ubuntu",
-		},
-		Customization: &imagedefinition.Customization{
-			ExtraPackages: []*imagedefinition.Package{
-				{
-					PackageName: "squashfs-tools",
-				},
-				{
-					PackageName: "snapd",
-				},
-			},
+		ImageName:    "ubuntu-server-amd64",
+		DisplayName:  "Ubuntu Server & more",
+		Architecture: "amd64",
+		Artifacts: &imagedefinition.Artifact{
+			Ova: &[]imagedefinition.Ova{{OvaName: "ubuntu.ova", OvaVolume: "pc", Memory: 4096}},
 		},
 	}
+	stateMachine.VolumeNames = map[string]string{"pc": "ubuntu.ova.img"}
 
-	err := helper.SetDefaults(&stateMachine.ImageDef)
+	err := stateMachine.makeTemporaryDirectories()
 	asserter.AssertErrNil(err, true)
+	outputDir := t.TempDir()
+	stateMachine.commonFlags.OutputDir = outputDir
+	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
 
-	err = stateMachine.makeTemporaryDirectories()
+	err = os.WriteFile(filepath.Join(outputDir, "ubuntu.ova.img"), make([]byte, 4096), 0644)
+	asserter.AssertErrNil(err, true)
+	// qemu-img is mocked, so provide the disk it would create
+	ovaDir := filepath.Join(stateMachine.stateMachineFlags.WorkDir, "ova", "ubuntu")
+	err = os.MkdirAll(ovaDir, 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(ovaDir, "ubuntu-disk1.vmdk"), []byte("vmdk"), 0644)
 	asserter.AssertErrNil(err, true)
 
-	t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
+	mockCmder := NewMockExecCommand()
+	execCommand = mockCmder.Command
+	t.Cleanup(func() { execCommand = exec.Command })
 
-	err = getBasicChroot(stateMachine.StateMachine)
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
 	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
 
-	// install the packages that snap-preseed needs
-	err = stateMachine.installPackages()
+	err = stateMachine.makeOva()
 	asserter.AssertErrNil(err, true)
 
-	err = stateMachine.cleanRootfs()
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
 	asserter.AssertErrNil(err, true)
 
-	// Check cleaned files were removed
-	cleaned := []string{
-		filepath.Join(stateMachine.tempDirs.chroot, "var", "lib", "dbus", "machine-id"),
-		filepath.Join(stateMachine.tempDirs.chroot, "etc", "ssh", "ssh_host_rsa_key"),
-		filepath.Join(stateMachine.tempDirs.chroot, "etc", "ssh", "ssh_host_rsa_key.pub"),
-		filepath.Join(stateMachine.tempDirs.chroot, "etc", "ssh", "ssh_host_ecdsa_key"),
-		filepath.Join(stateMachine.tempDirs.chroot, "etc", "ssh", "ssh_host_ecdsa_key.pub"),
-		filepath.Join(stateMachine.tempDirs.chroot, "dev", "stderr"),
-		filepath.Join(stateMachine.tempDirs.chroot, "dev", "stdin"),
-		filepath.Join(stateMachine.tempDirs.chroot, "dev", "stdout"),
-		filepath.Join(stateMachine.tempDirs.chroot, "dev", "fd"),
-		filepath.Join(stateMachine.tempDirs.chroot, "sys", "kernel", "security"),
-		filepath.Join(stateMachine.tempDirs.chroot, "sys", "fs", "cgroup"),
-		filepath.Join(stateMachine.tempDirs.chroot, "run", "mount", "utab.lock"),
-		filepath.Join(stateMachine.tempDirs.chroot, "run", "lock"),
+	expectedCmds := []string{
+		fmt.Sprintf("qemu-img convert -f raw -O vmdk -o subformat=streamOptimized %s/ubuntu.ova.img %s/ubuntu-disk1.vmdk", outputDir, ovaDir),
+		fmt.Sprintf("tar --format=ustar -cf %s/ubuntu.ova -C %s ubuntu.ovf ubuntu.mf ubuntu-disk1.vmdk", outputDir, ovaDir),
 	}
-	for _, file := range cleaned {
-		_, err := os.Stat(file)
-		if !os.IsNotExist(err) {
-			t.Errorf("File %s should not exist, but does", file)
+	for _, expected := range expectedCmds {
+		if !strings.Contains(string(readStdout), expected+"\n") {
+			t.Errorf("Expected command \"%s\" to be run, got:\n%s", expected, readStdout)
 		}
 	}
 
-	truncated := []string{
-		filepath.Join(stateMachine.tempDirs.chroot, "etc", "machine-id"),
-	}
-	for _, file := range truncated {
-		fileInfo, err := os.Stat(file)
-		if os.IsNotExist(err) {
-			t.Errorf("File %s should exist, but does not", file)
-		}
-
-		if fileInfo.Size() != 0 {
-			t.Errorf("File %s should be empty, but it is not. Size: %v", file, fileInfo.Size())
+	ovf, err := os.ReadFile(filepath.Join(ovaDir, "ubuntu.ovf"))
+	asserter.AssertErrNil(err, true)
+	for _, expected := range []string{
+		`<File ovf:href="ubuntu-disk1.vmdk" ovf:id="file1"/>`,
+		`<Disk ovf:capacity="4096" ovf:capacityAllocationUnits="byte"`,
+		`<Description>Ubuntu Server &amp; more</Description>`,
+		`<rasd:VirtualQuantity>2</rasd:VirtualQuantity>`,
+		`<rasd:VirtualQuantity>4096</rasd:VirtualQuantity>`,
+		`vmw:osType="ubuntu64Guest"`,
+	} {
+		if !strings.Contains(string(ovf), expected) {
+			t.Errorf("Expected \"%s\" in the OVF descriptor, got:\n%s", expected, ovf)
 		}
 	}
-}
-
-func TestClassicStateMachine_cleanRootfs(t *testing.T) {
-	sampleContent := "test"
-	sampleSize := int64(len(sampleContent))
-
-	testCases := []struct {
-		name                 string
-		mockFuncs            func() func()
-		expectedErr          string
-		initialRootfsContent []string
-		wantRootfsContent    map[string]int64 // name: size
-	}{
-		{
-			name: "success",
-			initialRootfsContent: []string{
-				filepath.Join("etc", "machine-id"),
-				filepath.Join("var", "lib", "dbus", "machine-id"),
-				filepath.Join("etc", "udev", "rules.d", "test-persistent-net.rules"),
-				filepath.Join("etc", "udev", "rules.d", "test2-persistent-net.rules"),
-				filepath.Join("var", "cache", "debconf", "test-old"),
-				filepath.Join("var", "lib", "dpkg", "testdpkg-old"),
-				filepath.Join("dev", "stderr"),
-				filepath.Join("dev", "stdin"),
-				filepath.Join("dev", "stdout"),
-				filepath.Join("sys", "kernel", "security"),
-				filepath.Join("run", "mount", "utab.lock"),
-			},
-			wantRootfsContent: map[string]int64{
-				filepath.Join("etc", "machine-id"):                                    0,
-				filepath.Join("etc", "udev", "rules.d", "test-persistent-net.rules"):  0,
-				filepath.Join("etc", "udev", "rules.d", "test2-persistent-net.rules"): 0,
-			},
-		},
-		{
-			name: "fail to clean files",
-			mockFuncs: func() func() {
-				mock := testhelper.NewOSMock(
-					&testhelper.OSMockConf{},
-				)
-
-				osRemoveAll = mock.RemoveAll
-				return func() { osRemoveAll = os.RemoveAll }
-			},
-			expectedErr: "Error removing",
-			initialRootfsContent: []string{
-				filepath.Join("etc", "machine-id"),
-				filepath.Join("var", "lib", "dbus", "machine-id"),
-				filepath.Join("etc", "udev", "rules.d", "test-persistent-net.rules"),
-				filepath.Join("var", "cache", "debconf", "test-old"),
-				filepath.Join("var", "lib", "dpkg", "testdpkg-old"),
-				filepath.Join("dev", "stderr"),
-				filepath.Join("dev", "stdin"),
-				filepath.Join("dev", "stdout"),
-				filepath.Join("sys", "kernel", "security"),
-				filepath.Join("run", "mount", "utab.lock"),
-			},
-			wantRootfsContent: map[string]int64{
-				filepath.Join("etc", "machine-id"):                                   sampleSize,
-				filepath.Join("var", "lib", "dbus", "machine-id"):                    sampleSize,
-				filepath.Join("etc", "udev", "rules.d", "test-persistent-net.rules"): sampleSize,
-				filepath.Join("var", "cache", "debconf", "test-old"):                 sampleSize,
-				filepath.Join("var", "lib", "dpkg", "testdpkg-old"):                  sampleSize,
-				filepath.Join("dev", "stderr"):                                       sampleSize,
-				filepath.Join("dev", "stdin"):                                        sampleSize,
-				filepath.Join("dev", "stdout"):                                       sampleSize,
-				filepath.Join("sys", "kernel", "security"):                           sampleSize,
-				filepath.Join("run", "mount", "utab.lock"):                           sampleSize,
-			},
-		},
-		{
-			name: "fail to truncate files",
-			mockFuncs: func() func() {
-				mock := testhelper.NewOSMock(
-					&testhelper.OSMockConf{},
-				)
+	if strings.Contains(string(ovf), "firmware") {
+		t.Errorf("Unexpected firmware configuration in the OVF descriptor:\n%s", ovf)
+	}
 
-				osTruncate = mock.Truncate
-				return func() { osTruncate = os.Truncate }
-			},
-			expectedErr: "Error truncating",
-			initialRootfsContent: []string{
-				filepath.Join("etc", "machine-id"),
-				filepath.Join("var", "lib", "dbus", "machine-id"),
-				filepath.Join("etc", "udev", "rules.d", "test-persistent-net.rules"),
-			},
-			wantRootfsContent: map[string]int64{
-				filepath.Join("etc", "machine-id"):                                   sampleSize,
-				filepath.Join("etc", "udev", "rules.d", "test-persistent-net.rules"): sampleSize,
+	ovfSum, err := helper.CalculateSHA256(filepath.Join(ovaDir, "ubuntu.ovf"))
+	asserter.AssertErrNil(err, true)
+	manifest, err := os.ReadFile(filepath.Join(ovaDir, "ubuntu.mf"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(fmt.Sprintf("SHA256(ubuntu.ovf)= %x\n"+
+		"SHA256(ubuntu-disk1.vmdk)= e0361263a9f568c21a59e75c3b7810bc5867866e5bd48f499f8b2e6ab723f059\n", ovfSum),
+		string(manifest))
+
+	// reproducible builds do not record the owners and times of the files
+	sourceDateEpoch := time.Unix(1700000000, 0)
+	stateMachine.sourceDateEpoch = &sourceDateEpoch
+	stdout, restoreStdout, err = helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
+
+	err = stateMachine.makeOva()
+	asserter.AssertErrNil(err, true)
+
+	restoreStdout()
+	readStdout, err = io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+
+	expected := fmt.Sprintf("tar --format=ustar --sort=name --mtime=@1700000000 --owner=0 --group=0 --numeric-owner "+
+		"-cf %s/ubuntu.ova -C %s ubuntu.ovf ubuntu.mf ubuntu-disk1.vmdk", outputDir, ovaDir)
+	if !strings.Contains(string(readStdout), expected+"\n") {
+		t.Errorf("Expected command \"%s\" to be run, got:\n%s", expected, readStdout)
+	}
+}
+
+// TestStateMachine_makeBmapAndCompressImages checks block maps are written
+// next to the raw images, which are then compressed
+func TestStateMachine_makeBmapAndCompressImages(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Debug = true
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Artifacts: &imagedefinition.Artifact{
+			Img: &[]imagedefinition.Img{
+				{ImgName: "first.img", Compression: "xz", Bmap: true},
+				{ImgName: "second.img", Compression: "zstd"},
+				{ImgName: "third.img", Compression: "gzip"},
+				{ImgName: "fourth.img", Compression: "uncompressed"},
 			},
 		},
 	}
+	outputDir := t.TempDir()
+	stateMachine.commonFlags.OutputDir = outputDir
+
+	err := os.WriteFile(filepath.Join(outputDir, "first.img"), make([]byte, 8192), 0644)
+	asserter.AssertErrNil(err, true)
+
+	mockCmder := NewMockExecCommand()
+	execCommand = mockCmder.Command
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
+
+	err = stateMachine.makeBmap()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.compressImages()
+	asserter.AssertErrNil(err, true)
+
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+
+	asserter.AssertEqual(fmt.Sprintf("xz --threads=0 --force %s/first.img\n"+
+		"zstd --threads=0 --rm --force --quiet %s/second.img\n"+
+		"pigz --force %s/third.img\n", outputDir, outputDir, outputDir), string(readStdout))
+
+	_, err = os.Stat(filepath.Join(outputDir, "first.img.bmap"))
+	asserter.AssertErrNil(err, true)
+	_, err = os.Stat(filepath.Join(outputDir, "second.img.bmap"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected no block map for second.img, got %v", err)
+	}
 
+	// the block map needs the raw image
+	err = os.Remove(filepath.Join(outputDir, "first.img"))
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.makeBmap()
+	asserter.AssertErrContains(err, "Error opening image")
+}
+
+// TestStateMachine_generateOCIImage checks the OCI image layout of the rootfs
+// is valid and configured as requested, as a directory and as a tar archive
+func TestStateMachine_generateOCIImage(t *testing.T) {
+	testCases := []struct {
+		name   string
+		format string
+	}{
+		{"directory", "directory"},
+		{"tar", "tar"},
+	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			asserter := helper.Asserter{T: t}
-			stateMachine := &ClassicStateMachine{}
+			var stateMachine ClassicStateMachine
 			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
-			stateMachine.parent = stateMachine
-
-			err := stateMachine.makeTemporaryDirectories()
-			asserter.AssertErrNil(err, true)
-
-			t.Cleanup(func() { os.RemoveAll(stateMachine.stateMachineFlags.WorkDir) })
-
-			if tc.mockFuncs != nil {
-				restoreMock := tc.mockFuncs()
-				t.Cleanup(restoreMock)
+			stateMachine.parent = &stateMachine
+			stateMachine.ImageDef = imagedefinition.ImageDefinition{
+				Architecture: "armhf",
+				Artifacts: &imagedefinition.Artifact{
+					Oci: &imagedefinition.Oci{
+						OciName:            "ubuntu-oci",
+						Format:             tc.format,
+						Tag:                "24.04",
+						Entrypoint:         []string{"/bin/bash"},
+						Env:                map[string]string{"LANG": "C.UTF-8", "A": "b"},
+						Labels:             map[string]string{"org.opencontainers.image.title": "ubuntu"},
+						ExcludeBootContent: helper.BoolPtr(true),
+					},
+				},
 			}
-
-			for _, path := range tc.initialRootfsContent {
-				// create dir if necessary
-				fullPath := filepath.Join(stateMachine.tempDirs.chroot, path)
-				err = os.MkdirAll(filepath.Dir(fullPath), 0777)
+			stateMachine.tempDirs.rootfs = t.TempDir()
+			stateMachine.stateMachineFlags.WorkDir = t.TempDir()
+			stateMachine.commonFlags.OutputDir = t.TempDir()
+			for _, file := range []string{"etc/hostname", "boot/vmlinuz"} {
+				err := os.MkdirAll(filepath.Join(stateMachine.tempDirs.rootfs, filepath.Dir(file)), 0755)
 				asserter.AssertErrNil(err, true)
-
-				err := os.WriteFile(fullPath, []byte(sampleContent), 0600)
+				err = os.WriteFile(filepath.Join(stateMachine.tempDirs.rootfs, file), []byte(file), 0644)
 				asserter.AssertErrNil(err, true)
 			}
 
-			err = stateMachine.cleanRootfs()
-			if err != nil || len(tc.expectedErr) != 0 {
-				asserter.AssertErrContains(err, tc.expectedErr)
+			err := stateMachine.generateOCIImage()
+			asserter.AssertErrNil(err, true)
+
+			layoutDir := filepath.Join(stateMachine.commonFlags.OutputDir, "ubuntu-oci")
+			if tc.format == "tar" {
+				layoutDir = t.TempDir()
+				err = helper.ExtractTarArchive(filepath.Join(stateMachine.commonFlags.OutputDir, "ubuntu-oci"), layoutDir, false)
+				asserter.AssertErrNil(err, true)
 			}
 
-			for path, size := range tc.wantRootfsContent {
-				fullPath := filepath.Join(stateMachine.tempDirs.chroot, path)
-				s, err := os.Stat(fullPath)
-				if os.IsNotExist(err) {
-					t.Errorf("File %s should exist, but does not", path)
+			readBlob := func(digest string, v any) []byte {
+				blob, err := os.ReadFile(filepath.Join(layoutDir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:")))
+				asserter.AssertErrNil(err, true)
+				asserter.AssertEqual(digest, fmt.Sprintf("sha256:%x", sha256.Sum256(blob)))
+				if v != nil {
+					err = json.Unmarshal(blob, v)
+					asserter.AssertErrNil(err, true)
 				}
+				return blob
+			}
 
-				if s.Size() != size {
-					t.Errorf("File size of %s is not matching: want %d, got %d", path, size, s.Size())
+			var index ociIndex
+			indexContent, err := os.ReadFile(filepath.Join(layoutDir, "index.json"))
+			asserter.AssertErrNil(err, true)
+			err = json.Unmarshal(indexContent, &index)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(1, len(index.Manifests))
+			asserter.AssertEqual("24.04", index.Manifests[0].Annotations["org.opencontainers.image.ref.name"])
+			asserter.AssertEqual(ociPlatform{Architecture: "arm", OS: "linux", Variant: "v7"}, *index.Manifests[0].Platform)
+
+			var manifest ociManifest
+			readBlob(index.Manifests[0].Digest, &manifest)
+			var config ociImageConfig
+			readBlob(manifest.Config.Digest, &config)
+			asserter.AssertEqual("arm", config.Architecture)
+			asserter.AssertEqual([]string{"/bin/bash"}, config.Config.Entrypoint)
+			asserter.AssertEqual([]string{"A=b", "LANG=C.UTF-8"}, config.Config.Env)
+			asserter.AssertEqual("ubuntu", config.Config.Labels["org.opencontainers.image.title"])
+
+			layer := readBlob(manifest.Layers[0].Digest, nil)
+			gzipReader, err := gzip.NewReader(bytes.NewReader(layer))
+			asserter.AssertErrNil(err, true)
+			uncompressedLayer, err := io.ReadAll(gzipReader)
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(config.Rootfs.DiffIDs[0], fmt.Sprintf("sha256:%x", sha256.Sum256(uncompressedLayer)))
+			names := make([]string, 0)
+			tarReader := tar.NewReader(bytes.NewReader(uncompressedLayer))
+			for {
+				header, err := tarReader.Next()
+				if err == io.EOF {
+					break
 				}
+				asserter.AssertErrNil(err, true)
+				names = append(names, header.Name)
 			}
+			asserter.AssertEqual([]string{"boot/", "etc/", "etc/hostname"}, names)
 		})
 	}
 }
 
-func Test_addUniqueSnaps(t *testing.T) {
-	type args struct {
-		currentSnaps []string
-		newSnaps     []string
-	}
-	tests := []struct {
-		name string
-		args args
-		want []string
-	}{
-		{
-			name: "no duplicate",
-			args: args{
-				currentSnaps: []string{
-					"a",
-					"b",
-				},
-				newSnaps: []string{
-					"c",
-					"d",
-				},
-			},
-			want: []string{
-				"a",
-				"b",
-				"c",
-				"d",
-			},
-		},
-		{
-			name: "current empty",
-			args: args{
-				currentSnaps: nil,
-				newSnaps: []string{
-					"c",
-					"d",
-				},
-			},
-			want: []string{
-				"c",
-				"d",
-			},
-		},
-		{
-			name: "new empty",
-			args: args{
-				currentSnaps: []string{
-					"a",
-					"b",
-				},
-				newSnaps: nil,
-			},
-			want: []string{
-				"a",
-				"b",
-			},
+// TestFailedGenerateOCIImage tests failures writing OCI images are reported
+func TestFailedGenerateOCIImage(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Architecture: "amd64",
+		Artifacts: &imagedefinition.Artifact{
+			Oci: &imagedefinition.Oci{OciName: "ubuntu-oci.tar", Format: "tar"},
 		},
-		{
-			name: "with duplicates, conserve order",
-			args: args{
-				currentSnaps: []string{
-					"a",
-					"b",
-					"e",
-					"f",
-				},
-				newSnaps: []string{
-					"c",
-					"d",
-					"e",
-					"f",
-				},
-			},
-			want: []string{
-				"a",
-				"b",
-				"e",
-				"f",
-				"c",
-				"d",
+	}
+	stateMachine.tempDirs.rootfs = t.TempDir()
+	stateMachine.stateMachineFlags.WorkDir = t.TempDir()
+	stateMachine.commonFlags.OutputDir = t.TempDir()
+
+	osMkdirAll = mockMkdirAll
+	t.Cleanup(func() { osMkdirAll = os.MkdirAll })
+	err := stateMachine.generateOCIImage()
+	asserter.AssertErrContains(err, "Error creating OCI image layout directory")
+	osMkdirAll = os.MkdirAll
+
+	osWriteFile = mockWriteFile
+	t.Cleanup(func() { osWriteFile = os.WriteFile })
+	err = stateMachine.generateOCIImage()
+	asserter.AssertErrContains(err, "blob")
+	osWriteFile = os.WriteFile
+
+	osCreate = mockCreate
+	t.Cleanup(func() { osCreate = os.Create })
+	err = stateMachine.generateOCIImage()
+	asserter.AssertErrContains(err, "Error creating OCI layer")
+	osCreate = os.Create
+
+	// only previous OCI image layouts are removed
+	stateMachine.ImageDef.Artifacts.Oci = &imagedefinition.Oci{OciName: "ubuntu-oci", Format: "directory"}
+	notLayout := filepath.Join(stateMachine.commonFlags.OutputDir, "ubuntu-oci", "keep")
+	err = os.MkdirAll(filepath.Dir(notLayout), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(notLayout, []byte("keep"), 0644)
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.generateOCIImage()
+	asserter.AssertErrContains(err, "exists and is not an OCI image layout")
+	_, err = os.Stat(notLayout)
+	asserter.AssertErrNil(err, true)
+
+	err = os.RemoveAll(filepath.Dir(notLayout))
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.generateOCIImage()
+	asserter.AssertErrNil(err, true)
+	err = stateMachine.generateOCIImage()
+	asserter.AssertErrNil(err, true)
+}
+
+// TestStateMachine_generateChecksums checks the checksums files only cover
+// the artifacts and are signed when a key is given
+func TestStateMachine_generateChecksums(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.commonFlags.Debug = true
+	stateMachine.parent = &stateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Class: "installer",
+		Artifacts: &imagedefinition.Artifact{
+			Img:      &[]imagedefinition.Img{{ImgName: "pc.img", Compression: "xz", Bmap: true}},
+			Qcow2:    &[]imagedefinition.Qcow2{{Qcow2Name: "pc.qcow2"}},
+			Manifest: &imagedefinition.Manifest{ManifestName: "pc.manifest"},
+			Checksums: &imagedefinition.Checksums{
+				SHA512: helper.BoolPtr(true),
 			},
 		},
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			asserter := helper.Asserter{T: t}
-			got := addUniqueSnaps(tt.args.currentSnaps, tt.args.newSnaps)
-			asserter.AssertEqual(tt.want, got)
-		})
+	stateMachine.VolumeNames = map[string]string{"pc": "pc.img"}
+	stateMachine.Opts.SignKey = "builder@example.com"
+	stateMachine.Opts.GnupgHome = "/srv/gnupg"
+	outputDir := t.TempDir()
+	stateMachine.commonFlags.OutputDir = outputDir
+
+	files := map[string]string{
+		"pc.img.xz":                  "img",
+		"pc.img.bmap":                "bmap",
+		"pc.img.zst":                 "stale img",
+		"pc.img.gz":                  "stale img",
+		"pc.qcow2":                   "qcow2",
+		"pc.manifest":                "manifest",
+		"casper/filesystem.squashfs": "squashfs",
+		"autoinstall.yaml":           "autoinstall",
+		"unrelated.txt":              "not an artifact",
+		"preseed/nested/ubuntu.seed": "seed",
+	}
+	for file, content := range files {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(outputDir, file)), 0755)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(filepath.Join(outputDir, file), []byte(content), 0644)
+		asserter.AssertErrNil(err, true)
+	}
+
+	mockCmder := NewMockExecCommand()
+	execCommand = mockCmder.Command
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
+
+	err = stateMachine.generateChecksums()
+	asserter.AssertErrNil(err, true)
+
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+
+	expectedFiles := []string{
+		"autoinstall.yaml",
+		"casper/filesystem.squashfs",
+		"pc.img.bmap",
+		"pc.img.xz",
+		"pc.manifest",
+		"pc.qcow2",
+		"preseed/nested/ubuntu.seed",
+	}
+	expectedSHA256 := ""
+	expectedSHA512 := ""
+	for _, file := range expectedFiles {
+		expectedSHA256 += fmt.Sprintf("%x *%s\n", sha256.Sum256([]byte(files[file])), file)
+		expectedSHA512 += fmt.Sprintf("%x *%s\n", sha512.Sum512([]byte(files[file])), file)
+	}
+	sha256Sums, err := os.ReadFile(filepath.Join(outputDir, "SHA256SUMS"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(expectedSHA256, string(sha256Sums))
+	sha512Sums, err := os.ReadFile(filepath.Join(outputDir, "SHA512SUMS"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(expectedSHA512, string(sha512Sums))
+
+	asserter.AssertEqual(fmt.Sprintf(
+		"gpg --batch --yes --homedir /srv/gnupg --local-user builder@example.com --output %s/SHA256SUMS.gpg --detach-sign %s/SHA256SUMS\n"+
+			"gpg --batch --yes --homedir /srv/gnupg --local-user builder@example.com --output %s/SHA512SUMS.gpg --detach-sign %s/SHA512SUMS\n",
+		outputDir, outputDir, outputDir, outputDir), string(readStdout))
+}
+
+// TestClassicStateMachine_validateSignKey checks a signing key can only be
+// given along with the checksums artifact
+func TestClassicStateMachine_validateSignKey(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine ClassicStateMachine
+	stateMachine.ImageDef = imagedefinition.ImageDefinition{
+		Artifacts: &imagedefinition.Artifact{},
 	}
+
+	err := stateMachine.validateSignKey()
+	asserter.AssertErrNil(err, true)
+
+	stateMachine.Opts.SignKey = "builder@example.com"
+	err = stateMachine.validateSignKey()
+	asserter.AssertErrContains(err, "--sign-key can only be used with the checksums artifact")
+
+	stateMachine.ImageDef.Artifacts.Checksums = &imagedefinition.Checksums{}
+	err = stateMachine.validateSignKey()
+	asserter.AssertErrNil(err, true)
 }
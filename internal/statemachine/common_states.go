@@ -9,6 +9,7 @@ import (
 
 	diskfs "github.com/diskfs/go-diskfs"
 	diskutils "github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/partition/gpt"
 	"github.com/snapcore/snapd/gadget"
 	"github.com/snapcore/snapd/gadget/quantity"
 	"github.com/snapcore/snapd/osutil"
@@ -350,6 +351,16 @@ func (stateMachine *StateMachine) populateBootfsLayoutStructure(laidOutStructure
 			return fmt.Errorf("Error in mountedFilesystem.Write(): %s", err.Error())
 		}
 	}
+
+	// classic images may customize the piboot configuration of the boot partition
+	if volume.Bootloader == "piboot" &&
+		(laidOutStructure.Role() == gadget.SystemBoot || laidOutStructure.Label() == gadget.SystemBoot) {
+		classicStateMachine, isClassic := stateMachine.parent.(*ClassicStateMachine)
+		if isClassic && classicStateMachine.ImageDef.Customization != nil &&
+			classicStateMachine.ImageDef.Customization.Bootloader != nil {
+			return customizePibootFiles(classicStateMachine.ImageDef.Customization.Bootloader, targetDir)
+		}
+	}
 	return nil
 }
 
@@ -454,7 +465,7 @@ func (stateMachine *StateMachine) makeDisk() error {
 		// TODO: go-diskfs doesn't set the disk ID when using an MBR partition table.
 		// this function is a temporary workaround, but we should change upstream go-diskfs
 		if volume.Schema == partition.SchemaMBR {
-			err = fixDiskIDOnMBR(imgName)
+			err = stateMachine.fixDiskIDOnMBR(imgName, volumeName)
 			if err != nil {
 				return err
 			}
@@ -508,6 +519,14 @@ func (stateMachine *StateMachine) partitionDisk(diskImg *diskutils.Disk, volume
 		return err
 	}
 
+	// go-diskfs generates random GUIDs for the disk and partitions left without one
+	if gptTable, ok := partitionTable.(*gpt.Table); ok && stateMachine.sourceDateEpoch != nil {
+		gptTable.GUID = stateMachine.buildUUID("gpt", volumeName).String()
+		for i, gptPartition := range gptTable.Partitions {
+			gptPartition.GUID = stateMachine.buildUUID("gpt", volumeName, strconv.Itoa(i)).String()
+		}
+	}
+
 	// Save the rootfs/boot partition numbers, for later use
 	// Store in any case, even if value is -1 to make it clear later it was not found
 	stateMachine.RootfsPartNum = rootfsPartitionNumber
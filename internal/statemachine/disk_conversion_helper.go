@@ -0,0 +1,259 @@
+package statemachine
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/snapcore/snapd/gadget/quantity"
+
+	"github.com/canonical/ubuntu-image/internal/arch"
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+	"github.com/canonical/ubuntu-image/internal/partition"
+)
+
+// vhdAlignment is the alignment of the virtual size of VHD images required by Azure
+const vhdAlignment = quantity.SizeMiB
+
+const (
+	defaultOvaCPUs   = 2
+	defaultOvaMemory = 2048
+)
+
+// qemuImgConvertCmd returns the command converting a raw disk image to the
+// given format
+func qemuImgConvertCmd(rawImg string, dest string, format string, options string) *exec.Cmd {
+	return execCommand("qemu-img",
+		"convert",
+		"-f",
+		"raw",
+		"-O",
+		format,
+		"-o",
+		options,
+		rawImg,
+		dest,
+	)
+}
+
+// imgCompressionExt returns the extension added to the name of an image by
+// its compression
+func imgCompressionExt(compression string) string {
+	switch compression {
+	case "xz":
+		return ".xz"
+	case "zstd":
+		return ".zst"
+	case "gzip":
+		return ".gz"
+	default:
+		return ""
+	}
+}
+
+// imgCompressCmd returns the multi-threaded command compressing an image in
+// place, adding the extension of the compression to its name. The
+// modification time of the image is left out of reproducible archives
+func imgCompressCmd(compression string, imgPath string, reproducible bool) (*exec.Cmd, error) {
+	switch compression {
+	case "xz":
+		return execCommand("xz", "--threads=0", "--force", imgPath), nil
+	case "zstd":
+		return execCommand("zstd", "--threads=0", "--rm", "--force", "--quiet", imgPath), nil
+	case "gzip":
+		if reproducible {
+			return execCommand("pigz", "--force", "--no-time", imgPath), nil
+		}
+		return execCommand("pigz", "--force", imgPath), nil
+	default:
+		return nil, fmt.Errorf("Unknown compression type: \"%s\"", compression)
+	}
+}
+
+// alignedRawImage returns a raw image of the given volume whose size is a
+// multiple of vhdAlignment. If the .img is not aligned, a grown copy of it
+// is made in the workdir so the .img artifact is left untouched
+func (stateMachine *StateMachine) alignedRawImage(rawImg string, volumeName string) (string, error) {
+	rawImgInfo, err := os.Stat(rawImg)
+	if err != nil {
+		return "", fmt.Errorf("Error getting size of %s: %s", rawImg, err.Error())
+	}
+	size := quantity.Size(rawImgInfo.Size())
+	if size%vhdAlignment == 0 {
+		return rawImg, nil
+	}
+	alignedSize := (size/vhdAlignment + 1) * vhdAlignment
+
+	alignedImg := filepath.Join(stateMachine.stateMachineFlags.WorkDir, filepath.Base(rawImg)+".aligned")
+	cmds := []*exec.Cmd{
+		execCommand("cp", "--sparse=always", rawImg, alignedImg),
+		execCommand("qemu-img", "resize", "-f", "raw", alignedImg, strconv.FormatUint(uint64(alignedSize), 10)),
+	}
+	volume := stateMachine.GadgetInfo.Volumes[volumeName]
+	if volume != nil && volume.Schema != partition.SchemaMBR {
+		// move the backup GPT header to the new end of the disk
+		cmds = append(cmds, execCommand("sgdisk", "--move-second-header", alignedImg))
+	}
+	for _, cmd := range cmds {
+		err := helper.RunCmd(cmd, stateMachine.commonFlags.Debug)
+		if err != nil {
+			return "", err
+		}
+	}
+	return alignedImg, nil
+}
+
+// ovfParams holds the values needed to generate an OVF descriptor
+type ovfParams struct {
+	Name         string
+	Description  string
+	CPUs         int
+	Memory       int
+	DiskFile     string
+	DiskCapacity int64
+	OSID         int
+	OSType       string
+	EFI          bool
+}
+
+// ovfTemplate is an OVF 1.0 descriptor of a virtual machine with a single
+// stream-optimized disk attached to a SCSI controller
+var ovfTemplate = template.Must(template.New("ovf").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:cim="http://schemas.dmtf.org/wbem/wscim/1/common" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1" xmlns:rasd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData" xmlns:vmw="http://www.vmware.com/schema/ovf" xmlns:vssd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_VirtualSystemSettingData" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <References>
+    <File ovf:href="{{xml .DiskFile}}" ovf:id="file1"/>
+  </References>
+  <DiskSection>
+    <Info>Virtual disk information</Info>
+    <Disk ovf:capacity="{{.DiskCapacity}}" ovf:capacityAllocationUnits="byte" ovf:diskId="vmdisk1" ovf:fileRef="file1" ovf:format="http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized"/>
+  </DiskSection>
+  <NetworkSection>
+    <Info>The list of logical networks</Info>
+    <Network ovf:name="nat">
+      <Description>The nat network</Description>
+    </Network>
+  </NetworkSection>
+  <VirtualSystem ovf:id="{{xml .Name}}">
+    <Info>A virtual machine</Info>
+    <Name>{{xml .Name}}</Name>
+    <OperatingSystemSection ovf:id="{{.OSID}}" vmw:osType="{{.OSType}}">
+      <Info>The kind of installed guest operating system</Info>
+      <Description>{{xml .Description}}</Description>
+    </OperatingSystemSection>
+    <VirtualHardwareSection>
+      <Info>Virtual hardware requirements</Info>
+      <System>
+        <vssd:ElementName>Virtual Hardware Family</vssd:ElementName>
+        <vssd:InstanceID>0</vssd:InstanceID>
+        <vssd:VirtualSystemIdentifier>{{xml .Name}}</vssd:VirtualSystemIdentifier>
+        <vssd:VirtualSystemType>vmx-13</vssd:VirtualSystemType>
+      </System>
+      <Item>
+        <rasd:AllocationUnits>hertz * 10^6</rasd:AllocationUnits>
+        <rasd:Description>Number of Virtual CPUs</rasd:Description>
+        <rasd:ElementName>{{.CPUs}} virtual CPU(s)</rasd:ElementName>
+        <rasd:InstanceID>1</rasd:InstanceID>
+        <rasd:ResourceType>3</rasd:ResourceType>
+        <rasd:VirtualQuantity>{{.CPUs}}</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:AllocationUnits>byte * 2^20</rasd:AllocationUnits>
+        <rasd:Description>Memory Size</rasd:Description>
+        <rasd:ElementName>{{.Memory}}MB of memory</rasd:ElementName>
+        <rasd:InstanceID>2</rasd:InstanceID>
+        <rasd:ResourceType>4</rasd:ResourceType>
+        <rasd:VirtualQuantity>{{.Memory}}</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:Address>0</rasd:Address>
+        <rasd:Description>SCSI Controller</rasd:Description>
+        <rasd:ElementName>SCSI Controller 0</rasd:ElementName>
+        <rasd:InstanceID>3</rasd:InstanceID>
+        <rasd:ResourceSubType>VirtualSCSI</rasd:ResourceSubType>
+        <rasd:ResourceType>6</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:AddressOnParent>0</rasd:AddressOnParent>
+        <rasd:ElementName>Hard Disk 1</rasd:ElementName>
+        <rasd:HostResource>ovf:/disk/vmdisk1</rasd:HostResource>
+        <rasd:InstanceID>4</rasd:InstanceID>
+        <rasd:Parent>3</rasd:Parent>
+        <rasd:ResourceType>17</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:AddressOnParent>0</rasd:AddressOnParent>
+        <rasd:AutomaticAllocation>true</rasd:AutomaticAllocation>
+        <rasd:Connection>nat</rasd:Connection>
+        <rasd:ElementName>Network adapter 1</rasd:ElementName>
+        <rasd:InstanceID>5</rasd:InstanceID>
+        <rasd:ResourceSubType>VmxNet3</rasd:ResourceSubType>
+        <rasd:ResourceType>10</rasd:ResourceType>
+      </Item>
+{{- if .EFI}}
+      <vmw:Config ovf:required="false" vmw:key="firmware" vmw:value="efi"/>
+{{- end}}
+    </VirtualHardwareSection>
+  </VirtualSystem>
+</Envelope>
+`))
+
+// xmlEscape escapes a string to be used as XML text or attribute value
+func xmlEscape(s string) string {
+	escaped := &strings.Builder{}
+	// writing to a strings.Builder cannot fail
+	_ = xml.EscapeText(escaped, []byte(s))
+	return escaped.String()
+}
+
+// generateOVF generates the OVF descriptor of the virtual machine of an ova
+// artifact, using the given stream-optimized disk
+func generateOVF(imageDef imagedefinition.ImageDefinition, ova imagedefinition.Ova, diskFile string, diskCapacity int64) (string, error) {
+	params := ovfParams{
+		Name:         imageDef.ImageName,
+		Description:  imageDef.DisplayName,
+		CPUs:         ova.CPUs,
+		Memory:       ova.Memory,
+		DiskFile:     diskFile,
+		DiskCapacity: diskCapacity,
+		// CIM operating system type "Ubuntu 64-Bit"
+		OSID:   94,
+		OSType: "ubuntu64Guest",
+	}
+	if params.CPUs == 0 {
+		params.CPUs = defaultOvaCPUs
+	}
+	if params.Memory == 0 {
+		params.Memory = defaultOvaMemory
+	}
+	if imageDef.Architecture == arch.ARM64 {
+		params.OSType = "arm-ubuntu64Guest"
+		params.EFI = true
+	}
+
+	ovf := &strings.Builder{}
+	err := ovfTemplate.Execute(ovf, params)
+	if err != nil {
+		return "", fmt.Errorf("Error generating OVF descriptor: %s", err.Error())
+	}
+	return ovf.String(), nil
+}
+
+// generateOVAManifest generates the manifest of an OVA package, listing the
+// SHA256 sums of the given files of dir
+func generateOVAManifest(dir string, files ...string) (string, error) {
+	manifest := &strings.Builder{}
+	for _, file := range files {
+		sum, err := helper.CalculateSHA256(filepath.Join(dir, file))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(manifest, "SHA256(%s)= %x\n", file, sum)
+	}
+	return manifest.String(), nil
+}
@@ -2,14 +2,19 @@ package statemachine
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"io/fs"
 	"math"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -18,7 +23,10 @@ import (
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/snapcore/snapd/gadget"
 	"github.com/snapcore/snapd/gadget/quantity"
+	"github.com/snapcore/snapd/progress"
 	"github.com/snapcore/snapd/seed"
+	"github.com/snapcore/snapd/snap/squashfs"
+	"github.com/snapcore/snapd/store"
 	"github.com/snapcore/snapd/timings"
 
 	"github.com/canonical/ubuntu-image/internal/helper"
@@ -170,7 +178,19 @@ func (stateMachine *StateMachine) prepareAndCreateFS(structure *gadget.VolumeStr
 		return err
 	}
 
-	return makeFS(structure, contentRoot, partImg, stateMachine.SectorSize, stateMachine.series)
+	if stateMachine.sourceDateEpoch == nil {
+		return makeFS(structure, contentRoot, partImg, stateMachine.SectorSize, stateMachine.series)
+	}
+
+	err = clampMtimes(contentRoot, *stateMachine.sourceDateEpoch)
+	if err != nil {
+		return fmt.Errorf("Error clamping the modification times of \"%s\": %s", contentRoot, err.Error())
+	}
+	err = makeFS(structure, contentRoot, partImg, stateMachine.SectorSize, stateMachine.series)
+	if err != nil {
+		return err
+	}
+	return stateMachine.setFilesystemID(structure, partImg)
 }
 
 // prepareDiskImg prepares a raw image
@@ -239,9 +259,8 @@ func hasContent(structure *gadget.VolumeStructure, contentRoot string) (bool, er
 
 const mbrDiskSignatureAddress = 440
 
-func fixDiskIDOnMBR(imgName string) error {
-	var existingDiskIds [][]byte
-	randomBytes, err := generateUniqueDiskID(&existingDiskIds)
+func (stateMachine *StateMachine) fixDiskIDOnMBR(imgName string, volumeName string) error {
+	diskID, err := stateMachine.mbrDiskID(volumeName)
 	if err != nil {
 		return fmt.Errorf("Error generating disk ID: %s", err.Error())
 	}
@@ -251,7 +270,7 @@ func fixDiskIDOnMBR(imgName string) error {
 			err.Error())
 	}
 	defer diskFile.Close()
-	_, err = diskFile.WriteAt(randomBytes, mbrDiskSignatureAddress)
+	_, err = diskFile.WriteAt(diskID, mbrDiskSignatureAddress)
 	if err != nil {
 		return fmt.Errorf("Error writing MBR disk identifier: %s", err.Error())
 	}
@@ -296,10 +315,26 @@ func WriteSnapManifest(snapsDir string, outputPath string) error {
 	return nil
 }
 
+// installedPackagesOnly filters the output of dpkg-query, where each line is
+// prefixed by the abbreviated package status, to keep only installed packages.
+// Removed packages that were not purged are still known by dpkg and are dropped.
+func installedPackagesOnly(dpkgQueryOutput []byte) []byte {
+	var installedPackages bytes.Buffer
+	for _, line := range strings.SplitAfter(string(dpkgQueryOutput), "\n") {
+		// the status abbreviation is 3 characters long, the second one being
+		// the current status of the package
+		if len(line) <= 3 || line[1] != 'i' {
+			continue
+		}
+		installedPackages.WriteString(line[3:])
+	}
+	return installedPackages.Bytes()
+}
+
 // generateClassicManifest generates the classic manifest file for the given rootfs
 func generateClassicManifest(rootfs string, outputPath string, debug bool) error {
 	adminDir := filepath.Join(rootfs, "var", "lib", "dpkg")
-	cmd := execCommand("dpkg-query", fmt.Sprintf("--admindir=%s", adminDir), "-W", "--showformat=${Package} ${Version}\n")
+	cmd := execCommand("dpkg-query", fmt.Sprintf("--admindir=%s", adminDir), "-W", "--showformat=${db:Status-Abbrev}${Package} ${Version}\n")
 	cmdOutput := helper.SetCommandOutput(cmd, debug)
 
 	if err := cmd.Run(); err != nil {
@@ -314,19 +349,45 @@ func generateClassicManifest(rootfs string, outputPath string, debug bool) error
 		return fmt.Errorf("Error creating manifest file: %s", err.Error())
 	}
 	defer manifest.Close()
-	_, err = manifest.Write(cmdOutput.Bytes())
+	_, err = manifest.Write(installedPackagesOnly(cmdOutput.Bytes()))
 	if err != nil {
 		return fmt.Errorf("error writing the manifest file: %w", err)
 	}
 	return nil
 }
 
+// localPackagesSuffix is appended to the name of a manifest to name the
+// file listing the packages installed from local .deb files
+const localPackagesSuffix = ".local"
+
+// writeLocalPackages records which packages of a manifest were installed from
+// local .deb files in a companion file, one package name per line, so the
+// format of the manifest is unchanged. A list from a previous build is removed
+// when there is no local package
+func writeLocalPackages(manifestPath string, localPackages []string) error {
+	localPath := manifestPath + localPackagesSuffix
+	if len(localPackages) == 0 {
+		err := osRemoveAll(localPath)
+		if err != nil {
+			return fmt.Errorf("Error removing the list of local packages: %s", err.Error())
+		}
+		return nil
+	}
+
+	sortedPackages := slices.Sorted(slices.Values(localPackages))
+	err := osWriteFile(localPath, []byte(strings.Join(sortedPackages, "\n")+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing the list of local packages: %s", err.Error())
+	}
+	return nil
+}
+
 // generateClassicManifestV2 generates the classic manifest file for the given rootfs
 // V2 has the same output as the livecd-rootfs tool.
 func generateClassicManifestV2(rootfs string, outputPath string, debug bool) error {
 	// get package list
 	adminDir := filepath.Join(rootfs, "var", "lib", "dpkg")
-	cmd := execCommand("dpkg-query", "--show", fmt.Sprintf("--admindir=%s", adminDir))
+	cmd := execCommand("dpkg-query", "--show", fmt.Sprintf("--admindir=%s", adminDir), "--showformat=${db:Status-Abbrev}${binary:Package}\t${Version}\n")
 	cmdOutput := helper.SetCommandOutput(cmd, debug)
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("Error generating package list with command \"%s\". "+
@@ -340,7 +401,7 @@ func generateClassicManifestV2(rootfs string, outputPath string, debug bool) err
 		return fmt.Errorf("Error creating manifest file: %w", err)
 	}
 	defer manifest.Close()
-	_, err = manifest.Write(cmdOutput.Bytes())
+	_, err = manifest.Write(installedPackagesOnly(cmdOutput.Bytes()))
 	if err != nil {
 		return fmt.Errorf("Error writing to the manifest file: %w", err)
 	}
@@ -589,7 +650,7 @@ func cloneGitRepo(imageDefinition imagedefinition.ImageDefinition, workDir strin
 
 // generateDebootstrapCmd generates the debootstrap command used to create a chroot
 // environment that will eventually become the rootfs of the resulting image
-func generateDebootstrapCmd(imageDefinition imagedefinition.ImageDefinition, targetDir string) *exec.Cmd {
+func generateDebootstrapCmd(imageDefinition imagedefinition.ImageDefinition, targetDir string, extraArgs ...string) *exec.Cmd {
 	debootstrapCmd := execCommand("debootstrap",
 		"--arch", imageDefinition.Architecture,
 		"--variant=minbase",
@@ -605,6 +666,8 @@ func generateDebootstrapCmd(imageDefinition imagedefinition.ImageDefinition, tar
 		debootstrapCmd.Args = append(debootstrapCmd.Args, "--components="+components)
 	}
 
+	debootstrapCmd.Args = append(debootstrapCmd.Args, extraArgs...)
+
 	// add the SUITE TARGET and MIRROR arguments
 	debootstrapCmd.Args = append(debootstrapCmd.Args, []string{
 		imageDefinition.Series,
@@ -625,6 +688,69 @@ func aptInstallChrootCmd(targetDir string, packageList []string, installRecommen
 	return generateAptPackageInstallingCmd(targetDir, append([]string{"install"}, packageList...), installRecommends)
 }
 
+// aptCleanChrootCmd returns the apt command to remove the downloaded packages from the chroot
+func aptCleanChrootCmd(targetDir string) *exec.Cmd {
+	return execCommand("chroot", targetDir, "apt", "clean")
+}
+
+// aptRemoveChrootCmd returns the apt command to remove or purge the packages in the chroot
+func aptRemoveChrootCmd(targetDir string, packageList []string, purge bool, autoremove bool) *exec.Cmd {
+	argumentList := []string{"remove"}
+	if purge {
+		argumentList = []string{"purge"}
+	}
+	if autoremove {
+		argumentList = append(argumentList, "--autoremove")
+	}
+	return generateAptPackageInstallingCmd(targetDir, append(argumentList, packageList...), true)
+}
+
+// aptMarkHoldChrootCmd returns the apt-mark command to hold the packages in the chroot
+func aptMarkHoldChrootCmd(targetDir string, packageList []string) *exec.Cmd {
+	return execCommand("chroot", append([]string{targetDir, "apt-mark", "hold"}, packageList...)...)
+}
+
+// resolvePackageVersion returns the first version of the package available
+// in the chroot matching the given version, which can be a glob
+func resolvePackageVersion(targetDir string, packageName string, versionPattern string) (string, error) {
+	madisonCmd := execCommand("chroot", targetDir, "apt-cache", "madison", packageName)
+	madisonOutput, err := madisonCmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Error listing available versions of package %s: %s", packageName, err.Error())
+	}
+
+	availableVersions := make([]string, 0)
+	for _, line := range strings.Split(string(madisonOutput), "\n") {
+		// lines are formatted as "<package> | <version> | <source>"
+		fields := strings.Split(line, "|")
+		if len(fields) < 3 {
+			continue
+		}
+		version := strings.TrimSpace(fields[1])
+		availableVersions = append(availableVersions, version)
+		matched, err := path.Match(versionPattern, version)
+		if err != nil {
+			return "", fmt.Errorf("Invalid version %s for package %s: %s", versionPattern, packageName, err.Error())
+		}
+		if matched {
+			return version, nil
+		}
+	}
+
+	return "", fmt.Errorf("Version %s of package %s is not available. Available versions are: %s",
+		versionPattern, packageName, strings.Join(availableVersions, ", "))
+}
+
+// localDebPackageName returns the name of the package held by a local .deb file
+func localDebPackageName(debPath string) (string, error) {
+	dpkgDebCmd := execCommand("dpkg-deb", "--field", debPath, "Package")
+	dpkgDebOutput, err := dpkgDebCmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Error reading the package name of %s: %s", debPath, err.Error())
+	}
+	return strings.TrimSpace(string(dpkgDebOutput)), nil
+}
+
 // aptUpgradeChrootCmd returns the apt command to upgrade packages in the chroot
 func aptUpgradeChrootCmd(targetDir string, installRecommends bool) *exec.Cmd {
 	return generateAptPackageInstallingCmd(targetDir, []string{"upgrade"}, installRecommends)
@@ -713,23 +839,191 @@ func manualCopyFile(customizations []*imagedefinition.CopyFile, confDefPath stri
 	return nil
 }
 
-// manualExecute executes executable files in the chroot
-func manualExecute(customizations []*imagedefinition.Execute, targetDir string, debug bool) error {
-	for _, c := range customizations {
-		executeCmd := execCommand("chroot", targetDir, c.ExecutePath)
+// customizeFile creates a file from inline content or copies a file or a
+// directory from the definition directory into the chroot, then sets its
+// mode and ownership
+func customizeFile(file *imagedefinition.File, confDefPath string, targetDir string, debug bool) error {
+	dest := filepath.Join(targetDir, file.Path)
+	err := osMkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating parent directory of \"%s\": %s", file.Path, err.Error())
+	}
+
+	recursive := false
+	if file.Source != "" {
+		source := filepath.Join(confDefPath, file.Source)
+		if debug {
+			fmt.Printf("Copying \"%s\" to \"%s\"\n", source, dest)
+		}
+		fileInfo, err := os.Stat(source)
+		if err != nil {
+			return fmt.Errorf("Error reading \"%s\": %s", source, err.Error())
+		}
+		recursive = fileInfo.IsDir()
+		if recursive {
+			// copy the content of the directory so dest is not nested
+			// in an existing directory
+			err = osMkdirAll(dest, fileInfo.Mode().Perm())
+			if err != nil {
+				return fmt.Errorf("Error creating directory \"%s\": %s", file.Path, err.Error())
+			}
+			source += "/."
+		}
+		err = osutilCopySpecialFile(source, dest)
+		if err != nil {
+			return fmt.Errorf("Error copying \"%s\" into chroot: %s", source, err.Error())
+		}
+	} else {
 		if debug {
-			fmt.Printf("Executing command \"%s\"\n", executeCmd.String())
+			fmt.Printf("Writing file \"%s\"\n", dest)
 		}
-		executeOutput := helper.SetCommandOutput(executeCmd, debug)
-		err := executeCmd.Run()
+		err = osWriteFile(dest, []byte(file.Content), 0644)
 		if err != nil {
-			return fmt.Errorf("Error running script \"%s\". Error is %s. Full output below:\n%s",
-				executeCmd.String(), err.Error(), executeOutput.String())
+			return fmt.Errorf("Error writing \"%s\": %s", file.Path, err.Error())
 		}
 	}
+
+	if file.Mode != "" {
+		mode, err := strconv.ParseUint(file.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("Invalid mode \"%s\" for \"%s\": %s", file.Mode, file.Path, err.Error())
+		}
+		err = osChmod(dest, os.FileMode(mode))
+		if err != nil {
+			return fmt.Errorf("Error changing the mode of \"%s\": %s", file.Path, err.Error())
+		}
+	}
+
+	if file.Owner != "" || file.Group != "" {
+		// owners and groups are resolved against the users of the chroot
+		chownCmd := execCommand("chroot", targetDir, "chown")
+		if recursive {
+			chownCmd.Args = append(chownCmd.Args, "-R")
+		}
+		chownCmd.Args = append(chownCmd.Args, fmt.Sprintf("%s:%s", file.Owner, file.Group), file.Path)
+		err = runCmd(chownCmd, debug)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// manualExecute executes scripts, either in the chroot or on the host
+func manualExecute(customizations []*imagedefinition.Execute, confDefPath string, targetDir string, debug bool) error {
+	for i, c := range customizations {
+		err := executeEntry(c, confDefPath, targetDir, debug)
+		if err != nil {
+			return fmt.Errorf("Error in execute entry %d (%s): %w", i, executeName(c), err)
+		}
+	}
+	return nil
+}
+
+// executeName returns a name identifying an execute entry in messages
+func executeName(c *imagedefinition.Execute) string {
+	if c.Name != "" {
+		return c.Name
+	}
+	if c.ExecutePath != "" {
+		return c.ExecutePath
+	}
+	return "inline script"
+}
+
+// executeEntry runs a single execute entry
+func executeEntry(c *imagedefinition.Execute, confDefPath string, targetDir string, debug bool) error {
+	inChroot := c.Chroot == nil || *c.Chroot
+
+	executePath := c.ExecutePath
+	if c.Script != "" {
+		scriptPath, cleanup, err := writeExecuteScript(c.Script, inChroot, targetDir)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		executePath = scriptPath
+	} else if !inChroot && !filepath.IsAbs(executePath) {
+		executePath = filepath.Join(confDefPath, executePath)
+	}
+
+	args := append([]string{executePath}, c.Args...)
+	if inChroot {
+		args = append([]string{"chroot", targetDir}, args...)
+	}
+	if c.Timeout > 0 {
+		args = append([]string{"timeout", strconv.Itoa(c.Timeout)}, args...)
+	}
+
+	executeCmd := execCommand(args[0], args[1:]...)
+	executeCmd.Env = executeEnv(c, inChroot, targetDir)
+	if debug {
+		fmt.Printf("Executing command \"%s\"\n", executeCmd.String())
+	}
+	executeOutput := helper.SetCommandOutput(executeCmd, debug)
+	err := executeCmd.Run()
+	if err != nil {
+		// timeout exits with 124 when the command times out
+		var exitErr *exec.ExitError
+		if c.Timeout > 0 && errors.As(err, &exitErr) && exitErr.ExitCode() == 124 {
+			return fmt.Errorf("Script \"%s\" timed out after %d seconds. Full output below:\n%s",
+				executeCmd.String(), c.Timeout, executeOutput.String())
+		}
+		return fmt.Errorf("Error running script \"%s\". Error is %s. Full output below:\n%s",
+			executeCmd.String(), err.Error(), executeOutput.String())
+	}
+	return nil
+}
+
+// executeEnv returns the environment of an execute entry. Scripts run on
+// the host get the path of the rootfs in $ROOTFS
+func executeEnv(c *imagedefinition.Execute, inChroot bool, targetDir string) []string {
+	env := os.Environ()
+	keys := make([]string, 0, len(c.Env))
+	for key := range c.Env {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		env = append(env, fmt.Sprintf("%s=%s", key, c.Env[key]))
+	}
+	if !inChroot {
+		env = append(env, fmt.Sprintf("ROOTFS=%s", targetDir))
+	}
+	return env
+}
+
+// writeExecuteScript writes an inline script in a temporary directory, in
+// the chroot or on the host, and returns the path to execute it and a
+// function removing it. Scripts without a shebang are run with /bin/sh
+func writeExecuteScript(script string, inChroot bool, targetDir string) (string, func(), error) {
+	baseDir := ""
+	if inChroot {
+		baseDir = filepath.Join(targetDir, "tmp")
+	}
+	scriptDir, err := osMkdirTemp(baseDir, "ubuntu-image-execute-")
+	if err != nil {
+		return "", nil, fmt.Errorf("Error creating a directory for the script: %s", err.Error())
+	}
+	cleanup := func() { osRemoveAll(scriptDir) }
+
+	if !strings.HasPrefix(script, "#!") {
+		script = "#!/bin/sh\n" + script
+	}
+	scriptPath := filepath.Join(scriptDir, "script")
+	err = osWriteFile(scriptPath, []byte(script), 0755)
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("Error writing the script: %s", err.Error())
+	}
+
+	if inChroot {
+		scriptPath = filepath.Join("/", strings.TrimPrefix(scriptPath, filepath.Clean(targetDir)))
+	}
+	return scriptPath, cleanup, nil
+}
+
 // manualTouchFile touches files in the chroot
 func manualTouchFile(customizations []*imagedefinition.TouchFile, targetDir string, debug bool) error {
 	for _, c := range customizations {
@@ -745,6 +1039,117 @@ func manualTouchFile(customizations []*imagedefinition.TouchFile, targetDir stri
 	return nil
 }
 
+// systemdUnitDirs are the directories, relative to the rootfs, holding systemd unit files
+var systemdUnitDirs = []string{
+	filepath.Join("etc", "systemd", "system"),
+	filepath.Join("usr", "lib", "systemd", "system"),
+	filepath.Join("lib", "systemd", "system"),
+}
+
+// systemdUnitTypes are the suffixes of the systemd unit types
+var systemdUnitTypes = []string{
+	".service", ".socket", ".device", ".mount", ".automount", ".swap",
+	".target", ".path", ".timer", ".slice", ".scope",
+}
+
+// systemdUnitFileName returns the name of the file defining a unit, following
+// systemctl semantics: units without a type suffix are services and template
+// instances are defined by their template unit file
+func systemdUnitFileName(unit string) string {
+	unitType := filepath.Ext(unit)
+	if !slices.Contains(systemdUnitTypes, unitType) {
+		unitType = ".service"
+		unit += unitType
+	}
+	if at := strings.Index(unit, "@"); at != -1 {
+		unit = unit[:at+1] + unitType
+	}
+	return unit
+}
+
+// systemdUnitExists returns whether a unit is defined in the given rootfs
+func systemdUnitExists(rootfs string, unit string) bool {
+	unitFileName := systemdUnitFileName(unit)
+	for _, unitDir := range systemdUnitDirs {
+		if _, err := os.Lstat(filepath.Join(rootfs, unitDir, unitFileName)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// supportedLocalesFile lists the locales that can be generated in the rootfs
+var supportedLocalesFile = filepath.Join("usr", "share", "i18n", "SUPPORTED")
+
+// isBuiltinLocale returns whether a locale is available without being generated
+func isBuiltinLocale(locale string) bool {
+	return locale == "C" || locale == "POSIX" || strings.HasPrefix(locale, "C.")
+}
+
+// localesToGenerate returns the locales of the system customization that
+// need to be generated, without duplicates
+func localesToGenerate(system *imagedefinition.System) []string {
+	locales := make([]string, 0, len(system.Locales)+1)
+	for _, locale := range append(system.Locales, system.Locale) {
+		if locale == "" || isBuiltinLocale(locale) || slices.Contains(locales, locale) {
+			continue
+		}
+		locales = append(locales, locale)
+	}
+	return locales
+}
+
+// unsupportedLocales returns the locales that are not listed as supported in the rootfs
+func unsupportedLocales(rootfs string, locales []string) ([]string, error) {
+	supportedBytes, err := osReadFile(filepath.Join(rootfs, supportedLocalesFile))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the supported locales, is the locales package installed? %s", err.Error())
+	}
+	supported := make(map[string]bool)
+	for _, line := range strings.Split(string(supportedBytes), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			supported[fields[0]] = true
+		}
+	}
+	unsupported := make([]string, 0)
+	for _, locale := range locales {
+		if !supported[locale] {
+			unsupported = append(unsupported, locale)
+		}
+	}
+	return unsupported, nil
+}
+
+// zoneinfoPath returns the path of a timezone definition, relative to the rootfs
+func zoneinfoPath(timezone string) string {
+	return filepath.Join("usr", "share", "zoneinfo", timezone)
+}
+
+// timezoneExists returns whether a timezone is defined in the given rootfs
+func timezoneExists(rootfs string, timezone string) bool {
+	if !filepath.IsLocal(timezone) {
+		return false
+	}
+	fileInfo, err := os.Stat(filepath.Join(rootfs, zoneinfoPath(timezone)))
+	return err == nil && fileInfo.Mode().IsRegular()
+}
+
+// generateKeyboardConfiguration returns the content of /etc/default/keyboard
+func generateKeyboardConfiguration(keyboard *imagedefinition.Keyboard) string {
+	return fmt.Sprintf(`# KEYBOARD CONFIGURATION FILE
+
+# Consult the keyboard(5) manual page.
+
+XKBMODEL="%s"
+XKBLAYOUT="%s"
+XKBVARIANT="%s"
+XKBOPTIONS="%s"
+
+BACKSPACE="guess"
+`, keyboard.Model, keyboard.Layout, keyboard.Variant, keyboard.Options)
+}
+
 // manualAddGroup adds groups in the chroot
 func manualAddGroup(customizations []*imagedefinition.AddGroup, targetDir string, debug bool) error {
 	for _, c := range customizations {
@@ -778,6 +1183,7 @@ func manualAddUser(customizations []*imagedefinition.AddUser, targetDir string,
 			addUserCmd.Args = append(addUserCmd.Args, []string{"--uid", c.UserID}...)
 			debugStatement = fmt.Sprintf("%s with UID %s\n", strings.TrimSpace(debugStatement), c.UserID)
 		}
+		addUserCmd.Args = append(addUserCmd.Args, userAddArgs(c)...)
 
 		addUserCmds = append(addUserCmds, addUserCmd)
 
@@ -794,10 +1200,19 @@ func manualAddUser(customizations []*imagedefinition.AddUser, targetDir string,
 			addUserCmds = append(addUserCmds, chPasswordCmd)
 		}
 
-		debugStatement = fmt.Sprintf("%s, forcing reseting the password at first login\n", strings.TrimSpace(debugStatement))
-		addUserCmds = append(addUserCmds,
-			execCommand("chroot", targetDir, "passwd", "--expire", c.UserName),
-		)
+		if c.ExpirePassword == nil || *c.ExpirePassword {
+			debugStatement = fmt.Sprintf("%s, forcing reseting the password at first login\n", strings.TrimSpace(debugStatement))
+			addUserCmds = append(addUserCmds,
+				execCommand("chroot", targetDir, "passwd", "--expire", c.UserName),
+			)
+		}
+
+		if len(c.AuthorizedKeys) > 0 {
+			debugStatement = fmt.Sprintf("%s, adding SSH authorized keys\n", strings.TrimSpace(debugStatement))
+			authorizedKeysCmd := execCommand("chroot", targetDir, "sh", "-c", addAuthorizedKeysScript, "sh", c.UserName)
+			authorizedKeysCmd.Stdin = strings.NewReader(strings.Join(c.AuthorizedKeys, "\n") + "\n")
+			addUserCmds = append(addUserCmds, authorizedKeysCmd)
+		}
 
 		if debug {
 			fmt.Print(debugStatement)
@@ -809,11 +1224,275 @@ func manualAddUser(customizations []*imagedefinition.AddUser, targetDir string,
 				return err
 			}
 		}
+
+		if c.Sudo != nil && *c.Sudo {
+			err := addSudoersDropIn(c, targetDir)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// addAuthorizedKeysScript appends the keys read on stdin to the authorized_keys
+// file of the user given as first argument, in its home directory
+const addAuthorizedKeysScript = `set -e
+home="$(getent passwd "$1" | cut -d: -f6)"
+group="$(id -gn "$1")"
+install -d -m 0700 -o "$1" -g "$group" "$home/.ssh"
+cat >> "$home/.ssh/authorized_keys"
+chown "$1:$group" "$home/.ssh/authorized_keys"
+chmod 0600 "$home/.ssh/authorized_keys"`
+
+// userAddArgs returns the useradd arguments matching the optional settings of a user
+func userAddArgs(c *imagedefinition.AddUser) []string {
+	args := make([]string, 0)
+	if c.PrimaryGroup != "" {
+		args = append(args, "--gid", c.PrimaryGroup)
+	}
+	if len(c.Groups) > 0 {
+		args = append(args, "--groups", strings.Join(c.Groups, ","))
+	}
+	if c.Shell != "" {
+		args = append(args, "--shell", c.Shell)
+	}
+	if c.HomeDir != "" {
+		args = append(args, "--home-dir", c.HomeDir)
 	}
+	// authorized keys are stored in the home directory, so make sure it exists
+	if c.HomeDir != "" || len(c.AuthorizedKeys) > 0 {
+		args = append(args, "--create-home")
+	}
+	if c.System != nil && *c.System {
+		args = append(args, "--system")
+	}
+	return args
+}
 
+// sudoersDropInPath returns the path of the sudoers drop-in of a user. sudo
+// ignores files in /etc/sudoers.d containing a "."
+func sudoersDropInPath(userName string) string {
+	return filepath.Join("etc", "sudoers.d", "90-ubuntu-image-"+strings.ReplaceAll(userName, ".", "_"))
+}
+
+// addSudoersDropIn allows a user to run any command with sudo
+func addSudoersDropIn(c *imagedefinition.AddUser, targetDir string) error {
+	rule := "ALL=(ALL:ALL) ALL"
+	if c.SudoNoPassword != nil && *c.SudoNoPassword {
+		rule = "ALL=(ALL:ALL) NOPASSWD: ALL"
+	}
+	sudoersPath := filepath.Join(targetDir, sudoersDropInPath(c.UserName))
+	err := osMkdirAll(filepath.Dir(sudoersPath), 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating sudoers.d directory: %s", err.Error())
+	}
+	err = osWriteFile(sudoersPath, []byte(fmt.Sprintf("%s %s\n", c.UserName, rule)), 0440)
+	if err != nil {
+		return fmt.Errorf("Error writing sudoers file for user %s: %s", c.UserName, err.Error())
+	}
 	return nil
 }
 
+// installerLayerSeed returns the seed whose packages are added by an installer
+// layer. Layers are named after the seeds they stack, such as "minimal.standard"
+func installerLayerSeed(layer string) string {
+	return layer[strings.LastIndex(layer, ".")+1:]
+}
+
+// baseLayerSeeds returns the seeds installed in the rootfs, that is the
+// first layer of an installer image, excluding the seeds of the upper layers
+func baseLayerSeeds(seedNames []string, layers []string) []string {
+	upperSeeds := make([]string, 0, len(layers))
+	for _, layer := range layers[1:] {
+		upperSeeds = append(upperSeeds, installerLayerSeed(layer))
+	}
+	baseSeeds := make([]string, 0, len(seedNames))
+	for _, seedName := range seedNames {
+		if !slices.Contains(upperSeeds, seedName) {
+			baseSeeds = append(baseSeeds, seedName)
+		}
+	}
+	return baseSeeds
+}
+
+// mksquashfsCmd returns the command creating a squashfs image of a directory
+func mksquashfsCmd(sourceDir string, squashfsPath string) *exec.Cmd {
+	return execCommand("mksquashfs", sourceDir, squashfsPath, "-noappend", "-comp", "xz", "-xattrs")
+}
+
+// squashfsArtifactCmd returns the command creating the squashfs artifact of
+// the rootfs. Extended attributes are kept, like in rootfs tarballs
+func squashfsArtifactCmd(rootfs string, squashfsPath string, squashfs *imagedefinition.Squashfs) *exec.Cmd {
+	args := []string{rootfs, squashfsPath, "-noappend", "-comp", squashfs.Compression, "-xattrs"}
+	if squashfs.BlockSize != "" {
+		args = append(args, "-b", squashfs.BlockSize)
+	}
+	if len(squashfs.Exclude) > 0 {
+		// exclusions are relative to the rootfs and must come last
+		args = append(args, "-wildcards", "-e")
+		for _, exclude := range squashfs.Exclude {
+			args = append(args, strings.TrimPrefix(exclude, "/"))
+		}
+	}
+	return execCommand("mksquashfs", args...)
+}
+
+// checksumsFileContent returns the content of a checksums file, in the format
+// of the sha256sum and sha512sum tools, of the given files of dir
+func checksumsFileContent(dir string, files []string, newHash func() hash.Hash) (string, error) {
+	sums := &strings.Builder{}
+	for _, file := range files {
+		f, err := os.Open(filepath.Join(dir, file))
+		if err != nil {
+			return "", fmt.Errorf("Error opening file \"%s\" to calculate its checksum: %s", file, err.Error())
+		}
+		hasher := newHash()
+		_, err = io.Copy(hasher, f)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("Error calculating checksum of file \"%s\": %s", file, err.Error())
+		}
+		fmt.Fprintf(sums, "%x *%s\n", hasher.Sum(nil), file)
+	}
+	return sums.String(), nil
+}
+
+// gpgDetachSignCmd returns the command creating a detached OpenPGP signature
+// of a file, named after it with the .gpg extension
+func gpgDetachSignCmd(key string, gnupgHome string, path string) *exec.Cmd {
+	args := []string{"--batch", "--yes"}
+	if gnupgHome != "" {
+		args = append(args, "--homedir", gnupgHome)
+	}
+	args = append(args, "--local-user", key, "--output", path+".gpg", "--detach-sign", path)
+	return execCommand("gpg", args...)
+}
+
+// isoGrubBIOSDir is the directory of the rootfs holding the GRUB modules
+// used to boot an ISO with BIOS
+const isoGrubBIOSDir = "usr/lib/grub/i386-pc"
+
+// isoCasperScriptsDir is the directory of the rootfs holding the casper boot
+// scripts, which the initrd of an ISO needs to boot its live system
+const isoCasperScriptsDir = "usr/share/initramfs-tools/scripts/casper"
+
+// isoVolumeIDMaxLength is the maximum length of an ISO 9660 volume ID
+const isoVolumeIDMaxLength = 32
+
+// isoVolumeID returns the volume ID of the ISO artifact. It defaults to the
+// display-name, truncated to the maximum length of a volume ID
+func isoVolumeID(imageDef imagedefinition.ImageDefinition) string {
+	if imageDef.Artifacts.Iso.VolumeID != "" {
+		return imageDef.Artifacts.Iso.VolumeID
+	}
+	volumeID := ""
+	for _, r := range imageDef.DisplayName {
+		if len(volumeID)+len(string(r)) > isoVolumeIDMaxLength {
+			break
+		}
+		volumeID += string(r)
+	}
+	return strings.TrimSpace(volumeID)
+}
+
+// isoGrubConfig generates the GRUB configuration booting the casper
+// squashfs of an ISO
+func isoGrubConfig(imageDef imagedefinition.ImageDefinition) string {
+	timeout := 5
+	cmdline := []string{}
+	if imageDef.Customization != nil && imageDef.Customization.Bootloader != nil {
+		bootloader := imageDef.Customization.Bootloader
+		if bootloader.Timeout != nil {
+			timeout = *bootloader.Timeout
+		}
+		cmdline = append(cmdline, bootloader.CmdlineAppend...)
+	}
+	cmdline = append(cmdline, "---")
+
+	return fmt.Sprintf(`set timeout=%d
+
+loadfont unicode
+
+menuentry "%s" {
+	set gfxpayload=keep
+	linux	/casper/vmlinuz %s
+	initrd	/casper/initrd
+}
+`, timeout, strings.ReplaceAll(imageDef.DisplayName, `"`, `\"`), strings.Join(cmdline, " "))
+}
+
+// resolveRootfsLink returns the path of the file a path of the rootfs points
+// to, following symlinks inside of the rootfs. Absolute symlinks, such as the
+// boot/vmlinuz one, are relative to the rootfs and not to the host. The rootfs
+// can be made of several layers, topmost first, as in an overlay: each path is
+// looked up in the first layer holding it
+func resolveRootfsLink(layers []string, relPath string) (string, error) {
+	// guard against symlink loops
+	for i := 0; i < 40; i++ {
+		fullPath := filepath.Join(layers[len(layers)-1], filepath.Join("/", relPath))
+		for _, layer := range layers {
+			layerPath := filepath.Join(layer, filepath.Join("/", relPath))
+			if _, err := os.Lstat(layerPath); err == nil {
+				fullPath = layerPath
+				break
+			}
+		}
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return "", err
+			}
+			// not a symlink
+			if _, err := os.Stat(fullPath); err != nil {
+				return "", err
+			}
+			return fullPath, nil
+		}
+		if filepath.IsAbs(target) {
+			relPath = target
+		} else {
+			relPath = filepath.Join(filepath.Dir(relPath), target)
+		}
+	}
+	return "", fmt.Errorf("too many levels of symbolic links in %s", relPath)
+}
+
+// unpackSnap extracts the content of a snap file into the given directory
+func unpackSnap(snapPath string, destDir string) error {
+	return squashfs.New(snapPath).Unpack("*", destDir)
+}
+
+// downloadSnapFromStore downloads the given snap for the given architecture
+// from the store to targetDir and returns the path of the downloaded file
+func downloadSnapFromStore(name string, channel string, arch string, targetDir string) (string, error) {
+	storeConfig := store.DefaultConfig()
+	storeConfig.Architecture = arch
+	snapStore := store.New(storeConfig, nil)
+	snapContext := context.Background()
+
+	results, _, err := snapStore.SnapAction(snapContext, nil, []*store.SnapAction{{
+		Action:       "download",
+		InstanceName: name,
+		Channel:      channel,
+	}}, nil, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	if len(results) != 1 {
+		return "", fmt.Errorf("expected one result for snap %s, got %d", name, len(results))
+	}
+	info := results[0].Info
+
+	targetPath := filepath.Join(targetDir, info.Filename())
+	err = snapStore.Download(snapContext, name, targetPath, &info.DownloadInfo, progress.Null, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	return targetPath, nil
+}
+
 // getPreseedsnaps returns a slice of the snaps that were preseeded in a chroot
 // and their channels
 func getPreseededSnaps(rootfs string) (seededSnaps map[string]string, err error) {
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"slices"
 	"strings"
 	"testing"
@@ -558,7 +559,7 @@ func TestFailedManualExecute(t *testing.T) {
 			ExecutePath: "/test/does/not/exist",
 		},
 	}
-	err := manualExecute(executes, "fakedir", true)
+	err := manualExecute(executes, "", "fakedir", true)
 	asserter.AssertErrContains(err, "Error running script")
 }
 
@@ -668,6 +669,30 @@ func Test_manualAddUser(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "create a service account",
+			addUsers: []*imagedefinition.AddUser{
+				{
+					UserName:       "svc",
+					ExpirePassword: helper.BoolPtr(false),
+					PrimaryGroup:   "svc",
+					Groups:         []string{"adm", "dialout"},
+					Shell:          "/bin/bash",
+					HomeDir:        "/srv/svc",
+					System:         helper.BoolPtr(true),
+					AuthorizedKeys: []string{"ssh-ed25519 AAAA1 svc@one", "ssh-ed25519 AAAA2 svc@two"},
+				},
+			},
+			expectedCmds: []expectedCmd{
+				{
+					cmd: "/usr/sbin/chroot fakedir useradd svc --gid svc --groups adm,dialout --shell /bin/bash --home-dir /srv/svc --create-home --system",
+				},
+				{
+					cmd:   "/usr/sbin/chroot fakedir sh -c " + addAuthorizedKeysScript + " sh svc",
+					stdin: "ssh-ed25519 AAAA1 svc@one\nssh-ed25519 AAAA2 svc@two\n",
+				},
+			},
+		},
 	}
 	for _, tc := range testCases {
 		t.Run("test_generate_apt_cmd_"+tc.name, func(t *testing.T) {
@@ -702,6 +727,54 @@ func Test_manualAddUser(t *testing.T) {
 	}
 }
 
+// Test_manualAddUser_sudo tests the sudoers drop-in written for users allowed to use sudo
+func Test_manualAddUser_sudo(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	targetDir := t.TempDir()
+
+	mockCmder := NewMockRunCommand()
+	runCmd = mockCmder.runCmd
+	t.Cleanup(func() { runCmd = helper.RunCmd })
+
+	addUsers := []*imagedefinition.AddUser{
+		{
+			UserName: "admin",
+			Sudo:     helper.BoolPtr(true),
+		},
+		{
+			UserName:       "svc.deploy",
+			Sudo:           helper.BoolPtr(true),
+			SudoNoPassword: helper.BoolPtr(true),
+		},
+		{
+			UserName: "guest",
+			Sudo:     helper.BoolPtr(false),
+		},
+	}
+	err := manualAddUser(addUsers, targetDir, false)
+	asserter.AssertErrNil(err, true)
+
+	for userName, expected := range map[string]string{
+		"admin":      "admin ALL=(ALL:ALL) ALL\n",
+		"svc.deploy": "svc.deploy ALL=(ALL:ALL) NOPASSWD: ALL\n",
+	} {
+		sudoers, err := os.ReadFile(filepath.Join(targetDir, sudoersDropInPath(userName)))
+		asserter.AssertErrNil(err, true)
+		asserter.AssertEqual(expected, string(sudoers))
+	}
+	asserter.AssertEqual("etc/sudoers.d/90-ubuntu-image-svc_deploy", sudoersDropInPath("svc.deploy"))
+
+	_, err = os.Stat(filepath.Join(targetDir, sudoersDropInPath("guest")))
+	if !os.IsNotExist(err) {
+		t.Errorf("No sudoers file should have been written for guest")
+	}
+
+	osWriteFile = mockWriteFile
+	t.Cleanup(func() { osWriteFile = os.WriteFile })
+	err = manualAddUser(addUsers, targetDir, false)
+	asserter.AssertErrContains(err, "Error writing sudoers file for user admin")
+}
+
 // TestFailedManualAddUser tests the fail case of the manualAddUser function
 func TestFailedManualAddUser(t *testing.T) {
 	t.Parallel()
@@ -799,6 +872,81 @@ func Test_aptInstallChrootCmd(t *testing.T) {
 	}
 }
 
+// Test_aptRemoveChrootCmd unit tests the aptRemoveChrootCmd function
+func Test_aptRemoveChrootCmd(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name       string
+		purge      bool
+		autoremove bool
+		expected   string
+	}{
+		{"remove", false, false, "chroot chroot1 apt --assume-yes --quiet --option=Dpkg::options::=--force-unsafe-io --option=Dpkg::Options::=--force-confold remove test1 test2"},
+		{"purge", true, false, "chroot chroot1 apt --assume-yes --quiet --option=Dpkg::options::=--force-unsafe-io --option=Dpkg::Options::=--force-confold purge test1 test2"},
+		{"purge_autoremove", true, true, "chroot chroot1 apt --assume-yes --quiet --option=Dpkg::options::=--force-unsafe-io --option=Dpkg::Options::=--force-confold purge --autoremove test1 test2"},
+	}
+	for _, tc := range testCases {
+		t.Run("test_apt_remove_chroot_cmd_"+tc.name, func(t *testing.T) {
+			aptCmd := aptRemoveChrootCmd("chroot1", []string{"test1", "test2"}, tc.purge, tc.autoremove)
+			if !strings.Contains(aptCmd.String(), tc.expected) {
+				t.Errorf("Expected apt command \"%s\" but got \"%s\"", tc.expected, aptCmd.String())
+			}
+		})
+	}
+}
+
+// Test_aptMarkHoldChrootCmd unit tests the aptMarkHoldChrootCmd function
+func Test_aptMarkHoldChrootCmd(t *testing.T) {
+	expected := "chroot chroot1 apt-mark hold test1 test2"
+	aptCmd := aptMarkHoldChrootCmd("chroot1", []string{"test1", "test2"})
+	if !strings.Contains(aptCmd.String(), expected) {
+		t.Errorf("Expected apt-mark command \"%s\" but got \"%s\"", expected, aptCmd.String())
+	}
+}
+
+// Test_resolvePackageVersion unit tests the resolvePackageVersion function
+func Test_resolvePackageVersion(t *testing.T) {
+	madisonOutput := " hello | 2.10-3 | http://archive.ubuntu.com/ubuntu noble/main amd64 Packages\n" +
+		" hello | 2.10-2 | http://archive.ubuntu.com/ubuntu noble-updates/main amd64 Packages\n" +
+		" hello | 2.9-1 | http://archive.ubuntu.com/ubuntu jammy/main amd64 Packages\n"
+	execCommand = func(string, ...string) *exec.Cmd {
+		return exec.Command("printf", madisonOutput)
+	}
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	testCases := []struct {
+		name          string
+		version       string
+		expected      string
+		expectedError string
+	}{
+		{"exact_version", "2.10-2", "2.10-2", ""},
+		{"glob_version", "2.9*", "2.9-1", ""},
+		{"glob_first_match", "2.10-*", "2.10-3", ""},
+		{"unavailable_version", "3.0-1", "", "Version 3.0-1 of package hello is not available. Available versions are: 2.10-3, 2.10-2, 2.9-1"},
+		{"invalid_version", "[", "", "Invalid version [ for package hello"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			version, err := resolvePackageVersion("chroot", "hello", tc.version)
+			if tc.expectedError != "" {
+				asserter.AssertErrContains(err, tc.expectedError)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.expected, version)
+		})
+	}
+
+	execCommand = func(string, ...string) *exec.Cmd {
+		return exec.Command("false")
+	}
+	asserter := helper.Asserter{T: t}
+	_, err := resolvePackageVersion("chroot", "hello", "2.10-2")
+	asserter.AssertErrContains(err, "Error listing available versions of package hello")
+}
+
 // We had a bug where the snap manifest would contain ".snap" in the
 // revision field. This test ensures that bug stays fixed
 func TestManifestRevisionFormat(t *testing.T) {
@@ -1167,3 +1315,345 @@ func TestStateMachine_setMk2fsConf(t *testing.T) {
 		})
 	}
 }
+
+// Test_systemdUnitFileName unit tests the systemdUnitFileName function
+func Test_systemdUnitFileName(t *testing.T) {
+	tests := []struct {
+		unit string
+		want string
+	}{
+		{unit: "ssh", want: "ssh.service"},
+		{unit: "ssh.service", want: "ssh.service"},
+		{unit: "ssh.socket", want: "ssh.socket"},
+		{unit: "multi-user.target", want: "multi-user.target"},
+		{unit: "getty@tty1.service", want: "getty@.service"},
+		{unit: "getty@tty1", want: "getty@.service"},
+		{unit: "systemd-fsck@dev-disk-by\\x2dlabel-writable", want: "systemd-fsck@.service"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.unit, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			asserter.AssertEqual(tt.want, systemdUnitFileName(tt.unit))
+		})
+	}
+}
+
+func Test_localesToGenerate(t *testing.T) {
+	tests := []struct {
+		name   string
+		system *imagedefinition.System
+		want   []string
+	}{
+		{
+			name:   "default locale only",
+			system: &imagedefinition.System{Locale: "fr_FR.UTF-8"},
+			want:   []string{"fr_FR.UTF-8"},
+		},
+		{
+			name: "default locale listed",
+			system: &imagedefinition.System{
+				Locale:  "de_DE.UTF-8",
+				Locales: []string{"en_US.UTF-8", "de_DE.UTF-8"},
+			},
+			want: []string{"en_US.UTF-8", "de_DE.UTF-8"},
+		},
+		{
+			name: "builtin locales",
+			system: &imagedefinition.System{
+				Locale:  "C.UTF-8",
+				Locales: []string{"POSIX", "C"},
+			},
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			asserter.AssertEqual(tt.want, localesToGenerate(tt.system))
+		})
+	}
+}
+
+func Test_unsupportedLocales(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	rootfs := t.TempDir()
+
+	_, err := unsupportedLocales(rootfs, []string{"en_US.UTF-8"})
+	asserter.AssertErrContains(err, "is the locales package installed?")
+
+	supportedPath := filepath.Join(rootfs, supportedLocalesFile)
+	err = os.MkdirAll(filepath.Dir(supportedPath), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(supportedPath, []byte("en_US.UTF-8 UTF-8\nfr_FR ISO-8859-1\n"), 0644)
+	asserter.AssertErrNil(err, true)
+
+	unsupported, err := unsupportedLocales(rootfs, []string{"en_US.UTF-8", "fr_FR", "xx_XX.UTF-8"})
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual([]string{"xx_XX.UTF-8"}, unsupported)
+}
+
+func Test_timezoneExists(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	rootfs := t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(rootfs, zoneinfoPath("Europe")), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(rootfs, zoneinfoPath("Europe/Paris")), []byte("TZif"), 0644)
+	asserter.AssertErrNil(err, true)
+
+	asserter.AssertEqual(true, timezoneExists(rootfs, "Europe/Paris"))
+	asserter.AssertEqual(false, timezoneExists(rootfs, "Europe"))
+	asserter.AssertEqual(false, timezoneExists(rootfs, "Europe/Atlantis"))
+	asserter.AssertEqual(false, timezoneExists(rootfs, "../../../etc/passwd"))
+}
+
+// Test_customizeFile tests files are created from inline content or copied
+// from the definition directory with the requested mode and ownership
+func Test_customizeFile(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	confDefPath := t.TempDir()
+	targetDir := t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(confDefPath, "conf", "sub"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(confDefPath, "conf", "sub", "app.conf"), []byte("key=value\n"), 0600)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(confDefPath, "motd"), []byte("Welcome\n"), 0600)
+	asserter.AssertErrNil(err, true)
+
+	mockCmder := NewMockRunCommand()
+	runCmd = mockCmder.runCmd
+	t.Cleanup(func() { runCmd = helper.RunCmd })
+
+	files := []*imagedefinition.File{
+		{
+			Path:    "/etc/app/inline.conf",
+			Content: "inline=true\n",
+			Mode:    "0640",
+			Owner:   "svc",
+			Group:   "adm",
+		},
+		{
+			Path:   "/etc/motd",
+			Source: "motd",
+		},
+		{
+			Path:   "/etc/app/conf.d",
+			Source: "conf",
+			Group:  "adm",
+		},
+	}
+	for _, file := range files {
+		err = customizeFile(file, confDefPath, targetDir, false)
+		asserter.AssertErrNil(err, true)
+	}
+
+	inline, err := os.ReadFile(filepath.Join(targetDir, "etc", "app", "inline.conf"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("inline=true\n", string(inline))
+	fileInfo, err := os.Stat(filepath.Join(targetDir, "etc", "app", "inline.conf"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(os.FileMode(0640), fileInfo.Mode().Perm())
+
+	// the mode of copied files is kept unless given
+	fileInfo, err = os.Stat(filepath.Join(targetDir, "etc", "motd"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(os.FileMode(0600), fileInfo.Mode().Perm())
+
+	// directories are copied recursively, without being nested
+	copied, err := os.ReadFile(filepath.Join(targetDir, "etc", "app", "conf.d", "sub", "app.conf"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual("key=value\n", string(copied))
+
+	expectedCmds := []string{
+		fmt.Sprintf("/usr/sbin/chroot %s chown svc:adm /etc/app/inline.conf", targetDir),
+		fmt.Sprintf("/usr/sbin/chroot %s chown -R :adm /etc/app/conf.d", targetDir),
+	}
+	if len(expectedCmds) != len(mockCmder.cmds) {
+		t.Fatalf("%v commands to be executed, expected %v", len(mockCmder.cmds), len(expectedCmds))
+	}
+	for i, cmd := range mockCmder.cmds {
+		asserter.AssertEqual(expectedCmds[i], cmd.String())
+	}
+
+	err = customizeFile(&imagedefinition.File{Path: "/etc/missing", Source: "missing"}, confDefPath, targetDir, false)
+	asserter.AssertErrContains(err, "Error reading")
+
+	osWriteFile = mockWriteFile
+	t.Cleanup(func() { osWriteFile = os.WriteFile })
+	err = customizeFile(files[0], confDefPath, targetDir, false)
+	asserter.AssertErrContains(err, "Error writing \"/etc/app/inline.conf\"")
+	osWriteFile = os.WriteFile
+
+	osChmod = mockChmod
+	t.Cleanup(func() { osChmod = os.Chmod })
+	err = customizeFile(files[0], confDefPath, targetDir, false)
+	asserter.AssertErrContains(err, "Error changing the mode")
+}
+
+// Test_manualExecute_host tests scripts run on the host with their
+// arguments, environment and timeout
+func Test_manualExecute_host(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	confDefPath := t.TempDir()
+	targetDir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(confDefPath, "hook.sh"), []byte("#!/bin/sh\necho \"$1\" > \"$ROOTFS/hook\"\n"), 0755)
+	asserter.AssertErrNil(err, true)
+
+	executes := []*imagedefinition.Execute{
+		{
+			ExecutePath: "hook.sh",
+			Args:        []string{"from-file"},
+			Chroot:      helper.BoolPtr(false),
+		},
+		{
+			Name:   "inline",
+			Script: "echo \"$GREETING $1\" > \"$ROOTFS/inline\"\n",
+			Args:   []string{"world"},
+			Env:    map[string]string{"GREETING": "hello"},
+			Chroot: helper.BoolPtr(false),
+		},
+	}
+	err = manualExecute(executes, confDefPath, targetDir, false)
+	asserter.AssertErrNil(err, true)
+
+	for file, expected := range map[string]string{
+		"hook":   "from-file\n",
+		"inline": "hello world\n",
+	} {
+		content, err := os.ReadFile(filepath.Join(targetDir, file))
+		asserter.AssertErrNil(err, true)
+		asserter.AssertEqual(expected, string(content))
+	}
+
+	// failures report the entry by index and name
+	executes = []*imagedefinition.Execute{
+		executes[1],
+		{
+			Name:    "too-slow",
+			Script:  "sleep 10",
+			Timeout: 1,
+			Chroot:  helper.BoolPtr(false),
+		},
+	}
+	err = manualExecute(executes, confDefPath, targetDir, false)
+	asserter.AssertErrContains(err, "Error in execute entry 1 (too-slow): Script")
+	asserter.AssertErrContains(err, "timed out after 1 seconds")
+
+	executes = []*imagedefinition.Execute{
+		{
+			Script: "exit 3",
+			Chroot: helper.BoolPtr(false),
+		},
+	}
+	err = manualExecute(executes, confDefPath, targetDir, false)
+	asserter.AssertErrContains(err, "Error in execute entry 0 (inline script): Error running script")
+}
+
+// Test_manualExecute_chroot tests inline scripts are written in the chroot
+// and removed once executed
+func Test_manualExecute_chroot(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	targetDir := t.TempDir()
+	err := os.Mkdir(filepath.Join(targetDir, "tmp"), 0755)
+	asserter.AssertErrNil(err, true)
+
+	mockCmder := NewMockExecCommand()
+	execCommand = mockCmder.Command
+	t.Cleanup(func() { execCommand = exec.Command })
+
+	stdout, restoreStdout, err := helper.CaptureStd(&os.Stdout)
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { restoreStdout() })
+
+	executes := []*imagedefinition.Execute{
+		{
+			Script:  "echo configuring",
+			Args:    []string{"--verbose"},
+			Timeout: 60,
+		},
+		{
+			ExecutePath: "/usr/bin/update-ca-certificates",
+		},
+	}
+	err = manualExecute(executes, "", targetDir, true)
+	asserter.AssertErrNil(err, true)
+
+	restoreStdout()
+	readStdout, err := io.ReadAll(stdout)
+	asserter.AssertErrNil(err, true)
+
+	expectedCmds := []*regexp.Regexp{
+		regexp.MustCompile(fmt.Sprintf("(?m)^timeout 60 chroot %s /tmp/ubuntu-image-execute-[0-9]+/script --verbose$", targetDir)),
+		regexp.MustCompile(fmt.Sprintf("(?m)^chroot %s /usr/bin/update-ca-certificates$", targetDir)),
+	}
+	for _, expected := range expectedCmds {
+		if !expected.Match(readStdout) {
+			t.Errorf("Expected a command matching %s, got:\n%s", expected.String(), readStdout)
+		}
+	}
+
+	scriptDirs, err := os.ReadDir(filepath.Join(targetDir, "tmp"))
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(0, len(scriptDirs))
+
+	osMkdirTemp = mockMkdirTemp
+	t.Cleanup(func() { osMkdirTemp = os.MkdirTemp })
+	err = manualExecute(executes, "", targetDir, true)
+	asserter.AssertErrContains(err, "Error in execute entry 0 (inline script): Error creating a directory for the script")
+}
+
+func Test_baseLayerSeeds(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	asserter.AssertEqual("minimal", installerLayerSeed("minimal"))
+	asserter.AssertEqual("live", installerLayerSeed("minimal.standard.live"))
+	asserter.AssertEqual(
+		[]string{"server-minimal", "minimal"},
+		baseLayerSeeds(
+			[]string{"server-minimal", "minimal", "standard", "live"},
+			[]string{"minimal", "minimal.standard", "minimal.standard.live"},
+		),
+	)
+}
+
+// Test_resolveRootfsLink tests symlinks are followed inside of the rootfs
+func Test_resolveRootfsLink(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	rootfs := t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(rootfs, "boot"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(rootfs, "boot", "vmlinuz-6.8.0-31-generic"), []byte(""), 0644)
+	asserter.AssertErrNil(err, true)
+	for link, target := range map[string]string{
+		"boot/vmlinuz":     "vmlinuz-6.8.0-31-generic",
+		"boot/vmlinuz.old": "/boot/vmlinuz",
+		"boot/escape":      "../../../../vmlinuz-6.8.0-31-generic",
+		"boot/loop":        "loop",
+	} {
+		err = os.Symlink(target, filepath.Join(rootfs, link))
+		asserter.AssertErrNil(err, true)
+	}
+
+	expected := filepath.Join(rootfs, "boot", "vmlinuz-6.8.0-31-generic")
+	for _, link := range []string{"boot/vmlinuz", "boot/vmlinuz.old", "boot/vmlinuz-6.8.0-31-generic"} {
+		resolved, err := resolveRootfsLink([]string{rootfs}, link)
+		asserter.AssertErrNil(err, true)
+		asserter.AssertEqual(expected, resolved)
+	}
+
+	_, err = resolveRootfsLink([]string{rootfs}, "boot/escape")
+	asserter.AssertErrContains(err, "no such file or directory")
+	_, err = resolveRootfsLink([]string{rootfs}, "boot/loop")
+	asserter.AssertErrContains(err, "too many levels of symbolic links")
+	// paths are looked up in the topmost layer holding them
+	upper := t.TempDir()
+	err = os.MkdirAll(filepath.Join(upper, "boot"), 0755)
+	asserter.AssertErrNil(err, true)
+	err = os.WriteFile(filepath.Join(upper, "boot", "vmlinuz-6.8.0-31-generic"), []byte(""), 0644)
+	asserter.AssertErrNil(err, true)
+	resolved, err := resolveRootfsLink([]string{upper, rootfs}, "boot/vmlinuz")
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(filepath.Join(upper, "boot", "vmlinuz-6.8.0-31-generic"), resolved)
+}
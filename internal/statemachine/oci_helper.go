@@ -0,0 +1,401 @@
+package statemachine
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/xattr"
+
+	"github.com/canonical/ubuntu-image/internal/arch"
+	"github.com/canonical/ubuntu-image/internal/imagedefinition"
+)
+
+const (
+	ociMediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+	ociMediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	ociMediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	ociMediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	ociDefaultTag        = "latest"
+)
+
+// ociBootContent are the directories whose content is left out of OCI
+// images when requested, as containers use the kernel of their host
+var ociBootContent = []string{
+	"boot",
+	"lib/firmware",
+	"lib/modules",
+	"usr/lib/firmware",
+	"usr/lib/modules",
+}
+
+// ociPlatform is the platform an OCI image runs on
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// ociPlatformFromArch returns the OCI platform of a Debian architecture
+func ociPlatformFromArch(architecture string) ociPlatform {
+	platform := ociPlatform{Architecture: architecture, OS: "linux"}
+	switch architecture {
+	case arch.ARMHF:
+		platform.Architecture = "arm"
+		platform.Variant = "v7"
+	case arch.ARM64:
+		platform.Variant = "v8"
+	case arch.I386:
+		platform.Architecture = "386"
+	case arch.PPC64EL:
+		platform.Architecture = "ppc64le"
+	}
+	return platform
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type ociContainerConfig struct {
+	Entrypoint []string          `json:"Entrypoint,omitempty"`
+	Cmd        []string          `json:"Cmd,omitempty"`
+	Env        []string          `json:"Env,omitempty"`
+	Labels     map[string]string `json:"Labels,omitempty"`
+}
+
+type ociRootfs struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type ociHistory struct {
+	Created   string `json:"created"`
+	CreatedBy string `json:"created_by"`
+}
+
+type ociImageConfig struct {
+	Created string `json:"created"`
+	ociPlatform
+	Config  ociContainerConfig `json:"config"`
+	Rootfs  ociRootfs          `json:"rootfs"`
+	History []ociHistory       `json:"history"`
+}
+
+// ociImageConfigFromArtifact returns the OCI image configuration of an oci
+// artifact, whose single layer has the given uncompressed digest
+func ociImageConfigFromArtifact(oci imagedefinition.Oci, platform ociPlatform, diffID string, created time.Time) ociImageConfig {
+	env := make([]string, 0, len(oci.Env))
+	for name, value := range oci.Env {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+
+	return ociImageConfig{
+		Created:     created.UTC().Format(time.RFC3339),
+		ociPlatform: platform,
+		Config: ociContainerConfig{
+			Entrypoint: oci.Entrypoint,
+			Cmd:        oci.Cmd,
+			Env:        env,
+			Labels:     oci.Labels,
+		},
+		Rootfs: ociRootfs{Type: "layers", DiffIDs: []string{diffID}},
+		History: []ociHistory{{
+			Created:   created.UTC().Format(time.RFC3339),
+			CreatedBy: "ubuntu-image",
+		}},
+	}
+}
+
+// writeOCIBlob writes a JSON document to the blobs of an OCI image layout and
+// returns its descriptor
+func writeOCIBlob(layoutDir string, mediaType string, doc any) (ociDescriptor, error) {
+	content, err := json.Marshal(doc)
+	if err != nil {
+		return ociDescriptor{}, fmt.Errorf("Error encoding %s: %s", mediaType, err.Error())
+	}
+	digest := fmt.Sprintf("%x", sha256.Sum256(content))
+	err = osWriteFile(filepath.Join(layoutDir, "blobs", "sha256", digest), content, 0644)
+	if err != nil {
+		return ociDescriptor{}, fmt.Errorf("Error writing %s blob: %s", mediaType, err.Error())
+	}
+	return ociDescriptor{MediaType: mediaType, Digest: "sha256:" + digest, Size: int64(len(content))}, nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.count += int64(len(p))
+	return len(p), nil
+}
+
+// writeOCILayer writes the gzipped tar layer of the rootfs to the blobs of an
+// OCI image layout. It returns the descriptor of the layer and the digest of
+// its uncompressed content
+func writeOCILayer(layoutDir string, rootfs string, exclude []string, sourceDateEpoch *time.Time) (ociDescriptor, string, error) {
+	blobsDir := filepath.Join(layoutDir, "blobs", "sha256")
+	layerFile, err := osCreate(filepath.Join(blobsDir, "layer.tar.gz"))
+	if err != nil {
+		return ociDescriptor{}, "", fmt.Errorf("Error creating OCI layer: %s", err.Error())
+	}
+	defer layerFile.Close()
+
+	digestHasher := sha256.New()
+	size := &countingWriter{}
+	gzipWriter := gzip.NewWriter(io.MultiWriter(layerFile, digestHasher, size))
+	diffIDHasher := sha256.New()
+	err = writeTarFromDir(io.MultiWriter(gzipWriter, diffIDHasher), rootfs, exclude, sourceDateEpoch)
+	if err != nil {
+		return ociDescriptor{}, "", fmt.Errorf("Error writing OCI layer: %s", err.Error())
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return ociDescriptor{}, "", fmt.Errorf("Error compressing OCI layer: %s", err.Error())
+	}
+
+	digest := hexSum(digestHasher)
+	err = osRename(layerFile.Name(), filepath.Join(blobsDir, digest))
+	if err != nil {
+		return ociDescriptor{}, "", fmt.Errorf("Error moving OCI layer: %s", err.Error())
+	}
+	layer := ociDescriptor{MediaType: ociMediaTypeLayer, Digest: "sha256:" + digest, Size: size.count}
+	return layer, "sha256:" + hexSum(diffIDHasher), nil
+}
+
+// hexSum returns the hexadecimal sum of a hash
+func hexSum(h hash.Hash) string {
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// writeOCILayout writes an OCI image layout of the rootfs to layoutDir, holding
+// a single layer image configured as described by the oci artifact. The
+// modification times of the layer are clamped to sourceDateEpoch if it is set
+func writeOCILayout(layoutDir string, rootfs string, oci imagedefinition.Oci, architecture string, created time.Time, sourceDateEpoch *time.Time) error {
+	err := osMkdirAll(filepath.Join(layoutDir, "blobs", "sha256"), 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating OCI image layout directory: %s", err.Error())
+	}
+
+	exclude := make([]string, 0)
+	if oci.ExcludeBootContent != nil && *oci.ExcludeBootContent {
+		exclude = ociBootContent
+	}
+	layer, diffID, err := writeOCILayer(layoutDir, rootfs, exclude, sourceDateEpoch)
+	if err != nil {
+		return err
+	}
+
+	platform := ociPlatformFromArch(architecture)
+	config, err := writeOCIBlob(layoutDir, ociMediaTypeConfig, ociImageConfigFromArtifact(oci, platform, diffID, created))
+	if err != nil {
+		return err
+	}
+	manifest, err := writeOCIBlob(layoutDir, ociMediaTypeManifest, ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociMediaTypeManifest,
+		Config:        config,
+		Layers:        []ociDescriptor{layer},
+		Annotations: map[string]string{
+			"org.opencontainers.image.created": created.UTC().Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	tag := oci.Tag
+	if tag == "" {
+		tag = ociDefaultTag
+	}
+	manifest.Annotations = map[string]string{"org.opencontainers.image.ref.name": tag}
+	manifest.Platform = &platform
+	index, err := json.Marshal(ociIndex{
+		SchemaVersion: 2,
+		MediaType:     ociMediaTypeIndex,
+		Manifests:     []ociDescriptor{manifest},
+	})
+	if err != nil {
+		return fmt.Errorf("Error encoding OCI image index: %s", err.Error())
+	}
+
+	for name, content := range map[string][]byte{
+		"index.json": index,
+		"oci-layout": []byte(`{"imageLayoutVersion":"1.0.0"}`),
+	} {
+		err := osWriteFile(filepath.Join(layoutDir, name), content, 0644)
+		if err != nil {
+			return fmt.Errorf("Error writing %s of the OCI image layout: %s", name, err.Error())
+		}
+	}
+	return nil
+}
+
+// removeOCILayout removes the OCI image layout of a previous build in
+// layoutDir. Directories which are not an OCI image layout are left untouched
+func removeOCILayout(layoutDir string) error {
+	_, err := os.Lstat(layoutDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = os.Lstat(filepath.Join(layoutDir, "oci-layout"))
+	if err != nil {
+		return fmt.Errorf("%s exists and is not an OCI image layout", layoutDir)
+	}
+	return osRemoveAll(layoutDir)
+}
+
+// isExcludedFromTar returns whether the content of one of the exclude
+// directories holds the relative path
+func isExcludedFromTar(relPath string, exclude []string) bool {
+	for _, dir := range exclude {
+		if strings.HasPrefix(relPath, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTarFromDir writes a PAX tar archive of the content of a directory,
+// preserving ownership, permissions, hard links, device files and extended
+// attributes. The content of the exclude directories, relative to dir, is
+// left out of it. If sourceDateEpoch is set, modification times are clamped
+// to it and access and change times are left out
+func writeTarFromDir(w io.Writer, dir string, exclude []string, sourceDateEpoch *time.Time) error {
+	tarWriter := tar.NewWriter(w)
+	hardLinks := make(map[uint64]string)
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepathRel(dir, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		if isExcludedFromTar(relPath, exclude) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// sockets cannot be archived, they are created by running programs
+		if d.Type()&fs.ModeSocket != 0 {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		linkTarget := ""
+		if d.Type()&fs.ModeSymlink != 0 {
+			linkTarget, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, linkTarget)
+		if err != nil {
+			return err
+		}
+		header.Name = relPath
+		if d.IsDir() {
+			header.Name += "/"
+		}
+		// the owners are only known by their IDs in the rootfs
+		header.Uname = ""
+		header.Gname = ""
+		header.Format = tar.FormatPAX
+		if sourceDateEpoch != nil {
+			if header.ModTime.After(*sourceDateEpoch) {
+				header.ModTime = *sourceDateEpoch
+			}
+			header.AccessTime = time.Time{}
+			header.ChangeTime = time.Time{}
+		}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && stat.Nlink > 1 {
+			if target, found := hardLinks[stat.Ino]; found {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = target
+				header.Size = 0
+			} else {
+				hardLinks[stat.Ino] = relPath
+			}
+		}
+
+		xattrs, err := xattr.LList(path)
+		if err != nil && !errors.Is(err, syscall.ENOTSUP) {
+			return err
+		}
+		for _, name := range xattrs {
+			value, err := xattr.LGet(path, name)
+			if err != nil {
+				return err
+			}
+			if header.PAXRecords == nil {
+				header.PAXRecords = make(map[string]string)
+			}
+			header.PAXRecords["SCHILY.xattr."+name] = string(value)
+		}
+
+		err = tarWriter.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		f, err := osOpen(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tarWriter, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tarWriter.Close()
+}
@@ -0,0 +1,84 @@
+package statemachine
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// Test_writeTarFromDir checks the content of a directory is archived with its
+// symlinks and hard links, and the content of the excluded directories left out
+func Test_writeTarFromDir(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	dir := t.TempDir()
+	for _, subDir := range []string{"boot", "etc", filepath.Join("usr", "lib", "modules", "6.8.0")} {
+		err := os.MkdirAll(filepath.Join(dir, subDir), 0755)
+		asserter.AssertErrNil(err, true)
+	}
+	for file, content := range map[string]string{
+		filepath.Join("boot", "vmlinuz"):                           "kernel",
+		filepath.Join("etc", "hostname"):                           "ubuntu",
+		filepath.Join("usr", "lib", "modules", "6.8.0", "modules"): "modules",
+	} {
+		err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0644)
+		asserter.AssertErrNil(err, true)
+	}
+	err := os.Link(filepath.Join(dir, "etc", "hostname"), filepath.Join(dir, "etc", "hostname.link"))
+	asserter.AssertErrNil(err, true)
+	err = os.Symlink("hostname", filepath.Join(dir, "etc", "hostname.symlink"))
+	asserter.AssertErrNil(err, true)
+
+	archive := &bytes.Buffer{}
+	err = writeTarFromDir(archive, dir, []string{"boot", "usr/lib/modules"}, nil)
+	asserter.AssertErrNil(err, true)
+
+	entries := make(map[string]*tar.Header)
+	names := make([]string, 0)
+	tarReader := tar.NewReader(archive)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		asserter.AssertErrNil(err, true)
+		entries[header.Name] = header
+		names = append(names, header.Name)
+	}
+
+	asserter.AssertEqual([]string{
+		"boot/",
+		"etc/",
+		"etc/hostname",
+		"etc/hostname.link",
+		"etc/hostname.symlink",
+		"usr/",
+		"usr/lib/",
+		"usr/lib/modules/",
+	}, names)
+	asserter.AssertEqual(byte(tar.TypeLink), entries["etc/hostname.link"].Typeflag)
+	asserter.AssertEqual("etc/hostname", entries["etc/hostname.link"].Linkname)
+	asserter.AssertEqual(byte(tar.TypeSymlink), entries["etc/hostname.symlink"].Typeflag)
+	asserter.AssertEqual("hostname", entries["etc/hostname.symlink"].Linkname)
+	asserter.AssertEqual("", entries["etc/hostname"].Uname)
+
+	// with SOURCE_DATE_EPOCH, the archive only depends on the content
+	sourceDateEpoch := time.Unix(1700000000, 0)
+	archives := make([][]byte, 0)
+	for _, mtime := range []time.Time{time.Now(), time.Now().Add(time.Hour)} {
+		err = os.Chtimes(filepath.Join(dir, "etc", "hostname"), mtime, mtime)
+		asserter.AssertErrNil(err, true)
+		archive := &bytes.Buffer{}
+		err = writeTarFromDir(archive, dir, nil, &sourceDateEpoch)
+		asserter.AssertErrNil(err, true)
+		archives = append(archives, archive.Bytes())
+	}
+	if !bytes.Equal(archives[0], archives[1]) {
+		t.Error("Archives of the same content with the same SOURCE_DATE_EPOCH differ")
+	}
+}
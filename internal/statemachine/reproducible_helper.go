@@ -0,0 +1,206 @@
+package statemachine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/snapcore/snapd/gadget"
+	"golang.org/x/sys/unix"
+)
+
+// sourceDateEpochEnv is the environment variable holding the timestamp to use
+// for reproducible builds, as described in https://reproducible-builds.org/specs/source-date-epoch/
+const sourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// e2fsprogsFakeTimeEnv makes the e2fsprogs tools use a fixed time instead of the current one
+const e2fsprogsFakeTimeEnv = "E2FSPROGS_FAKE_TIME"
+
+// Offsets of the fields of the boot sector of a FAT filesystem
+const (
+	fatBytesPerSectorOffset = 11
+	fat32BackupBootOffset   = 50
+	fat32FsTypeOffset       = 82
+	fat16VolumeIDOffset     = 39
+	fat32VolumeIDOffset     = 67
+)
+
+// setReproducibility enables reproducible builds when --reproducible is passed or
+// SOURCE_DATE_EPOCH is set. The timestamps of the build are then set to
+// SOURCE_DATE_EPOCH, or to the Unix epoch if it is not set, and the identifiers
+// usually generated randomly are derived from the definition file and this time
+func (stateMachine *StateMachine) setReproducibility(definitionPath string) error {
+	epochValue := osGetenv(sourceDateEpochEnv)
+	if epochValue == "" && !stateMachine.commonFlags.Reproducible {
+		return nil
+	}
+	var epoch int64
+	if epochValue != "" {
+		var err error
+		epoch, err = strconv.ParseInt(epochValue, 10, 64)
+		if err != nil || epoch < 0 {
+			return fmt.Errorf("Invalid value for %s: \"%s\". It must be a number of seconds since the Unix epoch",
+				sourceDateEpochEnv, epochValue)
+		}
+	}
+
+	definition, err := osReadFile(definitionPath)
+	if err != nil {
+		return fmt.Errorf("Error reading \"%s\" to derive the identifiers of the build: %s",
+			definitionPath, err.Error())
+	}
+	sourceDateEpoch := time.Unix(epoch, 0).UTC()
+	stateMachine.sourceDateEpoch = &sourceDateEpoch
+	stateMachine.buildNamespace = uuid.NewSHA1(uuid.Nil,
+		append(definition, []byte(strconv.FormatInt(epoch, 10))...))
+
+	// make the tools we call (mkfs, mcopy, mksquashfs, xorriso...) use the same
+	// time. e2fsprogs ignore a fake time of 0, so the closest one is used instead
+	fakeTime := max(epoch, 1)
+	for name, value := range map[string]string{
+		sourceDateEpochEnv:   strconv.FormatInt(epoch, 10),
+		e2fsprogsFakeTimeEnv: strconv.FormatInt(fakeTime, 10),
+	} {
+		err := osSetenv(name, value)
+		if err != nil {
+			return fmt.Errorf("Error setting %s: %s", name, err.Error())
+		}
+	}
+	return nil
+}
+
+// buildTime returns the time to record in the artifacts of the build
+func (stateMachine *StateMachine) buildTime() time.Time {
+	if stateMachine.sourceDateEpoch != nil {
+		return *stateMachine.sourceDateEpoch
+	}
+	return timeNow()
+}
+
+// buildUUID returns a random UUID, or for reproducible builds a UUID derived
+// from the build and the given names identifying what it is used for
+func (stateMachine *StateMachine) buildUUID(names ...string) uuid.UUID {
+	if stateMachine.sourceDateEpoch == nil {
+		return uuid.New()
+	}
+	return uuid.NewSHA1(stateMachine.buildNamespace, []byte(strings.Join(names, "/")))
+}
+
+// mbrDiskID returns the identifier to write in the MBR of a volume
+func (stateMachine *StateMachine) mbrDiskID(volumeName string) ([]byte, error) {
+	if stateMachine.sourceDateEpoch == nil {
+		var existingDiskIds [][]byte
+		return generateUniqueDiskID(&existingDiskIds)
+	}
+	diskID := stateMachine.buildUUID("mbr", volumeName)
+	return diskID[:4], nil
+}
+
+var clampRootfsMtimesState = stateFunc{"clamp_rootfs_mtimes", (*StateMachine).clampRootfsMtimes}
+
+// clampRootfsMtimes makes sure no file of the rootfs is more recent than SOURCE_DATE_EPOCH
+func (stateMachine *StateMachine) clampRootfsMtimes() error {
+	err := clampMtimes(stateMachine.tempDirs.rootfs, *stateMachine.sourceDateEpoch)
+	if err != nil {
+		return fmt.Errorf("Error clamping the modification times of the rootfs: %s", err.Error())
+	}
+	return nil
+}
+
+// clampMtimes sets the modification time of the files of dir more recent than
+// limit to limit. A missing dir has nothing to clamp
+func clampMtimes(dir string, limit time.Time) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().After(limit) {
+			return nil
+		}
+		limitTimeval := unix.NsecToTimeval(limit.UnixNano())
+		return unix.Lutimes(path, []unix.Timeval{limitTimeval, limitTimeval})
+	})
+}
+
+// setFilesystemID replaces the random identifiers mkfs gave to the filesystem
+// of a structure with ones derived from the build
+func (stateMachine *StateMachine) setFilesystemID(structure *gadget.VolumeStructure, partImg string) error {
+	structureID := []string{structure.VolumeName, strconv.Itoa(structure.YamlIndex)}
+	fsUUID := stateMachine.buildUUID(append([]string{"filesystem"}, structureID...)...)
+
+	switch {
+	case strings.HasPrefix(structure.Filesystem, "ext"):
+		hashSeed := stateMachine.buildUUID(append([]string{"hash_seed"}, structureID...)...)
+		// the journal keeps a copy of the UUID of the filesystem it was created
+		// in, so it is recreated once the new UUID is set. mkfs.ext4 -d only
+		// creates linear directories, so the hash seed can safely be changed
+		cmds := []*exec.Cmd{
+			execCommand("tune2fs", "-O", "^has_journal", partImg),
+			execCommand("tune2fs", "-U", fsUUID.String(), partImg),
+			execCommand("debugfs", "-w", "-R", "ssv hash_seed "+hashSeed.String(), partImg),
+			execCommand("tune2fs", "-j", partImg),
+		}
+		for _, cmd := range cmds {
+			err := runCmd(cmd, stateMachine.commonFlags.Debug)
+			if err != nil {
+				return fmt.Errorf("Error setting the identifiers of the filesystem \"%s\": %s",
+					partImg, err.Error())
+			}
+		}
+	case strings.HasPrefix(structure.Filesystem, "vfat"):
+		err := setVfatVolumeID(partImg, fsUUID[:4])
+		if err != nil {
+			return fmt.Errorf("Error setting the volume ID of the filesystem \"%s\": %s",
+				partImg, err.Error())
+		}
+	}
+	return nil
+}
+
+// setVfatVolumeID writes the volume ID of a FAT filesystem in its boot sector,
+// and in the backup of the boot sector of FAT32 filesystems
+func setVfatVolumeID(partImg string, volumeID []byte) error {
+	partFile, err := osOpenFile(partImg, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer partFile.Close()
+
+	bootSector := make([]byte, 512)
+	_, err = partFile.ReadAt(bootSector, 0)
+	if err != nil {
+		return err
+	}
+
+	offsets := []int64{fat16VolumeIDOffset}
+	if strings.HasPrefix(string(bootSector[fat32FsTypeOffset:]), "FAT32") {
+		bytesPerSector := binary.LittleEndian.Uint16(bootSector[fatBytesPerSectorOffset:])
+		backupBootSector := binary.LittleEndian.Uint16(bootSector[fat32BackupBootOffset:])
+		offsets = []int64{
+			fat32VolumeIDOffset,
+			int64(backupBootSector)*int64(bytesPerSector) + fat32VolumeIDOffset,
+		}
+	}
+	for _, offset := range offsets {
+		_, err := partFile.WriteAt(volumeID, offset)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
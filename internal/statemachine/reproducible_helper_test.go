@@ -0,0 +1,296 @@
+package statemachine
+
+import (
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/snapcore/snapd/gadget"
+	"github.com/snapcore/snapd/gadget/quantity"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+	"github.com/canonical/ubuntu-image/internal/testhelper"
+)
+
+// TestStateMachine_setReproducibility tests when reproducible builds are
+// enabled, with which time, and that this time is exported to the tools
+func TestStateMachine_setReproducibility(t *testing.T) {
+	definition := filepath.Join("testdata", "image_definitions", "test_oci.yaml")
+	tests := []struct {
+		name         string
+		reproducible bool
+		env          map[string]string
+		definition   string
+		wantEnabled  bool
+		wantEpoch    int64
+		wantEnv      map[string]string
+		expectedErr  string
+	}{
+		{
+			name:       "not reproducible",
+			env:        map[string]string{},
+			definition: definition,
+			wantEnv:    map[string]string{},
+		},
+		{
+			name:         "--reproducible without SOURCE_DATE_EPOCH",
+			reproducible: true,
+			env:          map[string]string{},
+			definition:   definition,
+			wantEnabled:  true,
+			wantEpoch:    0,
+			wantEnv: map[string]string{
+				"SOURCE_DATE_EPOCH":   "0",
+				"E2FSPROGS_FAKE_TIME": "1",
+			},
+		},
+		{
+			name:        "SOURCE_DATE_EPOCH set",
+			env:         map[string]string{"SOURCE_DATE_EPOCH": "1700000000"},
+			definition:  definition,
+			wantEnabled: true,
+			wantEpoch:   1700000000,
+			wantEnv: map[string]string{
+				"SOURCE_DATE_EPOCH":   "1700000000",
+				"E2FSPROGS_FAKE_TIME": "1700000000",
+			},
+		},
+		{
+			name:        "invalid SOURCE_DATE_EPOCH",
+			env:         map[string]string{"SOURCE_DATE_EPOCH": "yesterday"},
+			definition:  definition,
+			expectedErr: "Invalid value for SOURCE_DATE_EPOCH",
+		},
+		{
+			name:        "negative SOURCE_DATE_EPOCH",
+			env:         map[string]string{"SOURCE_DATE_EPOCH": "-1"},
+			definition:  definition,
+			expectedErr: "Invalid value for SOURCE_DATE_EPOCH",
+		},
+		{
+			name:         "missing definition",
+			reproducible: true,
+			env:          map[string]string{},
+			definition:   filepath.Join("testdata", "image_definitions", "missing.yaml"),
+			expectedErr:  "to derive the identifiers of the build",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			envHolder := &mockEnvHolder{env: tc.env, mockGetenv: true, mockSetenv: true}
+			osGetenv = envHolder.Getenv
+			osSetenv = envHolder.Setenv
+			t.Cleanup(func() {
+				osGetenv = os.Getenv
+				osSetenv = os.Setenv
+			})
+
+			var stateMachine StateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.commonFlags.Reproducible = tc.reproducible
+
+			err := stateMachine.setReproducibility(tc.definition)
+			if tc.expectedErr != "" {
+				asserter.AssertErrContains(err, tc.expectedErr)
+				return
+			}
+			asserter.AssertErrNil(err, true)
+			asserter.AssertEqual(tc.wantEnv, envHolder.env)
+			if !tc.wantEnabled {
+				if stateMachine.sourceDateEpoch != nil {
+					t.Errorf("Reproducible builds are enabled, but should not be")
+				}
+				return
+			}
+			asserter.AssertEqual(tc.wantEpoch, stateMachine.sourceDateEpoch.Unix())
+			asserter.AssertEqual(time.Unix(tc.wantEpoch, 0).UTC(), stateMachine.buildTime())
+		})
+	}
+}
+
+// TestStateMachine_buildUUID tests that the identifiers of reproducible builds
+// only depend on the definition, SOURCE_DATE_EPOCH and what they are used for
+func TestStateMachine_buildUUID(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	t.Cleanup(func() {
+		osGetenv = os.Getenv
+		osSetenv = os.Setenv
+	})
+
+	newStateMachine := func(definition string, epoch string) *StateMachine {
+		envHolder := &mockEnvHolder{env: map[string]string{"SOURCE_DATE_EPOCH": epoch}, mockGetenv: true, mockSetenv: true}
+		osGetenv = envHolder.Getenv
+		osSetenv = envHolder.Setenv
+		var stateMachine StateMachine
+		stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+		err := stateMachine.setReproducibility(filepath.Join("testdata", "image_definitions", definition))
+		asserter.AssertErrNil(err, true)
+		return &stateMachine
+	}
+
+	stateMachine := newStateMachine("test_oci.yaml", "1700000000")
+	sameStateMachine := newStateMachine("test_oci.yaml", "1700000000")
+	otherEpochStateMachine := newStateMachine("test_oci.yaml", "1700000001")
+	otherDefinitionStateMachine := newStateMachine("test_sbom.yaml", "1700000000")
+
+	asserter.AssertEqual(stateMachine.buildUUID("gpt", "pc"), sameStateMachine.buildUUID("gpt", "pc"))
+	if stateMachine.buildUUID("gpt", "pc") == stateMachine.buildUUID("gpt", "pc", "0") {
+		t.Error("The identifiers used for different purposes must differ")
+	}
+	if stateMachine.buildUUID("gpt", "pc") == otherEpochStateMachine.buildUUID("gpt", "pc") {
+		t.Error("The identifiers of builds with a different SOURCE_DATE_EPOCH must differ")
+	}
+	if stateMachine.buildUUID("gpt", "pc") == otherDefinitionStateMachine.buildUUID("gpt", "pc") {
+		t.Error("The identifiers of builds of a different definition must differ")
+	}
+
+	diskID, err := stateMachine.mbrDiskID("pc")
+	asserter.AssertErrNil(err, true)
+	sameDiskID, err := sameStateMachine.mbrDiskID("pc")
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(diskID, sameDiskID)
+
+	// builds which are not reproducible keep random identifiers
+	var randomStateMachine StateMachine
+	if randomStateMachine.buildUUID("gpt", "pc") == randomStateMachine.buildUUID("gpt", "pc") {
+		t.Error("The identifiers of builds which are not reproducible must be random")
+	}
+}
+
+// Test_clampMtimes tests that only the files more recent than the limit are clamped
+func Test_clampMtimes(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	dir, err := os.MkdirTemp(testhelper.DefaultTmpDir, "ubuntu-image-clamp-")
+	asserter.AssertErrNil(err, true)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	limit := time.Unix(1700000000, 0)
+	older := time.Unix(1600000000, 0)
+	err = os.MkdirAll(filepath.Join(dir, "etc"), 0755)
+	asserter.AssertErrNil(err, true)
+	for _, file := range []string{"etc/recent", "etc/older"} {
+		err = os.WriteFile(filepath.Join(dir, file), []byte(file), 0644)
+		asserter.AssertErrNil(err, true)
+	}
+	err = os.Chtimes(filepath.Join(dir, "etc", "older"), older, older)
+	asserter.AssertErrNil(err, true)
+	err = os.Symlink("recent", filepath.Join(dir, "etc", "link"))
+	asserter.AssertErrNil(err, true)
+
+	err = clampMtimes(dir, limit)
+	asserter.AssertErrNil(err, true)
+
+	for file, want := range map[string]time.Time{
+		".":          limit,
+		"etc":        limit,
+		"etc/recent": limit,
+		"etc/link":   limit,
+		"etc/older":  older,
+	} {
+		info, err := os.Lstat(filepath.Join(dir, file))
+		asserter.AssertErrNil(err, true)
+		if !info.ModTime().Equal(want) {
+			t.Errorf("Modification time of \"%s\" is %s instead of %s", file, info.ModTime(), want)
+		}
+	}
+
+	// a missing directory has nothing to clamp
+	err = clampMtimes(filepath.Join(dir, "missing"), limit)
+	asserter.AssertErrNil(err, true)
+}
+
+// Test_setVfatVolumeID tests the volume ID is written at the right offsets
+// for FAT16 and FAT32 filesystems
+func Test_setVfatVolumeID(t *testing.T) {
+	tests := []struct {
+		name        string
+		fsType      string
+		wantOffsets []int64
+	}{
+		{
+			name:        "FAT16",
+			fsType:      "FAT16   ",
+			wantOffsets: []int64{39},
+		},
+		{
+			name:        "FAT32",
+			fsType:      "FAT32   ",
+			wantOffsets: []int64{67, 6*512 + 67},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			partImg := filepath.Join(t.TempDir(), "part.img")
+			bootSector := make([]byte, 8*512)
+			binary.LittleEndian.PutUint16(bootSector[11:], 512)
+			if tc.fsType == "FAT32   " {
+				binary.LittleEndian.PutUint16(bootSector[50:], 6)
+				copy(bootSector[82:], tc.fsType)
+			} else {
+				copy(bootSector[54:], tc.fsType)
+			}
+			err := os.WriteFile(partImg, bootSector, 0644)
+			asserter.AssertErrNil(err, true)
+
+			volumeID := []byte{0xde, 0xad, 0xbe, 0xef}
+			err = setVfatVolumeID(partImg, volumeID)
+			asserter.AssertErrNil(err, true)
+
+			got, err := os.ReadFile(partImg)
+			asserter.AssertErrNil(err, true)
+			for _, offset := range tc.wantOffsets {
+				asserter.AssertEqual(volumeID, got[offset:offset+4])
+			}
+		})
+	}
+}
+
+// TestStateMachine_setFilesystemID tests the identifiers of an ext4
+// filesystem are replaced with ones derived from the build
+func TestStateMachine_setFilesystemID(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	t.Cleanup(func() {
+		osGetenv = os.Getenv
+		osSetenv = os.Setenv
+	})
+	envHolder := &mockEnvHolder{env: map[string]string{"SOURCE_DATE_EPOCH": "1700000000"}, mockGetenv: true, mockSetenv: true}
+	osGetenv = envHolder.Getenv
+	osSetenv = envHolder.Setenv
+
+	var stateMachine StateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	err := stateMachine.setReproducibility(filepath.Join("testdata", "image_definitions", "test_oci.yaml"))
+	asserter.AssertErrNil(err, true)
+
+	structure := &gadget.VolumeStructure{VolumeName: "pc", Filesystem: "ext4", YamlIndex: 2}
+	partImg := filepath.Join(t.TempDir(), "part2.img")
+	err = os.WriteFile(partImg, nil, 0644)
+	asserter.AssertErrNil(err, true)
+	err = os.Truncate(partImg, int64(8*quantity.SizeMiB))
+	asserter.AssertErrNil(err, true)
+	err = mkfsMake(structure.Filesystem, partImg, "", 8*quantity.SizeMiB, 512)
+	asserter.AssertErrNil(err, true)
+
+	err = stateMachine.setFilesystemID(structure, partImg)
+	asserter.AssertErrNil(err, true)
+
+	superblock, err := exec.Command("dumpe2fs", "-h", partImg).Output()
+	asserter.AssertErrNil(err, true)
+	fields := make(map[string]string)
+	for _, line := range strings.Split(string(superblock), "\n") {
+		field, value, found := strings.Cut(line, ":")
+		if found {
+			fields[field] = strings.TrimSpace(value)
+		}
+	}
+	asserter.AssertEqual(stateMachine.buildUUID("filesystem", "pc", "2").String(), fields["Filesystem UUID"])
+	asserter.AssertEqual(stateMachine.buildUUID("hash_seed", "pc", "2").String(), fields["Directory Hash Seed"])
+	err = exec.Command("e2fsck", "-fn", partImg).Run()
+	asserter.AssertErrNil(err, true)
+}
@@ -0,0 +1,571 @@
+package statemachine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/snapcore/snapd/seed"
+	"github.com/snapcore/snapd/timings"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+const (
+	sbomFormatSPDX      = "spdx"
+	sbomFormatCycloneDX = "cyclonedx"
+)
+
+// sbomFileNames are the names of the SBOMs of snap images, in the output directory
+var sbomFileNames = map[string]string{
+	sbomFormatSPDX:      "sbom.spdx.json",
+	sbomFormatCycloneDX: "sbom.cdx.json",
+}
+
+// debianCopyrightFormat is the Format field of machine-readable debian/copyright
+// files, without its scheme as both http:// and https:// are used
+const debianCopyrightFormat = "www.debian.org/doc/packaging-manuals/copyright-format/1.0"
+
+// sbomDebPackage is a Debian binary package installed in an image, along with
+// the source package it was built from and the licenses it is distributed under
+type sbomDebPackage struct {
+	Name          string
+	Version       string
+	Architecture  string
+	Source        string
+	SourceVersion string
+	Licenses      []string
+	Local         bool
+}
+
+// sbomSnap is a snap seeded in an image
+type sbomSnap struct {
+	Name     string
+	Revision string
+	Channel  string
+}
+
+// sbomImage holds the content of an image to describe in its SBOM
+type sbomImage struct {
+	Name         string
+	Version      string
+	Architecture string
+	Series       string
+	Packages     []sbomDebPackage
+	Snaps        []sbomSnap
+}
+
+// listSBOMDebPackages lists the Debian packages installed in the rootfs, with
+// their source package and the licenses found in their copyright file
+func listSBOMDebPackages(rootfs string, localPackages []string, debug bool) ([]sbomDebPackage, error) {
+	adminDir := filepath.Join(rootfs, "var", "lib", "dpkg")
+	cmd := execCommand("dpkg-query", "--show", fmt.Sprintf("--admindir=%s", adminDir),
+		"--showformat=${db:Status-Abbrev}${Package}\t${Version}\t${Architecture}\t${source:Package}\t${source:Version}\n")
+	cmdOutput := helper.SetCommandOutput(cmd, debug)
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Error generating package list with command \"%s\". "+
+			"Error is \"%s\". Full output below:\n%s",
+			cmd.String(), err.Error(), cmdOutput.String())
+	}
+
+	packages := make([]sbomDebPackage, 0)
+	scanner := bufio.NewScanner(strings.NewReader(string(installedPackagesOnly(cmdOutput.Bytes()))))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("Error parsing package list line \"%s\"", scanner.Text())
+		}
+		licenses, err := debianCopyrightLicenses(rootfs, fields[0])
+		if err != nil {
+			return nil, err
+		}
+		packages = append(packages, sbomDebPackage{
+			Name:          fields[0],
+			Version:       fields[1],
+			Architecture:  fields[2],
+			Source:        fields[3],
+			SourceVersion: fields[4],
+			Licenses:      licenses,
+			Local:         helper.SliceHasElement(localPackages, fields[0]),
+		})
+	}
+	return packages, nil
+}
+
+// debianCopyrightLicenses returns the sorted licenses listed in the copyright file
+// of a package. Only machine-readable copyright files can be parsed, no license
+// is returned for the other ones
+func debianCopyrightLicenses(rootfs string, packageName string) ([]string, error) {
+	copyrightPath := filepath.Join(rootfs, "usr", "share", "doc", packageName, "copyright")
+	copyright, err := osReadFile(copyrightPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Error reading copyright file of package %s: %s", packageName, err.Error())
+	}
+
+	lines := strings.Split(string(copyright), "\n")
+	format, found := strings.CutPrefix(lines[0], "Format:")
+	if !found {
+		return nil, nil
+	}
+	format = strings.TrimSuffix(strings.TrimSpace(format), "/")
+	_, format, _ = strings.Cut(format, "://")
+	if format != debianCopyrightFormat {
+		return nil, nil
+	}
+
+	licenses := make([]string, 0)
+	for _, line := range lines {
+		// the first line of a License field is the license name, the
+		// following indented ones are its text
+		fieldName, value, found := strings.Cut(line, ":")
+		if !found || !strings.EqualFold(fieldName, "License") {
+			continue
+		}
+		license := strings.TrimSpace(value)
+		if license != "" && !helper.SliceHasElement(licenses, license) {
+			licenses = append(licenses, license)
+		}
+	}
+	sort.Strings(licenses)
+	return licenses, nil
+}
+
+// listSBOMSeededSnaps lists the snaps of the seed in seedDir, if any
+func listSBOMSeededSnaps(seedDir string, label string) ([]sbomSnap, error) {
+	snaps := make([]sbomSnap, 0)
+	if _, err := os.Stat(seedDir); errors.Is(err, fs.ErrNotExist) {
+		return snaps, nil
+	}
+
+	preseed, err := seedOpen(seedDir, label)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening the seed file: %w", err)
+	}
+	err = preseed.LoadAssertions(nil, nil)
+	if err != nil {
+		if err != seed.ErrNoAssertions {
+			return nil, fmt.Errorf("Error loading assertions: %w", err)
+		}
+	} else {
+		measurer := timings.New(nil)
+		if err := preseed.LoadMeta(seed.AllModes, nil, measurer); err != nil {
+			return nil, fmt.Errorf("Error loading meta-data: %w", err)
+		}
+	}
+
+	err = preseed.Iter(func(sn *seed.Snap) error {
+		base := strings.TrimSuffix(filepath.Base(sn.Path), ".snap")
+		idx := strings.LastIndex(base, "_")
+		if idx == -1 {
+			return fmt.Errorf("Error parsing snap filename %q: expected format <name>_<revision>.snap", sn.Path)
+		}
+		snaps = append(snaps, sbomSnap{
+			Name:     sn.SnapName(),
+			Revision: base[idx+1:],
+			Channel:  sn.Channel,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snaps, nil
+}
+
+// purlEscape percent-encodes a purl component, as required by the purl spec
+func purlEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// debPurl returns the package URL of a Debian package of the Ubuntu archive
+func debPurl(name string, version string, architecture string, series string) string {
+	purl := fmt.Sprintf("pkg:deb/ubuntu/%s@%s?arch=%s", purlEscape(name), purlEscape(version), purlEscape(architecture))
+	if series != "" {
+		purl += "&distro=" + purlEscape(series)
+	}
+	return purl
+}
+
+var spdxIDInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+
+// spdxID returns an SPDX identifier made of the given parts
+func spdxID(parts ...string) string {
+	return "SPDXRef-" + spdxIDInvalidChars.ReplaceAllString(strings.Join(parts, "-"), "-")
+}
+
+// spdxLicenseRef returns the SPDX reference to a license named in a debian/copyright file
+func spdxLicenseRef(license string) string {
+	license = strings.ReplaceAll(license, "+", "-or-later")
+	return "LicenseRef-" + strings.Trim(spdxIDInvalidChars.ReplaceAllString(license, "-"), "-")
+}
+
+// spdxLicenseExpression converts a license of a debian/copyright file, which may
+// combine several licenses with "and" and "or", to an SPDX license expression.
+// The licenses it references are added to refs
+func spdxLicenseExpression(license string, refs map[string]string) string {
+	terms := make([]string, 0)
+	name := make([]string, 0)
+	addName := func() {
+		if len(name) > 0 {
+			ref := spdxLicenseRef(strings.Join(name, " "))
+			refs[ref] = strings.Join(name, " ")
+			terms = append(terms, ref)
+			name = name[:0]
+		}
+	}
+	for _, word := range strings.Fields(strings.ReplaceAll(license, ",", " ")) {
+		if strings.EqualFold(word, "and") || strings.EqualFold(word, "or") {
+			addName()
+			terms = append(terms, strings.ToUpper(word))
+			continue
+		}
+		name = append(name, word)
+	}
+	addName()
+	return strings.Join(terms, " ")
+}
+
+type spdxDocument struct {
+	SPDXVersion                string                 `json:"spdxVersion"`
+	DataLicense                string                 `json:"dataLicense"`
+	SPDXID                     string                 `json:"SPDXID"`
+	Name                       string                 `json:"name"`
+	DocumentNamespace          string                 `json:"documentNamespace"`
+	CreationInfo               spdxCreationInfo       `json:"creationInfo"`
+	Packages                   []spdxPackage          `json:"packages"`
+	Relationships              []spdxRelationship     `json:"relationships"`
+	HasExtractedLicensingInfos []spdxExtractedLicense `json:"hasExtractedLicensingInfos,omitempty"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	SPDXID                string            `json:"SPDXID"`
+	Name                  string            `json:"name"`
+	VersionInfo           string            `json:"versionInfo,omitempty"`
+	DownloadLocation      string            `json:"downloadLocation"`
+	FilesAnalyzed         bool              `json:"filesAnalyzed"`
+	LicenseConcluded      string            `json:"licenseConcluded"`
+	LicenseDeclared       string            `json:"licenseDeclared"`
+	CopyrightText         string            `json:"copyrightText"`
+	Comment               string            `json:"comment,omitempty"`
+	PrimaryPackagePurpose string            `json:"primaryPackagePurpose,omitempty"`
+	ExternalRefs          []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+type spdxExtractedLicense struct {
+	LicenseID     string `json:"licenseId"`
+	Name          string `json:"name"`
+	ExtractedText string `json:"extractedText"`
+}
+
+// newSPDXPackage returns an SPDX package with no assertion about its origin,
+// license and copyright
+func newSPDXPackage(id string, name string, version string) spdxPackage {
+	return spdxPackage{
+		SPDXID:           id,
+		Name:             name,
+		VersionInfo:      version,
+		DownloadLocation: "NOASSERTION",
+		LicenseConcluded: "NOASSERTION",
+		LicenseDeclared:  "NOASSERTION",
+		CopyrightText:    "NOASSERTION",
+	}
+}
+
+// purlExternalRefs returns the external references of a package with the given purl
+func purlExternalRefs(purl string) []spdxExternalRef {
+	return []spdxExternalRef{{
+		ReferenceCategory: "PACKAGE-MANAGER",
+		ReferenceType:     "purl",
+		ReferenceLocator:  purl,
+	}}
+}
+
+// generateSPDX generates an SPDX 2.3 JSON document describing the image
+func generateSPDX(image sbomImage, created time.Time, documentID uuid.UUID) ([]byte, error) {
+	imageID := spdxID("Image", image.Name)
+	imagePackage := newSPDXPackage(imageID, image.Name, image.Version)
+	imagePackage.PrimaryPackagePurpose = "OPERATING-SYSTEM"
+	doc := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              image.Name,
+		DocumentNamespace: fmt.Sprintf("https://ubuntu.com/spdxdocs/%s-%s", url.PathEscape(image.Name), documentID.String()),
+		CreationInfo: spdxCreationInfo{
+			Created:  created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: ubuntu-image"},
+		},
+		Packages: []spdxPackage{imagePackage},
+		Relationships: []spdxRelationship{
+			{SPDXElementID: "SPDXRef-DOCUMENT", RelationshipType: "DESCRIBES", RelatedSPDXElement: imageID},
+		},
+	}
+
+	licenseRefs := make(map[string]string)
+	sourceIDs := make(map[string]bool)
+	for _, pkg := range image.Packages {
+		binaryID := spdxID("DebianBinary", pkg.Name, pkg.Architecture, pkg.Version)
+		binary := newSPDXPackage(binaryID, pkg.Name, pkg.Version)
+		if pkg.Local {
+			binary.Comment = "Installed from a local .deb file"
+		} else {
+			binary.ExternalRefs = purlExternalRefs(debPurl(pkg.Name, pkg.Version, pkg.Architecture, image.Series))
+		}
+		if len(pkg.Licenses) > 0 {
+			expressions := make([]string, 0, len(pkg.Licenses))
+			for _, license := range pkg.Licenses {
+				expression := spdxLicenseExpression(license, licenseRefs)
+				if len(pkg.Licenses) > 1 && strings.Contains(expression, " ") {
+					expression = "(" + expression + ")"
+				}
+				expressions = append(expressions, expression)
+			}
+			binary.LicenseDeclared = strings.Join(expressions, " AND ")
+		}
+		doc.Packages = append(doc.Packages, binary)
+		doc.Relationships = append(doc.Relationships,
+			spdxRelationship{SPDXElementID: imageID, RelationshipType: "CONTAINS", RelatedSPDXElement: binaryID})
+
+		if pkg.Source == "" {
+			continue
+		}
+		sourceID := spdxID("DebianSource", pkg.Source, pkg.SourceVersion)
+		if !sourceIDs[sourceID] {
+			sourceIDs[sourceID] = true
+			source := newSPDXPackage(sourceID, pkg.Source, pkg.SourceVersion)
+			source.PrimaryPackagePurpose = "SOURCE"
+			if !pkg.Local {
+				source.ExternalRefs = purlExternalRefs(debPurl(pkg.Source, pkg.SourceVersion, "source", image.Series))
+			}
+			doc.Packages = append(doc.Packages, source)
+		}
+		doc.Relationships = append(doc.Relationships,
+			spdxRelationship{SPDXElementID: binaryID, RelationshipType: "GENERATED_FROM", RelatedSPDXElement: sourceID})
+	}
+
+	for _, sn := range image.Snaps {
+		snapID := spdxID("Snap", sn.Name, sn.Revision)
+		snapPackage := newSPDXPackage(snapID, sn.Name, sn.Revision)
+		snapPackage.PrimaryPackagePurpose = "APPLICATION"
+		if sn.Channel != "" {
+			snapPackage.Comment = "Channel: " + sn.Channel
+		}
+		doc.Packages = append(doc.Packages, snapPackage)
+		doc.Relationships = append(doc.Relationships,
+			spdxRelationship{SPDXElementID: imageID, RelationshipType: "CONTAINS", RelatedSPDXElement: snapID})
+	}
+
+	refs := make([]string, 0, len(licenseRefs))
+	for ref := range licenseRefs {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	for _, ref := range refs {
+		doc.HasExtractedLicensingInfos = append(doc.HasExtractedLicensingInfos, spdxExtractedLicense{
+			LicenseID:     ref,
+			Name:          licenseRefs[ref],
+			ExtractedText: fmt.Sprintf("License \"%s\" as named in machine-readable debian/copyright files", licenseRefs[ref]),
+		})
+	}
+
+	return marshalSBOM(doc)
+}
+
+type cycloneDXDocument struct {
+	BOMFormat    string                `json:"bomFormat"`
+	SpecVersion  string                `json:"specVersion"`
+	SerialNumber string                `json:"serialNumber"`
+	Version      int                   `json:"version"`
+	Metadata     cycloneDXMetadata     `json:"metadata"`
+	Components   []cycloneDXComponent  `json:"components"`
+	Dependencies []cycloneDXDependency `json:"dependencies"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string             `json:"timestamp"`
+	Tools     cycloneDXTools     `json:"tools"`
+	Component cycloneDXComponent `json:"component"`
+}
+
+type cycloneDXTools struct {
+	Components []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXComponent struct {
+	Type       string              `json:"type"`
+	BOMRef     string              `json:"bom-ref,omitempty"`
+	Name       string              `json:"name"`
+	Version    string              `json:"version,omitempty"`
+	PURL       string              `json:"purl,omitempty"`
+	Licenses   []cycloneDXLicense  `json:"licenses,omitempty"`
+	Properties []cycloneDXProperty `json:"properties,omitempty"`
+	Pedigree   *cycloneDXPedigree  `json:"pedigree,omitempty"`
+}
+
+type cycloneDXLicense struct {
+	License cycloneDXLicenseName `json:"license"`
+}
+
+type cycloneDXLicenseName struct {
+	Name string `json:"name"`
+}
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cycloneDXPedigree struct {
+	Ancestors []cycloneDXComponent `json:"ancestors"`
+}
+
+type cycloneDXDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+// generateCycloneDX generates a CycloneDX 1.5 JSON document describing the image.
+// Source packages are the pedigree ancestors of the binary packages built from them
+func generateCycloneDX(image sbomImage, created time.Time, documentID uuid.UUID) ([]byte, error) {
+	imageRef := "image:" + image.Name
+	doc := cycloneDXDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: documentID.URN(),
+		Version:      1,
+		Metadata: cycloneDXMetadata{
+			Timestamp: created.UTC().Format(time.RFC3339),
+			Tools: cycloneDXTools{
+				Components: []cycloneDXComponent{{Type: "application", Name: "ubuntu-image"}},
+			},
+			Component: cycloneDXComponent{
+				Type:    "operating-system",
+				BOMRef:  imageRef,
+				Name:    image.Name,
+				Version: image.Version,
+			},
+		},
+		Components: make([]cycloneDXComponent, 0, len(image.Packages)+len(image.Snaps)),
+	}
+	imageDependency := cycloneDXDependency{Ref: imageRef, DependsOn: make([]string, 0)}
+
+	for _, pkg := range image.Packages {
+		component := cycloneDXComponent{
+			Type:    "library",
+			BOMRef:  fmt.Sprintf("deb:%s:%s@%s", pkg.Name, pkg.Architecture, pkg.Version),
+			Name:    pkg.Name,
+			Version: pkg.Version,
+			Properties: []cycloneDXProperty{
+				{Name: "ubuntu-image:deb:architecture", Value: pkg.Architecture},
+			},
+		}
+		if pkg.Local {
+			component.Properties = append(component.Properties, cycloneDXProperty{Name: "ubuntu-image:deb:local", Value: "true"})
+		} else {
+			component.PURL = debPurl(pkg.Name, pkg.Version, pkg.Architecture, image.Series)
+		}
+		for _, license := range pkg.Licenses {
+			component.Licenses = append(component.Licenses, cycloneDXLicense{License: cycloneDXLicenseName{Name: license}})
+		}
+		if pkg.Source != "" {
+			source := cycloneDXComponent{
+				Type:    "library",
+				BOMRef:  fmt.Sprintf("deb-source:%s@%s", pkg.Source, pkg.SourceVersion),
+				Name:    pkg.Source,
+				Version: pkg.SourceVersion,
+			}
+			if !pkg.Local {
+				source.PURL = debPurl(pkg.Source, pkg.SourceVersion, "source", image.Series)
+			}
+			component.Pedigree = &cycloneDXPedigree{Ancestors: []cycloneDXComponent{source}}
+		}
+		doc.Components = append(doc.Components, component)
+		imageDependency.DependsOn = append(imageDependency.DependsOn, component.BOMRef)
+	}
+
+	for _, sn := range image.Snaps {
+		component := cycloneDXComponent{
+			Type:    "application",
+			BOMRef:  fmt.Sprintf("snap:%s@%s", sn.Name, sn.Revision),
+			Name:    sn.Name,
+			Version: sn.Revision,
+		}
+		if sn.Channel != "" {
+			component.Properties = []cycloneDXProperty{{Name: "ubuntu-image:snap:channel", Value: sn.Channel}}
+		}
+		doc.Components = append(doc.Components, component)
+		imageDependency.DependsOn = append(imageDependency.DependsOn, component.BOMRef)
+	}
+	doc.Dependencies = []cycloneDXDependency{imageDependency}
+
+	return marshalSBOM(doc)
+}
+
+// marshalSBOM encodes an SBOM document to indented JSON, leaving the "&"
+// separating the qualifiers of purls unescaped
+func marshalSBOM(doc any) ([]byte, error) {
+	sbom := &bytes.Buffer{}
+	encoder := json.NewEncoder(sbom)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(doc)
+	if err != nil {
+		return nil, err
+	}
+	return sbom.Bytes(), nil
+}
+
+// writeSBOM writes the SBOM of the image in the given format to outputPath,
+// created at the given time and identified by documentID
+func writeSBOM(image sbomImage, format string, outputPath string, created time.Time, documentID uuid.UUID) error {
+	var sbom []byte
+	var err error
+	switch format {
+	case sbomFormatSPDX:
+		sbom, err = generateSPDX(image, created, documentID)
+	case sbomFormatCycloneDX:
+		sbom, err = generateCycloneDX(image, created, documentID)
+	default:
+		return fmt.Errorf("Unknown SBOM format: \"%s\"", format)
+	}
+	if err != nil {
+		return fmt.Errorf("Error generating %s SBOM: %s", format, err.Error())
+	}
+
+	err = osWriteFile(outputPath, sbom, 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing SBOM file \"%s\": %s", outputPath, err.Error())
+	}
+	return nil
+}
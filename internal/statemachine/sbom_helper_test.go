@@ -0,0 +1,82 @@
+package statemachine
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/ubuntu-image/internal/helper"
+)
+
+// Test_spdxLicenseExpression checks the licenses of debian/copyright files
+// are converted to SPDX license expressions of license references
+func Test_spdxLicenseExpression(t *testing.T) {
+	testCases := []struct {
+		name         string
+		license      string
+		expected     string
+		expectedRefs map[string]string
+	}{
+		{"single", "MIT", "LicenseRef-MIT", map[string]string{"LicenseRef-MIT": "MIT"}},
+		{
+			"or_later",
+			"GPL-2+ or Artistic",
+			"LicenseRef-GPL-2-or-later OR LicenseRef-Artistic",
+			map[string]string{"LicenseRef-GPL-2-or-later": "GPL-2+", "LicenseRef-Artistic": "Artistic"},
+		},
+		{
+			"exception",
+			"GPL-3+ with OpenSSL exception, and BSD-3-clause",
+			"LicenseRef-GPL-3-or-later-with-OpenSSL-exception AND LicenseRef-BSD-3-clause",
+			map[string]string{
+				"LicenseRef-GPL-3-or-later-with-OpenSSL-exception": "GPL-3+ with OpenSSL exception",
+				"LicenseRef-BSD-3-clause":                          "BSD-3-clause",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			refs := make(map[string]string)
+			asserter.AssertEqual(tc.expected, spdxLicenseExpression(tc.license, refs))
+			if !reflect.DeepEqual(tc.expectedRefs, refs) {
+				t.Errorf("Expected license references %v, got %v", tc.expectedRefs, refs)
+			}
+		})
+	}
+}
+
+// Test_debianCopyrightLicenses checks licenses are only read from
+// machine-readable copyright files
+func Test_debianCopyrightLicenses(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	rootfs := t.TempDir()
+	for pkg, copyright := range map[string]string{
+		"machine-readable": "Format: https://www.debian.org/doc/packaging-manuals/copyright-format/1.0/\n\n" +
+			"Files: *\nLicense: LGPL-2.1+\n\nFiles: debian/*\nLicense: GPL-2+\n\nLicense: LGPL-2.1+\n On Debian systems...\n",
+		"machine-readable-http": "Format: http://www.debian.org/doc/packaging-manuals/copyright-format/1.0/\n\n" +
+			"Files: *\nLicense: LGPL-2.1+\n\nFiles: debian/*\nLicense: GPL-2+\n",
+		"free-form": "This package was debianized by someone.\n\nLicense: GPL-2+\n",
+	} {
+		docDir := filepath.Join(rootfs, "usr", "share", "doc", pkg)
+		err := os.MkdirAll(docDir, 0755)
+		asserter.AssertErrNil(err, true)
+		err = os.WriteFile(filepath.Join(docDir, "copyright"), []byte(copyright), 0644)
+		asserter.AssertErrNil(err, true)
+	}
+
+	for _, pkg := range []string{"machine-readable", "machine-readable-http"} {
+		licenses, err := debianCopyrightLicenses(rootfs, pkg)
+		asserter.AssertErrNil(err, true)
+		asserter.AssertEqual([]string{"GPL-2+", "LGPL-2.1+"}, licenses)
+	}
+
+	for _, pkg := range []string{"free-form", "missing"} {
+		licenses, err := debianCopyrightLicenses(rootfs, pkg)
+		asserter.AssertErrNil(err, true)
+		if len(licenses) != 0 {
+			t.Errorf("Expected no license for package %s, got %v", pkg, licenses)
+		}
+	}
+}
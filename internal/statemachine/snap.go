@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"slices"
 
 	"github.com/snapcore/snapd/asserts"
 
@@ -38,6 +39,9 @@ func (snapStateMachine *SnapStateMachine) Setup() error {
 
 	// set the states that will be used for this image type
 	snapStateMachine.states = snapStates
+	if len(snapStateMachine.Opts.SBOMFormats) > 0 {
+		snapStateMachine.states = append(slices.Clone(snapStates), generateSnapSBOMState)
+	}
 
 	if err := snapStateMachine.setConfDefDir(snapStateMachine.parent.(*SnapStateMachine).Args.ModelAssertion); err != nil {
 		return err
@@ -48,6 +52,10 @@ func (snapStateMachine *SnapStateMachine) Setup() error {
 		return err
 	}
 
+	if err := snapStateMachine.setReproducibility(snapStateMachine.Args.ModelAssertion); err != nil {
+		return err
+	}
+
 	// validate values of until and thru
 	if err := snapStateMachine.validateUntilThru(); err != nil {
 		return err
@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/snapcore/snapd/asserts"
@@ -209,3 +210,58 @@ func (stateMachine *StateMachine) generateSnapManifest() error {
 	snapsDir := filepath.Join(stateMachine.tempDirs.rootfs, "system-data", "var", "lib", "snapd", "snaps")
 	return WriteSnapManifest(snapsDir, outputPath)
 }
+
+var generateSnapSBOMState = stateFunc{"generate_snap_sbom", (*StateMachine).generateSnapSBOM}
+
+// generateSnapSBOM generates the software bills of materials of the snaps
+// seeded by prepare_image
+func (stateMachine *StateMachine) generateSnapSBOM() error {
+	snapStateMachine := stateMachine.parent.(*SnapStateMachine)
+
+	model, err := snapStateMachine.decodeModelAssertion()
+	if err != nil {
+		return err
+	}
+	seedDir, label, err := stateMachine.snapSeedDirAndLabel()
+	if err != nil {
+		return err
+	}
+	snaps, err := listSBOMSeededSnaps(seedDir, label)
+	if err != nil {
+		return err
+	}
+
+	image := sbomImage{
+		Name:         model.BrandID() + "-" + model.Model(),
+		Version:      strconv.Itoa(model.Revision()),
+		Architecture: model.Architecture(),
+		Series:       stateMachine.series,
+		Snaps:        snaps,
+	}
+	for _, format := range snapStateMachine.Opts.SBOMFormats {
+		err := writeSBOM(image, format, filepath.Join(stateMachine.commonFlags.OutputDir, sbomFileNames[format]),
+			stateMachine.buildTime(), stateMachine.buildUUID("sbom", sbomFileNames[format]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapSeedDirAndLabel returns the directory of the seed written by prepare_image
+// and, for UC20+ images, the label of its only system
+func (stateMachine *StateMachine) snapSeedDirAndLabel() (string, string, error) {
+	if !stateMachine.IsSeeded {
+		return filepath.Join(stateMachine.tempDirs.unpack, "image", "var", "lib", "snapd", "seed"), "", nil
+	}
+
+	seedDir := filepath.Join(stateMachine.tempDirs.unpack, "system-seed")
+	systems, err := osReadDir(filepath.Join(seedDir, "systems"))
+	if err != nil {
+		return "", "", fmt.Errorf("Error reading the systems of the seed: %s", err.Error())
+	}
+	if len(systems) != 1 {
+		return "", "", fmt.Errorf("Expected exactly one system in the seed, found %d", len(systems))
+	}
+	return seedDir, systems[0].Name(), nil
+}
@@ -17,6 +17,8 @@ import (
 
 	"github.com/snapcore/snapd/asserts"
 	"github.com/snapcore/snapd/image"
+	"github.com/snapcore/snapd/seed"
+	"github.com/snapcore/snapd/snap"
 	"github.com/snapcore/snapd/store"
 
 	"github.com/canonical/ubuntu-image/internal/arch"
@@ -597,6 +599,125 @@ func TestGenerateSnapManifest(t *testing.T) {
 	}
 }
 
+// TestGenerateSnapSBOM tests the SBOMs of snap images list the snaps of the seed
+func TestGenerateSnapSBOM(t *testing.T) {
+	testCases := []struct {
+		name          string
+		seeded        bool
+		expectedDir   string
+		expectedLabel string
+	}{
+		{"generate_snap_sbom_regular", false, filepath.Join("image", "var", "lib", "snapd", "seed"), ""},
+		{"generate_snap_sbom_seeded", true, "system-seed", "20240101"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asserter := helper.Asserter{T: t}
+			workDir := t.TempDir()
+
+			var stateMachine SnapStateMachine
+			stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+			stateMachine.parent = &stateMachine
+			stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+			stateMachine.Opts.SBOMFormats = []string{"spdx", "cyclonedx"}
+			stateMachine.series = "20.04"
+			stateMachine.IsSeeded = tc.seeded
+			stateMachine.tempDirs.unpack = filepath.Join(workDir, "unpack")
+			stateMachine.commonFlags.OutputDir = filepath.Join(workDir, "output")
+			err := os.MkdirAll(stateMachine.commonFlags.OutputDir, 0755)
+			asserter.AssertErrNil(err, true)
+			err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.unpack, "system-seed", "systems", "20240101"), 0755)
+			asserter.AssertErrNil(err, true)
+
+			seedOpen = func(seedDir string, label string) (seed.Seed, error) {
+				asserter.AssertEqual(filepath.Join(stateMachine.tempDirs.unpack, tc.expectedDir), seedDir)
+				asserter.AssertEqual(tc.expectedLabel, label)
+				return &mockSeed{
+					snaps: []*seed.Snap{
+						{
+							Path:     "snaps/pc-kernel_1234.snap",
+							SideInfo: &snap.SideInfo{RealName: "pc-kernel", Revision: snap.R(1234)},
+							Channel:  "20/stable",
+						},
+					},
+				}, nil
+			}
+			t.Cleanup(func() { seedOpen = seed.Open })
+			err = os.MkdirAll(filepath.Join(stateMachine.tempDirs.unpack, tc.expectedDir), 0755)
+			asserter.AssertErrNil(err, true)
+
+			err = stateMachine.generateSnapSBOM()
+			asserter.AssertErrNil(err, true)
+
+			spdx, err := os.ReadFile(filepath.Join(stateMachine.commonFlags.OutputDir, "sbom.spdx.json"))
+			asserter.AssertErrNil(err, true)
+			for _, expected := range []string{
+				`"name": "canonical-ubuntu-core-20-amd64"`,
+				`"SPDXID": "SPDXRef-Snap-pc-kernel-1234"`,
+				`"comment": "Channel: 20/stable"`,
+			} {
+				if !strings.Contains(string(spdx), expected) {
+					t.Errorf("Expected %s in the SPDX SBOM, got:\n%s", expected, spdx)
+				}
+			}
+			cyclonedx, err := os.ReadFile(filepath.Join(stateMachine.commonFlags.OutputDir, "sbom.cdx.json"))
+			asserter.AssertErrNil(err, true)
+			if !strings.Contains(string(cyclonedx), `"bom-ref": "snap:pc-kernel@1234"`) {
+				t.Errorf("Expected pc-kernel in the CycloneDX SBOM, got:\n%s", cyclonedx)
+			}
+		})
+	}
+}
+
+// TestFailedGenerateSnapSBOM tests failures finding the seed of snap images
+func TestFailedGenerateSnapSBOM(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	workDir := t.TempDir()
+
+	var stateMachine SnapStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+	stateMachine.Opts.SBOMFormats = []string{"spdx"}
+	stateMachine.IsSeeded = true
+	stateMachine.tempDirs.unpack = workDir
+
+	err := stateMachine.generateSnapSBOM()
+	asserter.AssertErrContains(err, "Error reading the systems of the seed")
+
+	for _, label := range []string{"20240101", "20240102"} {
+		err = os.MkdirAll(filepath.Join(workDir, "system-seed", "systems", label), 0755)
+		asserter.AssertErrNil(err, true)
+	}
+	err = stateMachine.generateSnapSBOM()
+	asserter.AssertErrContains(err, "Expected exactly one system in the seed, found 2")
+
+	stateMachine.Args.ModelAssertion = "/non-existent-path"
+	err = stateMachine.generateSnapSBOM()
+	asserter.AssertErrContains(err, "cannot read model assertion")
+}
+
+// TestSnapStateMachine_Setup_SBOM tests the SBOM state is only added when requested
+func TestSnapStateMachine_Setup_SBOM(t *testing.T) {
+	asserter := helper.Asserter{T: t}
+	var stateMachine SnapStateMachine
+	stateMachine.commonFlags, stateMachine.stateMachineFlags = helper.InitCommonOpts()
+	stateMachine.parent = &stateMachine
+	stateMachine.Args.ModelAssertion = filepath.Join("testdata", "modelAssertion20")
+	stateMachine.stateMachineFlags.WorkDir = t.TempDir()
+	stateMachine.commonFlags.DryRun = true
+
+	err := stateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(len(snapStates), len(stateMachine.states))
+
+	stateMachine.Opts.SBOMFormats = []string{"cyclonedx"}
+	err = stateMachine.Setup()
+	asserter.AssertErrNil(err, true)
+	asserter.AssertEqual(len(snapStates)+1, len(stateMachine.states))
+	asserter.AssertEqual("generate_snap_sbom", stateMachine.states[len(stateMachine.states)-1].name)
+}
+
 // TestFailedPopulateSnapRootfsContents tests a failure in the PopulateRootfsContents state
 // while building a snap image. This is achieved by mocking functions
 func TestFailedPopulateSnapRootfsContents(t *testing.T) {
@@ -56,6 +56,8 @@ var osOpen = os.Open
 var osOpenFile = os.OpenFile
 var osRemoveAll = os.RemoveAll
 var osRename = os.Rename
+var osSymlink = os.Symlink
+var osChmod = os.Chmod
 var osCreate = os.Create
 var osTruncate = os.Truncate
 var osGetenv = os.Getenv
@@ -67,10 +69,13 @@ var mkfsMakeWithContent = mkfs.MakeWithContent
 var mkfsMake = mkfs.Make
 var diskfsCreate = diskfs.Create
 var randRead = rand.Read
+var timeNow = time.Now
 var seedOpen = seed.Open
 var imagePrepare = image.Prepare
 var gojsonschemaValidate = gojsonschema.Validate
 var filepathRel = filepath.Rel
+var snapUnpack = unpackSnap
+var downloadSnap = downloadSnapFromStore
 
 // SmInterface allows different image types to implement their own setup/run/teardown functions
 type SmInterface interface {
@@ -115,6 +120,11 @@ type StateMachine struct {
 
 	series string
 
+	// set for reproducible builds, the time to use for the whole build and the
+	// namespace of the identifiers derived from the build
+	sourceDateEpoch *time.Time
+	buildNamespace  uuid.UUID
+
 	// The flags that were passed in on the command line
 	commonFlags       *commands.CommonOpts
 	stateMachineFlags *commands.StateMachineOpts
@@ -140,6 +150,9 @@ type StateMachine struct {
 
 	Packages []string
 	Snaps    []string
+
+	// names of the packages installed from local .deb files
+	LocalPackages []string
 }
 
 // SetCommonOpts stores the common options for all image types in the struct
@@ -478,6 +491,7 @@ func (stateMachine *StateMachine) loadState(partialStateMachine *StateMachine) e
 	stateMachine.MainVolumeName = partialStateMachine.MainVolumeName
 
 	stateMachine.Packages = partialStateMachine.Packages
+	stateMachine.LocalPackages = partialStateMachine.LocalPackages
 	stateMachine.Snaps = partialStateMachine.Snaps
 
 	if stateMachine.GadgetInfo != nil {
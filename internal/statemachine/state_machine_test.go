@@ -132,6 +132,12 @@ func mockRemoveAll(string) error {
 func mockRename(string, string) error {
 	return fmt.Errorf("Test error")
 }
+func mockSymlink(string, string) error {
+	return fmt.Errorf("Test error")
+}
+func mockChmod(string, os.FileMode) error {
+	return fmt.Errorf("Test error")
+}
 func mockTruncate(string, int64) error {
 	return fmt.Errorf("Test error")
 }
@@ -216,9 +222,12 @@ func TestExecHelperProcess(t *testing.T) {
 	// instead on the actual arguments. And this makes sense to me
 	switch os.Getenv("TEST_CASE") {
 	case "TestGeneratePackageManifest":
-		fmt.Fprint(os.Stdout, "foo 1.2\nbar 1.4-1ubuntu4.1\nlibbaz 0.1.3ubuntu2\n")
+		fmt.Fprint(os.Stdout, "ii foo 1.2\nhi bar 1.4-1ubuntu4.1\nii libbaz 0.1.3ubuntu2\nrc removed 1.0\n")
 	case "TestGeneratePackageManifestV2":
-		fmt.Fprint(os.Stdout, "foo\t1.2\nbar\t1.4-1ubuntu4.1\nlibbaz\t0.1.3ubuntu2\n")
+		fmt.Fprint(os.Stdout, "ii foo\t1.2\nhi bar\t1.4-1ubuntu4.1\nii libbaz\t0.1.3ubuntu2\nrc removed\t1.0\n")
+	case "TestStateMachine_generateSBOM":
+		fmt.Fprint(os.Stdout, "ii foo\t1:1.2+dfsg-1\tamd64\tfoo-src\t1:1.2+dfsg-1\n"+
+			"ii libbar\t0.1\tamd64\tbar\t0.1\nrc removed\t1.0\tamd64\tremoved\t1.0\n")
 	case "TestGenerateFilelist":
 		fmt.Fprint(os.Stdout, "/root\n/home\n/var")
 	case "TestFailedPreseedClassicImage",
@@ -226,6 +235,7 @@ func TestExecHelperProcess(t *testing.T) {
 		"TestFailedMakeQcow2Image",
 		"TestFailedGeneratePackageManifest",
 		"TestFailedGeneratePackageManifestV2",
+		"TestFailedGenerateSBOM",
 		"TestFailedGenerateFilelist",
 		"TestFailedGerminate",
 		"TestFailedSetupLiveBuildCommands",